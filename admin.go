@@ -0,0 +1,50 @@
+package storethehash
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// AdminPathPrefix is the path under which the admin handler serves its endpoints.
+const AdminPathPrefix = "/admin/"
+
+// NewAdminHandler returns an HTTP handler that exposes the state of a blockstore for diagnostics,
+// as JSON:
+//
+//	GET /admin/stats         the statistics of the store, see `store.Stats`
+//	GET /admin/slow-queries  the most recent slow reads and writes, see `SlowQueryLog`
+//	GET /admin/capabilities  the format version and features of the store, see `store.Capabilities`
+//
+// It isn't meant to be reachable by untrusted clients.
+func NewAdminHandler(bs *HashedBlockstore) http.Handler {
+	return &admin{bs: bs}
+}
+
+type admin struct {
+	bs *HashedBlockstore
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body interface{}
+	switch strings.TrimPrefix(r.URL.Path, AdminPathPrefix) {
+	case "stats":
+		body = a.bs.Stats()
+	case "slow-queries":
+		body = a.bs.SlowQueries()
+	case "capabilities":
+		body = a.bs.Capabilities()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(body)
+}
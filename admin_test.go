@@ -0,0 +1,52 @@
+package storethehash_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash"
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.OpenHashedBlockstore(filepath.Join(tempDir, "storethehash.index"), filepath.Join(tempDir, "storethehash.data"),
+		storethehash.SlowQueryLog(0, 10))
+	require.NoError(t, err)
+	defer bs.Close()
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	require.NoError(t, bs.Put(blks[0]))
+
+	server := httptest.NewServer(storethehash.NewAdminHandler(bs))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/stats")
+	require.NoError(t, err)
+	var stats store.Stats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, uint64(1), stats.Keys)
+
+	resp, err = http.Get(server.URL + "/admin/slow-queries")
+	require.NoError(t, err)
+	var queries []store.SlowQuery
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&queries))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEmpty(t, queries)
+	require.Equal(t, "put", queries[len(queries)-1].Op)
+	require.Equal(t, blks[0].Cid().Bytes(), queries[len(queries)-1].Key)
+
+	resp, err = http.Get(server.URL + "/admin/unknown")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
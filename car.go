@@ -0,0 +1,264 @@
+package storethehash
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	util "github.com/ipld/go-car/util"
+)
+
+// DAGScope determines which blocks of a DAG are written by WriteCAR.
+type DAGScope string
+
+const (
+	// DAGScopeAll writes the root block and all blocks that are reachable from it.
+	DAGScopeAll DAGScope = "all"
+	// DAGScopeBlock writes the root block only.
+	DAGScopeBlock DAGScope = "block"
+)
+
+// maxCBORDepth bounds the nesting of dag-cbor blocks whose links are read.
+const maxCBORDepth = 256
+
+var errInvalidBlock = errors.New("cannot decode links of block")
+
+// WriteCAR writes the DAG below `root` to `w` as a CARv1 file, as served to trustless gateway
+// clients. Blocks are written in depth-first order, every block only once.
+//
+// Links are followed for raw, dag-pb and dag-cbor blocks, blocks of other codecs are written
+// without following their links. It fails with `bstore.ErrNotFound` if a block is missing, the
+// blocks before it have been written by then.
+func WriteCAR(ctx context.Context, bs bstore.Blockstore, root cid.Cid, scope DAGScope, w io.Writer) error {
+	if err := util.LdWrite(w, carHeader(root)); err != nil {
+		return err
+	}
+	seen := cid.NewSet()
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !seen.Visit(c) {
+			continue
+		}
+		blk, err := bs.Get(c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c, err)
+		}
+		if err := util.LdWrite(w, c.Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+		if scope == DAGScopeBlock {
+			return nil
+		}
+		links, err := blockLinks(c, blk.RawData())
+		if err != nil {
+			return fmt.Errorf("%s: %w", c, err)
+		}
+		// The first link is visited first.
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i])
+		}
+	}
+	return nil
+}
+
+// carHeader returns the dag-cbor encoded header of a CARv1 file, `{"roots": [root], "version": 1}`.
+func carHeader(root cid.Cid) []byte {
+	header := []byte{0xa2, 0x65, 'r', 'o', 'o', 't', 's', 0x81, 0xd8, 42}
+	// Links are byte strings with a leading zero byte.
+	header = appendCBORHead(header, 2, uint64(1+len(root.Bytes())))
+	header = append(header, 0)
+	header = append(header, root.Bytes()...)
+	return append(header, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x01)
+}
+
+func appendCBORHead(data []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(data, major<<5|byte(n))
+	case n <= 0xff:
+		return append(data, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return append(data, major<<5|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		return append(data, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, n)
+	return append(append(data, major<<5|27), buf...)
+}
+
+// blockLinks returns the CIDs a block links to, in the order they appear in the block.
+func blockLinks(c cid.Cid, data []byte) ([]cid.Cid, error) {
+	switch c.Type() {
+	case cid.DagProtobuf:
+		return dagPBLinks(data)
+	case cid.DagCBOR:
+		var links []cid.Cid
+		rest, err := cborLinks(data, 0, &links)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) != 0 {
+			return nil, errInvalidBlock
+		}
+		return links, nil
+	}
+	return nil, nil
+}
+
+// dagPBLinks reads the hashes of the links (field 2) of a dag-pb node.
+func dagPBLinks(data []byte) ([]cid.Cid, error) {
+	var links []cid.Cid
+	for len(data) > 0 {
+		field, wireType, value, rest, err := protobufField(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		if field != 2 || wireType != 2 {
+			continue
+		}
+		// A PBLink, its hash is field 1.
+		for len(value) > 0 {
+			linkField, linkWireType, linkValue, linkRest, err := protobufField(value)
+			if err != nil {
+				return nil, err
+			}
+			value = linkRest
+			if linkField == 1 && linkWireType == 2 {
+				link, err := cid.Cast(linkValue)
+				if err != nil {
+					return nil, err
+				}
+				links = append(links, link)
+			}
+		}
+	}
+	return links, nil
+}
+
+// protobufField reads a field of a protobuf message. The value is only returned for
+// length-delimited fields.
+func protobufField(data []byte) (uint64, uint64, []byte, []byte, error) {
+	key, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, nil, nil, errInvalidBlock
+	}
+	data = data[n:]
+	field, wireType := key>>3, key&7
+	switch wireType {
+	case 0:
+		if _, n = binary.Uvarint(data); n <= 0 {
+			return 0, 0, nil, nil, errInvalidBlock
+		}
+		return field, wireType, nil, data[n:], nil
+	case 1:
+		if len(data) < 8 {
+			return 0, 0, nil, nil, errInvalidBlock
+		}
+		return field, wireType, nil, data[8:], nil
+	case 2:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return 0, 0, nil, nil, errInvalidBlock
+		}
+		return field, wireType, data[n : n+int(length)], data[n+int(length):], nil
+	case 5:
+		if len(data) < 4 {
+			return 0, 0, nil, nil, errInvalidBlock
+		}
+		return field, wireType, nil, data[4:], nil
+	}
+	return 0, 0, nil, nil, errInvalidBlock
+}
+
+// cborLinks reads one dag-cbor data item, appends the links (tag 42) within it and returns the
+// data behind the item.
+func cborLinks(data []byte, depth int, links *[]cid.Cid) ([]byte, error) {
+	if depth > maxCBORDepth {
+		return nil, errInvalidBlock
+	}
+	major, n, data, err := cborHead(data)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0, 1, 7:
+		return data, nil
+	case 2, 3:
+		if uint64(len(data)) < n {
+			return nil, errInvalidBlock
+		}
+		return data[n:], nil
+	case 4, 5:
+		items := n
+		if major == 5 {
+			items = 2 * n
+		}
+		for i := uint64(0); i < items; i++ {
+			if data, err = cborLinks(data, depth+1, links); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+	// A tag, links are byte strings with a leading zero byte.
+	if n != 42 {
+		return cborLinks(data, depth+1, links)
+	}
+	major, length, data, err := cborHead(data)
+	if err != nil {
+		return nil, err
+	}
+	if major != 2 || length < 1 || uint64(len(data)) < length || data[0] != 0 {
+		return nil, errInvalidBlock
+	}
+	link, err := cid.Cast(data[1:length])
+	if err != nil {
+		return nil, err
+	}
+	*links = append(*links, link)
+	return data[length:], nil
+}
+
+// cborHead reads the head of a CBOR data item and returns its major type and argument. Floats are
+// skipped. Items of indefinite length aren't allowed in dag-cbor.
+func cborHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errInvalidBlock
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, nil, errInvalidBlock
+	}
+	if len(data) < size {
+		return 0, 0, nil, errInvalidBlock
+	}
+	var n uint64
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	return major, n, data[size:], nil
+}
@@ -0,0 +1,133 @@
+package storethehash_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	util "github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func newBlock(t *testing.T, codec uint64, data []byte) blocks.Block {
+	c, err := cid.V1Builder{Codec: codec, MhType: multihash.SHA2_256}.Sum(data)
+	require.NoError(t, err)
+	blk, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+	return blk
+}
+
+// dagPBNode encodes a dag-pb node with the given links and no data.
+func dagPBNode(links ...cid.Cid) []byte {
+	var node []byte
+	for _, link := range links {
+		pbLink := append([]byte{0x0a}, varint(len(link.Bytes()))...)
+		pbLink = append(pbLink, link.Bytes()...)
+		node = append(node, 0x12)
+		node = append(node, varint(len(pbLink))...)
+		node = append(node, pbLink...)
+	}
+	return node
+}
+
+// dagCBORNode encodes a dag-cbor list of the given links.
+func dagCBORNode(links ...cid.Cid) []byte {
+	node := []byte{0x80 | byte(len(links))}
+	for _, link := range links {
+		node = append(node, 0xd8, 42, 0x58, byte(len(link.Bytes())+1), 0)
+		node = append(node, link.Bytes()...)
+	}
+	return node
+}
+
+func varint(n int) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, uint64(n))]
+}
+
+// readCAR returns the CIDs of the blocks of a CAR file in order.
+func readCAR(t *testing.T, r io.Reader) []cid.Cid {
+	br := bufio.NewReader(r)
+	header, err := util.LdRead(br)
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(header, []byte("roots")))
+	var cids []cid.Cid
+	for {
+		c, data, err := util.ReadNode(br)
+		if err == io.EOF {
+			return cids
+		}
+		require.NoError(t, err)
+		sum, err := c.Prefix().Sum(data)
+		require.NoError(t, err)
+		require.Equal(t, c, sum)
+		cids = append(cids, c)
+	}
+}
+
+func TestWriteCAR(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.OpenHashedBlockstore(filepath.Join(tempDir, "storethehash.index"), filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	defer bs.Close()
+
+	leaves := testutil.GenerateBlocksOfSize(3, 100)
+	pbNode := newBlock(t, cid.DagProtobuf, dagPBNode(leaves[0].Cid(), leaves[1].Cid()))
+	// The root links to the first leaf twice, it is written once.
+	root := newBlock(t, cid.DagCBOR, dagCBORNode(pbNode.Cid(), leaves[2].Cid(), leaves[0].Cid()))
+	require.NoError(t, bs.PutMany(append(leaves, pbNode, root)))
+
+	var buf bytes.Buffer
+	require.NoError(t, storethehash.WriteCAR(context.Background(), bs, root.Cid(), storethehash.DAGScopeAll, &buf))
+	expected := []cid.Cid{root.Cid(), pbNode.Cid(), leaves[0].Cid(), leaves[1].Cid(), leaves[2].Cid()}
+	require.Equal(t, expected, readCAR(t, &buf))
+
+	buf.Reset()
+	require.NoError(t, storethehash.WriteCAR(context.Background(), bs, root.Cid(), storethehash.DAGScopeBlock, &buf))
+	require.Equal(t, []cid.Cid{root.Cid()}, readCAR(t, &buf))
+
+	missing := newBlock(t, cid.DagProtobuf, dagPBNode(testutil.GenerateBlocksOfSize(1, 100)[0].Cid()))
+	require.NoError(t, bs.Put(missing))
+	err = storethehash.WriteCAR(context.Background(), bs, missing.Cid(), storethehash.DAGScopeAll, ioutil.Discard)
+	require.True(t, errors.Is(err, bstore.ErrNotFound))
+
+	server := httptest.NewServer(storethehash.NewGatewayHandler(bs))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/ipfs/"+root.Cid().String(), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", storethehash.CARContentType)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), storethehash.CARContentType))
+	require.Equal(t, expected, readCAR(t, resp.Body))
+
+	resp, err = http.Get(server.URL + "/ipfs/" + root.Cid().String() + "?format=car&dag-scope=block")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []cid.Cid{root.Cid()}, readCAR(t, resp.Body))
+
+	absent := testutil.GenerateBlocksOfSize(1, 100)[0]
+	resp, err = http.Get(server.URL + "/ipfs/" + absent.Cid().String() + "?format=car")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// benchResult is the outcome of a benchmark, it's written as is with -json.
+type benchResult struct {
+	// Version of the module the command was built from, "(devel)" for local builds
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Count     int    `json:"count"`
+	ValueSize int    `json:"value_size"`
+	Bits      uint   `json:"bits"`
+
+	Put benchPhase `json:"put"`
+	Get benchPhase `json:"get"`
+	// Bytes the files grew by per byte of keys and values that were put
+	WriteAmplification float64 `json:"write_amplification"`
+
+	Flushes           uint64 `json:"flushes"`
+	FlushErrors       uint64 `json:"flush_errors"`
+	FlushedWork       uint64 `json:"flushed_work"`
+	LastFlushDuration int64  `json:"last_flush_duration_ns"`
+}
+
+// benchPhase describes the operations of one kind, durations are in nanoseconds.
+type benchPhase struct {
+	Ops         int     `json:"ops"`
+	Duration    int64   `json:"duration_ns"`
+	OpsPerSec   float64 `json:"ops_per_sec"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+	P50         int64   `json:"p50_ns"`
+	P90         int64   `json:"p90_ns"`
+	P99         int64   `json:"p99_ns"`
+	Max         int64   `json:"max_ns"`
+}
+
+func bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	sf := addStoreFlags(fs)
+	count := fs.Int("count", 10000, "number of values that are put and read")
+	valueSize := fs.Int("size", 1024, "size of the values in bytes")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 || *valueSize < 1 {
+		return fmt.Errorf("-count and -size must be positive")
+	}
+	// Without a store, a temporary one is used.
+	if sf.dir == "" && sf.indexPath == "" && sf.dataPath == "" {
+		dir, err := ioutil.TempDir("", "sth-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		sf.dir = dir
+	}
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.Start()
+
+	result, err := runBench(s, *count, *valueSize)
+	if err != nil {
+		return err
+	}
+	result.Bits = sf.bits
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	printBench(os.Stdout, result)
+	return nil
+}
+
+// runBench puts `count` values of random data and reads them back in random order.
+func runBench(s *store.Store, count int, valueSize int) (benchResult, error) {
+	result := benchResult{
+		Version:   "unknown",
+		GoVersion: runtime.Version(),
+		Count:     count,
+		ValueSize: valueSize,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		result.Version = info.Main.Version
+	}
+
+	keys := make([][]byte, count)
+	values := make([][]byte, count)
+	var userBytes int64
+	for n := range keys {
+		values[n] = make([]byte, valueSize)
+		if _, err := rand.Read(values[n]); err != nil {
+			return result, err
+		}
+		mh, err := multihash.Sum(values[n], multihash.SHA2_256, -1)
+		if err != nil {
+			return result, err
+		}
+		keys[n] = cid.NewCidV1(cid.Raw, mh).Bytes()
+		userBytes += int64(len(keys[n]) + valueSize)
+	}
+
+	before := s.Stats()
+	latencies := make([]time.Duration, count)
+	start := time.Now()
+	for n := range keys {
+		opStart := time.Now()
+		if err := s.Put(keys[n], values[n]); err != nil {
+			return result, err
+		}
+		latencies[n] = time.Since(opStart)
+	}
+	// The data isn't written until it's flushed.
+	s.Flush()
+	if err := s.Err(); err != nil {
+		return result, err
+	}
+	result.Put = newBenchPhase(latencies, time.Since(start), userBytes)
+
+	order := mathrand.Perm(count)
+	start = time.Now()
+	for n, key := range order {
+		opStart := time.Now()
+		_, found, err := s.Get(keys[key])
+		if err != nil {
+			return result, err
+		}
+		if !found {
+			return result, fmt.Errorf("value that was put is missing")
+		}
+		latencies[n] = time.Since(opStart)
+	}
+	result.Get = newBenchPhase(latencies, time.Since(start), userBytes)
+
+	after := s.Stats()
+	grown := int64(after.PrimarySize-before.PrimarySize) + int64(after.IndexSize-before.IndexSize)
+	result.WriteAmplification = float64(grown) / float64(userBytes)
+	result.Flushes = after.Flushes - before.Flushes
+	result.FlushErrors = after.FlushErrors - before.FlushErrors
+	result.FlushedWork = uint64(after.FlushedWork - before.FlushedWork)
+	result.LastFlushDuration = int64(after.LastFlushDuration)
+	return result, nil
+}
+
+func newBenchPhase(latencies []time.Duration, total time.Duration, bytes int64) benchPhase {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) int64 {
+		return int64(latencies[(len(latencies)-1)*p/100])
+	}
+	seconds := total.Seconds()
+	return benchPhase{
+		Ops:         len(latencies),
+		Duration:    int64(total),
+		OpsPerSec:   float64(len(latencies)) / seconds,
+		BytesPerSec: float64(bytes) / seconds,
+		P50:         percentile(50),
+		P90:         percentile(90),
+		P99:         percentile(99),
+		Max:         int64(latencies[len(latencies)-1]),
+	}
+}
+
+func printBench(w io.Writer, result benchResult) {
+	fmt.Fprintf(w, "%d values of %d bytes, %d bucket bits\n", result.Count, result.ValueSize, result.Bits)
+	for _, phase := range []struct {
+		name string
+		benchPhase
+	}{{"put", result.Put}, {"get", result.Get}} {
+		fmt.Fprintf(w, "%s: %.0f ops/s, %.2f MiB/s, p50 %s, p90 %s, p99 %s, max %s\n", phase.name,
+			phase.OpsPerSec, phase.BytesPerSec/(1<<20), time.Duration(phase.P50), time.Duration(phase.P90),
+			time.Duration(phase.P99), time.Duration(phase.Max))
+	}
+	fmt.Fprintf(w, "write amplification: %.2f\n", result.WriteAmplification)
+	fmt.Fprintf(w, "flushes: %d (%d failed), %d work, last took %s\n", result.Flushes, result.FlushErrors,
+		result.FlushedWork, time.Duration(result.LastFlushDuration))
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// drillScenarios are the kinds of damage a drill simulates.
+var drillScenarios = []string{"truncate-tail", "flip-bytes", "remove-checkpoint"}
+
+// Number of bytes that flip-bytes corrupts.
+const drillFlips = 8
+
+// drillEntry is a live entry of the store before it was damaged.
+type drillEntry struct {
+	sum [sha256.Size]byte
+	// Location of the entry in the data file
+	blk types.Block
+}
+
+// drillBaseline describes the copy of the store before it is damaged.
+type drillBaseline struct {
+	entries  map[string]drillEntry
+	dataSize int64
+	// Entry that was written last
+	last types.Block
+}
+
+// drillResult is the outcome of one scenario.
+type drillResult struct {
+	scenario string
+	// Range of the data file that was damaged
+	from, to int64
+	// Problems that Verify found before recovery
+	problems int
+	rebuilt  bool
+	// Error that recovery failed with, if any
+	recoveryErr error
+	entries     int
+	// Entries that were lost or changed within the damaged range, which the durability level
+	// allows, and outside of it, which it doesn't.
+	lostInRange, lostOutside       int
+	changedInRange, changedOutside int
+	duration                       time.Duration
+}
+
+// ok returns whether the damage stayed within the guarantees of the durability level.
+func (r drillResult) ok() bool {
+	return r.recoveryErr == nil && r.lostOutside == 0 && r.changedOutside == 0
+}
+
+func drill(args []string) error {
+	fs := flag.NewFlagSet("drill", flag.ExitOnError)
+	sf := addStoreFlags(fs)
+	scenarios := fs.String("scenarios", strings.Join(drillScenarios, ","), "comma-separated damage to simulate: "+strings.Join(drillScenarios, ", "))
+	durability := fs.String("durability", "buffered", "durability level the store is written with: buffered, flush or sync")
+	tail := fs.Int64("tail", 64*1024, "bytes at the end of the data file that a crash may damage with buffered or flush durability")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "seed of the simulated damage")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := sf.paths(); err != nil {
+		return err
+	}
+	level, err := parseDurability(*durability)
+	if err != nil {
+		return err
+	}
+	for _, scenario := range strings.Split(*scenarios, ",") {
+		if !isDrillScenario(scenario) {
+			return fmt.Errorf("unknown scenario %q", scenario)
+		}
+	}
+
+	// The store itself is never touched, every scenario works on its own copy.
+	dir, err := ioutil.TempDir("", "sth-drill")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	pristine, err := copyStore(sf, filepath.Join(dir, "pristine"))
+	if err != nil {
+		return err
+	}
+	baseline, err := readDrillBaseline(pristine)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d entries, %d bytes of data, seed %d\n", len(baseline.entries), baseline.dataSize, *seed)
+
+	rng := rand.New(rand.NewSource(*seed))
+	failed := false
+	for n, scenario := range strings.Split(*scenarios, ",") {
+		copied, err := copyStore(pristine, filepath.Join(dir, fmt.Sprint(n)))
+		if err != nil {
+			return err
+		}
+		result, err := runDrill(copied, baseline, scenario, level, *tail, rng)
+		if err != nil {
+			return fmt.Errorf("%s: %w", scenario, err)
+		}
+		printDrill(os.Stdout, result)
+		failed = failed || !result.ok()
+	}
+	if failed {
+		return fmt.Errorf("data loss exceeded the guarantees of %s durability", *durability)
+	}
+	return nil
+}
+
+func isDrillScenario(name string) bool {
+	for _, scenario := range drillScenarios {
+		if name == scenario {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDurability(name string) (store.DurabilityLevel, error) {
+	switch name {
+	case "buffered":
+		return store.Buffered, nil
+	case "flush":
+		return store.FlushOnPut, nil
+	case "sync":
+		return store.SyncOnPut, nil
+	default:
+		return 0, fmt.Errorf("unknown durability level %q", name)
+	}
+}
+
+// copyStore copies the index and data file of a store together with the files that accompany
+// them, e.g. the free list, into `dir`.
+func copyStore(sf *storeFlags, dir string) (*storeFlags, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	copied := &storeFlags{
+		indexPath: filepath.Join(dir, filepath.Base(sf.indexPath)),
+		dataPath:  filepath.Join(dir, filepath.Base(sf.dataPath)),
+		bits:      sf.bits,
+	}
+	for _, path := range []string{sf.indexPath, sf.dataPath} {
+		paths, err := filepath.Glob(path + "*")
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if err := copyFile(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return copied, nil
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// readDrillBaseline records the live entries of the store and where they are in the data file.
+func readDrillBaseline(sf *storeFlags) (drillBaseline, error) {
+	baseline := drillBaseline{entries: make(map[string]drillEntry)}
+	s, err := sf.open()
+	if err != nil {
+		return baseline, err
+	}
+	err = s.Scan(nil, nil, func(key []byte, value []byte) error {
+		baseline.entries[string(key)] = drillEntry{sum: sha256.Sum256(value)}
+		return nil
+	})
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return baseline, err
+	}
+
+	data, err := cidprimary.OpenCIDPrimary(sf.dataPath)
+	if err != nil {
+		return baseline, err
+	}
+	defer data.Close()
+	baseline.dataSize = int64(data.Size())
+	iter, err := data.Iter()
+	if err != nil {
+		return baseline, err
+	}
+	blockIter := iter.(primary.BlockIter)
+	for {
+		key, _, err := iter.Next()
+		if err == io.EOF {
+			return baseline, nil
+		}
+		if err != nil {
+			return baseline, err
+		}
+		// Later entries of a key replace earlier ones.
+		blk := blockIter.Block()
+		if entry, ok := baseline.entries[string(key)]; ok {
+			entry.blk = blk
+			baseline.entries[string(key)] = entry
+		}
+		baseline.last = blk
+	}
+}
+
+// runDrill damages the copy of a store, recovers it and compares its entries with the baseline.
+func runDrill(sf *storeFlags, baseline drillBaseline, scenario string, level store.DurabilityLevel, tail int64, rng *rand.Rand) (drillResult, error) {
+	start := time.Now()
+	result := drillResult{scenario: scenario, entries: len(baseline.entries)}
+	// A crash loses the writes that weren't synced yet. With SyncOnPut, that is at most the write
+	// that was in progress.
+	result.to = baseline.dataSize
+	result.from = baseline.dataSize - tail
+	if level == store.SyncOnPut {
+		result.from = int64(baseline.last.Offset)
+	}
+	if result.from < 0 {
+		result.from = 0
+	}
+
+	rebuild := false
+	switch scenario {
+	case "truncate-tail":
+		// The data file is cut off somewhere within the range, as by a torn write.
+		size := result.from + rng.Int63n(result.to-result.from+1)
+		if err := os.Truncate(sf.dataPath, size); err != nil {
+			return result, err
+		}
+	case "flip-bytes":
+		if err := flipBytes(sf.dataPath, result.from, result.to, rng); err != nil {
+			return result, err
+		}
+	case "remove-checkpoint":
+		// The index is a checkpoint of the data file, recovery replays the data file to rebuild
+		// it. No data is damaged.
+		result.from, result.to = baseline.dataSize, baseline.dataSize
+		paths, err := filepath.Glob(sf.indexPath + "*")
+		if err != nil {
+			return result, err
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil {
+				return result, err
+			}
+		}
+		rebuild = true
+	}
+
+	s, err := recoverDrill(sf, rebuild, &result)
+	if err != nil {
+		result.recoveryErr = err
+		result.duration = time.Since(start)
+		return result, nil
+	}
+	defer s.Close()
+	for key, entry := range baseline.entries {
+		inRange := int64(entry.blk.Offset+types.Position(entry.blk.Size)) > result.from
+		value, found, err := s.Get([]byte(key))
+		switch {
+		case err != nil || !found:
+			if inRange {
+				result.lostInRange++
+			} else {
+				result.lostOutside++
+			}
+		case sha256.Sum256(value) != entry.sum:
+			if inRange {
+				result.changedInRange++
+			} else {
+				result.changedOutside++
+			}
+		}
+	}
+	result.duration = time.Since(start)
+	return result, nil
+}
+
+// flipBytes inverts bytes at random positions within [from, to) of the file.
+func flipBytes(path string, from int64, to int64, rng *rand.Rand) error {
+	if to <= from {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1)
+	for n := 0; n < drillFlips; n++ {
+		off := from + rng.Int63n(to-from)
+		if _, err := file.ReadAt(buf, off); err != nil {
+			_ = file.Close()
+			return err
+		}
+		buf[0] ^= 0xff
+		if _, err := file.WriteAt(buf, off); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// recoverDrill opens the damaged store the way an operator would recover it: the index is checked
+// with Verify and rebuilt from the data file if it doesn't match, or if it is missing.
+func recoverDrill(sf *storeFlags, rebuild bool, result *drillResult) (*store.Store, error) {
+	if !rebuild {
+		s, err := sf.open()
+		if err != nil {
+			return nil, err
+		}
+		report, err := s.Verify(context.Background())
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		result.problems = len(report.Problems)
+		if report.OK() {
+			return s, nil
+		}
+		if err := s.Close(); err != nil {
+			return nil, err
+		}
+	}
+	data, err := cidprimary.OpenCIDPrimary(sf.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.RebuildIndex(sf.indexPath, data, uint8(sf.bits))
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.rebuilt = true
+	return sf.open()
+}
+
+func printDrill(w io.Writer, result drillResult) {
+	verdict := "ok"
+	if !result.ok() {
+		verdict = "FAILED"
+	}
+	fmt.Fprintf(w, "%s: %s in %s\n", result.scenario, verdict, result.duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "  damaged bytes %d to %d, %d problems found, index rebuilt: %t\n", result.from, result.to,
+		result.problems, result.rebuilt)
+	if result.recoveryErr != nil {
+		fmt.Fprintf(w, "  recovery failed: %s\n", result.recoveryErr)
+		return
+	}
+	fmt.Fprintf(w, "  lost %d and changed %d of %d entries within the damaged range (allowed)\n",
+		result.lostInRange, result.changedInRange, result.entries)
+	fmt.Fprintf(w, "  lost %d and changed %d entries outside of it\n", result.lostOutside, result.changedOutside)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+)
+
+// Characters used for the cells of the heatmap, from empty to full.
+const shades = " .:-=+*#%@"
+
+func heatmap(args []string) error {
+	fs := flag.NewFlagSet("heatmap", flag.ExitOnError)
+	sf := addStoreFlags(fs)
+	in := fs.String("in", "", "render usage that was exported before instead of reading a store")
+	export := fs.String("export", "", "write the usage of every bucket to this file")
+	width := fs.Int("width", 64, "number of cells per row")
+	height := fs.Int("height", 16, "number of rows")
+	bytes := fs.Bool("bytes", false, "shade cells by bytes instead of records")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *width < 1 || *height < 1 {
+		return fmt.Errorf("-width and -height must be positive")
+	}
+
+	usage, err := loadUsage(sf, *in)
+	if err != nil {
+		return err
+	}
+	if *export != "" {
+		file, err := os.Create(*export)
+		if err != nil {
+			return err
+		}
+		if _, err := usage.WriteTo(file); err != nil {
+			_ = file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+
+	values, unit := usage.Records, "records"
+	if *bytes {
+		values, unit = usage.Bytes, "bytes"
+	}
+	renderHeatmap(os.Stdout, values, *width, *height)
+	summarize(os.Stdout, values, unit)
+	return nil
+}
+
+func loadUsage(sf *storeFlags, in string) (index.BucketUsage, error) {
+	if in != "" {
+		file, err := os.Open(in)
+		if err != nil {
+			return index.BucketUsage{}, err
+		}
+		defer file.Close()
+		return index.ReadBucketUsage(file)
+	}
+	s, err := sf.open()
+	if err != nil {
+		return index.BucketUsage{}, err
+	}
+	defer s.Close()
+	return s.BucketUsage()
+}
+
+// renderHeatmap draws the values as a grid of `width` x `height` cells. Adjacent buckets are
+// summed up into a single cell, the shade of a cell is relative to the fullest cell.
+func renderHeatmap(w io.Writer, values []uint32, width int, height int) {
+	cells := width * height
+	if len(values) < cells {
+		cells = len(values)
+	}
+	perCell := (len(values) + cells - 1) / cells
+	sums := make([]uint64, cells)
+	var max uint64
+	for n, value := range values {
+		cell := n / perCell
+		sums[cell] += uint64(value)
+		if sums[cell] > max {
+			max = sums[cell]
+		}
+	}
+	fmt.Fprintf(w, "%d buckets, %d per cell\n", len(values), perCell)
+	var line strings.Builder
+	for start := 0; start < cells; start += width {
+		line.Reset()
+		line.WriteByte('|')
+		for cell := start; cell < start+width && cell < cells; cell++ {
+			shade := 0
+			if max > 0 {
+				shade = int(sums[cell] * uint64(len(shades)-1) / max)
+			}
+			line.WriteByte(shades[shade])
+		}
+		line.WriteByte('|')
+		fmt.Fprintln(w, line.String())
+	}
+}
+
+// summarize prints how evenly the values are distributed over the buckets.
+func summarize(w io.Writer, values []uint32, unit string) {
+	if len(values) == 0 {
+		return
+	}
+	var total uint64
+	var empty int
+	min, max := uint32(math.MaxUint32), uint32(0)
+	for _, value := range values {
+		total += uint64(value)
+		if value == 0 {
+			empty++
+		}
+		if value < min {
+			min = value
+		}
+		if value > max {
+			max = value
+		}
+	}
+	mean := float64(total) / float64(len(values))
+	var variance float64
+	for _, value := range values {
+		variance += (float64(value) - mean) * (float64(value) - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(values)))
+	fmt.Fprintf(w, "%d %s, %d empty buckets\n", total, unit, empty)
+	fmt.Fprintf(w, "per bucket: min %d, max %d, mean %.2f, stddev %.2f\n", min, max, mean, stddev)
+}
@@ -0,0 +1,108 @@
+// Command sth inspects storethehash stores.
+//
+// Usage:
+//
+//	sth <command> [flags]
+//
+// Run `sth <command> -h` for the flags of a command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+)
+
+type command struct {
+	run   func(args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"bench":   {bench, "measure the throughput and latency of puts and gets"},
+	"drill":   {drill, "damage a copy of a store like a crash would and check what recovery restores"},
+	"heatmap": {heatmap, "show how keys are distributed over the buckets of the index"},
+	"resize":  {resize, "rewrite the index with a different number of bucket bits"},
+	"serve":   {serve, "serve the blocks of a blockstore over HTTP as a read-only gateway"},
+	"shell":   {shell, "read and write entries interactively, of a local store or a daemon"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "sth %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sth <command> [flags]\n\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+// storeFlags are the flags that are needed to open a store.
+type storeFlags struct {
+	dir       string
+	indexPath string
+	dataPath  string
+	bits      uint
+}
+
+func addStoreFlags(fs *flag.FlagSet) *storeFlags {
+	var sf storeFlags
+	fs.StringVar(&sf.dir, "dir", "", "directory of a blockstore, sets -index and -data to the files within")
+	fs.StringVar(&sf.indexPath, "index", "", "path of the index file")
+	fs.StringVar(&sf.dataPath, "data", "", "path of the data file (CID primary storage)")
+	fs.UintVar(&sf.bits, "bits", 24, "number of bits used for the buckets of the index")
+	return &sf
+}
+
+// paths sets the paths of the index and the data file from the directory if they aren't given.
+func (sf *storeFlags) paths() error {
+	if sf.dir != "" {
+		if sf.indexPath == "" {
+			sf.indexPath = filepath.Join(sf.dir, "storethehash.index")
+		}
+		if sf.dataPath == "" {
+			sf.dataPath = filepath.Join(sf.dir, "storethehash.data")
+		}
+	}
+	if sf.indexPath == "" || sf.dataPath == "" {
+		return fmt.Errorf("-dir or -index and -data are required")
+	}
+	return nil
+}
+
+// open opens the store with the CID primary storage.
+func (sf *storeFlags) open() (*store.Store, error) {
+	if err := sf.paths(); err != nil {
+		return nil, err
+	}
+	primary, err := cidprimary.OpenCIDPrimary(sf.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	return store.OpenStore(sf.indexPath, primary, uint8(sf.bits), time.Second, store.DefaultBurstRate)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+)
+
+func resize(args []string) error {
+	fs := flag.NewFlagSet("resize", flag.ExitOnError)
+	sf := addStoreFlags(fs)
+	to := fs.Uint("to", 0, "number of bits the buckets of the resized index use")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := sf.paths(); err != nil {
+		return err
+	}
+	if *to == 0 || *to > 32 {
+		return fmt.Errorf("-to must be between 1 and 32")
+	}
+	start := time.Now()
+	primary, err := cidprimary.OpenCIDPrimary(sf.dataPath)
+	if err != nil {
+		return err
+	}
+	err = store.ResizeIndex(sf.indexPath, primary, uint8(sf.bits), uint8(*to))
+	if closeErr := primary.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("resized index from %d to %d bits in %s, open the store with -bits %d\n", sf.bits, *to,
+		time.Since(start).Round(time.Millisecond), *to)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	storethehash "github.com/hannahhoward/go-storethehash"
+)
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	sf := addStoreFlags(fs)
+	addr := fs.String("addr", "127.0.0.1:8080", "address to listen on")
+	cacheSize := fs.Int64("cache-size", 0, "cache up to this many bytes of blocks in memory, 0 disables the cache")
+	cacheTTL := fs.Duration("cache-ttl", 10*time.Second, "how long blocks stay in the cache")
+	adminAPI := fs.Bool("admin", false, "serve the stats and slow queries of the store under "+storethehash.AdminPathPrefix)
+	warmup := fs.Bool("warmup", false, "read the files into the page cache in the background after opening the store")
+	slowThreshold := fs.Duration("slow-threshold", 100*time.Millisecond, "duration from which on reads and writes are logged as slow queries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := sf.paths(); err != nil {
+		return err
+	}
+	bs, err := storethehash.OpenHashedBlockstore(sf.indexPath, sf.dataPath, storethehash.IndexBitSize(uint8(sf.bits)),
+		storethehash.SlowQueryLog(*slowThreshold, 1000))
+	if err != nil {
+		return err
+	}
+	defer bs.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *warmup {
+		go func() {
+			if err := bs.Warmup(ctx); err != nil && err != context.Canceled {
+				fmt.Fprintf(os.Stderr, "warmup failed: %s\n", err)
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	gateway := storethehash.NewGatewayHandler(bs, storethehash.GatewayCache(*cacheSize, *cacheTTL))
+	mux.Handle(storethehash.GatewayPathPrefix, gateway)
+	if *adminAPI {
+		mux.Handle(storethehash.AdminPathPrefix, storethehash.NewAdminHandler(bs))
+	}
+	server := &http.Server{Addr: *addr, Handler: mux}
+
+	// Shut down on interrupt, so that the store is closed cleanly.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		_ = server.Shutdown(context.Background())
+	}()
+	fmt.Fprintf(os.Stderr, "serving blocks on http://%s%s<cid>\n", *addr, storethehash.GatewayPathPrefix)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	storethehash "github.com/hannahhoward/go-storethehash"
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const shellHelp = `commands:
+  get <key>          print the value of a key
+  put <key> <value>  store a value, prefix it with 0x to pass hex
+  has <key>          print whether a key is stored
+  stat               print the statistics of the store
+  iter [count]       list the first count keys (default 10) in index order
+  find <prefix> [count]
+                     list the first count keys (default 10) whose digest starts with the
+                     given hex prefix
+  help               print this help
+  exit               leave the shell
+
+Keys are CIDs, hex (optionally prefixed with 0x) or base32 as used for the keys of IPFS
+datastores. A remote store only supports get, has and stat, its keys need to be CIDs.
+`
+
+// shellPrompt is printed before every command.
+const shellPrompt = "sth> "
+
+// errStopIter stops an iteration early.
+var errStopIter = errors.New("stop iteration")
+
+// errRemote is returned by the commands that a remote store doesn't support.
+var errRemote = errors.New("not supported by a remote store")
+
+func shell(args []string) error {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	sf := addStoreFlags(fs)
+	remote := fs.String("remote", "", "base URL of a daemon started with `sth serve -admin`, e.g. "+
+		"http://127.0.0.1:8080, to use instead of a local store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var st shellStore
+	if *remote != "" {
+		st = &remoteStore{url: strings.TrimSuffix(*remote, "/"), client: http.DefaultClient}
+	} else {
+		s, err := sf.open()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		s.Start()
+		st = localStore{s}
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		// Commands are piped in, e.g. from a script.
+		return runShell(st, newScannerLines(os.Stdin, os.Stdout), os.Stdout)
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+	// The terminal edits the lines and keeps the history of the session, which the arrow keys
+	// go through.
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, shellPrompt)
+	if width, height, err := terminal.GetSize(fd); err == nil {
+		_ = term.SetSize(width, height)
+	}
+	return runShell(st, term, term)
+}
+
+// lineReader reads the commands of the shell.
+type lineReader interface {
+	// ReadLine returns the next line without its line break, or io.EOF once the input ends.
+	ReadLine() (string, error)
+}
+
+// scannerLines reads commands line by line from input that isn't a terminal.
+type scannerLines struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func newScannerLines(in io.Reader, out io.Writer) *scannerLines {
+	scanner := bufio.NewScanner(in)
+	// Values are passed on the command line.
+	scanner.Buffer(nil, 16*1024*1024)
+	return &scannerLines{scanner: scanner, out: out}
+}
+
+func (sl *scannerLines) ReadLine() (string, error) {
+	fmt.Fprint(sl.out, shellPrompt)
+	if !sl.scanner.Scan() {
+		fmt.Fprintln(sl.out)
+		if err := sl.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return sl.scanner.Text(), nil
+}
+
+// runShell runs the commands of `lines` until it ends or `exit` is read.
+func runShell(st shellStore, lines lineReader, out io.Writer) error {
+	for {
+		line, err := lines.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "exit" || fields[0] == "quit" {
+			return nil
+		}
+		if err := runShellCommand(st, out, fields[0], fields[1:]); err != nil {
+			fmt.Fprintf(out, "error: %s\n", err)
+		}
+	}
+}
+
+func runShellCommand(st shellStore, out io.Writer, cmd string, args []string) error {
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: get <key>")
+		}
+		key, err := parseKey(args[0])
+		if err != nil {
+			return err
+		}
+		value, found, err := st.Get(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			fmt.Fprintln(out, "not found")
+			return nil
+		}
+		fmt.Fprintln(out, formatValue(value))
+	case "put":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: put <key> <value>")
+		}
+		key, err := parseKey(args[0])
+		if err != nil {
+			return err
+		}
+		value := []byte(args[1])
+		if strings.HasPrefix(args[1], "0x") {
+			if value, err = hex.DecodeString(args[1][2:]); err != nil {
+				return err
+			}
+		}
+		err = st.Put(key, value)
+		if err == types.ErrKeyExists {
+			fmt.Fprintln(out, "unchanged")
+			return nil
+		}
+		return err
+	case "has":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: has <key>")
+		}
+		key, err := parseKey(args[0])
+		if err != nil {
+			return err
+		}
+		has, err := st.Has(key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, has)
+	case "stat":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: stat")
+		}
+		stats, err := st.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "keys:             %d\n", stats.Keys)
+		fmt.Fprintf(out, "primary size:     %d\n", stats.PrimarySize)
+		fmt.Fprintf(out, "index size:       %d\n", stats.IndexSize)
+		fmt.Fprintf(out, "occupied buckets: %d of %d\n", stats.OccupiedBuckets, stats.Buckets)
+		fmt.Fprintf(out, "outstanding work: %d\n", stats.OutstandingWork)
+		fmt.Fprintf(out, "flushes:          %d (%d failed)\n", stats.Flushes, stats.FlushErrors)
+	case "iter":
+		count := 10
+		if len(args) > 1 {
+			return fmt.Errorf("usage: iter [count]")
+		}
+		if len(args) == 1 {
+			var err error
+			if count, err = strconv.Atoi(args[0]); err != nil {
+				return err
+			}
+		}
+		n := 0
+		err := st.Scan(nil, nil, func(key []byte, value []byte) error {
+			if n == count {
+				return errStopIter
+			}
+			n++
+			fmt.Fprintf(out, "%s %d bytes\n", formatKey(key), len(value))
+			return nil
+		})
+		if err != nil && err != errStopIter {
+			return err
+		}
+	case "find":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: find <prefix> [count]")
+		}
+		prefix, err := hex.DecodeString(strings.TrimPrefix(args[0], "0x"))
+		if err != nil {
+			return err
+		}
+		count := 10
+		if len(args) == 2 {
+			if count, err = strconv.Atoi(args[1]); err != nil {
+				return err
+			}
+		}
+		keys, err := st.FindByDigestPrefix(prefix, count)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Fprintln(out, formatKey(key))
+		}
+	case "help":
+		fmt.Fprint(out, shellHelp)
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	}
+	return nil
+}
+
+// shellStore is the store the shell works with, a local one or a remote daemon.
+type shellStore interface {
+	Get(key []byte) ([]byte, bool, error)
+	Put(key []byte, value []byte) error
+	Has(key []byte) (bool, error)
+	Stats() (store.Stats, error)
+	Scan(start []byte, end []byte, fn func(key []byte, value []byte) error) error
+	FindByDigestPrefix(prefix []byte, limit int) ([][]byte, error)
+}
+
+// localStore is a store that was opened by the shell.
+type localStore struct {
+	*store.Store
+}
+
+func (ls localStore) Get(key []byte) ([]byte, bool, error) {
+	return ls.Store.Get(key)
+}
+
+func (ls localStore) Stats() (store.Stats, error) {
+	return ls.Store.Stats(), nil
+}
+
+// remoteStore is a blockstore that is served by `sth serve`. Blocks are read through the gateway
+// and the statistics through the admin API, it can't be written to.
+type remoteStore struct {
+	// Base URL of the daemon
+	url    string
+	client *http.Client
+}
+
+// request sends a request for the block with the given key to the gateway. It returns nil if the
+// block wasn't found, the body of the response needs to be closed otherwise.
+func (rs *remoteStore) request(method string, key []byte) (*http.Response, error) {
+	c, err := cid.Cast(key)
+	if err != nil {
+		return nil, fmt.Errorf("keys of a remote store need to be CIDs: %w", err)
+	}
+	req, err := http.NewRequest(method, rs.url+storethehash.GatewayPathPrefix+c.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", storethehash.RawBlockContentType)
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil
+	default:
+		defer resp.Body.Close()
+		return nil, remoteError(resp)
+	}
+}
+
+func (rs *remoteStore) Get(key []byte) ([]byte, bool, error) {
+	resp, err := rs.request(http.MethodGet, key)
+	if err != nil || resp == nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (rs *remoteStore) Has(key []byte) (bool, error) {
+	resp, err := rs.request(http.MethodHead, key)
+	if err != nil || resp == nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (rs *remoteStore) Stats() (store.Stats, error) {
+	var stats store.Stats
+	resp, err := rs.client.Get(rs.url + storethehash.AdminPathPrefix + "stats")
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stats, remoteError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
+
+func (rs *remoteStore) Put(key []byte, value []byte) error {
+	return errRemote
+}
+
+func (rs *remoteStore) Scan(start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+	return errRemote
+}
+
+func (rs *remoteStore) FindByDigestPrefix(prefix []byte, limit int) ([][]byte, error) {
+	return nil, errRemote
+}
+
+// remoteError returns the error of a failed request to a daemon.
+func remoteError(resp *http.Response) error {
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+}
+
+// parseKey decodes a key that is given as CID, hex or base32.
+func parseKey(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "0x") {
+		return hex.DecodeString(s[2:])
+	}
+	if c, err := cid.Decode(s); err == nil {
+		return c.Bytes(), nil
+	}
+	if key, err := hex.DecodeString(s); err == nil {
+		return key, nil
+	}
+	if key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s)); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("cannot decode key %q as CID, hex or base32", s)
+}
+
+// formatKey returns a key as CID if it is one, as hex otherwise.
+func formatKey(key []byte) string {
+	if c, err := cid.Cast(key); err == nil {
+		return c.String()
+	}
+	return hex.EncodeToString(key)
+}
+
+// formatValue returns a value as quoted string if it is printable text, as hex otherwise.
+func formatValue(value []byte) string {
+	if utf8.Valid(value) && strings.IndexFunc(string(value), func(r rune) bool {
+		return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+	}) < 0 {
+		return strconv.Quote(string(value))
+	}
+	return "0x" + hex.EncodeToString(value)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	storethehash "github.com/hannahhoward/go-storethehash"
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// runScript runs the given commands in a shell and returns its output.
+func runScript(t *testing.T, st shellStore, script string) string {
+	var out strings.Builder
+	require.NoError(t, runShell(st, newScannerLines(strings.NewReader(script), &out), &out))
+	return out.String()
+}
+
+func TestParseKey(t *testing.T) {
+	blk := testutil.GenerateBlocksOfSize(1, 10)[0]
+	key, err := parseKey(blk.Cid().String())
+	require.NoError(t, err)
+	require.Equal(t, blk.Cid().Bytes(), key)
+	require.Equal(t, blk.Cid().String(), formatKey(key))
+
+	key, err = parseKey("0x0102")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2}, key)
+	key, err = parseKey("0a0b")
+	require.NoError(t, err)
+	require.Equal(t, []byte{10, 11}, key)
+	require.Equal(t, "0a0b", formatKey(key))
+	_, err = parseKey("not a key!")
+	require.Error(t, err)
+
+	require.Equal(t, `"hello"`, formatValue([]byte("hello")))
+	require.Equal(t, "0x00ff", formatValue([]byte{0, 255}))
+}
+
+func TestShell(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, 24, time.Second, 4*1024*1024)
+	require.NoError(t, err)
+	defer s.Close()
+	s.Start()
+	blk := testutil.GenerateBlocksOfSize(1, 10)[0]
+	key := blk.Cid().String()
+
+	out := runScript(t, localStore{s}, "has "+key+"\nput "+key+" hello\n\nput "+key+" hello\nget "+key+
+		"\nhas "+key+"\niter\nstat\nget\nfrobnicate\nexit\nget "+key+"\n")
+	lines := strings.Split(out, "\n")
+	require.Equal(t, "sth> false", lines[0])
+	require.Equal(t, "sth> sth> sth> unchanged", lines[1])
+	require.Equal(t, `sth> "hello"`, lines[2])
+	require.Equal(t, "sth> true", lines[3])
+	require.Equal(t, "sth> "+key+" 5 bytes", lines[4])
+	require.Equal(t, "sth> keys:             1", lines[5])
+	require.Contains(t, out, "sth> error: usage: get <key>\n")
+	require.Contains(t, out, `sth> error: unknown command "frobnicate", try help`)
+	// Nothing is run after exit.
+	require.True(t, strings.HasSuffix(out, "try help\nsth> "))
+}
+
+func TestRemoteShell(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.OpenHashedBlockstore(filepath.Join(tempDir, "storethehash.index"), filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	defer bs.Close()
+	bs.Start()
+	blks := testutil.GenerateBlocksOfSize(2, 10)
+	require.NoError(t, bs.Put(blks[0]))
+	mux := http.NewServeMux()
+	mux.Handle(storethehash.GatewayPathPrefix, storethehash.NewGatewayHandler(bs))
+	mux.Handle(storethehash.AdminPathPrefix, storethehash.NewAdminHandler(bs))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	st := &remoteStore{url: server.URL, client: server.Client()}
+
+	out := runScript(t, st, "get "+blks[0].Cid().String()+"\nhas "+blks[0].Cid().String()+"\nget "+blks[1].Cid().String()+
+		"\nhas "+blks[1].Cid().String()+"\nstat\nget 0x0102\nput "+blks[1].Cid().String()+" hello\niter\n")
+	lines := strings.Split(out, "\n")
+	require.Equal(t, "sth> "+formatValue(blks[0].RawData()), lines[0])
+	require.Equal(t, "sth> true", lines[1])
+	require.Equal(t, "sth> not found", lines[2])
+	require.Equal(t, "sth> false", lines[3])
+	require.Equal(t, "sth> keys:             1", lines[4])
+	require.Contains(t, out, "error: keys of a remote store need to be CIDs")
+	require.Contains(t, out, "sth> error: "+errRemote.Error()+"\nsth> error: "+errRemote.Error()+"\n")
+}
@@ -0,0 +1,284 @@
+package storethehash
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// GatewayPathPrefix is the path under which the gateway serves blocks.
+const GatewayPathPrefix = "/ipfs/"
+
+// RawBlockContentType is the media type of a raw block, as defined by the trustless gateway
+// specification.
+const RawBlockContentType = "application/vnd.ipld.raw"
+
+// CARContentType is the media type of a CAR file, as defined by the trustless gateway
+// specification.
+const CARContentType = "application/vnd.ipld.car"
+
+// FormatVersionHeader carries the format version of the store in every response of the gateway,
+// if the blockstore reports its capabilities as HashedBlockstore does.
+const FormatVersionHeader = "Storethehash-Format-Version"
+
+// CapabilitiesHeader lists the enabled features of the store in every response of the gateway,
+// separated by commas, see `store.Capabilities`.
+const CapabilitiesHeader = "Storethehash-Capabilities"
+
+// RequireHeader lists the features a client depends on, separated by commas. Requests that require
+// a feature that isn't enabled are rejected with 412 Precondition Failed.
+const RequireHeader = "Storethehash-Require"
+
+// capabilityReporter is implemented by blockstores that report the capabilities of their store, as
+// HashedBlockstore does.
+type capabilityReporter interface {
+	Capabilities() store.Capabilities
+}
+
+// Response formats of the gateway, as set with `?format=`.
+const (
+	formatRaw = "raw"
+	formatCAR = "car"
+)
+
+// blockStreamer is implemented by blockstores that can read a block incrementally, as
+// HashedBlockstore does.
+type blockStreamer interface {
+	GetStream(c cid.Cid) (io.ReadCloser, int64, error)
+}
+
+// NewGatewayHandler returns a read-only HTTP handler that serves the blocks of a blockstore as a
+// minimal subset of an IPFS gateway: `GET /ipfs/<cid>` (and HEAD) return the raw block, or a CAR
+// file with the DAG below it.
+//
+// A request selects the format by accepting `RawBlockContentType` or `CARContentType`, or with
+// `?format=raw` or `?format=car`, as trustless clients do. Raw blocks are returned by default. CAR
+// files are written by WriteCAR, `?dag-scope=block` limits them to the requested block. Responses
+// are immutable, hence they are cacheable forever and conditional requests with the ETag are
+// answered with 304. Clients verify a block by hashing it, nothing is trusted on the side of the
+// server. Blocks are streamed to the client if the blockstore supports it.
+//
+// Responses carry the format version and the features of the store, see CapabilitiesHeader.
+// Clients that depend on features list them in RequireHeader.
+//
+// Responses can be cached in memory with the GatewayCache option.
+func NewGatewayHandler(bs bstore.Blockstore, options ...GatewayOption) http.Handler {
+	c := gatewayConfig{now: time.Now}
+	for _, option := range options {
+		option(&c)
+	}
+	g := &gateway{bs: bs}
+	if c.cacheSize > 0 && c.cacheTTL > 0 {
+		g.cache = newBlockCache(c.cacheSize, c.cacheTTL, c.now)
+	}
+	return g
+}
+
+type gateway struct {
+	bs bstore.Blockstore
+	// cache is nil unless the handler was created with GatewayCache.
+	cache *blockCache
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.negotiate(w, r) {
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, GatewayPathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, GatewayPathPrefix)
+	if strings.Contains(path, "/") {
+		// Paths within a DAG need the DAG to be traversed.
+		http.Error(w, "only blocks can be requested, not paths within them", http.StatusNotImplemented)
+		return
+	}
+	c, err := cid.Decode(path)
+	if err != nil {
+		http.Error(w, "invalid CID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := responseFormat(r)
+	if format == "" {
+		http.Error(w, "only "+RawBlockContentType+" and "+CARContentType+" are supported", http.StatusNotAcceptable)
+		return
+	}
+	scope := DAGScopeAll
+	if format == formatCAR {
+		if s := r.URL.Query().Get("dag-scope"); s != "" {
+			scope = DAGScope(s)
+		}
+		if scope != DAGScopeAll && scope != DAGScopeBlock {
+			http.Error(w, "unsupported dag-scope "+string(scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	etag := `"` + c.String() + "." + format + `"`
+	if scope == DAGScopeBlock {
+		etag = `"` + c.String() + `.block.car"`
+	}
+	header := w.Header()
+	header.Set("Etag", etag)
+	header.Set("X-Ipfs-Path", GatewayPathPrefix+c.String())
+	if r.Header.Get("If-None-Match") == etag {
+		has, err := g.bs.Has(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if has {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if format == formatCAR {
+		g.serveCAR(w, r, c, scope)
+		return
+	}
+
+	var data io.Reader
+	var size int64
+	if r.Method == http.MethodHead {
+		var n int
+		n, err = g.bs.GetSize(c)
+		size = int64(n)
+	} else if g.cache != nil {
+		var value []byte
+		value, err = g.cache.get(c, func() ([]byte, error) {
+			blk, err := g.bs.Get(c)
+			if err != nil {
+				return nil, err
+			}
+			return blk.RawData(), nil
+		})
+		if err == nil {
+			data = bytes.NewReader(value)
+			size = int64(len(value))
+		}
+	} else if streamer, ok := g.bs.(blockStreamer); ok {
+		var value io.ReadCloser
+		if value, size, err = streamer.GetStream(c); err == nil {
+			defer value.Close()
+			data = value
+		}
+	} else {
+		var blk blocks.Block
+		if blk, err = g.bs.Get(c); err == nil {
+			data = bytes.NewReader(blk.RawData())
+			size = int64(len(blk.RawData()))
+		}
+	}
+	if err == bstore.ErrNotFound {
+		header.Del("Etag")
+		http.Error(w, "block not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		header.Del("Etag")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	header.Set("Content-Type", RawBlockContentType)
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "public, max-age=29030400, immutable")
+	header.Set("Content-Disposition", `attachment; filename="`+c.String()+`.bin"`)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = io.Copy(w, data)
+	}
+}
+
+// negotiate reports the capabilities of the store in the response headers and checks that it has
+// all features the request requires. It returns false if the request was rejected.
+func (g *gateway) negotiate(w http.ResponseWriter, r *http.Request) bool {
+	var capabilities store.Capabilities
+	reporter, ok := g.bs.(capabilityReporter)
+	if ok {
+		capabilities = reporter.Capabilities()
+		w.Header().Set(FormatVersionHeader, strconv.Itoa(capabilities.FormatVersion))
+		w.Header().Set(CapabilitiesHeader, strings.Join(capabilities.Features, ", "))
+	}
+	var missing []string
+	for _, required := range strings.Split(r.Header.Get(RequireHeader), ",") {
+		required = strings.TrimSpace(required)
+		if required != "" && !capabilities.Has(required) {
+			missing = append(missing, required)
+		}
+	}
+	if len(missing) > 0 {
+		http.Error(w, "unsupported capabilities: "+strings.Join(missing, ", "), http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// serveCAR writes the DAG below the given root as CAR file.
+func (g *gateway) serveCAR(w http.ResponseWriter, r *http.Request, root cid.Cid, scope DAGScope) {
+	has, err := g.bs.Has(root)
+	if err != nil {
+		w.Header().Del("Etag")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		w.Header().Del("Etag")
+		http.Error(w, "block not found", http.StatusNotFound)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", CARContentType+"; version=1; order=dfs; dups=n")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "public, max-age=29030400, immutable")
+	header.Set("Content-Disposition", `attachment; filename="`+root.String()+`.car"`)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := WriteCAR(r.Context(), g.bs, root, scope, w); err != nil {
+		// The status was sent already, the client only notices a missing block if the response
+		// is cut off.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// responseFormat returns the format the client asked for, raw if it didn't ask for any specific
+// format and an empty string if it asked for an unsupported one.
+func responseFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if format == formatRaw || format == formatCAR {
+			return format
+		}
+		return ""
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatRaw
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		switch mediaType {
+		case RawBlockContentType, "*/*", "application/*":
+			return formatRaw
+		case CARContentType:
+			return formatCAR
+		}
+	}
+	return ""
+}
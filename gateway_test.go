@@ -0,0 +1,114 @@
+package storethehash_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash"
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGateway(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.OpenHashedBlockstore(filepath.Join(tempDir, "storethehash.index"), filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	defer bs.Close()
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	require.NoError(t, bs.Put(blks[0]))
+
+	server := httptest.NewServer(storethehash.NewGatewayHandler(bs))
+	defer server.Close()
+	request := func(method string, path string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	path := "/ipfs/" + blks[0].Cid().String()
+	resp := request(http.MethodGet, path, map[string]string{"Accept": storethehash.RawBlockContentType})
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, blks[0].RawData(), body)
+	require.Equal(t, storethehash.RawBlockContentType, resp.Header.Get("Content-Type"))
+	require.Equal(t, `"`+blks[0].Cid().String()+`.raw"`, resp.Header.Get("Etag"))
+	etag := resp.Header.Get("Etag")
+
+	resp = request(http.MethodHead, path+"?format=raw", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, strconv.Itoa(len(blks[0].RawData())), resp.Header.Get("Content-Length"))
+
+	resp = request(http.MethodGet, path, map[string]string{"If-None-Match": etag})
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		header map[string]string
+		status int
+	}{
+		{http.MethodGet, "/ipfs/" + blks[1].Cid().String(), nil, http.StatusNotFound},
+		{http.MethodGet, "/ipfs/not-a-cid", nil, http.StatusBadRequest},
+		{http.MethodGet, path + "/some/path", nil, http.StatusNotImplemented},
+		{http.MethodGet, path, map[string]string{"Accept": "application/json"}, http.StatusNotAcceptable},
+		{http.MethodGet, path + "?format=tar", nil, http.StatusNotAcceptable},
+		{http.MethodGet, path + "?format=car&dag-scope=entity", nil, http.StatusBadRequest},
+		{http.MethodPost, path, nil, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/ipns/example.com", nil, http.StatusNotFound},
+	} {
+		resp := request(tc.method, tc.path, tc.header)
+		resp.Body.Close()
+		require.Equal(t, tc.status, resp.StatusCode, "%s %s", tc.method, tc.path)
+	}
+}
+
+func TestGatewayCapabilities(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.OpenHashedBlockstore(filepath.Join(tempDir, "storethehash.index"), filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	defer bs.Close()
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	require.NoError(t, bs.Put(blks[0]))
+
+	server := httptest.NewServer(storethehash.NewGatewayHandler(bs))
+	defer server.Close()
+	request := func(required string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/ipfs/"+blks[0].Cid().String(), nil)
+		require.NoError(t, err)
+		if required != "" {
+			req.Header.Set(storethehash.RequireHeader, required)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := request("")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, strconv.Itoa(bs.Capabilities().FormatVersion), resp.Header.Get(storethehash.FormatVersionHeader))
+	require.Contains(t, resp.Header.Get(storethehash.CapabilitiesHeader), store.CapabilityDelete)
+
+	resp = request(store.CapabilityDelete + ", " + store.CapabilityStreaming)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The blockstore has no namespaces.
+	resp = request(store.CapabilityDelete + ", namespaces")
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+}
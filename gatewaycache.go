@@ -0,0 +1,128 @@
+package storethehash
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+type gatewayConfig struct {
+	cacheSize int64
+	cacheTTL  time.Duration
+	now       func() time.Time
+}
+
+// GatewayOption configures the handler returned by NewGatewayHandler.
+type GatewayOption func(*gatewayConfig)
+
+// GatewayCache caches the blocks the gateway serves in memory for `ttl`, up to `size` bytes of
+// blocks in total, the least recently used ones are dropped first. Concurrent requests for a block
+// that isn't cached are coalesced into a single read of the blockstore, which protects the store
+// from bursts of identical requests for hot blocks.
+//
+// Blocks are read into memory instead of being streamed while the cache is enabled, those that are
+// larger than a quarter of the cache aren't cached. Only raw blocks are cached, not CAR files.
+func GatewayCache(size int64, ttl time.Duration) GatewayOption {
+	return func(c *gatewayConfig) {
+		c.cacheSize = size
+		c.cacheTTL = ttl
+	}
+}
+
+// GatewayClock sets the clock that cached blocks expire by, `time.Now` by default.
+func GatewayClock(now func() time.Time) GatewayOption {
+	return func(c *gatewayConfig) {
+		c.now = now
+	}
+}
+
+// blockCache is an LRU cache of blocks whose entries expire after a TTL. Reads of blocks that
+// aren't cached are coalesced.
+type blockCache struct {
+	lk       sync.Mutex
+	size     int64
+	maxSize  int64
+	ttl      time.Duration
+	now      func() time.Time
+	entries  map[string]*list.Element
+	lru      *list.List
+	inflight map[string]*blockFlight
+}
+
+type blockCacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// blockFlight is a read of a block that other requests for it wait for.
+type blockFlight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newBlockCache(maxSize int64, ttl time.Duration, now func() time.Time) *blockCache {
+	return &blockCache{
+		maxSize:  maxSize,
+		ttl:      ttl,
+		now:      now,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*blockFlight),
+	}
+}
+
+// get returns the cached data of the block, or reads it with `load`. Concurrent calls for the same
+// block share a single call of `load` and its error.
+func (bc *blockCache) get(c cid.Cid, load func() ([]byte, error)) ([]byte, error) {
+	key := c.KeyString()
+	bc.lk.Lock()
+	if elem, ok := bc.entries[key]; ok {
+		entry := elem.Value.(*blockCacheEntry)
+		if bc.now().Before(entry.expires) {
+			bc.lru.MoveToFront(elem)
+			bc.lk.Unlock()
+			return entry.data, nil
+		}
+		bc.remove(elem)
+	}
+	if flight, ok := bc.inflight[key]; ok {
+		bc.lk.Unlock()
+		<-flight.done
+		return flight.data, flight.err
+	}
+	flight := &blockFlight{done: make(chan struct{})}
+	bc.inflight[key] = flight
+	bc.lk.Unlock()
+
+	flight.data, flight.err = load()
+
+	bc.lk.Lock()
+	delete(bc.inflight, key)
+	if flight.err == nil && int64(len(flight.data)) <= bc.maxSize/4 {
+		bc.add(key, flight.data)
+	}
+	bc.lk.Unlock()
+	close(flight.done)
+	return flight.data, flight.err
+}
+
+// add caches a block, it must be called with the lock held.
+func (bc *blockCache) add(key string, data []byte) {
+	entry := &blockCacheEntry{key: key, data: data, expires: bc.now().Add(bc.ttl)}
+	bc.entries[key] = bc.lru.PushFront(entry)
+	bc.size += int64(len(data))
+	for bc.size > bc.maxSize {
+		bc.remove(bc.lru.Back())
+	}
+}
+
+// remove drops a cached block, it must be called with the lock held.
+func (bc *blockCache) remove(elem *list.Element) {
+	entry := bc.lru.Remove(elem).(*blockCacheEntry)
+	delete(bc.entries, entry.key)
+	bc.size -= int64(len(entry.data))
+}
@@ -0,0 +1,91 @@
+package storethehash_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBlockstore counts the reads of blocks, which wait until release is closed.
+type countingBlockstore struct {
+	bstore.Blockstore
+	gets    int64
+	release chan struct{}
+}
+
+func (cb *countingBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	atomic.AddInt64(&cb.gets, 1)
+	<-cb.release
+	return cb.Blockstore.Get(c)
+}
+
+func TestGatewayCache(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.OpenHashedBlockstore(filepath.Join(tempDir, "storethehash.index"), filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	defer bs.Close()
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	require.NoError(t, bs.Put(blk))
+
+	counting := &countingBlockstore{Blockstore: bs, release: make(chan struct{})}
+	var nowLk sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		nowLk.Lock()
+		defer nowLk.Unlock()
+		return now
+	}
+	handler := storethehash.NewGatewayHandler(counting, storethehash.GatewayCache(1<<20, time.Minute),
+		storethehash.GatewayClock(clock))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	get := func() {
+		resp, err := http.Get(server.URL + "/ipfs/" + blk.Cid().String())
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, blk.RawData(), body)
+	}
+
+	// Concurrent requests share a single read.
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	for atomic.LoadInt64(&counting.gets) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the other requests time to arrive.
+	time.Sleep(50 * time.Millisecond)
+	close(counting.release)
+	wg.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(&counting.gets))
+
+	// Cached until the TTL passes.
+	get()
+	require.Equal(t, int64(1), atomic.LoadInt64(&counting.gets))
+	nowLk.Lock()
+	now = now.Add(2 * time.Minute)
+	nowLk.Unlock()
+	get()
+	require.Equal(t, int64(2), atomic.LoadInt64(&counting.gets))
+}
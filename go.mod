@@ -5,10 +5,15 @@ go 1.15
 require (
 	github.com/ipfs/go-block-format v0.0.3
 	github.com/ipfs/go-cid v0.0.7
+	github.com/ipfs/go-datastore v0.4.2
 	github.com/ipfs/go-ipfs-blockstore v1.0.4-0.20210205083733-fb07d7bc5aec
 	github.com/ipfs/go-ipfs-blocksutil v0.0.1
+	github.com/ipfs/go-ipfs-ds-help v1.0.0
 	github.com/ipfs/go-ipfs-util v0.0.2
+	github.com/ipfs/go-metrics-interface v0.0.1
 	github.com/ipld/go-car v0.1.0
 	github.com/multiformats/go-multihash v0.0.14
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/crypto v0.0.0-20190611184440-5c40567a22f8
+	golang.org/x/sys v0.0.0-20190610200419-93c9922d18ae
 )
@@ -0,0 +1,194 @@
+package storethehash
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	"github.com/multiformats/go-multihash"
+)
+
+// DefaultImportPrefix is the namespace under which go-ipfs keeps its blocks.
+const DefaultImportPrefix = "/blocks"
+
+const defaultCheckpointInterval = 1024
+
+// ImportProgress describes how far an import got.
+type ImportProgress struct {
+	// Number of blocks that were written
+	Imported uint64
+	// Number of blocks that were already present
+	Skipped uint64
+	// Datastore key of the last block that was processed
+	LastKey string
+}
+
+type importOptions struct {
+	prefix             string
+	checkpointPath     string
+	checkpointInterval int
+	progress           func(ImportProgress)
+}
+
+type ImportOption func(*importOptions)
+
+// ImportPrefix sets the namespace of the datastore that contains the blocks, `DefaultImportPrefix`
+// by default.
+func ImportPrefix(prefix string) ImportOption {
+	return func(o *importOptions) {
+		o.prefix = prefix
+	}
+}
+
+// ImportCheckpoint makes an import resumable. Every `interval` blocks, the blocks are flushed and the
+// key of the last one is written to the file at `path`. An import with the same checkpoint file
+// continues after that key.
+func ImportCheckpoint(path string, interval int) ImportOption {
+	return func(o *importOptions) {
+		o.checkpointPath = path
+		if interval > 0 {
+			o.checkpointInterval = interval
+		}
+	}
+}
+
+// ImportProgressFunc sets a function that is called with the progress of the import whenever a
+// checkpoint is reached and when the import finishes.
+func ImportProgressFunc(fn func(ImportProgress)) ImportOption {
+	return func(o *importOptions) {
+		o.progress = fn
+	}
+}
+
+// ImportDatastore copies all blocks from a go-datastore, e.g. the badger or leveldb datastore of an
+// IPFS repo, into the blockstore.
+//
+// Blocks are expected under the prefix set with ImportPrefix, keyed by the base32 encoded multihash
+// as go-ipfs does since v0.5. Blocks keyed by their CID, as in older repos, are imported as well.
+// Blocks keyed by a multihash are stored under a CIDv1 with the raw codec, which doesn't matter for
+// lookups, as the blockstore indexes the digest only.
+//
+// Blocks are read in key order. Together with ImportCheckpoint, an import that was cancelled or
+// failed can be resumed. Blocks that are already present are skipped.
+func (bs *HashedBlockstore) ImportDatastore(ctx context.Context, ds datastore.Read, options ...ImportOption) (ImportProgress, error) {
+	opts := importOptions{
+		prefix:             DefaultImportPrefix,
+		checkpointInterval: defaultCheckpointInterval,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	q := query.Query{
+		Prefix: opts.prefix,
+		Orders: []query.Order{query.OrderByKey{}},
+	}
+	var progress ImportProgress
+	if opts.checkpointPath != "" {
+		lastKey, err := readCheckpoint(opts.checkpointPath)
+		if err != nil {
+			return progress, err
+		}
+		if lastKey != "" {
+			progress.LastKey = lastKey
+			q.Filters = []query.Filter{query.FilterKeyCompare{Op: query.GreaterThan, Key: lastKey}}
+		}
+	}
+	results, err := ds.Query(q)
+	if err != nil {
+		return progress, err
+	}
+	defer results.Close()
+
+	checkpoint := func() error {
+		if opts.checkpointPath != "" {
+			// The checkpoint must not get ahead of the data on disk.
+			bs.store.Flush()
+			if err := bs.store.Err(); err != nil {
+				return err
+			}
+			if err := writeCheckpoint(opts.checkpointPath, progress.LastKey); err != nil {
+				return err
+			}
+		}
+		if opts.progress != nil {
+			opts.progress(progress)
+		}
+		return nil
+	}
+
+	sinceCheckpoint := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+		result, ok := results.NextSync()
+		if !ok {
+			break
+		}
+		if result.Error != nil {
+			return progress, result.Error
+		}
+		c, err := importedCid(datastore.RawKey(result.Key))
+		if err != nil {
+			return progress, err
+		}
+		err = bs.store.Put(c.Bytes(), result.Value)
+		switch err {
+		case nil:
+			progress.Imported++
+		case types.ErrKeyExists:
+			progress.Skipped++
+		default:
+			return progress, err
+		}
+		progress.LastKey = result.Key
+
+		sinceCheckpoint++
+		if sinceCheckpoint == opts.checkpointInterval {
+			if err := checkpoint(); err != nil {
+				return progress, err
+			}
+			sinceCheckpoint = 0
+		}
+	}
+	return progress, checkpoint()
+}
+
+// importedCid returns the CID of a block from its datastore key.
+func importedCid(key datastore.Key) (cid.Cid, error) {
+	raw, err := dshelp.BinaryFromDsKey(datastore.NewKey(key.BaseNamespace()))
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	if mh, err := multihash.Cast(raw); err == nil {
+		return cid.NewCidV1(cid.Raw, mh), nil
+	}
+	return cid.Cast(raw)
+}
+
+func readCheckpoint(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func writeCheckpoint(path string, key string) error {
+	// Write the checkpoint atomically, a torn one would skip blocks.
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(key+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
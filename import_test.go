@@ -0,0 +1,65 @@
+package storethehash_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportDatastore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.OpenHashedBlockstore(filepath.Join(tempDir, "storethehash.index"),
+		filepath.Join(tempDir, "storethehash.data"), storethehash.IndexBitSize(16))
+	require.NoError(t, err)
+	defer bs.Close()
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	blks := testutil.GenerateBlocksOfSize(50, 100)
+	for _, blk := range blks {
+		key := datastore.NewKey(storethehash.DefaultImportPrefix).Child(dshelp.MultihashToDsKey(blk.Cid().Hash()))
+		require.NoError(t, ds.Put(key, blk.RawData()))
+	}
+	// Other namespaces are ignored.
+	require.NoError(t, ds.Put(datastore.NewKey("/pins/foo"), []byte("bar")))
+
+	// Cancel the first import after the second checkpoint.
+	checkpointPath := filepath.Join(tempDir, "import.checkpoint")
+	ctx, cancel := context.WithCancel(context.Background())
+	checkpoints := 0
+	progress, err := bs.ImportDatastore(ctx, ds, storethehash.ImportCheckpoint(checkpointPath, 10),
+		storethehash.ImportProgressFunc(func(storethehash.ImportProgress) {
+			checkpoints++
+			if checkpoints == 2 {
+				cancel()
+			}
+		}))
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, uint64(20), progress.Imported)
+
+	// The second import continues at the checkpoint.
+	progress, err = bs.ImportDatastore(context.Background(), ds, storethehash.ImportCheckpoint(checkpointPath, 10))
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), progress.Imported)
+	require.Equal(t, uint64(0), progress.Skipped)
+
+	// Without a checkpoint, everything is skipped.
+	progress, err = bs.ImportDatastore(context.Background(), ds)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), progress.Imported)
+	require.Equal(t, uint64(50), progress.Skipped)
+
+	for _, blk := range blks {
+		stored, err := bs.Get(blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), stored.RawData())
+	}
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// DefaultAccessWindows are the windows AccessStats reports if no windows are passed.
+var DefaultAccessWindows = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// AccessStats describes how much of the stored data was recently read or written, see
+// `Store.AccessStats`.
+type AccessStats struct {
+	// Number of live entries and their total size in bytes.
+	Keys      uint64
+	LiveBytes uint64
+	// Data accessed within each window, in the order the windows were passed.
+	Windows []AccessWindow
+}
+
+// AccessWindow is the share of the live data that was accessed within a window.
+type AccessWindow struct {
+	Window time.Duration
+	// Number of entries and bytes that were read or written within the window.
+	Keys  uint64
+	Bytes uint64
+}
+
+// Fraction returns the share of the live bytes that was accessed within the window.
+func (w AccessWindow) Fraction(stats AccessStats) float64 {
+	if stats.LiveBytes == 0 {
+		return 0
+	}
+	return float64(w.Bytes) / float64(stats.LiveBytes)
+}
+
+// accessTracker records when every key was last read or written.
+type accessTracker struct {
+	lk         sync.Mutex
+	lastAccess map[string]time.Time
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{lastAccess: make(map[string]time.Time)}
+}
+
+func (a *accessTracker) touch(key []byte) {
+	now := time.Now()
+	a.lk.Lock()
+	a.lastAccess[string(key)] = now
+	a.lk.Unlock()
+}
+
+func (a *accessTracker) get(key []byte) (time.Time, bool) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	t, ok := a.lastAccess[string(key)]
+	return t, ok
+}
+
+// onAccess is called after the value of a key was read or written.
+func (s *Store) onAccess(key []byte) {
+	if s.access != nil {
+		s.access.touch(key)
+	}
+}
+
+// AccessStats reports which share of the live bytes was read or written within each of the given
+// windows, `DefaultAccessWindows` if none are given. This helps to size caches, pick the threshold
+// of tiered storages or decide whether part of the data could be moved to colder storage.
+//
+// Accesses are only tracked if the store was opened with `TrackAccess`, and only since then.
+// Entries that weren't accessed since the store was opened are cold in all windows. It scans the
+// whole store.
+func (s *Store) AccessStats(windows ...time.Duration) (AccessStats, error) {
+	if s.access == nil {
+		return AccessStats{}, types.ErrNoAccessTracking
+	}
+	if len(windows) == 0 {
+		windows = DefaultAccessWindows
+	}
+	stats := AccessStats{Windows: make([]AccessWindow, len(windows))}
+	for i, window := range windows {
+		stats.Windows[i].Window = window
+	}
+	now := time.Now()
+	err := s.Scan(nil, nil, func(key []byte, value []byte) error {
+		stats.Keys++
+		stats.LiveBytes += uint64(len(value))
+		last, ok := s.access.get(key)
+		if !ok {
+			return nil
+		}
+		age := now.Sub(last)
+		for i := range stats.Windows {
+			if age <= stats.Windows[i].Window {
+				stats.Windows[i].Keys++
+				stats.Windows[i].Bytes += uint64(len(value))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return AccessStats{}, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,50 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessStats(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.TrackAccess())
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := append(testutil.GenerateBlocksOfSize(3, 100), testutil.GenerateBlocksOfSize(1, 300)...)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, found, err := s.Get(blks[3].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+
+	stats, err := s.AccessStats(50*time.Millisecond, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), stats.Keys)
+	require.Equal(t, uint64(600), stats.LiveBytes)
+	require.Equal(t, store.AccessWindow{Window: 50 * time.Millisecond, Keys: 1, Bytes: 300}, stats.Windows[0])
+	require.Equal(t, store.AccessWindow{Window: time.Hour, Keys: 4, Bytes: 600}, stats.Windows[1])
+	require.Equal(t, 0.5, stats.Windows[0].Fraction(stats))
+
+	stats, err = s.AccessStats()
+	require.NoError(t, err)
+	require.Len(t, stats.Windows, len(store.DefaultAccessWindows))
+
+	s2, err := store.OpenStore(filepath.Join(tempDir, "other.index"), inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s2.Close()
+	_, err = s2.AccessStats()
+	require.Equal(t, types.ErrNoAccessTracking, err)
+}
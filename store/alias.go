@@ -0,0 +1,88 @@
+package store
+
+import (
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Alias makes the value of `existingKey` available under `newKey` as well, e.g. to address a block
+// by both its CIDv0 and CIDv1 or by a legacy identifier. Only a small entry that refers to the
+// stored value is written, the value itself isn't copied.
+//
+// The value is kept as long as any key refers to it: updating or removing `existingKey` doesn't
+// affect `newKey`, and a GC keeps the value for both. If `newKey` is already stored, its value is
+// replaced. It fails with `types.ErrKeyNotFound` if `existingKey` isn't stored and with
+// `types.ErrAliasNotSupported` if the primary storage doesn't implement `primary.Aliaser`. Aliases
+// aren't supported in multi-value and appendable mode.
+func (s *Store) Alias(newKey []byte, existingKey []byte) error {
+	aliaser, ok := s.index.Primary.(primary.Aliaser)
+	if !ok {
+		return types.ErrAliasNotSupported
+	}
+	if s.multiValue {
+		return types.ErrMultiValue
+	}
+	if s.appendable {
+		return types.ErrAppendable
+	}
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	existingIndexKey, target, found, err := lookup(s.index, existingKey)
+	if err != nil {
+		return err
+	}
+	if found {
+		if found, err = verify(s.index, existingIndexKey, target); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return types.ErrKeyNotFound
+	}
+
+	indexKey, prevBlk, found, err := lookup(s.index, newKey)
+	if err != nil {
+		return err
+	}
+	if found {
+		if prevBlk == target {
+			// Both keys map to the same index key.
+			return types.ErrKeyExists
+		}
+		if found, err = verify(s.index, indexKey, prevBlk); err != nil {
+			return err
+		}
+	}
+
+	blk, err := aliaser.PutAlias(newKey, target)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if s.bloom != nil {
+			if err := s.bloom.Add(indexKey); err != nil {
+				return err
+			}
+		}
+		if err := s.index.Put(indexKey, blk); err != nil {
+			return err
+		}
+	} else {
+		if err := s.index.Update(indexKey, blk); err != nil {
+			return err
+		}
+		if err := s.freelist.Put(prevBlk); err != nil {
+			return err
+		}
+	}
+	s.noteIndexChange(indexKey)
+	if err := s.provenance.Put(indexKey, ""); err != nil {
+		return err
+	}
+	s.forgetAbsent(indexKey)
+	return s.settle(types.Work(blk.Size))
+}
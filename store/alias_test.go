@@ -0,0 +1,82 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlias(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+
+	blks := testutil.GenerateBlocksOfSize(4, 1000)
+	key, alias := blks[0].Cid().Bytes(), blks[1].Cid().Bytes()
+	require.NoError(t, s.Put(key, blks[0].RawData()))
+	require.Equal(t, types.ErrKeyNotFound, s.Alias(blks[2].Cid().Bytes(), blks[3].Cid().Bytes()))
+	require.NoError(t, s.Alias(alias, key))
+	require.Equal(t, types.ErrKeyExists, s.Alias(key, key))
+
+	check := func(s *store.Store, key []byte, expected []byte) {
+		value, found, err := s.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, expected, value)
+		size, found, err := s.GetSize(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Size(len(expected)), size)
+	}
+	check(s, alias, blks[0].RawData())
+	s.Flush()
+	check(s, alias, blks[0].RawData())
+	// The value isn't copied.
+	require.True(t, s.Stats().PrimarySize < 2*1000)
+
+	// The alias keeps the value when the original key is updated, also across a GC.
+	require.NoError(t, s.Put(key, blks[2].RawData()))
+	s.Flush()
+	require.NoError(t, s.GC(context.Background()))
+	check(s, key, blks[2].RawData())
+	check(s, alias, blks[0].RawData())
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	check(s, key, blks[2].RawData())
+	check(s, alias, blks[0].RawData())
+
+	// An alias can be replaced by another one.
+	require.NoError(t, s.Alias(alias, key))
+	check(s, alias, blks[2].RawData())
+}
+
+func TestAliasNotSupported(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	s, err := store.OpenStore(indexPath, inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.Equal(t, types.ErrAliasNotSupported, s.Alias(blks[1].Cid().Bytes(), blks[0].Cid().Bytes()))
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Append adds `more` to the end of the value of a key, e.g. a provenance record to the records of a
+// CID. Only `more` is written, as a new segment that links to the previous segments of the value.
+// If the key isn't stored yet, Append behaves like Put.
+//
+// The store needs to be opened with the `Appendable` option, otherwise `types.ErrNoAppend` is
+// returned. Reads of a value that consists of many segments read all of them, GC rewrites them into
+// a contiguous chain but doesn't merge them.
+func (s *Store) Append(key []byte, more []byte) error {
+	if !s.appendable {
+		return types.ErrNoAppend
+	}
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	unlock, err := s.lockChain(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var indexKey []byte
+	var blk types.Block
+	var found bool
+	err = s.retry("append", func() error {
+		var err error
+		indexKey, blk, found, err = s.lookupFiltered(key)
+		if err != nil || !found {
+			return err
+		}
+		// The index only stores prefixes, the entry may belong to a different key.
+		found, err = verify(s.index, indexKey, blk)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		// The first segment starts the chain of the key.
+		if err := s.checkValue(key, len(more)); err != nil {
+			return err
+		}
+		segment, err := s.index.Primary.Put(key, encodeChained(types.Block{}, more, false))
+		if err != nil {
+			return err
+		}
+		if err := s.indexEntry(key, indexKey, segment, types.Size(len(more)), false, types.Block{}); err != nil {
+			return err
+		}
+		return s.settle(types.Work(len(key) + len(more)))
+	}
+	if len(more) == 0 {
+		return nil
+	}
+
+	segment, err := s.index.Primary.Put(key, encodeChained(blk, more, false))
+	if err != nil {
+		return err
+	}
+	if err := s.index.Update(indexKey, segment); err != nil {
+		return err
+	}
+	s.noteIndexChange(indexKey)
+	s.forgetAbsent(indexKey)
+	s.onAccess(key)
+	return s.settle(types.Work(len(key) + len(more)))
+}
+
+// joinedValue returns the segments of the appendable value whose most recent segment is `data`,
+// joined in the order they were appended.
+func joinedValue(primaryStorage primary.PrimaryStorage, data []byte) ([]byte, bool, error) {
+	segments, err := liveValues(primaryStorage, data, 0)
+	if err != nil || len(segments) == 0 {
+		return nil, false, err
+	}
+	var size int
+	for _, segment := range segments {
+		size += len(segment)
+	}
+	value := make([]byte, 0, size)
+	// The segments were collected from the most recent one backwards.
+	for i := len(segments) - 1; i >= 0; i-- {
+		value = append(value, segments[i]...)
+	}
+	return value, true, nil
+}
+
+// chained returns whether values are stored as chains of entries, which link to the entry of the
+// previous value or segment of their key.
+func (s *Store) chained() bool {
+	return s.multiValue || s.appendable
+}
+
+// chainValue returns the value of a key whose most recent entry is `data`: the most recent value in
+// multi-value mode, all segments joined in appendable mode.
+func (s *Store) chainValue(data []byte) ([]byte, bool, error) {
+	if s.appendable {
+		return joinedValue(s.index.Primary, data)
+	}
+	return latestValue(s.index.Primary, data)
+}
@@ -0,0 +1,125 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppend(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	openStore := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, store.Appendable())
+		require.NoError(t, err)
+		return s
+	}
+
+	s := openStore()
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	key := blks[0].Cid().Bytes()
+	other := blks[1].Cid().Bytes()
+	// Appending to a missing key starts its value.
+	require.NoError(t, s.Append(key, []byte("record-1;")))
+	require.NoError(t, s.Append(key, []byte("record-2;")))
+	require.NoError(t, s.Append(key, []byte("record-3;")))
+	require.NoError(t, s.Put(other, []byte("old")))
+	require.NoError(t, s.Put(other, []byte("value")))
+	require.NoError(t, s.Append(other, []byte("+more")))
+
+	check := func() {
+		value, found, err := s.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, []byte("record-1;record-2;record-3;"), value)
+		size, found, err := s.GetSize(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Size(len(value)), size)
+
+		value, found, err = s.Get(other)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, []byte("value+more"), value)
+		has, err := s.Has(other)
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	check()
+
+	// Putting the stored value changes nothing, putting another one replaces all segments.
+	require.Equal(t, types.ErrKeyExists, s.Put(other, []byte("value+more")))
+	require.NoError(t, s.Put(blks[2].Cid().Bytes(), []byte("replaced")))
+	require.NoError(t, s.Append(blks[2].Cid().Bytes(), []byte("!")))
+	require.NoError(t, s.Put(blks[2].Cid().Bytes(), []byte("replaced")))
+	value, found, err := s.Get(blks[2].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("replaced"), value)
+
+	s.Flush()
+	require.NoError(t, s.Close())
+	s = openStore()
+	defer s.Close()
+	check()
+
+	// GC rewrites the segments and reclaims the replaced values.
+	sizeBefore := s.Stats().PrimarySize
+	require.NoError(t, s.GC(context.Background()))
+	require.True(t, s.Stats().PrimarySize < sizeBefore)
+	check()
+	require.NoError(t, s.Append(key, []byte("record-4;")))
+	value, _, err = s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record-1;record-2;record-3;record-4;"), value)
+}
+
+func TestAppendConcurrent(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, store.Appendable())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Appends of a key are serialized, none of them is lost.
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, s.Append(key, []byte("x")))
+		}()
+	}
+	wg.Wait()
+	value, found, err := s.Get(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, value, 20)
+}
+
+func TestAppendNotEnabled(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+	require.Equal(t, types.ErrNoAppend, s.Append(key, []byte("more")))
+
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	_, err = store.OpenStore(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, store.Appendable(), store.MultiValue())
+	require.Equal(t, types.ErrAppendable, err)
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// OutstandingWork returns the amount of work that is buffered in memory and waits to be flushed.
+//
+// Together with WaitForFlush, it allows callers to implement their own admission control, e.g.
+// with `RateLimit(NoRateLimit{})` to turn off the throttling of writers by the store.
+func (s *Store) OutstandingWork() types.Work {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	return s.outstandingWork()
+}
+
+// WaitForFlush blocks until all work that is outstanding when it's called was flushed, either by
+// the background flusher or by a call to Flush. It doesn't trigger a flush itself, a store that
+// wasn't started is only flushed by explicit calls.
+//
+// It returns the error of the context if it's done first, `types.ErrStoreClosed` if the store is
+// closed first, and the error of the store if the flush failed.
+func (s *Store) WaitForFlush(ctx context.Context) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if s.OutstandingWork() == 0 {
+		return nil
+	}
+	// Only a flush that starts from now on is sure to include all outstanding work.
+	s.rateLk.RLock()
+	target := s.flushStarted + 1
+	s.rateLk.RUnlock()
+	for {
+		s.rateLk.RLock()
+		finished, done := s.flushFinished, s.flushDone
+		s.rateLk.RUnlock()
+		if finished >= target {
+			return s.Err()
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.ctx.Done():
+			return types.ErrStoreClosed
+		}
+	}
+}
+
+// finishFlush wakes up the callers of WaitForFlush after the flush with the given sequence number
+// finished.
+func (s *Store) finishFlush(seq uint64) {
+	s.rateLk.Lock()
+	defer s.rateLk.Unlock()
+	if seq > s.flushFinished {
+		s.flushFinished = seq
+	}
+	close(s.flushDone)
+	s.flushDone = make(chan struct{})
+}
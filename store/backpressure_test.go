@@ -0,0 +1,60 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForFlush(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.WaitForFlush(context.Background()))
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.NotZero(t, s.OutstandingWork())
+
+	t.Logf("The store wasn't started, nothing flushes it")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, s.WaitForFlush(ctx))
+
+	t.Logf("A flush releases the waiter")
+	waitErr := make(chan error)
+	go func() {
+		waitErr <- s.WaitForFlush(context.Background())
+	}()
+	// The flush needs to start after the waiter did.
+	time.Sleep(50 * time.Millisecond)
+	s.Flush()
+	require.NoError(t, <-waitErr)
+	require.Zero(t, s.OutstandingWork())
+
+	t.Logf("The background flusher releases the waiter")
+	require.NoError(t, s.SetSyncInterval(10*time.Millisecond))
+	s.Start()
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+	require.NoError(t, s.WaitForFlush(context.Background()))
+	require.Zero(t, s.OutstandingWork())
+}
+
+func TestWaitForFlushClosed(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+
+	waitErr := make(chan error)
+	go func() {
+		waitErr <- s.WaitForFlush(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, s.Close())
+	require.Equal(t, types.ErrStoreClosed, <-waitErr)
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Names of the files within a backup.
+const (
+	BackupIndexName     = "index"
+	BackupPrimaryName   = "primary"
+	BackupChecksumsName = "checksums"
+)
+
+// Backup writes the index and the primary storage, as they are at the time of the call, to `w`.
+// The store stays open for reads and writes while the backup is running.
+//
+// The backup is a tar archive with the raw index file (`BackupIndexName`) and the raw data of the
+// primary storage (`BackupPrimaryName`), followed by their SHA-256 checksums in the format of
+// sha256sum (`BackupChecksumsName`). The data of every further part of a `primary.Partitioned`
+// storage is stored as `BackupPrimaryName` with the suffix of the part. It can be restored with
+// `RestoreStore`. The primary storage needs to implement `primary.Backuper` and `primary.Sizer`,
+// the parts of a partitioned one the latter as well. A GC that runs concurrently aborts the
+// backup with `types.ErrSnapshotInvalidated`. Segmented indexes aren't supported, their sealed
+// segments can be copied as files instead, see `index.Segments`.
+func (s *Store) Backup(w io.Writer) error {
+	sn, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+	backuper, ok := sn.index.Primary.(primary.Backuper)
+	if !ok || sn.primary == nil {
+		return types.ErrBackupNotSupported
+	}
+	if sn.index.Segmented() {
+		return types.ErrSegmentedIndex
+	}
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	type backupFile struct {
+		name   string
+		size   int64
+		readAt func([]byte, int64) (int, error)
+	}
+	files := []backupFile{{BackupIndexName, int64(sn.index.Size()), sn.index.ReadRawAt}}
+	for _, part := range sn.primary {
+		base := int64(part.base)
+		files = append(files, backupFile{BackupPrimaryName + part.suffix, int64(part.end - part.base),
+			func(p []byte, off int64) (int, error) {
+				return backuper.ReadRawAt(p, base+off)
+			}})
+	}
+	var checksums strings.Builder
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.name,
+			Mode:    0o644,
+			Size:    file.size,
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		reader := &snapshotReader{sn: sn, readAt: file.readAt, size: file.size}
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, hash), reader); err != nil {
+			return err
+		}
+		fmt.Fprintf(&checksums, "%s  %s\n", hex.EncodeToString(hash.Sum(nil)), file.name)
+	}
+	header := &tar.Header{
+		Name:    BackupChecksumsName,
+		Mode:    0o644,
+		Size:    int64(checksums.Len()),
+		ModTime: now,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(tw, checksums.String()); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// snapshotReader reads the first `size` bytes of a file of a snapshot. It fails if the snapshot
+// gets invalid while reading.
+type snapshotReader struct {
+	sn     *Snapshot
+	readAt func([]byte, int64) (int, error)
+	off    int64
+	size   int64
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if err := r.sn.acquire(); err != nil {
+		return 0, err
+	}
+	n, err := r.readAt(p, r.off)
+	r.sn.store.swapLk.RUnlock()
+	r.off += int64(n)
+	if err == io.EOF {
+		if n == len(p) {
+			err = nil
+		} else {
+			// The file must not be shorter than at the time of the snapshot.
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
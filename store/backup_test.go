@@ -0,0 +1,126 @@
+package store_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	for _, blk := range blks[:5] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	var backup bytes.Buffer
+	require.NoError(t, s.Backup(&backup))
+	// Writes after the backup aren't part of it.
+	for _, blk := range blks[5:] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	s.Flush()
+
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	restored, err := store.RestoreStore(indexPath, bytes.NewReader(backup.Bytes()), dataPath,
+		openCIDPrimary, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.Equal(t, uint64(5), restored.Stats().Keys)
+	for n, blk := range blks {
+		value, found, err := restored.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.Equal(t, n < 5, found)
+		if found {
+			require.Equal(t, blk.RawData(), value)
+		}
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	var backup bytes.Buffer
+	require.NoError(t, s.Backup(&backup))
+
+	restore := func(data []byte) error {
+		tempDir, err := ioutil.TempDir("", "sth")
+		require.NoError(t, err)
+		indexPath := filepath.Join(tempDir, "storethehash.index")
+		dataPath := filepath.Join(tempDir, "storethehash.data")
+		restored, err := store.RestoreStore(indexPath, bytes.NewReader(data), dataPath,
+			openCIDPrimary, defaultSyncInterval, defaultBurstRate)
+		if err == nil {
+			restored.Close()
+			return nil
+		}
+		// Nothing is left behind.
+		files, readErr := ioutil.ReadDir(tempDir)
+		require.NoError(t, readErr)
+		require.Empty(t, files)
+		return err
+	}
+
+	// Flip a byte of the last block value.
+	corrupt := append([]byte{}, backup.Bytes()...)
+	idx := bytes.LastIndex(corrupt, blks[4].RawData())
+	require.True(t, idx >= 0)
+	corrupt[idx] ^= 0xff
+	err = restore(corrupt)
+	require.True(t, errors.Is(err, types.ErrInvalidBackup), err)
+
+	// Truncated backups lack the checksums.
+	err = restore(backup.Bytes()[:backup.Len()/2])
+	require.True(t, errors.Is(err, types.ErrInvalidBackup), err)
+
+	// The checksums match, but the index is no index.
+	var invalid bytes.Buffer
+	tw := tar.NewWriter(&invalid)
+	var checksums strings.Builder
+	for _, file := range []struct{ name, data string }{
+		{store.BackupIndexName, "not an index"},
+		{store.BackupPrimaryName, ""},
+		{store.BackupPrimaryName + ".large", ""},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(file.data))}))
+		_, err := tw.Write([]byte(file.data))
+		require.NoError(t, err)
+		sum := sha256.Sum256([]byte(file.data))
+		fmt.Fprintf(&checksums, "%s  %s\n", hex.EncodeToString(sum[:]), file.name)
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: store.BackupChecksumsName, Mode: 0o644, Size: int64(checksums.Len())}))
+	_, err = tw.Write([]byte(checksums.String()))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	err = restore(invalid.Bytes())
+	require.True(t, errors.Is(err, types.ErrInvalidBackup), err)
+
+	require.NoError(t, restore(backup.Bytes()))
+}
+
+func openCIDPrimary(path string) (primary.PrimaryStorage, error) {
+	return cidprimary.OpenCIDPrimary(path)
+}
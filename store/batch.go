@@ -0,0 +1,170 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Batch stages puts and deletes that are applied together, see Store.NewBatch.
+type Batch struct {
+	store *Store
+
+	lk     sync.Mutex
+	ops    []batchOp
+	closed bool
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// NewBatch returns an empty batch of writes to the store.
+//
+// The writes of a batch are only staged in memory until Commit applies all of them at once and
+// syncs them to disk, readers either see all of them or none. Discard drops them instead. A batch
+// can be used from several goroutines, but can't be reused once it was committed or discarded.
+func (s *Store) NewBatch() *Batch {
+	return &Batch{store: s}
+}
+
+// Put stages a value for the key. The key and value must not be modified until the batch is
+// committed or discarded.
+func (b *Batch) Put(key []byte, value []byte) error {
+	if err := b.store.checkValue(key, len(value)); err != nil {
+		return err
+	}
+	return b.add(batchOp{key: key, value: value})
+}
+
+// Delete stages the removal of the key, see Store.Delete.
+func (b *Batch) Delete(key []byte) error {
+	return b.add(batchOp{key: key, delete: true})
+}
+
+func (b *Batch) add(op batchOp) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.closed {
+		return types.ErrBatchClosed
+	}
+	b.ops = append(b.ops, op)
+	return nil
+}
+
+// Len returns the number of staged writes.
+func (b *Batch) Len() int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return len(b.ops)
+}
+
+// Discard drops all staged writes. Discarding a batch that was already committed has no effect.
+func (b *Batch) Discard() {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.ops = nil
+	b.closed = true
+}
+
+// Commit applies the staged writes in the order they were staged and syncs them to disk.
+//
+// A batch with a key that can't be stored is rejected as a whole before anything is written. Puts
+// of values that are already stored are skipped, like Put skips them. While sync is paused, see
+// PauseSync, the writes become visible and are synced once the store is resumed.
+//
+// If a write fails while the batch is applied or synced, e.g. due to an I/O error, the batch is
+// rolled back and the error is returned. The writes before the batch are flushed first, the
+// rollback reopens the files as Reopen does, which discards everything that was written since. It
+// needs a primary storage that implements `primary.Reopener` and sync not to be paused. Otherwise,
+// or if the rollback fails, the store fails as it does when a flush fails, it rejects all further
+// operations and doesn't write any of the batch to the files.
+func (b *Batch) Commit() error {
+	b.lk.Lock()
+	if b.closed {
+		b.lk.Unlock()
+		return types.ErrBatchClosed
+	}
+	ops := b.ops
+	b.ops = nil
+	b.closed = true
+	b.lk.Unlock()
+	return b.store.commitBatch(ops)
+}
+
+func (s *Store) commitBatch(ops []batchOp) error {
+	// Readers must not see a partially applied batch.
+	s.swapLk.Lock()
+	defer s.swapLk.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		indexKey, err := s.index.Primary.IndexKey(op.key)
+		if err != nil {
+			return err
+		}
+		if _, err := s.index.Bucket(indexKey); err != nil {
+			return err
+		}
+	}
+
+	// Reopening the files discards everything since the last flush, which needs to be the batch
+	// only.
+	reopener, rollback := s.index.Primary.(primary.Reopener)
+	if rollback && s.outstandingWork() > 0 {
+		if _, err := s.commit(true); err != nil {
+			if !isPaused(err) {
+				s.setErr(err)
+				return err
+			}
+			rollback = false
+		}
+	}
+
+	var work types.Work
+	for _, op := range ops {
+		var opWork types.Work
+		var err error
+		if op.delete {
+			opWork, err = s.deleteEntry(op.key)
+		} else {
+			opWork, err = s.putEntry(op.key, op.value, false, time.Time{}, 0, nil)
+		}
+		if err == types.ErrKeyExists {
+			continue
+		}
+		if err != nil {
+			return s.abortBatch(reopener, rollback, err)
+		}
+		work += opWork
+	}
+	if work == 0 {
+		return nil
+	}
+	_, err := s.commit(true)
+	if err != nil && !isPaused(err) {
+		return s.abortBatch(reopener, rollback, err)
+	}
+	return nil
+}
+
+// abortBatch rolls back a batch that failed with the given error, or fails the store if that isn't
+// possible. It returns the error of the batch and must be called with swapLk held for writing.
+func (s *Store) abortBatch(reopener primary.Reopener, rollback bool, err error) error {
+	if !rollback {
+		s.setErr(fmt.Errorf("cannot apply batch: %w", err))
+		return err
+	}
+	if reopenErr := s.reopen(reopener); reopenErr != nil {
+		s.setErr(fmt.Errorf("cannot roll back batch: %w", reopenErr))
+		return err
+	}
+	s.log.Warnw("rolled back batch", "path", s.path, "err", err)
+	return err
+}
@@ -0,0 +1,152 @@
+package store_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	has := func(s *store.Store, key []byte) bool {
+		has, err := s.Has(key)
+		require.NoError(t, err)
+		return has
+	}
+
+	blks := testutil.GenerateBlocksOfSize(4, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+
+	batch := s.NewBatch()
+	for _, blk := range blks[1:] {
+		require.NoError(t, batch.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, batch.Delete(blks[0].Cid().Bytes()))
+	require.Equal(t, 4, batch.Len())
+	// Nothing is visible before the batch is committed.
+	require.True(t, has(s, blks[0].Cid().Bytes()))
+	for _, blk := range blks[1:] {
+		require.False(t, has(s, blk.Cid().Bytes()))
+	}
+	require.NoError(t, batch.Commit())
+	require.Equal(t, types.ErrBatchClosed, batch.Commit())
+	require.Equal(t, types.ErrBatchClosed, batch.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+
+	require.False(t, has(s, blks[0].Cid().Bytes()))
+	for _, blk := range blks[1:] {
+		require.True(t, has(s, blk.Cid().Bytes()))
+	}
+	// The batch was synced right away.
+	require.Zero(t, s.Stats().OutstandingWork)
+
+	// A discarded batch isn't applied.
+	batch = s.NewBatch()
+	require.NoError(t, batch.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	batch.Discard()
+	require.Equal(t, types.ErrBatchClosed, batch.Commit())
+	require.False(t, has(s, blks[0].Cid().Bytes()))
+
+	// A batch with an invalid key is rejected as a whole.
+	batch = s.NewBatch()
+	require.NoError(t, batch.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.NoError(t, batch.Put([]byte("not a cid"), []byte("value")))
+	require.Error(t, batch.Commit())
+	require.False(t, has(s, blks[0].Cid().Bytes()))
+	require.NoError(t, s.Err())
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	require.False(t, has(s, blks[0].Cid().Bytes()))
+	for _, blk := range blks[1:] {
+		require.True(t, has(s, blk.Cid().Bytes()))
+	}
+}
+
+// failingPutPrimary fails to store values of the given key.
+type failingPutPrimary struct {
+	*cidprimary.CIDPrimary
+	fail []byte
+}
+
+func (fp *failingPutPrimary) Put(key []byte, value []byte) (types.Block, error) {
+	if bytes.Equal(key, fp.fail) {
+		return types.Block{}, errors.New("injected failure")
+	}
+	return fp.CIDPrimary.Put(key, value)
+}
+
+func TestBatchRollback(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, &failingPutPrimary{primary, blks[3].Cid().Bytes()}, defaultIndexSizeBits,
+			defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	get := func(s *store.Store, key []byte) []byte {
+		value, found, err := s.Get(key)
+		require.NoError(t, err)
+		if !found {
+			return nil
+		}
+		return value
+	}
+
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	// Not flushed before the batch.
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+
+	batch := s.NewBatch()
+	require.NoError(t, batch.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+	require.NoError(t, batch.Delete(blks[0].Cid().Bytes()))
+	require.NoError(t, batch.Put(blks[1].Cid().Bytes(), []byte("updated")))
+	require.NoError(t, batch.Put(blks[3].Cid().Bytes(), blks[3].RawData()))
+	require.NoError(t, batch.Put(blks[4].Cid().Bytes(), blks[4].RawData()))
+	require.EqualError(t, batch.Commit(), "injected failure")
+
+	// None of the batch was applied and the store keeps working.
+	check := func(s *store.Store) {
+		require.Equal(t, blks[0].RawData(), get(s, blks[0].Cid().Bytes()))
+		require.Equal(t, blks[1].RawData(), get(s, blks[1].Cid().Bytes()))
+		require.Equal(t, blks[2].RawData(), get(s, blks[2].Cid().Bytes()))
+		for _, blk := range blks[3:] {
+			require.Nil(t, get(s, blk.Cid().Bytes()))
+		}
+	}
+	require.NoError(t, s.Err())
+	require.Nil(t, get(s, blks[2].Cid().Bytes()))
+	require.NoError(t, s.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+	check(s)
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	check(s)
+}
@@ -0,0 +1,310 @@
+// Package bloom provides a bloom filter of the keys of a store that is persisted next to its index.
+//
+// The filter answers most lookups of keys that aren't stored without reading the index. It's kept
+// up to date incrementally: inserted keys are appended to a log, which is folded into a snapshot of
+// the filter when it is closed. Opening the filter reads the snapshot and replays the log, hence
+// the time it takes doesn't grow with the number of keys of the store.
+package bloom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// The snapshot file contains the filter:
+//
+//	|      8 bytes      |     1 byte    |  8 bytes each  |
+//	|  Number of words  |  Hash count   |     Words      |
+//
+// The log file contains the keys that were inserted since the snapshot was written:
+//
+//	|  2 bytes   |  Key length  |
+//	| Key length |     Key      |
+const (
+	snapshotSuffix = ".bloom"
+	logSuffix      = ".bloom.log"
+	headerSize     = 9
+	lengthBytes    = 2
+)
+
+const bufferSize = 32 * 4096
+
+// Bits per key and number of hashes for a false positive rate of about 1%.
+const (
+	bitsPerKey = 10
+	hashCount  = 7
+)
+
+// Filter is a bloom filter of keys that is persisted to files next to an index.
+type Filter struct {
+	words  []uint64
+	hashes uint8
+
+	path            string
+	lk              sync.Mutex
+	log             *os.File
+	writer          *bufio.Writer
+	outstandingWork types.Work
+}
+
+// Open opens the filter that belongs to the index at the given path, it's created with room for
+// `expectedKeys` keys if it doesn't exist yet. The size of an existing filter is kept.
+//
+// It returns false if there was no filter, in which case all keys that are already stored need to
+// be inserted, see Insert and Checkpoint.
+func Open(path string, expectedKeys uint64) (*Filter, bool, error) {
+	f := &Filter{path: path}
+	loaded, err := f.loadSnapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	if !loaded {
+		words := (expectedKeys*bitsPerKey + 63) / 64
+		if words == 0 {
+			words = 1
+		}
+		f.words = make([]uint64, words)
+		f.hashes = hashCount
+		// A log without snapshot belongs to a filter that is gone.
+		if err := os.Remove(path + logSuffix); err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+	}
+	if err := f.openLog(); err != nil {
+		return nil, false, err
+	}
+	return f, loaded, nil
+}
+
+func (f *Filter) loadSnapshot() (bool, error) {
+	data, err := ioutil.ReadFile(f.path + snapshotSuffix)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(data) < headerSize {
+		return false, nil
+	}
+	words := binary.LittleEndian.Uint64(data)
+	if uint64(len(data)-headerSize) != words*8 {
+		return false, nil
+	}
+	f.hashes = data[8]
+	f.words = make([]uint64, words)
+	for n := range f.words {
+		f.words[n] = binary.LittleEndian.Uint64(data[headerSize+n*8:])
+	}
+	return true, nil
+}
+
+// openLog replays the log into the filter and opens it for appending. A key that was only
+// partially written is removed.
+func (f *Filter) openLog() error {
+	file, err := os.OpenFile(f.path+logSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(file, bufferSize)
+	var size int64
+	lengthBuf := make([]byte, lengthBytes)
+	for {
+		if _, err := io.ReadFull(reader, lengthBuf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			_ = file.Close()
+			return err
+		}
+		key := make([]byte, binary.LittleEndian.Uint16(lengthBuf))
+		if _, err := io.ReadFull(reader, key); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			_ = file.Close()
+			return err
+		}
+		f.Insert(key)
+		size += int64(lengthBytes + len(key))
+	}
+	if err := file.Truncate(size); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.log = file
+	f.writer = bufio.NewWriterSize(file, bufferSize)
+	return nil
+}
+
+// positions returns the bits a key maps to, derived from a single 64-bit hash by double hashing.
+func (f *Filter) positions(key []byte, fn func(word int, mask uint64) bool) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32
+	bits := uint64(len(f.words)) * 64
+	for n := uint64(0); n < uint64(f.hashes); n++ {
+		bit := (h1 + n*h2) % bits
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return
+		}
+	}
+}
+
+// Test returns false if the key was never inserted. It may return true for keys that weren't.
+func (f *Filter) Test(key []byte) bool {
+	found := true
+	f.positions(key, func(word int, mask uint64) bool {
+		if atomic.LoadUint64(&f.words[word])&mask == 0 {
+			found = false
+		}
+		return found
+	})
+	return found
+}
+
+// Insert adds a key to the filter without recording it in the log. It's only persisted by the next
+// checkpoint.
+func (f *Filter) Insert(key []byte) {
+	f.positions(key, func(word int, mask uint64) bool {
+		for {
+			old := atomic.LoadUint64(&f.words[word])
+			if old&mask != 0 || atomic.CompareAndSwapUint64(&f.words[word], old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+// Add adds a key to the filter and records it in the log.
+func (f *Filter) Add(key []byte) error {
+	if len(key) > math.MaxUint16 {
+		return types.ErrOutOfBounds
+	}
+	f.Insert(key)
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	lengthBuf := make([]byte, lengthBytes)
+	binary.LittleEndian.PutUint16(lengthBuf, uint16(len(key)))
+	if _, err := f.writer.Write(lengthBuf); err != nil {
+		return err
+	}
+	if _, err := f.writer.Write(key); err != nil {
+		return err
+	}
+	f.outstandingWork += types.Work(lengthBytes + len(key))
+	return nil
+}
+
+// Checkpoint writes a snapshot of the filter and empties the log.
+func (f *Filter) Checkpoint() error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	data := make([]byte, headerSize+8*len(f.words))
+	binary.LittleEndian.PutUint64(data, uint64(len(f.words)))
+	data[8] = f.hashes
+	for n := range f.words {
+		binary.LittleEndian.PutUint64(data[headerSize+n*8:], atomic.LoadUint64(&f.words[n]))
+	}
+	// The snapshot is replaced atomically, the log is only emptied once it's in place. If that
+	// fails, the keys of the log are inserted again on open, which doesn't change the filter.
+	tmpPath := f.path + snapshotSuffix + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, f.path+snapshotSuffix); err != nil {
+		return err
+	}
+	f.writer.Reset(f.log)
+	f.outstandingWork = 0
+	if err := f.log.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.log.Seek(0, io.SeekStart)
+	return err
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *Filter) Flush() (types.Work, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	work := f.outstandingWork
+	if err := f.writer.Flush(); err != nil {
+		return 0, err
+	}
+	f.outstandingWork = 0
+	return work, nil
+}
+
+func (f *Filter) Sync() error {
+	if _, err := f.Flush(); err != nil {
+		return err
+	}
+	return f.log.Sync()
+}
+
+func (f *Filter) OutstandingWork() types.Work {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.outstandingWork
+}
+
+// Reopen discards the keys that weren't flushed and reopens the log, e.g. after a write failed.
+// Their bits stay set.
+func (f *Filter) Reopen() error {
+	_ = f.log.Close()
+	return f.openLog()
+}
+
+// Close writes a snapshot of the filter and closes its files.
+func (f *Filter) Close() error {
+	if _, err := f.Flush(); err != nil {
+		_ = f.log.Close()
+		return err
+	}
+	if err := f.Checkpoint(); err != nil {
+		_ = f.log.Close()
+		return err
+	}
+	return f.log.Close()
+}
+
+// Remove removes the files of the filter that belongs to the index at the given path, e.g. because
+// the index was replaced and the filter may lack some of its keys.
+func Remove(path string) error {
+	for _, suffix := range []string{snapshotSuffix, logSuffix} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
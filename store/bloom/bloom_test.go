@@ -0,0 +1,71 @@
+package bloom_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/bloom"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "storethehash.index")
+	f, loaded, err := bloom.Open(path, 1000)
+	require.NoError(t, err)
+	require.False(t, loaded)
+	for i := 0; i < 500; i++ {
+		f.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	require.NoError(t, f.Checkpoint())
+
+	// Keys added after the checkpoint are only in the log, which survives a crash.
+	for i := 500; i < 1000; i++ {
+		require.NoError(t, f.Add([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	require.NoError(t, f.Sync())
+	// Append a torn record, it's dropped on open.
+	file, err := os.OpenFile(path+".bloom.log", os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{4, 0, 'd', 'd'})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// f is never closed, as if the process crashed.
+	f2, loaded, err := bloom.Open(path, 1000)
+	require.NoError(t, err)
+	require.True(t, loaded)
+	for i := 0; i < 1000; i++ {
+		require.True(t, f2.Test([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f2.Test([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	require.True(t, falsePositives < 300)
+	require.NoError(t, f2.Add([]byte("key-x")))
+	require.NoError(t, f2.Close())
+
+	// Closing folds the log into the snapshot.
+	info, err := os.Stat(path + ".bloom.log")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+	f, loaded, err = bloom.Open(path, 1000)
+	require.NoError(t, err)
+	require.True(t, loaded)
+	require.True(t, f.Test([]byte("key-x")))
+	require.True(t, f.Test([]byte("key-999")))
+	require.NoError(t, f.Close())
+
+	require.NoError(t, bloom.Remove(path))
+	f, loaded, err = bloom.Open(path, 1000)
+	require.NoError(t, err)
+	defer f.Close()
+	require.False(t, loaded)
+}
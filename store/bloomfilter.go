@@ -0,0 +1,77 @@
+package store
+
+import (
+	"sync/atomic"
+
+	"github.com/hannahhoward/go-storethehash/store/bloom"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// openBloom opens the bloom filter of the index at the given path. A filter that doesn't exist yet
+// is built from the keys of the index and written right away, so that this only happens once.
+func openBloom(path string, idx *index.Index, expectedKeys uint64) (*bloom.Filter, error) {
+	filter, loaded, err := bloom.Open(path, expectedKeys)
+	if err != nil {
+		return nil, err
+	}
+	if loaded {
+		return filter, nil
+	}
+	err = idx.Scan(nil, nil, func(_ []byte, blk types.Block) error {
+		indexKey, err := idx.Primary.GetIndexKey(blk)
+		if err != nil {
+			return err
+		}
+		filter.Insert(indexKey)
+		return nil
+	})
+	if err == nil {
+		err = filter.Checkpoint()
+	}
+	if err != nil {
+		_ = filter.Close()
+		_ = bloom.Remove(path)
+		return nil, err
+	}
+	return filter, nil
+}
+
+// bloomAbsent returns true if the bloom filter rules out that the key is stored. It's always false
+// without a filter.
+//
+// The filter contains every key that was ever stored, hence it also answers for snapshots.
+func (s *Store) bloomAbsent(key []byte) (bool, error) {
+	if s.bloom == nil {
+		return false, nil
+	}
+	indexKey, err := s.index.Primary.IndexKey(key)
+	if err != nil {
+		return false, err
+	}
+	if s.bloom.Test(indexKey) {
+		return false, nil
+	}
+	atomic.AddUint64(&s.filteredLookups, 1)
+	return true, nil
+}
+
+// lookupFiltered is like lookup, but doesn't read the index if the bloom filter rules out the key.
+func (s *Store) lookupFiltered(key []byte) ([]byte, types.Block, bool, error) {
+	if s.bloom == nil {
+		return lookup(s.index, key)
+	}
+	indexKey, err := s.index.Primary.IndexKey(key)
+	if err != nil {
+		return nil, types.Block{}, false, err
+	}
+	if !s.bloom.Test(indexKey) {
+		atomic.AddUint64(&s.filteredLookups, 1)
+		return indexKey, types.Block{}, false, nil
+	}
+	blk, found, err := s.index.Get(indexKey)
+	if err != nil {
+		return nil, types.Block{}, false, err
+	}
+	return indexKey, blk, found, nil
+}
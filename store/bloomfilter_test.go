@@ -0,0 +1,71 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary := inmemory.NewInmemory(nil)
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+
+	// The store exists before the filter, it's built from the index on open.
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	for _, blk := range blks[:10] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Close())
+
+	open := func() *store.Store {
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+			store.BloomFilter(100))
+		require.NoError(t, err)
+		return s
+	}
+	s = open()
+	_, err = os.Stat(indexPath + ".bloom")
+	require.NoError(t, err)
+	for _, blk := range blks[10:15] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	check := func(s *store.Store) {
+		for _, blk := range blks[:15] {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, blk.RawData(), value)
+		}
+		for _, blk := range blks[15:] {
+			has, err := s.Has(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.False(t, has)
+		}
+	}
+	check(s)
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	check(s)
+	require.True(t, s.Stats().FilteredLookups >= 5)
+
+	// The filter answers for snapshots as well.
+	sn, err := s.Snapshot()
+	require.NoError(t, err)
+	for i, blk := range blks {
+		has, err := sn.Has(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.Equal(t, i < 15, has)
+	}
+}
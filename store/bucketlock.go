@@ -0,0 +1,49 @@
+package store
+
+import "sort"
+
+// Number of locks the buckets of the index are spread over by LockBuckets.
+const bucketLockStripes = 1024
+
+// LockBuckets locks the buckets of the index that the given keys belong to and returns the
+// function that unlocks them. It blocks while another caller holds the lock of any of them.
+//
+// The locks are advisory: reads and writes of the store don't take them, they only exclude other
+// callers of LockBuckets. Applications use them to guard a critical section that spans several
+// operations, e.g. checking some keys and putting others depending on the result, without a
+// global lock around the whole store. All keys of a critical section need to be locked with a
+// single call, locking more keys while holding the locks of others may deadlock.
+//
+// Buckets share a fixed number of locks, hence locking a key may also wait for unrelated keys.
+func (s *Store) LockBuckets(keys ...[]byte) (func(), error) {
+	s.swapLk.RLock()
+	idx := s.index
+	s.swapLk.RUnlock()
+	stripes := make([]int, 0, len(keys))
+	seen := make(map[int]struct{}, len(keys))
+	for _, key := range keys {
+		indexKey, err := idx.Primary.IndexKey(key)
+		if err != nil {
+			return nil, err
+		}
+		bucket, err := idx.Bucket(indexKey)
+		if err != nil {
+			return nil, err
+		}
+		stripe := int(bucket % bucketLockStripes)
+		if _, ok := seen[stripe]; !ok {
+			seen[stripe] = struct{}{}
+			stripes = append(stripes, stripe)
+		}
+	}
+	// Locks are always taken in the same order, so that overlapping calls don't deadlock.
+	sort.Ints(stripes)
+	for _, stripe := range stripes {
+		s.bucketLks[stripe].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			s.bucketLks[stripes[i]].Unlock()
+		}
+	}, nil
+}
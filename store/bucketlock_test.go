@@ -0,0 +1,66 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockBuckets(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Check-then-put of a counter doesn't lose increments.
+	key := []byte("counter-key")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				unlock, err := s.LockBuckets(key)
+				require.NoError(t, err)
+				value, _, err := s.Get(key)
+				require.NoError(t, err)
+				n, _ := strconv.Atoi(string(value))
+				require.NoError(t, s.Put(key, []byte(strconv.Itoa(n+1))))
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	value, found, err := s.Get(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "160", string(value))
+
+	// A call that locks several keys waits for any of them.
+	unlock, err := s.LockBuckets(key)
+	require.NoError(t, err)
+	locked := make(chan func())
+	go func() {
+		unlock, err := s.LockBuckets([]byte("other-key"), key, key)
+		require.NoError(t, err)
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("bucket was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	(<-locked)()
+
+	_, err = s.LockBuckets([]byte("ab"))
+	require.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// valueCache keeps recently read entries of the primary storage in memory, keyed by their
+// position. Entries are evicted in least-recently-used order once their total size exceeds the
+// capacity.
+//
+// Entries of an append-only storage never change, the cache only needs to be cleared when the
+// positions are reused, i.e. when the files are compacted or truncated.
+type valueCache struct {
+	lk       sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[types.Position]*list.Element
+	// Entries ordered by last use, the most recently used first
+	lru          *list.List
+	hits, misses uint64
+}
+
+type cacheEntry struct {
+	pos   types.Position
+	key   []byte
+	value []byte
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		entries:  make(map[types.Position]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns copies of the key and value stored at the given position.
+func (c *valueCache) get(pos types.Position) ([]byte, []byte, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	elem, ok := c.entries[pos]
+	if !ok {
+		c.misses++
+		return nil, nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	return append([]byte(nil), entry.key...), append([]byte(nil), entry.value...), true
+}
+
+// put adds copies of the key and value stored at the given position. Entries larger than the
+// capacity aren't cached.
+func (c *valueCache) put(pos types.Position, key []byte, value []byte) {
+	size := int64(len(key) + len(value))
+	if size > c.capacity {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if _, ok := c.entries[pos]; ok {
+		return
+	}
+	entry := &cacheEntry{pos, append([]byte(nil), key...), append([]byte(nil), value...)}
+	c.entries[pos] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		evicted := c.lru.Remove(oldest).(*cacheEntry)
+		delete(c.entries, evicted.pos)
+		c.size -= int64(len(evicted.key) + len(evicted.value))
+	}
+}
+
+// clear removes all entries.
+func (c *valueCache) clear() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.entries = make(map[types.Position]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *valueCache) stats() (uint64, uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.hits, c.misses
+}
+
+// getCached returns the value of a key like get, but serves the entry from the value cache of the
+// store if it has one. The phases of the read are measured with `trace`, which may be nil.
+func (s *Store) getCached(key []byte, trace *opTrace) ([]byte, bool, error) {
+	indexKey, blk, found, err := lookup(s.index, key)
+	trace.mark(phaseIndexScan)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	if s.cache == nil {
+		value, found, err := readValue(s.index, indexKey, blk)
+		trace.mark(phasePrimaryRead)
+		return value, found, err
+	}
+	primaryKey, value, ok := s.cache.get(blk.Offset)
+	if !ok {
+		primaryKey, value, err = s.index.Primary.Get(blk)
+		trace.mark(phasePrimaryRead)
+		if err != nil {
+			return nil, false, err
+		}
+		s.cache.put(blk.Offset, primaryKey, value)
+	}
+	return matchValue(s.index, indexKey, primaryKey, value)
+}
@@ -0,0 +1,65 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueCache(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	// Room for about two of the blocks.
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.ValueCache(2500))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(4, 1000)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	s.Flush()
+	get := func(i int) {
+		value, found, err := s.Get(blks[i].Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blks[i].RawData(), value)
+	}
+	get(0)
+	get(0)
+	get(1)
+	get(2)
+	// The first block was evicted.
+	get(0)
+	stats := s.Stats()
+	require.Equal(t, uint64(1), stats.CacheHits)
+	require.Equal(t, uint64(4), stats.CacheMisses)
+
+	// Values that are returned from the cache can be modified by the caller.
+	value, _, err := s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	value[0]++
+	get(0)
+
+	// GC moves the entries, the cache doesn't return stale ones.
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[3].RawData()))
+	s.Flush()
+	require.NoError(t, s.GC(context.Background()))
+	value, found, err := s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[3].RawData(), value)
+	get(2)
+	get(0)
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+)
+
+// Names of the optional features of a store, as reported by Capabilities.
+const (
+	// Keys can be deleted, see Delete
+	CapabilityDelete = "delete"
+	// Keys have a list of values, see `MultiValue`
+	CapabilityMultiValue = "multi-value"
+	// Values can be appended to, see `Appendable`
+	CapabilityAppend = "append"
+	// Values expire, see `Expiry`
+	CapabilityExpiry = "expiry"
+	// Entries have an insertion time and flags, see `EntryMetadata`
+	CapabilityMetadata = "metadata"
+	// New values are merged with existing ones, see `WithMergeOperator`
+	CapabilityMerge = "merge"
+	// Values are read incrementally, see GetStream
+	CapabilityStreaming = "streaming"
+	// Keys can refer to the value of another key, see Alias
+	CapabilityAliases = "aliases"
+	// Garbage is reclaimed, see GC
+	CapabilityCompaction = "compaction"
+)
+
+// Capabilities describes the format and the optional features of a store, so that clients, e.g. of
+// a network API, can adapt to the store they talk to.
+type Capabilities struct {
+	// Version of the format of the index file, see `index.IndexVersion`
+	FormatVersion int `json:"format_version"`
+	// Names of the enabled features, e.g. `CapabilityMultiValue`
+	Features []string `json:"features"`
+}
+
+// Has returns whether the given feature is enabled.
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns the format version and the enabled features of the store. Some features
+// depend on the options it was opened with, others on the interfaces the primary storage
+// implements.
+func (s *Store) Capabilities() Capabilities {
+	s.swapLk.RLock()
+	storage := s.index.Primary
+	s.swapLk.RUnlock()
+
+	features := []string{CapabilityDelete}
+	if s.multiValue {
+		features = append(features, CapabilityMultiValue)
+	}
+	if s.appendable {
+		features = append(features, CapabilityAppend)
+	}
+	if s.expiry {
+		features = append(features, CapabilityExpiry)
+	}
+	if s.metadata {
+		features = append(features, CapabilityMetadata)
+	}
+	if s.mergeOperator != nil {
+		features = append(features, CapabilityMerge)
+	}
+	if _, ok := storage.(primary.Streamer); ok {
+		features = append(features, CapabilityStreaming)
+	}
+	if _, ok := storage.(primary.Aliaser); ok {
+		features = append(features, CapabilityAliases)
+	}
+	if _, ok := storage.(primary.Compactor); ok {
+		features = append(features, CapabilityCompaction)
+	}
+	return Capabilities{FormatVersion: int(index.IndexVersion), Features: features}
+}
@@ -0,0 +1,34 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	capabilities := s.Capabilities()
+	require.Equal(t, int(index.IndexVersion), capabilities.FormatVersion)
+	require.Equal(t, []string{store.CapabilityDelete, store.CapabilityStreaming, store.CapabilityAliases,
+		store.CapabilityCompaction}, capabilities.Features)
+	require.False(t, capabilities.Has(store.CapabilityMultiValue))
+
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	s, err = store.OpenStore(indexPath, inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.MultiValue())
+	require.NoError(t, err)
+	defer s.Close()
+	capabilities = s.Capabilities()
+	require.Equal(t, []string{store.CapabilityDelete, store.CapabilityMultiValue}, capabilities.Features)
+	require.True(t, capabilities.Has(store.CapabilityMultiValue))
+}
@@ -0,0 +1,32 @@
+package store
+
+import "github.com/hannahhoward/go-storethehash/store/types"
+
+// CompactIndex reclaims the space of the outdated record lists in the index file, which every
+// write leaves behind, see `index.Index.Compact`. Unlike GC, the primary storage isn't touched. It
+// returns the number of bytes the index file shrank by.
+//
+// The store is locked while the index is compacted, reads and writes wait until it's done.
+// Snapshots of the store become invalid.
+func (s *Store) CompactIndex() (int64, error) {
+	s.swapLk.Lock()
+	defer s.swapLk.Unlock()
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	if !s.isOpen() {
+		return 0, types.ErrStoreClosed
+	}
+	if _, err := s.commit(true); err != nil {
+		s.setErr(err)
+		return 0, err
+	}
+	// Snapshots share the file of the index, which is replaced.
+	s.generation++
+	shrunk, err := s.index.Compact()
+	if err != nil {
+		return 0, err
+	}
+	s.log.Infow("compacted index", "path", s.path, "bytes", shrunk, "size", s.index.Size())
+	return shrunk, nil
+}
@@ -0,0 +1,39 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactIndex(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(100, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	s.Flush()
+	// The deletes replace the record lists of their buckets.
+	for _, blk := range blks[:50] {
+		require.NoError(t, s.Delete(blk.Cid().Bytes()))
+	}
+	s.Flush()
+	size := s.Stats().IndexSize
+
+	shrunk, err := s.CompactIndex()
+	require.NoError(t, err)
+	require.True(t, shrunk > 0)
+	require.Equal(t, size-types.Position(shrunk), s.Stats().IndexSize)
+	for n, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.Equal(t, n >= 50, found)
+		if found {
+			require.Equal(t, blk.RawData(), value)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package store
+
+// CompactIndexBits is the largest number of bucket bits that `CompactMode` creates an index with,
+// its bucket table takes 48KiB of memory.
+const CompactIndexBits = 12
+
+// compactIndexBits returns the number of bucket bits to open the index at the given path with in
+// compact mode. An existing index keeps its size, a new one has at most CompactIndexBits.
+func compactIndexBits(path string, indexSizeBits uint8) (uint8, error) {
+	bits, found, err := indexFileBits(path)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return bits, nil
+	}
+	if indexSizeBits > CompactIndexBits {
+		return CompactIndexBits, nil
+	}
+	return indexSizeBits, nil
+}
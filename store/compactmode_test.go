@@ -0,0 +1,52 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactMode(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	goroutines := runtime.NumGoroutine()
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.CompactMode())
+	require.NoError(t, err)
+	s.Start()
+	require.True(t, runtime.NumGoroutine() <= goroutines)
+	require.Equal(t, uint64(1<<store.CompactIndexBits), s.Stats().Buckets)
+
+	blks := testutil.GenerateBlocksOfSize(100, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// Nothing is flushed in the background.
+	require.NotZero(t, s.Stats().OutstandingWork)
+	s.Flush()
+	require.Zero(t, s.Stats().OutstandingWork)
+	require.NoError(t, s.Close())
+
+	// The index keeps its size, also when the store is opened without the option.
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, primary, store.CompactIndexBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
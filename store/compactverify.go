@@ -0,0 +1,105 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// compactionSample holds the checksums of the entries that are verified after a compaction, see
+// `VerifyCompaction`.
+type compactionSample struct {
+	primary primary.PrimaryStorage
+	reader  primary.CompactionReader
+	percent float64
+	entries []sampledEntry
+}
+
+type sampledEntry struct {
+	indexKey []byte
+	// Location of the entry in the compacted copy
+	blk      types.Block
+	checksum [sha256.Size]byte
+}
+
+// newCompactionSample returns the sample of a compaction, nil if compactions aren't verified. In
+// multi-value and appendable mode, the values are rewritten rather than copied, hence they aren't
+// verified.
+func (s *Store) newCompactionSample(compaction primary.Compaction) (*compactionSample, error) {
+	if s.verifyPercent <= 0 || s.chained() {
+		return nil, nil
+	}
+	reader, ok := compaction.(primary.CompactionReader)
+	if !ok {
+		return nil, types.ErrCompactionVerificationNotSupported
+	}
+	return &compactionSample{primary: s.index.Primary, reader: reader, percent: s.verifyPercent}, nil
+}
+
+// add records the checksum of the entry at `blk` if it's picked for the sample, `moved` is its
+// location in the compacted copy.
+func (cs *compactionSample) add(blk types.Block, moved types.Block) error {
+	if cs == nil || rand.Float64()*100 >= cs.percent {
+		return nil
+	}
+	key, value, err := cs.primary.Get(blk)
+	if err != nil {
+		return err
+	}
+	indexKey, err := cs.primary.IndexKey(key)
+	if err != nil {
+		return err
+	}
+	cs.entries = append(cs.entries, sampledEntry{indexKey: indexKey, blk: moved, checksum: sha256.Sum256(value)})
+	return nil
+}
+
+// verifyCompaction looks up the sampled entries in the rewritten index at `path`, reads them from
+// the compacted copy and compares them with their checksums before the compaction. It must be
+// called before the compaction is committed, so that the old files are kept if it fails.
+func (s *Store) verifyCompaction(path string, sample *compactionSample) error {
+	if sample == nil {
+		return nil
+	}
+	idx, err := index.OpenIndex(path, s.index.Primary, s.indexSizeBits, s.indexOptions...)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	for _, entry := range sample.entries {
+		blk, found, err := idx.Get(entry.indexKey)
+		if err != nil {
+			return err
+		}
+		if !found || blk != entry.blk {
+			return s.compactionMismatch(entry, "index refers to %v instead of %v", blk, entry.blk)
+		}
+		key, value, err := sample.reader.Get(blk)
+		if err != nil {
+			return s.compactionMismatch(entry, "cannot read entry: %s", err)
+		}
+		indexKey, err := s.index.Primary.IndexKey(key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(indexKey, entry.indexKey) {
+			return s.compactionMismatch(entry, "entry has key %x", indexKey)
+		}
+		if sha256.Sum256(value) != entry.checksum {
+			return s.compactionMismatch(entry, "checksum mismatch")
+		}
+	}
+	s.log.Infow("verified compaction", "path", s.path, "sampled", len(sample.entries))
+	return nil
+}
+
+func (s *Store) compactionMismatch(entry sampledEntry, format string, args ...interface{}) error {
+	err := fmt.Errorf("%w: key %x: %s", types.ErrCompactionVerification, entry.indexKey, fmt.Sprintf(format, args...))
+	s.log.Errorw("compaction failed verification, keeping the old files", "path", s.path, "err", err)
+	return err
+}
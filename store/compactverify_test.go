@@ -0,0 +1,118 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptingPrimary compacts into a copy where every entry after the first one refers to the
+// location of the first one.
+type corruptingPrimary struct {
+	*cidprimary.CIDPrimary
+}
+
+func (p corruptingPrimary) Compact() (primary.Compaction, error) {
+	compaction, err := p.CIDPrimary.Compact()
+	if err != nil {
+		return nil, err
+	}
+	return &corruptingCompaction{Compaction: compaction}, nil
+}
+
+type corruptingCompaction struct {
+	primary.Compaction
+	first *types.Block
+}
+
+func (c *corruptingCompaction) Move(blk types.Block) (types.Block, error) {
+	moved, err := c.Compaction.Move(blk)
+	if err != nil {
+		return types.Block{}, err
+	}
+	if c.first == nil {
+		c.first = &moved
+	}
+	return types.Block{Offset: c.first.Offset, Size: moved.Size}, nil
+}
+
+func (c *corruptingCompaction) Get(blk types.Block) ([]byte, []byte, error) {
+	return c.Compaction.(primary.CompactionReader).Get(blk)
+}
+
+func TestVerifyCompaction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	cp, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, corruptingPrimary{cp}, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.VerifyCompaction(100))
+	require.NoError(t, err)
+
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	s.Flush()
+	err = s.GC(context.Background())
+	require.True(t, errors.Is(err, types.ErrCompactionVerification), "unexpected error %v", err)
+	// The old files are kept and the store keeps working.
+	require.NoError(t, s.Err())
+	_, err = os.Stat(indexPath + ".gc")
+	require.True(t, os.IsNotExist(err))
+	check := func(s *store.Store) {
+		for _, blk := range blks {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, blk.RawData(), value)
+		}
+	}
+	check(s)
+	require.NoError(t, s.Close())
+
+	// An intact compaction passes.
+	cp, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, cp, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.VerifyCompaction(100))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.GC(context.Background()))
+	check(s)
+}
+
+// opaquePrimary compacts into a copy that can't be read before it is committed.
+type opaquePrimary struct {
+	*cidprimary.CIDPrimary
+}
+
+func (p opaquePrimary) Compact() (primary.Compaction, error) {
+	compaction, err := p.CIDPrimary.Compact()
+	return struct{ primary.Compaction }{compaction}, err
+}
+
+func TestVerifyCompactionNotSupported(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	cp, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), opaquePrimary{cp}, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.VerifyCompaction(10))
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, types.ErrCompactionVerificationNotSupported, s.GC(context.Background()))
+	require.NoError(t, s.Err())
+}
@@ -0,0 +1,37 @@
+package store
+
+// Consistency determines which writes a read sees.
+type Consistency int
+
+const (
+	// ReadCommitted sees every Put that returned, whether or not it was flushed yet. This is the
+	// default.
+	ReadCommitted Consistency = iota
+	// ReadStale only sees writes that were flushed to the files. The write pools aren't consulted,
+	// hence recent writes may be missing or show their previous value. Use this when a possibly
+	// outdated answer is good enough and reads shouldn't contend with writers.
+	ReadStale
+)
+
+type readConfig struct {
+	consistency Consistency
+}
+
+// ReadOption configures a single read.
+type ReadOption func(*readConfig)
+
+// WithConsistency sets the consistency of a read.
+func WithConsistency(consistency Consistency) ReadOption {
+	return func(c *readConfig) {
+		c.consistency = consistency
+	}
+}
+
+// readConsistency returns the consistency that the given options set.
+func readConsistency(options []ReadOption) Consistency {
+	var c readConfig
+	for _, option := range options {
+		option(&c)
+	}
+	return c.consistency
+}
@@ -0,0 +1,48 @@
+package store_test
+
+import (
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsistency(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	s.Flush()
+	// Neither write is flushed.
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), []byte("updated")))
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+
+	committed := store.WithConsistency(store.ReadCommitted)
+	value, found, err := s.Get(blks[0].Cid().Bytes(), committed)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("updated"), value)
+	_, found, err = s.Get(blks[1].Cid().Bytes(), committed)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	stale := store.WithConsistency(store.ReadStale)
+	value, found, err = s.Get(blks[0].Cid().Bytes(), stale)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	_, found, err = s.Get(blks[1].Cid().Bytes(), stale)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	s.Flush()
+	value, found, err = s.Get(blks[0].Cid().Bytes(), stale)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("updated"), value)
+	_, found, err = s.Get(blks[1].Cid().Bytes(), stale)
+	require.NoError(t, err)
+	require.True(t, found)
+}
@@ -0,0 +1,41 @@
+package store
+
+// DegradationMetrics is implemented by metrics that report whether a store is degraded to
+// read-only mode, see `DegradeOnWriteError`. It is optional, metrics that don't implement it
+// aren't told about it.
+type DegradationMetrics interface {
+	// SetDegraded is called when a failed write degrades the store, and when Reopen recovers it.
+	SetDegraded(degraded bool)
+}
+
+// Degraded returns whether a failed write degraded the store to read-only mode, see
+// `DegradeOnWriteError`. Err returns the error of that write.
+func (s *Store) Degraded() bool {
+	s.stateLk.RLock()
+	defer s.stateLk.RUnlock()
+	return s.degraded
+}
+
+// readErr returns the error that reads fail with, and whether the store is degraded, in which case
+// reads are served from the flushed data only.
+func (s *Store) readErr() (bool, error) {
+	s.stateLk.RLock()
+	defer s.stateLk.RUnlock()
+	if s.degraded {
+		return true, nil
+	}
+	return false, s.err
+}
+
+// getFlushedLatest returns the value of a key like getLatest, but only considers the flushed part
+// of the index.
+func (s *Store) getFlushedLatest(key []byte) ([]byte, bool, error) {
+	value, found, err := getFlushed(s.index, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	if s.chained() {
+		return s.chainValue(value)
+	}
+	return s.decodeValue(value)
+}
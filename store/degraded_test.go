@@ -0,0 +1,89 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// degradationMetrics records the changes of the degraded mode.
+type degradationMetrics struct {
+	recordingMetrics
+	degraded []bool
+}
+
+func (m *degradationMetrics) SetDegraded(degraded bool) {
+	m.degraded = append(m.degraded, degraded)
+}
+
+func TestDegradeOnWriteError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	cp, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	fp := &failingFlushPrimary{CIDPrimary: cp, path: dataPath}
+	metrics := &degradationMetrics{}
+	s, err := store.OpenStore(indexPath, fp, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.DegradeOnWriteError(), store.WithMetrics(metrics))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	s.Flush()
+	require.NoError(t, s.Err())
+	require.False(t, s.Stats().Degraded)
+
+	fp.fail = true
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+	_, err = s.FlushResult()
+	require.Equal(t, errDiskFull, err)
+	require.Equal(t, errDiskFull, s.Err())
+	require.True(t, s.Degraded())
+	require.True(t, s.Stats().Degraded)
+	require.Equal(t, []bool{true}, metrics.degraded)
+
+	t.Logf("Flushed data is still served")
+	value, found, err := s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	has, err := s.Has(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, has)
+	size, found, err := s.GetSize(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, len(blks[0].RawData()), int(size))
+
+	t.Logf("Data that wasn't flushed isn't")
+	_, found, err = s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, found)
+	has, err = s.Has(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	t.Logf("Writes are rejected")
+	require.Equal(t, errDiskFull, s.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+
+	t.Logf("Reopen recovers the store")
+	fp.fail = false
+	require.NoError(t, s.Reopen())
+	require.False(t, s.Degraded())
+	require.Equal(t, []bool{true, false}, metrics.degraded)
+	require.NoError(t, s.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+	s.Flush()
+	require.NoError(t, s.Err())
+	value, found, err = s.Get(blks[2].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[2].RawData(), value)
+}
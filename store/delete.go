@@ -0,0 +1,64 @@
+package store
+
+import "github.com/hannahhoward/go-storethehash/store/types"
+
+// Delete removes a key from the store. Deleting a key that isn't stored is not an error.
+//
+// Only the entry in the index is removed, the space of the value in the primary storage is
+// reclaimed by the next GC. An index that is rebuilt from the primary storage with RebuildIndex
+// contains deleted keys again. In multi-value mode, all values of the key are removed.
+func (s *Store) Delete(key []byte) error {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	work, err := s.deleteEntry(key)
+	if err != nil || work == 0 {
+		return err
+	}
+	return s.settle(work)
+}
+
+// deleteEntry removes a key like Delete and returns the work it caused without settling it, which
+// is zero if the key wasn't stored. It must be called with swapLk held.
+func (s *Store) deleteEntry(key []byte) (types.Work, error) {
+	if s.chained() || s.mergeOperator != nil {
+		// A concurrent put of the key would build on the removed entry.
+		unlock, err := s.lockChain(key)
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+	}
+
+	var indexKey []byte
+	var blk types.Block
+	var found bool
+	err := s.retry("delete", func() error {
+		var err error
+		indexKey, blk, found, err = s.lookupFiltered(key)
+		if err != nil || !found {
+			return err
+		}
+		// The index only stores prefixes, the entry may belong to a different key.
+		found, err = verify(s.index, indexKey, blk)
+		return err
+	})
+	if err != nil || !found {
+		return 0, err
+	}
+	if _, err := s.index.Remove(indexKey); err != nil {
+		return 0, err
+	}
+	s.noteIndexChange(indexKey)
+	// Of a key with several values, only the most recent entry is added, so that the deletion
+	// survives a recovery on open, GC takes care of the previous ones.
+	if err := s.freelist.Put(blk); err != nil {
+		return 0, err
+	}
+	if err := s.provenance.Put(indexKey, ""); err != nil {
+		return 0, err
+	}
+	return types.Work(len(key)), nil
+}
@@ -0,0 +1,62 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelete(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Delete(blks[0].Cid().Bytes()))
+	_, found, err := s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, found)
+	// Deleting a key that isn't stored does nothing.
+	require.NoError(t, s.Delete(blks[0].Cid().Bytes()))
+	require.NoError(t, s.Close())
+
+	s = open()
+	has, err := s.Has(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, has)
+	for _, blk := range blks[1:] {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+
+	// GC drops the value, a deleted key can be put again.
+	size := s.Stats().PrimarySize
+	require.NoError(t, s.GC(context.Background()))
+	require.True(t, s.Stats().PrimarySize < size)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	value, found, err := s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,142 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmptyValues(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		// Few buckets keep scanning the index fast.
+		s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+
+	// Every other key is an existence marker, the last one is overwritten with a marker later.
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	expected := make(map[string][]byte)
+	for n, blk := range blks {
+		value := blk.RawData()
+		if n%2 == 0 {
+			value = []byte{}
+		}
+		require.NoError(t, s.Put(blk.Cid().Bytes(), value))
+		expected[string(blk.Cid().Bytes())] = value
+	}
+	check := func(s *store.Store) {
+		for _, blk := range blks {
+			key := blk.Cid().Bytes()
+			value, found, err := s.Get(key)
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, len(expected[string(key)]), len(value))
+			require.Equal(t, string(expected[string(key)]), string(value))
+			size, found, err := s.GetSize(key)
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, len(expected[string(key)]), int(size))
+			has, err := s.Has(key)
+			require.NoError(t, err)
+			require.True(t, has)
+		}
+		scanned := 0
+		require.NoError(t, s.Scan(nil, nil, func(key []byte, value []byte) error {
+			require.Equal(t, string(expected[string(key)]), string(value))
+			scanned++
+			return nil
+		}))
+		require.Equal(t, len(blks), scanned)
+	}
+
+	t.Logf("Empty values are stored before and after a flush")
+	check(s)
+	require.Equal(t, types.ErrKeyExists, s.Put(blks[0].Cid().Bytes(), []byte{}))
+	s.Flush()
+	check(s)
+
+	t.Logf("Overwriting a value with an empty one")
+	last := blks[len(blks)-1].Cid().Bytes()
+	require.NoError(t, s.Put(last, nil))
+	expected[string(last)] = []byte{}
+	check(s)
+
+	t.Logf("Empty values survive compaction")
+	require.NoError(t, s.GC(context.Background()))
+	check(s)
+
+	t.Logf("Empty values are iterated")
+	require.NoError(t, s.Close())
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	iter, err := primary.Iter()
+	require.NoError(t, err)
+	empty := 0
+	for {
+		key, value, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, string(expected[string(key)]), string(value))
+		if len(value) == 0 {
+			empty++
+		}
+	}
+	require.Equal(t, len(blks)/2+1, empty)
+	require.NoError(t, primary.Close())
+
+	t.Logf("Empty values survive reopening")
+	s = open()
+	defer s.Close()
+	check(s)
+}
+
+func TestDenyEmptyValues(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, store.AllowEmptyValues(false))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	key := blks[0].Cid().Bytes()
+	require.Equal(t, types.ErrEmptyValue, s.Put(key, nil))
+	require.Equal(t, types.ErrEmptyValue, s.PutIfAbsent(key, []byte{}))
+	_, _, err = s.GetOrPut(key, nil)
+	require.Equal(t, types.ErrEmptyValue, err)
+	require.Equal(t, types.ErrEmptyValue, s.PutFrom(key, bytes.NewReader(nil), 0))
+	batch := s.NewBatch()
+	require.Equal(t, types.ErrEmptyValue, batch.Put(key, nil))
+	batch.Discard()
+	has, err := s.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, s.Put(key, blks[0].RawData()))
+	// Getting the stored value doesn't write anything.
+	value, loaded, err := s.GetOrPut(key, nil)
+	require.NoError(t, err)
+	require.True(t, loaded)
+	require.Equal(t, blks[0].RawData(), value)
+}
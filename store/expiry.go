@@ -0,0 +1,265 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// In expiry mode, every value is stored with a header that holds its expiration time in
+// nanoseconds since the Unix epoch, zero if it never expires.
+//
+//	|       8 bytes      |  Variable size  |
+//	|  Expiration time   |      Value      |
+const expiryHeaderSize = 8
+
+func encodeExpiring(expiresAt time.Time, value []byte) []byte {
+	data := make([]byte, expiryHeaderSize+len(value))
+	if !expiresAt.IsZero() {
+		binary.LittleEndian.PutUint64(data, uint64(expiresAt.UnixNano()))
+	}
+	copy(data[expiryHeaderSize:], value)
+	return data
+}
+
+// decodeExpiring splits the data of an entry into its expiration time and its value. The time is
+// zero if the value never expires.
+func decodeExpiring(data []byte) (time.Time, []byte, error) {
+	if len(data) < expiryHeaderSize {
+		return time.Time{}, nil, fmt.Errorf("value of %d bytes is too short for an expiring entry", len(data))
+	}
+	var expiresAt time.Time
+	if nanos := binary.LittleEndian.Uint64(data); nanos != 0 {
+		expiresAt = time.Unix(0, int64(nanos))
+	}
+	return expiresAt, data[expiryHeaderSize:], nil
+}
+
+// unexpired returns the value of an entry, or false if it expired.
+func unexpired(data []byte) ([]byte, bool, error) {
+	expiresAt, value, err := decodeExpiring(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+// PutExpiring stores a value that is treated as missing from `expiresAt` on. The store needs to be
+// opened with the `Expiry` option.
+func (s *Store) PutExpiring(key []byte, value []byte, expiresAt time.Time) error {
+	if !s.expiry {
+		return types.ErrNoExpiry
+	}
+	return s.observePut(key, value, false, expiresAt, 0)
+}
+
+// PutTTL stores a value that expires after the given duration, see PutExpiring.
+func (s *Store) PutTTL(key []byte, value []byte, ttl time.Duration) error {
+	return s.PutExpiring(key, value, time.Now().Add(ttl))
+}
+
+// SweepExpired removes all expired entries and reclaims their space. It returns the number of
+// removed entries.
+//
+// Expired entries are removed by rewriting the files the same way GC does, see there for the
+// requirements. Nothing is rewritten if no entry expired.
+func (s *Store) SweepExpired(ctx context.Context) (int, error) {
+	if !s.expiry {
+		return 0, types.ErrNoExpiry
+	}
+	expired := 0
+	s.swapLk.RLock()
+	err := scan(s.index, nil, nil, func(_ []byte, data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, found, err := s.decodeValue(data)
+		if !found {
+			expired++
+		}
+		return err
+	})
+	s.swapLk.RUnlock()
+	if err != nil || expired == 0 {
+		return 0, err
+	}
+
+	removed := 0
+	err = s.compact(ctx, func(blk types.Block) (bool, error) {
+		_, data, err := s.index.Primary.Get(blk)
+		if err != nil {
+			return false, err
+		}
+		_, found, err := s.decodeValue(data)
+		if err != nil || found {
+			return false, err
+		}
+		removed++
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Number of buckets the periodic sweep checks every sweep interval
+const sweepBuckets = 64 * scrubBatch
+
+// sweep removes the records of expired entries every sweep interval until the context is done, see
+// removeExpired.
+func (s *Store) sweep(ctx context.Context) {
+	t := time.NewTicker(s.sweepInterval)
+	defer t.Stop()
+
+	// The bucket the next sweep starts at
+	var next uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-t.C:
+			var removed int
+			var err error
+			removed, next, err = s.removeExpired(ctx, next)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.log.Errorw("sweeping expired entries failed", "path", s.path, "err", err)
+				}
+				continue
+			}
+			if removed > 0 {
+				s.log.Infow("removed expired entries", "path", s.path, "count", removed)
+			}
+		}
+	}
+}
+
+// removeExpired removes the records of expired entries from up to `sweepBuckets` buckets of the
+// index from bucket `from` on, a batch of buckets at a time like Scrub checks them. It pauses after
+// batches that removed entries, the writes they cause are settled like those of puts. Unlike
+// SweepExpired it doesn't rewrite the files, the entries are added to the freelist and their space
+// is reclaimed by the next GC. It returns the number of removed entries and the bucket to continue
+// at, which is zero once the last bucket was checked.
+func (s *Store) removeExpired(ctx context.Context, from uint64) (int, uint64, error) {
+	removed := 0
+	for bucket := from; bucket < from+sweepBuckets; bucket += scrubBatch {
+		if err := ctx.Err(); err != nil {
+			return removed, bucket, err
+		}
+		n, done, err := s.removeExpiredBatch(index.BucketIndex(bucket))
+		removed += n
+		if err != nil {
+			return removed, bucket, err
+		}
+		if done {
+			return removed, 0, nil
+		}
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+				return removed, bucket + scrubBatch, ctx.Err()
+			case <-time.After(scrubPause):
+			}
+		}
+	}
+	return removed, from + sweepBuckets, nil
+}
+
+// removeExpiredBatch removes the expired records of the batch of buckets starting at `first`. It
+// returns the number of removed records and true if there are no more buckets, also if `first` is
+// beyond the last bucket, e.g. because the index was resized meanwhile.
+func (s *Store) removeExpiredBatch(first index.BucketIndex) (int, bool, error) {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return 0, false, err
+	}
+	numBuckets := uint64(1) << s.indexSizeBits
+	last := uint64(first) + scrubBatch
+	if last > numBuckets {
+		last = numBuckets
+	}
+	if s.growth != nil {
+		// Removed records aren't carried over to the grown index, the next sweep removes them.
+		return 0, last == numBuckets, nil
+	}
+	removed := 0
+	var work types.Work
+	for bucket := uint64(first); bucket < last; bucket++ {
+		n, bucketWork, err := s.removeExpiredRecords(index.BucketIndex(bucket))
+		removed += n
+		work += bucketWork
+		if err != nil {
+			return removed, false, err
+		}
+	}
+	if work == 0 {
+		return removed, last == numBuckets, nil
+	}
+	return removed, last == numBuckets, s.settle(work)
+}
+
+// removeExpiredRecords removes the expired records of a bucket. A record is only removed if it still
+// refers to the expired entry, a key that is put meanwhile keeps its new value. It returns the number
+// of removed records and the work their removal caused.
+func (s *Store) removeExpiredRecords(bucket index.BucketIndex) (int, types.Work, error) {
+	// Blocks of the entries that didn't expire
+	live := make(map[types.Block]struct{})
+	removed := 0
+	var work types.Work
+	for {
+		// Removing a record may shorten the keys of its neighbours, hence the records are listed
+		// again after every removal.
+		var key []byte
+		var blk types.Block
+		err := s.index.ForEachBucketRecord(bucket, func(record index.Record) error {
+			if key != nil {
+				return nil
+			}
+			if _, ok := live[record.Block]; ok {
+				return nil
+			}
+			_, data, err := s.index.Primary.Get(record.Block)
+			if err != nil {
+				return err
+			}
+			_, found, err := s.decodeValue(data)
+			if err != nil {
+				return err
+			}
+			if found {
+				live[record.Block] = struct{}{}
+				return nil
+			}
+			key = append([]byte{}, record.Key...)
+			blk = record.Block
+			return nil
+		})
+		if err != nil || key == nil {
+			return removed, work, err
+		}
+		ok, err := s.index.RemoveRecord(bucket, key, blk)
+		if err != nil {
+			return removed, work, err
+		}
+		if !ok {
+			// The record changed meanwhile, the next sweep checks it again.
+			live[blk] = struct{}{}
+			continue
+		}
+		if err := s.freelist.Put(blk); err != nil {
+			return removed, work, err
+		}
+		removed++
+		work += types.Work(len(key))
+	}
+}
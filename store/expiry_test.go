@@ -0,0 +1,121 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiry(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, store.Expiry(0))
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.NoError(t, s.PutExpiring(blks[1].Cid().Bytes(), blks[1].RawData(), time.Now().Add(-time.Second)))
+	require.NoError(t, s.PutTTL(blks[2].Cid().Bytes(), blks[2].RawData(), time.Hour))
+
+	check := func(s *store.Store) {
+		for n, blk := range blks {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.Equal(t, n != 1, found)
+			has, err := s.Has(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.Equal(t, n != 1, has)
+			size, found, err := s.GetSize(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.Equal(t, n != 1, found)
+			if n != 1 {
+				require.Equal(t, blk.RawData(), value)
+				require.Equal(t, types.Size(len(blk.RawData())), size)
+			}
+		}
+		var scanned int
+		require.NoError(t, s.Scan(nil, nil, func(_ []byte, _ []byte) error {
+			scanned++
+			return nil
+		}))
+		require.Equal(t, 2, scanned)
+	}
+	check(s)
+
+	// An expired key can be put again.
+	require.NoError(t, s.PutTTL(blks[1].Cid().Bytes(), blks[1].RawData(), time.Hour))
+	value, found, err := s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[1].RawData(), value)
+	require.NoError(t, s.PutExpiring(blks[1].Cid().Bytes(), blks[1].RawData(), time.Now().Add(-time.Second)))
+
+	removed, err := s.SweepExpired(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, uint64(2), s.Stats().Keys)
+	check(s)
+	removed, err = s.SweepExpired(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	check(s)
+}
+
+func TestExpirySweep(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate,
+		store.Expiry(10*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+	s.Start()
+
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.PutTTL(blk.Cid().Bytes(), blk.RawData(), 20*time.Millisecond))
+	}
+	require.Equal(t, uint64(len(blks)), s.Stats().Keys)
+	size := s.Stats().PrimarySize
+	// A sweep of the small index checks all buckets.
+	for s.Stats().Keys > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The sweep doesn't rewrite the files, GC reclaims the space.
+	require.Equal(t, size, s.Stats().PrimarySize)
+	require.NoError(t, s.GC(context.Background()))
+	require.Zero(t, s.Stats().PrimarySize)
+}
+
+func TestExpiryNotEnabled(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	require.Equal(t, types.ErrNoExpiry, s.PutTTL(blk.Cid().Bytes(), blk.RawData(), time.Hour))
+	_, err = s.SweepExpired(context.Background())
+	require.Equal(t, types.ErrNoExpiry, err)
+}
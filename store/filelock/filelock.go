@@ -0,0 +1,85 @@
+// Package filelock provides advisory locks of files that keep several processes from opening the
+// same store.
+//
+// A lock is taken on a separate lock file next to the file it protects, the protected files may be
+// replaced, e.g. by GC, while the lock file stays in place. Within a process, locks are counted
+// instead: locking a path that the process holds already succeeds, the lock is released once it
+// was unlocked as often as it was locked. The lock file is left behind on unlock.
+package filelock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix is appended to the path of a protected file to get the path of its lock file.
+const Suffix = ".lock"
+
+// Lock is a lock of a file, see Acquire.
+type Lock struct {
+	path string
+}
+
+type heldLock struct {
+	file *os.File
+	refs int
+}
+
+var held = struct {
+	sync.Mutex
+	locks map[string]*heldLock
+}{locks: make(map[string]*heldLock)}
+
+// Acquire locks the file at the given path. It fails with `types.ErrStoreLocked` right away if
+// another process holds the lock.
+func Acquire(path string) (*Lock, error) {
+	lockPath, err := filepath.Abs(path + Suffix)
+	if err != nil {
+		return nil, err
+	}
+	held.Lock()
+	defer held.Unlock()
+	if h, ok := held.locks[lockPath]; ok {
+		h.refs++
+		return &Lock{lockPath}, nil
+	}
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		_ = file.Close()
+		if err == errLocked {
+			return nil, fmt.Errorf("%w: %s", types.ErrStoreLocked, path)
+		}
+		return nil, err
+	}
+	held.locks[lockPath] = &heldLock{file: file, refs: 1}
+	return &Lock{lockPath}, nil
+}
+
+// Release releases the lock. It does nothing if the lock was released already.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	held.Lock()
+	defer held.Unlock()
+	path := l.path
+	h, ok := held.locks[path]
+	if !ok || path == "" {
+		return nil
+	}
+	l.path = ""
+	h.refs--
+	if h.refs > 0 {
+		return nil
+	}
+	// Closing the file releases the lock.
+	delete(held.locks, path)
+	return h.file.Close()
+}
@@ -0,0 +1,63 @@
+package filelock_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/filelock"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHelperProcess tries to acquire the lock of the path in FILELOCK_PATH when it runs as a
+// separate process, see tryInOtherProcess.
+func TestHelperProcess(t *testing.T) {
+	path := os.Getenv("FILELOCK_PATH")
+	if path == "" {
+		return
+	}
+	lock, err := filelock.Acquire(path)
+	if errors.Is(err, types.ErrStoreLocked) {
+		fmt.Print("locked")
+		return
+	}
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+	fmt.Print("acquired")
+}
+
+func tryInOtherProcess(t *testing.T, path string) string {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+	cmd.Env = append(os.Environ(), "FILELOCK_PATH="+path)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestAcquire(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("needs flock")
+	}
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "storethehash.index")
+
+	lock, err := filelock.Acquire(path)
+	require.NoError(t, err)
+	// The process holds the lock already.
+	again, err := filelock.Acquire(path)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+	require.Contains(t, tryInOtherProcess(t, path), "locked")
+
+	require.NoError(t, again.Release())
+	// Releasing twice does nothing.
+	require.NoError(t, again.Release())
+	require.Contains(t, tryInOtherProcess(t, path), "acquired")
+}
@@ -38,6 +38,18 @@ func OpenFreeList(path string) (*FreeList, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Remove a block that was only partially written, e.g. by a failed flush.
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if torn := stat.Size() % (types.SizeBytesLen + types.OffBytesLen); torn != 0 {
+		if err := file.Truncate(stat.Size() - torn); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
 	return &FreeList{
 		file:     file,
 		writer:   bufio.NewWriterSize(file, blockBufferSize),
@@ -89,6 +101,13 @@ func (cp *FreeList) commit() (types.Work, error) {
 		}
 		work += blockWork
 	}
+	// Hand the data over to the OS, so that it can be read from the file.
+	if err := cp.writer.Flush(); err != nil {
+		return 0, err
+	}
+	cp.poolLk.Lock()
+	cp.curPool = newBlockPool()
+	cp.poolLk.Unlock()
 	return work, nil
 }
 
@@ -109,6 +128,20 @@ func (cp *FreeList) Sync() error {
 	return nil
 }
 
+// Truncate removes all blocks from the free list, e.g. once their space was reclaimed.
+func (cp *FreeList) Truncate() error {
+	cp.poolLk.Lock()
+	defer cp.poolLk.Unlock()
+	cp.writer.Reset(cp.file)
+	cp.curPool = newBlockPool()
+	cp.nextPool = newBlockPool()
+	cp.outstandingWork = 0
+	if err := cp.file.Truncate(0); err != nil {
+		return err
+	}
+	return cp.file.Sync()
+}
+
 func (cp *FreeList) Close() error {
 	return cp.file.Close()
 }
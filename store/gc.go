@@ -0,0 +1,231 @@
+package store
+
+import (
+	"context"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the rewritten index while a GC is running.
+const gcSuffix = ".gc"
+
+// GC reclaims the space of all entries in the primary storage that are no longer referenced by
+// the index, e.g. because their key was updated.
+//
+// The live entries are copied into a compacted primary storage and the index is rewritten to point
+// to their new locations, then both replace the current files. The store is locked while the GC is
+// running, reads and writes wait until it's done. If the GC is interrupted by a crash, it's either
+// finished or rolled back the next time the store is opened.
+//
+// The primary storage needs to implement `primary.Compactor`. Cancelling the context aborts the GC
+// as long as the files haven't been swapped yet. With `VerifyCompaction`, a sample of the entries
+// is checked before the files are swapped.
+func (s *Store) GC(ctx context.Context) error {
+	return s.compact(ctx, nil)
+}
+
+// compact replaces the files with compacted ones like GC does, entries for which `drop` returns
+// true are removed.
+func (s *Store) compact(ctx context.Context, drop func(types.Block) (bool, error)) error {
+	return s.replaceFiles(func(path string, compaction primary.Compaction) error {
+		// In multi-value and appendable mode, the entries link to the locations of the previous
+		// values of their key, hence the values are written anew instead of being moved.
+		writer, ok := compaction.(primary.CompactionWriter)
+		if s.multiValue && !ok {
+			return types.ErrMultiValue
+		}
+		if s.appendable && !ok {
+			return types.ErrAppendable
+		}
+		sample, err := s.newCompactionSample(compaction)
+		if err != nil {
+			return err
+		}
+		// Several keys may point to the same entry, it must only be moved once.
+		moved := make(map[types.Block]types.Block)
+		err = s.index.Rewrite(path, func(blk types.Block) (types.Block, bool, error) {
+			if err := ctx.Err(); err != nil {
+				return types.Block{}, false, err
+			}
+			if drop != nil {
+				dropped, err := drop(blk)
+				if err != nil || dropped {
+					return types.Block{}, false, err
+				}
+			}
+			if s.chained() {
+				// Keys whose values were all removed are dropped.
+				return compactChain(s.index.Primary, writer, blk)
+			}
+			if newBlk, ok := moved[blk]; ok {
+				return newBlk, true, nil
+			}
+			newBlk, err := compaction.Move(blk)
+			if err != nil {
+				return types.Block{}, false, err
+			}
+			moved[blk] = newBlk
+			if err := sample.add(blk, newBlk); err != nil {
+				return types.Block{}, false, err
+			}
+			return newBlk, true, nil
+		})
+		if err != nil {
+			return err
+		}
+		return s.verifyCompaction(path, sample)
+	})
+}
+
+// Clear removes all entries from the store.
+//
+// Empty primary storage and index files replace the current ones, the same way as GC replaces
+// them, hence concurrent reads either see the whole store or an empty one. Writes that are still
+// outstanding when Clear is called are removed as well.
+//
+// The primary storage needs to implement `primary.Compactor`.
+func (s *Store) Clear() error {
+	return s.replaceFiles(func(path string, _ primary.Compaction) error {
+		// Nothing is moved, opening a new index creates an empty one.
+		if err := index.RemoveSegments(path); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		idx, err := index.OpenIndex(path, s.index.Primary, s.indexSizeBits, s.indexOptions...)
+		if err != nil {
+			return err
+		}
+		return idx.Close()
+	})
+}
+
+// replaceFiles replaces the primary storage and the index with new ones. `writeIndex` writes the
+// new index to the given path, it moves all entries it refers to into the new primary storage.
+func (s *Store) replaceFiles(writeIndex func(path string, compaction primary.Compaction) error) error {
+	s.swapLk.Lock()
+	defer s.swapLk.Unlock()
+
+	compactor, ok := s.index.Primary.(primary.Compactor)
+	if !ok {
+		return types.ErrCompactionNotSupported
+	}
+
+	s.stateLk.RLock()
+	open := s.open
+	s.stateLk.RUnlock()
+	if !open {
+		return types.ErrStoreClosed
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	// Only data on disk is moved.
+	if _, err := s.commit(true); err != nil {
+		s.setErr(err)
+		return err
+	}
+
+	compaction, err := compactor.Compact()
+	if err != nil {
+		return err
+	}
+	gcPath := s.path + gcSuffix
+	if err := writeIndex(gcPath, compaction); err != nil {
+		_ = os.Remove(gcPath)
+		_ = compaction.Abort()
+		return err
+	}
+
+	// The new index is complete. Once the primary storage is replaced, it's moved in place by
+	// `recoverGC` in case the following steps fail.
+	s.generation++
+	if s.cache != nil {
+		// The positions of the entries changed.
+		s.cache.clear()
+	}
+	if err := compaction.Commit(); err != nil {
+		s.setErr(err)
+		return err
+	}
+	if err := s.swapIndex(gcPath); err != nil {
+		s.setErr(err)
+		return err
+	}
+	// All freed blocks were reclaimed.
+	if err := s.freelist.Truncate(); err != nil {
+		s.setErr(err)
+		return err
+	}
+	// The sources of keys that were replaced, deleted or collected aren't kept.
+	err = s.provenance.Compact(func(indexKey []byte) (bool, error) {
+		_, found, err := s.index.Get(indexKey)
+		return found, err
+	})
+	if err != nil {
+		s.setErr(err)
+		return err
+	}
+	s.log.Infow("replaced files with compacted ones", "path", s.path, "generation", s.generation)
+	return nil
+}
+
+// swapIndex replaces the index with the one at the given path. It must be called with swapLk held
+// for writing.
+func (s *Store) swapIndex(path string) error {
+	primary := s.index.Primary
+	if err := s.index.Close(); err != nil {
+		return err
+	}
+	if err := index.RenameIndex(path, s.path); err != nil {
+		return err
+	}
+	idx, err := index.OpenIndex(s.path, primary, s.indexSizeBits, withWriteAheadLog(s.indexOptions, s.wal)...)
+	if err != nil {
+		return err
+	}
+	s.index = idx
+	// All entries were moved into the new index.
+	s.indexedPrimary = readPrimaryBounds(primary)
+	return nil
+}
+
+// recoverGC finishes or rolls back a GC of the store with the given index path that was
+// interrupted by a crash.
+func recoverGC(path string, primaryStorage primary.PrimaryStorage, log Logger) error {
+	gcPath := path + gcSuffix
+	_, err := os.Stat(gcPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pending := err == nil
+
+	compactor, ok := primaryStorage.(primary.Compactor)
+	if !ok {
+		if pending {
+			log.Infow("removing index of interrupted GC", "path", path)
+			return os.Remove(gcPath)
+		}
+		return nil
+	}
+	discarded, err := compactor.DiscardCompaction()
+	if err != nil {
+		return err
+	}
+	if !pending {
+		return nil
+	}
+	if discarded {
+		// The primary storage wasn't replaced yet, hence neither is the index.
+		log.Infow("rolling back interrupted GC", "path", path)
+		return os.Remove(gcPath)
+	}
+	// The primary storage was replaced, the rewritten index belongs to it.
+	log.Infow("finishing interrupted GC", "path", path)
+	return index.RenameIndex(gcPath, path)
+}
@@ -0,0 +1,303 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+
+	// Overwrite half of the keys, which leaves their previous values behind as garbage.
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	values := testutil.GenerateBlocksOfSize(10, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	for n, value := range values {
+		require.NoError(t, s.Put(blks[n].Cid().Bytes(), value.RawData()))
+	}
+	s.Flush()
+	before := s.Stats().PrimarySize
+
+	require.NoError(t, s.GC(context.Background()))
+	after := s.Stats().PrimarySize
+	require.Equal(t, before*2/3, after)
+	require.Equal(t, uint64(len(blks)), s.Stats().Keys)
+
+	check := func(s *store.Store) {
+		for n, blk := range blks {
+			expected := blk.RawData()
+			if n < len(values) {
+				expected = values[n].RawData()
+			}
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, expected, value)
+		}
+	}
+	check(s)
+
+	// The store keeps working after a GC.
+	extra := testutil.GenerateBlocksOfSize(1, 100)[0]
+	require.NoError(t, s.Put(extra.Cid().Bytes(), extra.RawData()))
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	check(s)
+	value, found, err := s.Get(extra.Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, extra.RawData(), value)
+	require.Equal(t, after+types.Position(cidprimary.CIDSizePrefix+len(extra.Cid().Bytes())+len(extra.RawData())),
+		s.Stats().PrimarySize)
+}
+
+func TestGCCancel(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, s.GC(ctx))
+	require.NoError(t, s.Err())
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
+
+func TestGCNotSupported(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(nil),
+		defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, types.ErrCompactionNotSupported, s.GC(context.Background()))
+}
+
+func TestGCRecovery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Close())
+
+	// A GC that crashed before the primary storage was replaced is rolled back.
+	require.NoError(t, ioutil.WriteFile(indexPath+".gc", []byte("partial"), 0o644))
+	require.NoError(t, ioutil.WriteFile(dataPath+".gc", []byte("partial"), 0o644))
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = os.Stat(indexPath + ".gc")
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dataPath + ".gc")
+	require.True(t, os.IsNotExist(err))
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
+
+func TestGCDedup(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"), cidprimary.Dedup())
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits,
+		defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The second key references the value of the first one, which is overwritten afterwards.
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[0].RawData()))
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[1].RawData()))
+	require.NoError(t, s.GC(context.Background()))
+
+	value, found, err := s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	size, found, err := s.GetSize(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, types.Size(len(blks[0].RawData())), size)
+}
+
+func TestClear(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks[:4] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Clear())
+	require.Zero(t, s.Stats().Keys)
+	require.Zero(t, s.Stats().PrimarySize)
+	for _, blk := range blks[:4] {
+		has, err := s.Has(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+
+	// The store can be written to after it was cleared.
+	require.NoError(t, s.Put(blks[4].Cid().Bytes(), blks[4].RawData()))
+	require.NoError(t, s.Close())
+
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(1), s.Stats().Keys)
+	value, found, err := s.Get(blks[4].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[4].RawData(), value)
+}
+
+func TestClearIndexOptions(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+			store.IndexOptions(index.FullKeys()))
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	for _, blk := range blks[:10] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Clear())
+
+	// The new index is written with the options of the store.
+	file, err := os.Open(indexPath)
+	require.NoError(t, err)
+	header, _, err := index.ReadHeader(file)
+	require.NoError(t, file.Close())
+	require.NoError(t, err)
+	require.NotZero(t, header.Flags&index.FlagFullKeys)
+	for _, blk := range blks[10:] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Close())
+	s = open()
+	defer s.Close()
+	require.Equal(t, uint64(10), s.Stats().Keys)
+	for _, blk := range blks[10:] {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
+
+func TestGCSegments(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate,
+			store.IndexOptions(index.Segments(1024)))
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	blks := testutil.GenerateBlocksOfSize(100, 100)
+	for n, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+		if n%10 == 9 {
+			s.Flush()
+		}
+	}
+	for _, blk := range blks[:50] {
+		require.NoError(t, s.Delete(blk.Cid().Bytes()))
+	}
+	s.Flush()
+	_, err = os.Stat(indexPath + ".001")
+	require.NoError(t, err)
+
+	// The rewritten index replaces all segments, it starts a new set of them.
+	require.NoError(t, s.GC(context.Background()))
+	matches, err := filepath.Glob(indexPath + ".gc*")
+	require.NoError(t, err)
+	require.Empty(t, matches)
+	check := func(s *store.Store) {
+		for n, blk := range blks {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.Equal(t, n >= 50, found)
+			if found {
+				require.Equal(t, blk.RawData(), value)
+			}
+		}
+	}
+	check(s)
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	check(s)
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// GetOrPut returns the value of the key if it's stored, otherwise it puts the given value and
+// returns that. `loaded` is true if the value was already stored.
+//
+// The key is looked up only once, the lookup and the put happen while the lock of the key's bucket
+// is held, see LockBuckets. Hence concurrent calls of GetOrPut and PutIfAbsent for the same key
+// agree on a single value. Plain puts don't take the lock, they can still replace the value. It must
+// not be called while the lock of the key's bucket is held by the caller.
+func (s *Store) GetOrPut(key []byte, value []byte) ([]byte, bool, error) {
+	unlockBucket, err := s.LockBuckets(key)
+	if err != nil {
+		return nil, false, err
+	}
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	start := time.Now()
+	stored, loaded, work, err := s.getOrPut(key, value)
+	unlockBucket()
+	if err != nil || loaded {
+		return stored, loaded, err
+	}
+	if err := s.settle(work); err != nil {
+		return nil, false, err
+	}
+	if s.metrics != nil {
+		s.metrics.ObservePut(len(key)+len(value), time.Since(start))
+	}
+	return value, false, nil
+}
+
+// PutIfAbsent puts the value unless the key is already stored, in which case `types.ErrKeyExists`
+// is returned, see GetOrPut.
+func (s *Store) PutIfAbsent(key []byte, value []byte) error {
+	_, loaded, err := s.GetOrPut(key, value)
+	if err != nil {
+		return err
+	}
+	if loaded {
+		return types.ErrKeyExists
+	}
+	return nil
+}
+
+// getOrPut returns the stored value of the key or writes the given one, in which case it returns
+// the work that needs to be settled. It must be called with swapLk held.
+func (s *Store) getOrPut(key []byte, value []byte) ([]byte, bool, types.Work, error) {
+	if err := s.Err(); err != nil {
+		return nil, false, 0, err
+	}
+	if s.chained() || s.mergeOperator != nil {
+		unlock, err := s.lockChain(key)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		defer unlock()
+	}
+
+	var indexKey []byte
+	var prev types.Block
+	var found bool
+	var data []byte
+	err := s.retry("put", func() error {
+		var err error
+		indexKey, prev, found, err = s.lookupFiltered(key)
+		if err != nil || !found {
+			return err
+		}
+		data, found, err = readValue(s.index, indexKey, prev)
+		return err
+	})
+	if err != nil {
+		return nil, false, 0, err
+	}
+	// The entry of the key is replaced if its value expired or all its values were removed.
+	replace := found
+	if found && s.chained() {
+		if data, found, err = s.chainValue(data); err != nil {
+			return nil, false, 0, err
+		}
+	}
+	if found && (s.expiry || s.metadata) {
+		if data, found, err = s.decodeValue(data); err != nil {
+			return nil, false, 0, err
+		}
+	}
+	if found {
+		s.onAccess(key)
+		if s.policy != nil {
+			s.policy.OnGet(key)
+		}
+		return data, true, 0, nil
+	}
+
+	if err := s.checkValue(key, len(value)); err != nil {
+		return nil, false, 0, err
+	}
+	data = value
+	if s.expiry {
+		data = encodeExpiring(time.Time{}, data)
+	}
+	if s.metadata {
+		data = encodeMeta(Meta{Inserted: time.Now()}, data)
+	}
+	if s.chained() {
+		var chainPrev types.Block
+		if replace && s.multiValue {
+			chainPrev = prev
+		}
+		data = encodeChained(chainPrev, data, false)
+	}
+	blk, err := s.index.Primary.Put(key, data)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if err := s.indexEntry(key, indexKey, blk, types.Size(len(value)), replace, prev); err != nil {
+		return nil, false, 0, err
+	}
+	return nil, false, types.Work(len(key) + len(data)), nil
+}
@@ -0,0 +1,87 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOrPut(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	key := blks[0].Cid().Bytes()
+
+	// Concurrent callers agree on a single value.
+	const callers = 8
+	values := make([][]byte, callers)
+	loaded := make([]bool, callers)
+	var wg sync.WaitGroup
+	for n := 0; n < callers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var err error
+			values[n], loaded[n], err = s.GetOrPut(key, []byte{byte(n)})
+			require.NoError(t, err)
+		}(n)
+	}
+	wg.Wait()
+	stored, found, err := s.Get(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	puts := 0
+	for n := range values {
+		require.Equal(t, stored, values[n])
+		if !loaded[n] {
+			puts++
+		}
+	}
+	require.Equal(t, 1, puts)
+
+	require.Equal(t, types.ErrKeyExists, s.PutIfAbsent(key, []byte("other")))
+	require.NoError(t, s.PutIfAbsent(blks[1].Cid().Bytes(), blks[1].RawData()))
+	value, found, err := s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[1].RawData(), value)
+}
+
+func TestGetOrPutExpired(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.Expiry(0))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	key := blk.Cid().Bytes()
+	require.NoError(t, s.PutExpiring(key, []byte("old"), time.Now().Add(-time.Second)))
+
+	// An expired value counts as absent.
+	value, loaded, err := s.GetOrPut(key, blk.RawData())
+	require.NoError(t, err)
+	require.False(t, loaded)
+	require.Equal(t, blk.RawData(), value)
+	value, loaded, err = s.GetOrPut(key, []byte("new"))
+	require.NoError(t, err)
+	require.True(t, loaded)
+	require.Equal(t, blk.RawData(), value)
+}
@@ -0,0 +1,307 @@
+package store
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the index that a growth writes, it replaces the index once it is complete.
+const growSuffix = ".grow"
+
+// Outstanding work after which the index that a growth writes is flushed.
+const growFlushWork = rebuildFlushWork
+
+// indexGrowth tracks the index keys whose records change while a grown index is built from a
+// snapshot of the index, their records are carried over before the indexes are switched.
+type indexGrowth struct {
+	lk      sync.Mutex
+	changed map[string]struct{}
+}
+
+// noteIndexChange records that the record of the given index key changed while the index is
+// growing. It must be called with swapLk held.
+func (s *Store) noteIndexChange(indexKey []byte) {
+	g := s.growth
+	if g == nil {
+		return
+	}
+	g.lk.Lock()
+	g.changed[string(indexKey)] = struct{}{}
+	g.lk.Unlock()
+}
+
+// GrowIndex rebuilds the index with `bits` bucket bits and switches over to it, which shortens the
+// record lists of an index whose buckets hold too many keys. Nothing is done if the index already
+// has at least that many bits.
+//
+// Reads and writes continue while the new index is built from a snapshot of the current one, they
+// only wait while the records that changed meanwhile are carried over and the indexes are switched.
+// GC waits until the growth is done. The growth is abandoned if the context is done or the store
+// is closed before the switch, a growth that is interrupted by a crash leaves the index as it was.
+//
+// The index keeps its new size. Open the store with the new number of bits afterwards, or with
+// `AutoGrowIndex`, which accepts an index that has more bits than given to OpenStore.
+func (s *Store) GrowIndex(ctx context.Context, bits uint8) error {
+	s.growLk.Lock()
+	defer s.growLk.Unlock()
+
+	// Take the snapshot the new index is built from, the changes after it are tracked.
+	s.swapLk.Lock()
+	if err := s.Err(); err != nil {
+		s.swapLk.Unlock()
+		return err
+	}
+	if !s.isOpen() {
+		s.swapLk.Unlock()
+		return types.ErrStoreClosed
+	}
+	if bits <= s.indexSizeBits {
+		s.swapLk.Unlock()
+		return nil
+	}
+	if _, err := s.commit(true); err != nil {
+		s.setErr(err)
+		s.swapLk.Unlock()
+		return err
+	}
+	snapshot, err := s.index.Snapshot()
+	if err != nil {
+		s.swapLk.Unlock()
+		return err
+	}
+	generation := s.generation
+	fromBits := s.indexSizeBits
+	s.growth = &indexGrowth{changed: make(map[string]struct{})}
+	s.swapLk.Unlock()
+
+	growPath := s.path + growSuffix
+	grown, err := s.buildGrownIndex(ctx, growPath, snapshot, bits, generation)
+
+	s.swapLk.Lock()
+	defer s.swapLk.Unlock()
+	growth := s.growth
+	s.growth = nil
+	if err == nil && s.generation != generation {
+		// GC replaced the files, the snapshot is outdated.
+		err = types.ErrSnapshotInvalidated
+	}
+	if err == nil {
+		err = s.Err()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && !s.isOpen() {
+		err = types.ErrStoreClosed
+	}
+	if err == nil {
+		err = s.carryOver(grown, growth)
+	}
+	if grown != nil {
+		if closeErr := grown.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		_ = os.Remove(growPath)
+		return err
+	}
+
+	// The old index is closed by the swap, it must not have outstanding work.
+	if _, err := s.commit(true); err != nil {
+		s.setErr(err)
+		_ = os.Remove(growPath)
+		return err
+	}
+	s.indexSizeBits = bits
+	// Snapshots of the old index become invalid.
+	s.generation++
+	if err := s.swapIndex(growPath); err != nil {
+		s.setErr(err)
+		return err
+	}
+	s.log.Infow("grew index", "path", s.path, "from_bits", fromBits, "bits", bits, "keys", s.index.Count())
+	return nil
+}
+
+// buildGrownIndex writes the records of the snapshot into a new index with the given number of
+// bits at `path`. The returned index is open, also if an error is returned.
+func (s *Store) buildGrownIndex(ctx context.Context, path string, snapshot *index.Index, bits uint8, generation uint64) (*index.Index, error) {
+	// The primary storage must not be replaced while the entries are read.
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if s.generation != generation {
+		return nil, types.ErrSnapshotInvalidated
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	grown, err := index.OpenIndex(path, s.index.Primary, bits, s.indexOptions...)
+	if err != nil {
+		return nil, err
+	}
+	err = copyRecords(snapshot, grown, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.ctx.Err(); err != nil {
+			return types.ErrStoreClosed
+		}
+		return nil
+	})
+	return grown, err
+}
+
+// copyRecords puts the records of the index `from` into the index `to`, which may have a different
+// number of bucket bits. `check` is called before every record, the copy stops at the first error
+// it returns. The copied records are flushed but not synced.
+func copyRecords(from *index.Index, to *index.Index, check func() error) error {
+	err := from.ForEachRecord(func(_ index.BucketIndex, record index.Record) error {
+		if err := check(); err != nil {
+			return err
+		}
+		// The records only store key prefixes, the full keys determine the new buckets.
+		indexKey, err := from.Primary.GetIndexKey(record.Block)
+		if err != nil {
+			return err
+		}
+		if record.HasValueSize {
+			err = to.PutWithSize(indexKey, record.Block, record.ValueSize)
+		} else {
+			err = to.Put(indexKey, record.Block)
+		}
+		if err != nil {
+			return err
+		}
+		if to.OutstandingWork() >= growFlushWork {
+			_, err = to.Flush()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = to.Flush()
+	return err
+}
+
+// carryOver updates the grown index with the current records of the keys that changed while it
+// was built. It must be called with swapLk held for writing.
+func (s *Store) carryOver(grown *index.Index, growth *indexGrowth) error {
+	for key := range growth.changed {
+		indexKey := []byte(key)
+		record, found, err := s.index.GetRecord(indexKey)
+		if err != nil {
+			return err
+		}
+		if found {
+			if found, err = verify(s.index, indexKey, record.Block); err != nil {
+				return err
+			}
+		}
+		blk, exists, err := grown.Get(indexKey)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if exists, err = verify(grown, indexKey, blk); err != nil {
+				return err
+			}
+		}
+		switch {
+		case found && exists && record.HasValueSize:
+			err = grown.UpdateWithSize(indexKey, record.Block, record.ValueSize)
+		case found && exists:
+			err = grown.Update(indexKey, record.Block)
+		case found && record.HasValueSize:
+			err = grown.PutWithSize(indexKey, record.Block, record.ValueSize)
+		case found:
+			err = grown.Put(indexKey, record.Block)
+		case exists:
+			_, err = grown.Remove(indexKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := grown.Flush(); err != nil {
+		return err
+	}
+	return grown.Sync()
+}
+
+// autoGrowIndex grows the index by a bit if its buckets hold more keys on average than
+// `AutoGrowIndex` allows. The growth runs in the background, only one at a time.
+func (s *Store) autoGrowIndex() {
+	if s.growAverage <= 0 || !atomic.CompareAndSwapUint32(&s.autoGrowing, 0, 1) {
+		return
+	}
+	s.swapLk.RLock()
+	bits := s.indexSizeBits
+	keys := s.index.Count()
+	occupied, _ := s.index.OccupiedBuckets()
+	s.swapLk.RUnlock()
+	if bits >= s.growMaxBits || occupied == 0 || float64(keys)/float64(occupied) <= s.growAverage {
+		atomic.StoreUint32(&s.autoGrowing, 0)
+		return
+	}
+	s.goBackground(func(ctx context.Context) {
+		defer atomic.StoreUint32(&s.autoGrowing, 0)
+		if err := s.GrowIndex(ctx, bits+1); err != nil && ctx.Err() == nil {
+			s.log.Warnw("growing index failed", "path", s.path, "bits", bits+1, "err", err)
+		}
+	})
+}
+
+// isOpen returns whether the store wasn't closed yet.
+func (s *Store) isOpen() bool {
+	s.stateLk.RLock()
+	defer s.stateLk.RUnlock()
+	return s.open
+}
+
+// removeGrownIndex removes the index of a growth that was interrupted by a crash before it was
+// switched to.
+func removeGrownIndex(path string) error {
+	if err := os.Remove(path + growSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// grownIndexBits returns the number of bucket bits of the index at the given path if it has more
+// than `indexSizeBits` because it was grown, `indexSizeBits` otherwise.
+func grownIndexBits(path string, indexSizeBits uint8) (uint8, error) {
+	bits, found, err := indexFileBits(path)
+	if err != nil {
+		return 0, err
+	}
+	if found && bits > indexSizeBits {
+		return bits, nil
+	}
+	return indexSizeBits, nil
+}
+
+// indexFileBits returns the number of bucket bits in the header of the index at the given path.
+// Nothing is found if there is no index or its header can't be read, opening the index reports the
+// latter.
+func indexFileBits(path string) (uint8, bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	header, _, err := index.ReadHeader(file)
+	if err != nil {
+		return 0, false, nil
+	}
+	return header.BucketsBits, true, nil
+}
@@ -0,0 +1,121 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrowIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+
+	blks := testutil.GenerateBlocksOfSize(2000, 100)
+	for _, blk := range blks[:1000] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	// Writes continue while the index grows.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.GrowIndex(context.Background(), 10)
+	}()
+	for _, blk := range blks[1000:] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	for _, blk := range blks[:100] {
+		require.NoError(t, s.Delete(blk.Cid().Bytes()))
+	}
+	require.NoError(t, <-done)
+	// Also changes after the switch end up in the grown index.
+	for _, blk := range blks[100:200] {
+		require.NoError(t, s.Delete(blk.Cid().Bytes()))
+	}
+
+	check := func(s *store.Store) {
+		for n, blk := range blks {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.Equal(t, n >= 200, found)
+			if found {
+				require.Equal(t, blk.RawData(), value)
+			}
+		}
+		stats := s.Stats()
+		require.Equal(t, uint64(1<<10), stats.Buckets)
+		require.Equal(t, uint64(len(blks)-200), stats.Keys)
+	}
+	check(s)
+	// Growing to fewer bits does nothing.
+	require.NoError(t, s.GrowIndex(context.Background(), 9))
+	require.NoError(t, s.Close())
+
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, store.AutoGrowIndex(4, 16))
+	require.NoError(t, err)
+	defer s.Close()
+	check(s)
+}
+
+func TestGrowIndexCancel(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(100, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, s.GrowIndex(ctx, 25))
+	require.Equal(t, uint64(1<<24), s.Stats().Buckets)
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
+
+func TestAutoGrowIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, 4, 10*time.Millisecond,
+		defaultBurstRate, store.AutoGrowIndex(2, 8))
+	require.NoError(t, err)
+	defer s.Close()
+	s.Start()
+
+	blks := testutil.GenerateBlocksOfSize(500, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// The index grows a bit at a time until it reaches the maximum.
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Stats().Buckets != 1<<8 {
+		require.True(t, time.Now().Before(deadline), "index did not grow")
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
@@ -66,3 +66,59 @@ func (b SizeBuckets) Get(index BucketIndex) (types.Size, error) {
 	}
 	return b[int(index)], nil
 }
+
+// BucketTable holds the location of the current record list of every bucket.
+//
+// The default table keeps everything in memory. Deployments where the table doesn't fit into RAM
+// can use a paged table instead, see `PagedBuckets`.
+type BucketTable interface {
+	// Get returns the offset and size of the record list of a bucket. A zero offset means the
+	// bucket is empty.
+	Get(index BucketIndex) (types.Position, types.Size, error)
+	// Put updates the location of the record list of a bucket.
+	Put(index BucketIndex, offset types.Position, size types.Size) error
+	// Close releases any resources held by the table.
+	Close() error
+}
+
+// memBucketTable is a bucket table that is fully resident in memory.
+type memBucketTable struct {
+	buckets     Buckets
+	sizeBuckets SizeBuckets
+}
+
+// NewMemBucketTable returns a bucket table that keeps all buckets in memory.
+func NewMemBucketTable(indexSizeBits uint8) (BucketTable, error) {
+	buckets, err := NewBuckets(indexSizeBits)
+	if err != nil {
+		return nil, err
+	}
+	sizeBuckets, err := NewSizeBuckets(indexSizeBits)
+	if err != nil {
+		return nil, err
+	}
+	return &memBucketTable{buckets, sizeBuckets}, nil
+}
+
+func (t *memBucketTable) Get(index BucketIndex) (types.Position, types.Size, error) {
+	offset, err := t.buckets.Get(index)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := t.sizeBuckets.Get(index)
+	if err != nil {
+		return 0, 0, err
+	}
+	return offset, size, nil
+}
+
+func (t *memBucketTable) Put(index BucketIndex, offset types.Position, size types.Size) error {
+	if err := t.buckets.Put(index, offset); err != nil {
+		return err
+	}
+	return t.sizeBuckets.Put(index, size)
+}
+
+func (t *memBucketTable) Close() error {
+	return nil
+}
@@ -1,6 +1,8 @@
 package index_test
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/hannahhoward/go-storethehash/store/index"
@@ -60,3 +62,33 @@ func TestGetErrir(t *testing.T) {
 	_, err = buckets.Get(333)
 	require.EqualError(t, err, types.ErrOutOfBounds.Error())
 }
+
+func TestPagedBucketTable(t *testing.T) {
+	var bucketBits uint8 = 12
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	table, err := index.NewPagedBucketTable(filepath.Join(tempDir, "buckets"), bucketBits, 2)
+	require.NoError(t, err)
+	defer table.Close()
+
+	// Touch more pages than can be resident, so that pages get evicted and read back. Positions
+	// beyond 4 GiB keep all their bits.
+	for i := 0; i < 1<<bucketBits; i += 7 {
+		err = table.Put(index.BucketIndex(i), types.Position(i*100)<<32, types.Size(i))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 1<<bucketBits; i++ {
+		offset, size, err := table.Get(index.BucketIndex(i))
+		require.NoError(t, err)
+		if i%7 == 0 {
+			require.Equal(t, types.Position(i*100)<<32, offset)
+			require.Equal(t, types.Size(i), size)
+		} else {
+			require.Equal(t, types.Position(0), offset)
+			require.Equal(t, types.Size(0), size)
+		}
+	}
+
+	_, _, err = table.Get(1 << bucketBits)
+	require.EqualError(t, err, types.ErrOutOfBounds.Error())
+}
@@ -0,0 +1,207 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the checkpoint of the bucket table next to the index, see Checkpoints.
+const checkpointSuffix = ".checkpoint"
+
+// The checkpoint contains the locations of the record lists of the non-empty buckets as of a
+// position in the index:
+//
+//	| 4 bytes |   1 byte    | 8 bytes  |   4 bytes   | 8 bytes | 8 bytes  |      4 bytes      | 16 bytes each | 4 bytes  |
+//	|  Magic  | Bucket bits | Position | Fingerprint |  Keys   | Occupied | Number of buckets |    Buckets    | Checksum |
+//
+// Every bucket consists of its number, the offset and the size of its record list. The fingerprint
+// is a CRC32 of the bytes of the index before the position, so that the checkpoint of an index
+// that was replaced in the meantime isn't used. The checksum covers everything before it.
+const (
+	checkpointHeaderSize = 4 + 1 + types.OffBytesLen + 4 + 8 + 8 + 4
+	checkpointEntrySize  = 4 + types.OffBytesLen + types.SizeBytesLen
+)
+
+// Magic bytes at the start of a checkpoint.
+var checkpointMagic = []byte("STHC")
+
+// Number of bytes of the index before the position of a checkpoint that its fingerprint covers.
+const fingerprintSize = 256
+
+// checkpoint is a checkpoint that was read from disk.
+type checkpoint struct {
+	pos            types.Position
+	fingerprint    uint32
+	keys, occupied uint64
+	// Buckets as they are stored
+	entries []byte
+}
+
+// readCheckpoint returns the checkpoint of the index at the given path. It returns nil if there is
+// none or it can't be used with the given number of bucket bits.
+func readCheckpoint(path string, indexSizeBits uint8) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(path + checkpointSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < checkpointHeaderSize+ListChecksumSize || !bytes.HasPrefix(data, checkpointMagic) {
+		return nil, nil
+	}
+	body := data[:len(data)-ListChecksumSize]
+	if crc32.Checksum(body, castagnoliTable) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, nil
+	}
+	count := binary.LittleEndian.Uint32(body[checkpointHeaderSize-4:])
+	if body[4] != indexSizeBits || len(body) != checkpointHeaderSize+int(count)*checkpointEntrySize {
+		return nil, nil
+	}
+	return &checkpoint{
+		pos:         types.Position(binary.LittleEndian.Uint64(body[5:])),
+		fingerprint: binary.LittleEndian.Uint32(body[5+types.OffBytesLen:]),
+		keys:        binary.LittleEndian.Uint64(body[9+types.OffBytesLen:]),
+		occupied:    binary.LittleEndian.Uint64(body[17+types.OffBytesLen:]),
+		entries:     body[checkpointHeaderSize:],
+	}, nil
+}
+
+// matches returns whether the checkpoint belongs to the index that is read from `index`, whose
+// record lists start at `start`.
+func (cp *checkpoint) matches(index *segmentedFile, start types.Position) bool {
+	if cp.pos < start {
+		return false
+	}
+	index.lk.RLock()
+	from := index.find(int64(cp.pos) - 1).base
+	index.lk.RUnlock()
+	fp, err := fingerprint(index, from, cp.pos)
+	return err == nil && fp == cp.fingerprint
+}
+
+// apply puts the buckets of the checkpoint into the bucket table.
+func (cp *checkpoint) apply(buckets BucketTable) error {
+	for entries := cp.entries; len(entries) > 0; entries = entries[checkpointEntrySize:] {
+		bucket := BucketIndex(binary.LittleEndian.Uint32(entries))
+		offset := types.Position(binary.LittleEndian.Uint64(entries[4:]))
+		size := types.Size(binary.LittleEndian.Uint32(entries[4+types.OffBytesLen:]))
+		if err := buckets.Put(bucket, offset, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fingerprint returns the CRC32 of the bytes of the index before `pos`, at most fingerprintSize of
+// them and none before `from`.
+func fingerprint(index io.ReaderAt, from types.Position, pos types.Position) (uint32, error) {
+	size := types.Position(fingerprintSize)
+	if pos-from < size {
+		size = pos - from
+	}
+	data := make([]byte, size)
+	if _, err := index.ReadAt(data, int64(pos-size)); err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(data, castagnoliTable), nil
+}
+
+// checkpoint writes a checkpoint of the bucket table as of the end of the flushed data, see
+// Checkpoints. Unless `force` is set, it's only written once the index grew by the interval since
+// the last one. It must be called after the index file was synced, not concurrently with a flush.
+func (i *Index) checkpoint(force bool) error {
+	if i.checkpointInterval == 0 || !i.countsFlushed || i.flushedLength == i.checkpointed {
+		return nil
+	}
+	if !force && int64(i.flushedLength-i.checkpointed) < i.checkpointInterval {
+		return nil
+	}
+	pos := i.flushedLength
+	var from types.Position
+	if i.segments != nil {
+		i.segments.lk.RLock()
+		from = i.segments.find(int64(pos) - 1).base
+		i.segments.lk.RUnlock()
+	}
+	fp, err := fingerprint(i.file, from, pos)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, checkpointHeaderSize, checkpointHeaderSize+int(i.flushedOccupied)*checkpointEntrySize+ListChecksumSize)
+	copy(data, checkpointMagic)
+	data[4] = i.sizeBits
+	binary.LittleEndian.PutUint64(data[5:], uint64(pos))
+	binary.LittleEndian.PutUint32(data[5+types.OffBytesLen:], fp)
+	binary.LittleEndian.PutUint64(data[9+types.OffBytesLen:], i.flushedKeys)
+	binary.LittleEndian.PutUint64(data[17+types.OffBytesLen:], i.flushedOccupied)
+	entry := make([]byte, checkpointEntrySize)
+	var count uint32
+	i.bucketLk.RLock()
+	for bucket := uint64(0); bucket < 1<<i.sizeBits; bucket++ {
+		offset, size, err := i.buckets.Get(BucketIndex(bucket))
+		if err != nil {
+			i.bucketLk.RUnlock()
+			return err
+		}
+		if offset == 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint32(entry, uint32(bucket))
+		binary.LittleEndian.PutUint64(entry[4:], uint64(offset))
+		binary.LittleEndian.PutUint32(entry[4+types.OffBytesLen:], uint32(size))
+		data = append(data, entry...)
+		count++
+	}
+	i.bucketLk.RUnlock()
+	binary.LittleEndian.PutUint32(data[checkpointHeaderSize-4:], count)
+	checksum := make([]byte, ListChecksumSize)
+	binary.LittleEndian.PutUint32(checksum, crc32.Checksum(data, castagnoliTable))
+	if err := writeFileAtomic(i.file.Name()+checkpointSuffix, append(data, checksum...)); err != nil {
+		return err
+	}
+	i.checkpointed = pos
+	return nil
+}
+
+// OpenedFromCheckpoint returns the position of the checkpoint the index was opened from, only the
+// record lists behind it were read. It returns false if the whole index was read, see Checkpoints.
+func (i *Index) OpenedFromCheckpoint() (types.Position, bool) {
+	return i.openedFrom, i.openedFrom != 0
+}
+
+// removeCheckpoint removes the checkpoint of the index at the given path, if there is one.
+func removeCheckpoint(path string) error {
+	if err := os.Remove(path + checkpointSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at the given path with one that contains the data. The file is
+// synced before it replaces the existing one.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,101 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoints(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key3 := []byte{17, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key4 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}, {key4, {0x50}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	options := []index.Option{index.Checkpoints(1 << 20), index.PagedBuckets(1)}
+	check := func(i *index.Index, expected map[string]types.Block) {
+		for key, blk := range expected {
+			found, ok, err := i.Get([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, blk, found)
+		}
+		require.Equal(t, uint64(len(expected)), i.Count())
+	}
+
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Sync())
+	// The index didn't grow by the interval yet, the checkpoint is written on close.
+	_, err = os.Stat(indexPath + ".checkpoint")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, i.Close())
+	_, err = os.Stat(indexPath + ".checkpoint")
+	require.NoError(t, err)
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	checkpointed, ok := i.OpenedFromCheckpoint()
+	require.True(t, ok)
+	require.Equal(t, i.Size(), checkpointed)
+	check(i, map[string]types.Block{
+		string(key1): {Offset: 0, Size: 1},
+		string(key2): {Offset: 1, Size: 1},
+	})
+	// The changes behind the checkpoint are read on open, as after a crash.
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	require.NoError(t, i.Put(key4, types.Block{Offset: 3, Size: 1}))
+	_, err = i.Remove(key2)
+	require.NoError(t, err)
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Sync())
+
+	i2, err := index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	opened, ok := i2.OpenedFromCheckpoint()
+	require.True(t, ok)
+	require.Equal(t, checkpointed, opened)
+	expected := map[string]types.Block{
+		string(key1): {Offset: 0, Size: 1},
+		string(key3): {Offset: 2, Size: 1},
+		string(key4): {Offset: 3, Size: 1},
+	}
+	check(i2, expected)
+	occupied, _ := i2.OccupiedBuckets()
+	require.Equal(t, uint64(2), occupied)
+	require.NoError(t, i2.Close())
+	require.NoError(t, i.Close())
+
+	// A checkpoint that doesn't match the index is ignored.
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	rewritePath := indexPath + ".rewrite"
+	require.NoError(t, i.Rewrite(rewritePath, func(blk types.Block) (types.Block, bool, error) {
+		return types.Block{Offset: blk.Offset + 10, Size: blk.Size}, true, nil
+	}))
+	require.NoError(t, i.Close())
+	require.NoError(t, os.Rename(rewritePath, indexPath))
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	_, ok = i.OpenedFromCheckpoint()
+	require.False(t, ok)
+	for key, blk := range expected {
+		expected[key] = types.Block{Offset: blk.Offset + 10, Size: blk.Size}
+	}
+	check(i, expected)
+	require.NoError(t, i.Close())
+}
@@ -0,0 +1,83 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordListChecksums(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key3 := []byte{17, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+
+	// Record lists with and without checksum can be mixed.
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.RecordListChecksums())
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	info, err := os.Stat(indexPath)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	for n, key := range [][]byte{key1, key2, key3} {
+		blk, found, err := i.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Block{Offset: types.Position(n), Size: 1}, blk)
+	}
+	require.NoError(t, i.Close())
+	require.Equal(t, index.FlagRecordListChecksums, readIndexHeader(t, indexPath).Flags)
+
+	// Flip a byte of the record list of the second key.
+	offset := info.Size() - int64(index.ListChecksumSize) - 1
+	flip := func() {
+		file, err := os.OpenFile(indexPath, os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer file.Close()
+		data := make([]byte, 1)
+		_, err = file.ReadAt(data, offset)
+		require.NoError(t, err)
+		data[0] ^= 0xff
+		_, err = file.WriteAt(data, offset)
+		require.NoError(t, err)
+	}
+
+	// Corruption is found by reads of the record list...
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.RecordListChecksums())
+	require.NoError(t, err)
+	flip()
+	_, _, err = i.Get(key2)
+	require.IsType(t, types.ErrIndexCorrupt(0), err)
+	// ...which doesn't affect other buckets.
+	_, found, err := i.Get(key1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NoError(t, i.Close())
+
+	// ...and by the scan on open.
+	_, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.IsType(t, types.ErrIndexCorrupt(0), err)
+	flip()
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+}
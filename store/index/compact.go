@@ -0,0 +1,131 @@
+package index
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the index file while it is compacted.
+const compactSuffix = ".compact"
+
+// Compact reclaims the space of the record lists that were replaced by newer versions. The current
+// record list of every bucket is written to a new file next to the index, which replaces the index
+// file once it's complete and synced. A crash before leaves the index file as it was, the new file
+// is removed when the index is opened. It returns the number of bytes the index file shrank by.
+//
+// A segmented index isn't rewritten, instead the sealed segments that only contain replaced record
+// lists are removed, see Segments.
+//
+// Outstanding work is flushed and synced first. Compact must not be called concurrently with any
+// other method of the index, and snapshots of the index can't be used anymore afterwards.
+func (i *Index) Compact() (int64, error) {
+	if _, err := i.Flush(); err != nil {
+		return 0, err
+	}
+	if err := i.Sync(); err != nil {
+		return 0, err
+	}
+	if i.segments != nil {
+		dropped, err := i.dropSegments()
+		if err != nil {
+			return dropped, err
+		}
+		// The checkpoint may refer to a dropped segment.
+		i.checkpointed = 0
+		return dropped, i.checkpoint(true)
+	}
+	if mem, ok := i.file.(*memoryFile); ok {
+		return i.compactMemory(mem)
+	}
+	path := i.file.Name()
+	compactPath := path + compactSuffix
+	file, err := openFileRandom(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+	// The buckets are written in order, empty ones are skipped.
+	var placed []bucketBlock
+	length, err := i.rewrite(file, i.flags, func(blk types.Block) (types.Block, bool, error) {
+		return blk, true, nil
+	}, func(bucket BucketIndex, blk types.Block) {
+		placed = append(placed, bucketBlock{bucket, blk})
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(compactPath)
+		return 0, err
+	}
+	if err := os.Rename(compactPath, path); err != nil {
+		_ = os.Remove(compactPath)
+		return 0, err
+	}
+
+	// Continue with the new file the same way OpenIndex does.
+	flags := os.O_RDWR | os.O_APPEND
+	if i.preallocate > 0 {
+		flags = os.O_RDWR
+	}
+	file, err = openFileRandom(path, flags)
+	if err != nil {
+		return 0, err
+	}
+	if i.preallocate > 0 {
+		if _, err := file.Seek(int64(length), io.SeekStart); err != nil {
+			_ = file.Close()
+			return 0, err
+		}
+	}
+	if err := i.placeBuckets(placed); err != nil {
+		_ = file.Close()
+		return 0, err
+	}
+	_ = i.file.Close()
+	shrunk := int64(i.length) - int64(length)
+	i.file = file
+	i.writer = bufio.NewWriterSize(file, indexBufferSize)
+	i.length = length
+	i.flushedLength = length
+	i.allocated = length
+	// The new header has no end field, the end is found by the scan on open.
+	i.endOffset = 0
+	i.torn = TornTail{}
+	// The offsets of the cached record lists refer to the old file.
+	if i.listCache != nil {
+		i.listCache.clear()
+	}
+	// The checkpoint refers to the old file.
+	if err := removeCheckpoint(path); err != nil {
+		return shrunk, err
+	}
+	i.checkpointed = 0
+	return shrunk, i.checkpoint(true)
+}
+
+// placeBuckets points the buckets to the record lists of a rewritten index, which are ordered by
+// bucket. Buckets without a record list become empty.
+func (i *Index) placeBuckets(placed []bucketBlock) error {
+	for bucket := uint64(0); bucket < 1<<i.sizeBits; bucket++ {
+		var blk types.Block
+		if len(placed) > 0 && placed[0].bucket == BucketIndex(bucket) {
+			blk = placed[0].blk
+			placed = placed[1:]
+		}
+		if err := i.buckets.Put(BucketIndex(bucket), blk.Offset, blk.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCompactedIndex removes the new file of a compaction that was interrupted by a crash.
+func removeCompactedIndex(path string) error {
+	if err := os.Remove(path + compactSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
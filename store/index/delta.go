@@ -0,0 +1,171 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// A record list that is larger than the size set with Deltas is written as delta against the last
+// complete version of it, the base, as long as the delta is small compared to the base:
+//
+//	| 13 bytes | 8 bytes | 4 bytes |    4 bytes     |       4 bytes      | 4 bytes each |   Variable size  |
+//	|  Marker  |  Base   |  Base   | Number of keys | Number of removals |  Removals    | Inserted records |
+//	|          | offset  |  size   |                |                    |              |                  |
+//
+// Removals are the positions of the records of the base that are replaced, the inserted records
+// are sorted by key. Reads merge the delta into the base. Every delta refers to the base directly,
+// hence it contains all changes since the base was written.
+const deltaMarker types.Position = overflowMarker - 2
+
+// Size of the fields of a delta up to the removals.
+const deltaHeaderSize = markerSize + types.OffBytesLen + types.SizeBytesLen + 4 + 4
+
+// A delta is only written while it's smaller than the base divided by this ratio, otherwise the
+// complete record list is written, which becomes the base of the following deltas.
+const maxDeltaRatio = 4
+
+// deltaBase returns the location of the base of a delta.
+func deltaBase(records []byte) types.Block {
+	return types.Block{
+		Offset: types.Position(binary.LittleEndian.Uint64(records[markerSize:])),
+		Size:   types.Size(binary.LittleEndian.Uint32(records[markerSize+types.OffBytesLen:])),
+	}
+}
+
+// deltaCount returns the number of keys of the record list a delta describes.
+func deltaCount(records []byte) uint32 {
+	return binary.LittleEndian.Uint32(records[markerSize+types.OffBytesLen+types.SizeBytesLen:])
+}
+
+// mergeDelta returns the record list that a delta describes, with the bucket prefix of the delta.
+func (i *Index) mergeDelta(data []byte) ([]byte, error) {
+	delta := data[BucketPrefixSize:]
+	baseData, err := i.readList(deltaBase(delta).Offset, deltaBase(delta).Size)
+	if err != nil {
+		return nil, err
+	}
+	base, _ := NewSeekRecordList(baseData)
+	removals := int(binary.LittleEndian.Uint32(delta[deltaHeaderSize-4:]))
+	removed := make(map[int]bool, removals)
+	for n := 0; n < removals; n++ {
+		removed[int(binary.LittleEndian.Uint32(delta[deltaHeaderSize+n*4:]))] = true
+	}
+	inserted := RecordList(delta[deltaHeaderSize+removals*4:])
+
+	merged := make([]byte, BucketPrefixSize, BucketPrefixSize+len(base)+len(inserted))
+	copy(merged, data)
+	baseIter, insertedIter := base.Iter(), inserted.Iter()
+	var next *Record
+	for !baseIter.Done() {
+		record := baseIter.Next()
+		if removed[record.Pos] {
+			continue
+		}
+		for next != nil || !insertedIter.Done() {
+			if next == nil {
+				r := insertedIter.Next()
+				next = &r
+			}
+			if bytes.Compare(next.Key, record.Key) > 0 {
+				break
+			}
+			merged = append(merged, inserted[next.Pos:next.NextPos()]...)
+			next = nil
+		}
+		merged = append(merged, base[record.Pos:record.NextPos()]...)
+	}
+	if next != nil {
+		merged = append(merged, inserted[next.Pos:]...)
+	} else {
+		merged = append(merged, inserted[insertedIter.pos:]...)
+	}
+	return merged, nil
+}
+
+// encodeDelta returns the delta that turns the base of the bucket's flushed record list into the
+// given records. It returns false if the record list should be written completely, because there
+// is no base or the delta isn't small enough.
+func (i *Index) encodeDelta(bucket BucketIndex, records RecordList) ([]byte, bool, error) {
+	i.bucketLk.RLock()
+	indexOffset, recordListSize, err := i.buckets.Get(bucket)
+	i.bucketLk.RUnlock()
+	if err != nil || indexOffset == 0 {
+		return nil, false, err
+	}
+	// Only the start of the flushed record list is needed to find the base.
+	start := make([]byte, min(int(recordListSize), BucketPrefixSize+deltaHeaderSize))
+	if _, err := i.file.ReadAt(start, int64(indexOffset)); err != nil {
+		return nil, false, err
+	}
+	baseBlk := types.Block{Offset: indexOffset, Size: recordListSize}
+	switch listMarker(start[BucketPrefixSize:]) {
+	case deltaMarker:
+		baseBlk = deltaBase(start[BucketPrefixSize:])
+	case overflowMarker, overflowChildMarker:
+		return nil, false, nil
+	}
+	if int(baseBlk.Size) < i.deltaSize {
+		return nil, false, nil
+	}
+	baseData, err := i.readList(baseBlk.Offset, baseBlk.Size)
+	if err != nil {
+		return nil, false, err
+	}
+	base, _ := NewSeekRecordList(baseData)
+
+	var removals []int
+	var inserted []byte
+	var count uint32
+	baseIter, newIter := base.Iter(), records.Iter()
+	var old, cur *Record
+	for {
+		if old == nil && !baseIter.Done() {
+			r := baseIter.Next()
+			old = &r
+		}
+		if cur == nil && !newIter.Done() {
+			r := newIter.Next()
+			cur = &r
+			count++
+		}
+		if old == nil && cur == nil {
+			break
+		}
+		var cmp int
+		switch {
+		case old == nil:
+			cmp = 1
+		case cur == nil:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(old.Key, cur.Key)
+		}
+		if cmp == 0 && bytes.Equal(base[old.Pos:old.NextPos()], records[cur.Pos:cur.NextPos()]) {
+			old, cur = nil, nil
+			continue
+		}
+		if cmp <= 0 {
+			removals = append(removals, old.Pos)
+			old = nil
+		}
+		if cmp >= 0 {
+			inserted = append(inserted, records[cur.Pos:cur.NextPos()]...)
+			cur = nil
+		}
+		if deltaHeaderSize+len(removals)*4+len(inserted) > len(base)/maxDeltaRatio {
+			return nil, false, nil
+		}
+	}
+	delta := make([]byte, deltaHeaderSize+len(removals)*4, deltaHeaderSize+len(removals)*4+len(inserted))
+	binary.LittleEndian.PutUint64(delta, uint64(deltaMarker))
+	binary.LittleEndian.PutUint64(delta[markerSize:], uint64(baseBlk.Offset))
+	binary.LittleEndian.PutUint32(delta[markerSize+types.OffBytesLen:], uint32(baseBlk.Size))
+	binary.LittleEndian.PutUint32(delta[markerSize+types.OffBytesLen+types.SizeBytesLen:], count)
+	binary.LittleEndian.PutUint32(delta[deltaHeaderSize-4:], uint32(len(removals)))
+	for n, pos := range removals {
+		binary.LittleEndian.PutUint32(delta[deltaHeaderSize+n*4:], uint32(pos))
+	}
+	return append(delta, inserted...), true, nil
+}
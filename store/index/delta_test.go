@@ -0,0 +1,101 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltas(t *testing.T) {
+	// All keys are in bucket 3.
+	var keys [][]byte
+	var data [][2][]byte
+	for n := 0; n < 300; n++ {
+		key := []byte{3, byte(n), byte(n >> 8), 4, 5, 6, 7, 8, 9, 10}
+		keys = append(keys, key)
+		data = append(data, [2][]byte{key, {byte(n)}})
+	}
+	primaryStorage := inmemory.NewInmemory(data)
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	options := []index.Option{index.Deltas(256), index.SeekTableThreshold(64)}
+	check := func(i *index.Index, expected map[int]types.Block) {
+		for n, blk := range expected {
+			found, ok, err := i.Get(keys[n])
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, blk, found)
+		}
+		require.Equal(t, uint64(len(expected)), i.Count())
+		var count int
+		require.NoError(t, i.ForEachRecord(func(bucket index.BucketIndex, record index.Record) error {
+			count++
+			return nil
+		}))
+		require.Equal(t, len(expected), count)
+	}
+	expected := make(map[int]types.Block)
+	put := func(i *index.Index, n int) {
+		blk := types.Block{Offset: types.Position(n), Size: 1}
+		require.NoError(t, i.Put(keys[n], blk))
+		expected[n] = blk
+	}
+
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	for n := 0; n < 100; n++ {
+		put(i, n)
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+
+	// Only the inserted record is written, together with a reference to the complete list.
+	size := i.Size()
+	put(i, 100)
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.True(t, i.Size()-size < 128)
+	check(i, expected)
+
+	// Updates and removals are part of the delta as well.
+	require.NoError(t, i.Update(keys[5], types.Block{Offset: 5, Size: 2}))
+	expected[5] = types.Block{Offset: 5, Size: 2}
+	removed, err := i.Remove(keys[6])
+	require.NoError(t, err)
+	require.True(t, removed)
+	delete(expected, 6)
+	_, err = i.Flush()
+	require.NoError(t, err)
+	check(i, expected)
+	found, ok, err := i.GetFlushed(keys[5])
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, types.Block{Offset: 5, Size: 2}, found)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	check(i, expected)
+	// Once the delta grows too large, the complete list is written again.
+	for n := 101; n < 300; n++ {
+		put(i, n)
+		_, err = i.Flush()
+		require.NoError(t, err)
+	}
+	check(i, expected)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	check(i, expected)
+	_, err = i.Compact()
+	require.NoError(t, err)
+	check(i, expected)
+	require.NoError(t, i.Close())
+}
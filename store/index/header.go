@@ -0,0 +1,246 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// The header of the index
+//
+// The serialized header is:
+// ```text
+//     |   4 bytes   |         1 byte        |                1 byte               |     2 bytes     |
+//     | Magic bytes | Version of the header | Number of bits used for the buckets | Feature flags   |
+// ```
+//
+// Indexes that are created with preallocation have an additional field:
+// ```text
+//     |             8 bytes               |
+//     | End of the data at the last sync  |
+// ```
+//
+// Headers before version 3 have neither magic bytes nor feature flags, they still can be read.
+type Header struct {
+	// A version number in case we change the header
+	Version byte
+	// The number of bits used to determine the in-memory buckets
+	BucketsBits byte
+	// The features that the record lists of the index may use. Always zero for headers before
+	// version 3.
+	Flags HeaderFlags
+	// The end of the record lists as of the last sync or clean close, the file may be
+	// preallocated beyond. Zero if the header has no such field.
+	End types.Position
+}
+
+// HeaderFlags are the features an index file uses, versions that don't know all of them refuse to
+// open it.
+type HeaderFlags uint16
+
+const (
+	// FlagSeekTables marks indexes that may contain record lists with seek tables, see
+	// SeekTableThreshold.
+	FlagSeekTables HeaderFlags = 1 << iota
+	// FlagKeyChecksums marks indexes that may contain records with key checksums, see
+	// KeyChecksums.
+	FlagKeyChecksums
+	// FlagValueSizes marks indexes that may contain records with value sizes, see ValueSizes.
+	FlagValueSizes
+	// FlagPreallocated marks indexes that may continue with preallocated space after the end
+	// field, see Preallocate.
+	FlagPreallocated
+	// FlagRecordListChecksums marks indexes that may contain record lists with checksums, see
+	// RecordListChecksums.
+	FlagRecordListChecksums
+	// FlagSegments marks indexes whose record lists may continue in further segment files, see
+	// Segments.
+	FlagSegments
+	// FlagOverflow marks indexes whose buckets may be split into child lists, see Overflow.
+	FlagOverflow
+	// FlagDeltas marks indexes that may contain record lists that are deltas, see Deltas.
+	FlagDeltas
+	// FlagFullKeys marks indexes that store the complete index key in every record, see FullKeys.
+	// Unlike the other flags it's only set when the index is created.
+	FlagFullKeys
+
+	knownFlags = FlagSeekTables | FlagKeyChecksums | FlagValueSizes | FlagPreallocated | FlagRecordListChecksums |
+		FlagSegments | FlagOverflow | FlagDeltas | FlagFullKeys
+)
+
+// Magic bytes at the start of headers since version 3.
+var headerMagic = []byte("STHI")
+
+// First version of the header with magic bytes and feature flags.
+const magicVersion = 3
+
+// Largest header that is read, anything larger is not an index.
+const maxHeaderSize = 256
+
+func NewHeader(bucketsBits byte) Header {
+	return Header{Version: IndexVersion, BucketsBits: bucketsBits}
+}
+
+func FromHeader(h Header) []byte {
+	if h.Version < magicVersion {
+		// Older headers are written in their own format.
+		return fromLegacyHeader(h)
+	}
+	size := len(headerMagic) + 4
+	if h.End != 0 {
+		size += types.OffBytesLen
+	}
+	data := make([]byte, size)
+	n := copy(data, headerMagic)
+	data[n], data[n+1] = h.Version, h.BucketsBits
+	binary.LittleEndian.PutUint16(data[n+2:], uint16(h.Flags))
+	if h.End != 0 {
+		binary.LittleEndian.PutUint64(data[n+4:], uint64(h.End))
+	}
+	return data
+}
+
+func fromLegacyHeader(h Header) []byte {
+	if h.End == 0 {
+		return []byte{h.Version, h.BucketsBits}
+	}
+	data := make([]byte, 2+types.OffBytesLen)
+	data[0], data[1] = h.Version, h.BucketsBits
+	binary.LittleEndian.PutUint64(data[2:], uint64(h.End))
+	return data
+}
+
+func FromBytes(data []byte) Header {
+	if !bytes.HasPrefix(data, headerMagic) {
+		header := Header{
+			Version:     data[0],
+			BucketsBits: data[1],
+		}
+		if len(data) >= 2+types.OffBytesLen {
+			header.End = types.Position(binary.LittleEndian.Uint64(data[2:]))
+		}
+		return header
+	}
+	data = data[len(headerMagic):]
+	header := Header{
+		Version:     data[0],
+		BucketsBits: data[1],
+		Flags:       HeaderFlags(binary.LittleEndian.Uint16(data[2:])),
+	}
+	if len(data) >= 4+types.OffBytesLen {
+		header.End = types.Position(binary.LittleEndian.Uint64(data[4:]))
+	}
+	return header
+}
+
+// flagsOffset returns the position of the feature flags within the index file, zero if the header
+// has none.
+func (h Header) flagsOffset() int64 {
+	if h.Version < magicVersion {
+		return 0
+	}
+	return int64(SizePrefixSize + len(headerMagic) + 2)
+}
+
+// endOffset returns the position of the end field within the index file, behind the size prefix
+// and the first fields of the header. It is zero if the header has no end field.
+func (h Header) endOffset() int64 {
+	switch {
+	case h.End == 0:
+		return 0
+	case h.Version < magicVersion:
+		return int64(SizePrefixSize + 2)
+	default:
+		return int64(SizePrefixSize + len(headerMagic) + 4)
+	}
+}
+
+// validate checks that an index with the header can be opened with the given number of bucket
+// bits.
+func (h Header) validate(indexSizeBits uint8) error {
+	if h.Version > IndexVersion {
+		return types.ErrIndexVersion{h.Version, IndexVersion}
+	}
+	if unknown := h.Flags &^ knownFlags; unknown != 0 {
+		return types.ErrIndexFeatures(unknown)
+	}
+	if h.BucketsBits != indexSizeBits {
+		return types.ErrIndexWrongBitSize{h.BucketsBits, indexSizeBits}
+	}
+	return nil
+}
+
+// featureFlags returns the features that an index with the given configuration writes.
+func featureFlags(c config) HeaderFlags {
+	var flags HeaderFlags
+	if c.seekTableThreshold > 0 {
+		flags |= FlagSeekTables
+	}
+	if c.keyChecksums {
+		flags |= FlagKeyChecksums
+	}
+	if c.valueSizes {
+		flags |= FlagValueSizes
+	}
+	if c.preallocate > 0 {
+		flags |= FlagPreallocated
+	}
+	if c.listChecksums {
+		flags |= FlagRecordListChecksums
+	}
+	if c.segmentSize > 0 {
+		flags |= FlagSegments
+	}
+	if c.overflowSize > 0 {
+		flags |= FlagOverflow
+	}
+	if c.deltaSize > 0 {
+		flags |= FlagDeltas
+	}
+	if c.fullKeys {
+		flags |= FlagFullKeys
+	}
+	return flags
+}
+
+// Returns the headet together with the bytes read.
+//
+// The bytes read include all the bytes that were read by this function. Hence it also includes
+// the 4-byte size prefix of the header besides the size of the header data itself.
+//
+// `types.ErrNotIndex` is returned if the file doesn't start with a header.
+func ReadHeader(file *os.File) (Header, types.Position, error) {
+	headerSizeBuffer := make([]byte, SizePrefixSize)
+	_, err := io.ReadFull(file, headerSizeBuffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Header{}, 0, types.ErrNotIndex
+	}
+	if err != nil {
+		return Header{}, 0, err
+	}
+	headerSize := binary.LittleEndian.Uint32(headerSizeBuffer)
+	if headerSize < 2 || headerSize > maxHeaderSize {
+		return Header{}, 0, types.ErrNotIndex
+	}
+	headerBytes := make([]byte, headerSize)
+	_, err = io.ReadFull(file, headerBytes)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Header{}, 0, types.ErrNotIndex
+	}
+	if err != nil {
+		return Header{}, 0, err
+	}
+	magic := bytes.HasPrefix(headerBytes, headerMagic)
+	if magic && len(headerBytes) < len(headerMagic)+4 {
+		return Header{}, 0, types.ErrNotIndex
+	}
+	header := FromBytes(headerBytes)
+	// Only old headers lack the magic bytes, and only new ones have them.
+	if magic != (header.Version >= magicVersion) || header.Version == 0 {
+		return Header{}, 0, types.ErrNotIndex
+	}
+	return header, types.Position(SizePrefixSize) + types.Position(headerSize), nil
+}
@@ -0,0 +1,118 @@
+package index_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func readIndexHeader(t *testing.T, indexPath string) index.Header {
+	file, err := os.Open(indexPath)
+	require.NoError(t, err)
+	defer file.Close()
+	header, _, err := index.ReadHeader(file)
+	require.NoError(t, err)
+	return header
+}
+
+// writeIndexFile writes an index file with the given header and record list data.
+func writeIndexFile(t *testing.T, indexPath string, header []byte, data []byte) {
+	file := make([]byte, index.SizePrefixSize, index.SizePrefixSize+len(header)+len(data))
+	binary.LittleEndian.PutUint32(file, uint32(len(header)))
+	file = append(append(file, header...), data...)
+	require.NoError(t, ioutil.WriteFile(indexPath, file, 0o644))
+}
+
+func TestHeaderValidation(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primaryStorage := inmemory.NewInmemory(nil)
+
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, index.KeyChecksums())
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+	header := readIndexHeader(t, indexPath)
+	require.Equal(t, index.IndexVersion, header.Version)
+	require.Equal(t, index.FlagKeyChecksums, header.Flags)
+
+	_, err = index.OpenIndex(indexPath, primaryStorage, 10)
+	require.Equal(t, types.ErrIndexWrongBitSize{8, 10}, err)
+
+	// Features that are enabled later are added to the flags.
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.ValueSizes())
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+	require.Equal(t, index.FlagKeyChecksums|index.FlagValueSizes, readIndexHeader(t, indexPath).Flags)
+
+	newer := header
+	newer.Version = index.IndexVersion + 1
+	writeIndexFile(t, indexPath, index.FromHeader(newer), nil)
+	_, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.Equal(t, types.ErrIndexVersion{index.IndexVersion + 1, index.IndexVersion}, err)
+
+	unknown := header
+	unknown.Flags = 1 << 15
+	writeIndexFile(t, indexPath, index.FromHeader(unknown), nil)
+	_, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.Equal(t, types.ErrIndexFeatures(1<<15), err)
+
+	require.NoError(t, ioutil.WriteFile(indexPath, []byte("this is not an index file"), 0o644))
+	_, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.Equal(t, types.ErrNotIndex, err)
+}
+
+func TestHeaderMigration(t *testing.T) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key, {0x20}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+
+	// Write an index and give it the header of version 2.
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key, types.Block{Offset: 0, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+	data, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+	headerSize := binary.LittleEndian.Uint32(data)
+	writeIndexFile(t, indexPath, []byte{2, 8}, data[index.SizePrefixSize+int(headerSize):])
+
+	// Without migration, the index is opened as it is.
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	blk, found, err := i.Get(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, types.Block{Offset: 0, Size: 1}, blk)
+	require.NoError(t, i.Close())
+	require.Equal(t, byte(2), readIndexHeader(t, indexPath).Version)
+
+	var migrated []index.Header
+	migrate := func(path string, header index.Header) error {
+		migrated = append(migrated, header)
+		return index.UpgradeHeader(path, header)
+	}
+	for n := 0; n < 2; n++ {
+		i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.Migrate(migrate))
+		require.NoError(t, err)
+		blk, found, err = i.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Block{Offset: 0, Size: 1}, blk)
+		require.NoError(t, i.Close())
+	}
+	// Only the old header is migrated.
+	require.Equal(t, []index.Header{{Version: 2, BucketsBits: 8}}, migrated)
+	require.Equal(t, index.IndexVersion, readIndexHeader(t, indexPath).Version)
+}
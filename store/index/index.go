@@ -3,11 +3,14 @@ package index
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/hannahhoward/go-storethehash/store/primary"
 	"github.com/hannahhoward/go-storethehash/store/types"
@@ -24,11 +27,21 @@ The format of that append only log is:
     | Size of the header |   [`Header`]  | Size of the Recordlist |   Recordlist   | … |
 ```
 */
-const IndexVersion uint8 = 2
+const IndexVersion uint8 = 3
 
 // Number of bytes used for the size prefix of a record list.
 const SizePrefixSize int = 4
 
+// Number of bytes of the checksum that follows a record list, see RecordListChecksums.
+const ListChecksumSize int = 4
+
+// Bit of the size prefix that marks record lists that are followed by a checksum.
+const listChecksumFlag uint32 = 1 << 31
+
+// MaxRecordListSize is the size of the largest record list including its bucket prefix, the size
+// prefix has one bit less than a block size. Positions within the index file have 64 bits.
+const MaxRecordListSize = int(listChecksumFlag - 1)
+
 // Remove the prefix that is used for the bucket.
 //
 // The first bits of a key are used to determine the bucket to put the key into. This function
@@ -38,46 +51,71 @@ func StripBucketPrefix(key []byte, bits byte) []byte {
 	return key[(bits / 8):]
 }
 
-// The header of the index
-//
-// The serialized header is:
-// ```text
-//     |         1 byte        |                1 byte               |
-//     | Version of the header | Number of bits used for the buckets |
-// ```
-type Header struct {
-	// A version number in case we change the header
-	Version byte
-	// The number of bits used to determine the in-memory buckets
-	BucketsBits byte
-}
-
-func NewHeader(bucketsBits byte) Header {
-	return Header{IndexVersion, bucketsBits}
-}
-
-func FromHeader(h Header) []byte {
-	return []byte{h.Version, h.BucketsBits}
-}
-
-func FromBytes(bytes []byte) Header {
-	return Header{
-		Version:     bytes[0],
-		BucketsBits: bytes[1],
-	}
-}
-
 type Index struct {
 	sizeBits          uint8
-	buckets           Buckets
-	sizeBuckets       SizeBuckets
-	file              *os.File
+	buckets           BucketTable
+	file              indexFile
 	writer            *bufio.Writer
 	Primary           primary.PrimaryStorage
 	bucketLk          sync.RWMutex
 	outstandingWork   types.Work
 	curPool, nextPool bucketPool
 	length            types.Position
+	// Child lists of overflowing buckets that weren't flushed yet, see Overflow
+	curChildren, nextChildren childPool
+	// End of the data that was completely handed over to the OS, only accessed by commit
+	flushedLength types.Position
+	// Number of keys and of non-empty buckets, protected by bucketLk
+	keys     uint64
+	occupied uint64
+	// Record lists larger than this are written with a seek table, zero disables seek tables
+	seekTableThreshold int
+	// Minimum number of bytes of an index key that are stored, see MinKeyLength
+	minKeyLength int
+	// Whether index keys are stored completely, see FullKeys
+	fullKeys bool
+	// Whether records store a checksum of the full key, see KeyChecksums
+	keyChecksums bool
+	// Whether records store the size of the value, see ValueSizes
+	valueSizes bool
+	// Size of the extents the file is grown by, zero disables preallocation, see Preallocate
+	preallocate int64
+	// Size of the file including the preallocated space, only accessed by commit and Close
+	allocated types.Position
+	// Position of the end field of the header that is updated on sync, zero if it has none
+	endOffset int64
+	// Features the index file uses, see HeaderFlags
+	flags HeaderFlags
+	// Whether record lists are written with a checksum, see RecordListChecksums
+	listChecksums bool
+	// Incomplete record list that was cut off when the index was opened
+	torn TornTail
+	// Log of the changes that aren't in the index file yet, nil if there is none, see WriteAheadLog
+	wal *writeAheadLog
+	// Number of changes that were replayed from the write-ahead log on open
+	replayed uint64
+	// Segments of the index file, nil if it isn't segmented, see Segments
+	segments *segmentedFile
+	// Size that segments are rotated at, zero if they aren't, see Segments
+	segmentSize int64
+	// Growth of the index after which a checkpoint is written, zero if none are, see Checkpoints
+	checkpointInterval int64
+	// Size above which record lists are split into child lists, zero if they aren't, see Overflow
+	overflowSize int
+	// Size above which record lists are written as deltas, zero if they aren't, see Deltas
+	deltaSize int
+	// Receives the record lists that are flushed, nil if there is none, see ReplicationJournal
+	journal Journal
+	// Recently read record lists, nil if they aren't cached, see ListCache
+	listCache *listCache
+	// End of the data the last checkpoint covers, only accessed by Sync and Close
+	checkpointed types.Position
+	// Position of the checkpoint the index was opened from, zero if there was none
+	openedFrom types.Position
+	// Number of keys and non-empty buckets as of the end of the last commit, only valid if the
+	// commit wasn't interrupted. Only accessed by commit and Sync.
+	flushedKeys, flushedOccupied uint64
+	countsFlushed                bool
 }
 
 const indexBufferSize = 32 * 4096
@@ -89,18 +127,64 @@ const BucketPoolSize = 1024
 // Open and index.
 //
 // It is created if there is no existing index at that path.
-func OpenIndex(path string, primary primary.PrimaryStorage, indexSizeBits uint8) (*Index, error) {
+func OpenIndex(path string, primary primary.PrimaryStorage, indexSizeBits uint8, options ...Option) (*Index, error) {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
 	var file *os.File
-	var buckets Buckets
-	var sizeBuckets SizeBuckets
-	var length types.Position
-	stat, err := os.Stat(path)
+	var length, allocated types.Position
+	var keys, occupied uint64
+	var endOffset int64
+	var headerFlags HeaderFlags
+	var torn TornTail
+	var manifest []segment
+	var checkpointed types.Position
+	if c.segmentSize > 0 && c.preallocate > 0 {
+		return nil, types.ErrSegmentedIndex
+	}
+	if err := removeCompactedIndex(path); err != nil {
+		return nil, err
+	}
+	if c.migrate != nil {
+		if err := migrateIndex(path, c.migrate); err != nil {
+			return nil, err
+		}
+	}
+	buckets, err := newBucketTable(path, indexSizeBits, c)
+	if err != nil {
+		return nil, err
+	}
+	// A preallocated file is written at the end of the data instead of the end of the file.
+	flags := os.O_RDWR | os.O_APPEND | os.O_EXCL
+	if c.preallocate > 0 {
+		flags = os.O_RDWR | os.O_EXCL
+	}
+	_, err = os.Stat(path)
 	if os.IsNotExist(err) {
-		header := FromHeader(NewHeader(indexSizeBits))
+		// Segments and checkpoints of a previous index at the path don't belong to the new one.
+		if err := RemoveSegments(path); err != nil {
+			_ = buckets.Close()
+			return nil, err
+		}
+		if err := removeCheckpoint(path); err != nil {
+			_ = buckets.Close()
+			return nil, err
+		}
+		h := NewHeader(indexSizeBits)
+		h.Flags = featureFlags(c)
+		if c.preallocate > 0 {
+			// The end field points behind the header it's part of.
+			h.End = 1
+			h.End = types.Position(SizePrefixSize + len(FromHeader(h)))
+			endOffset = h.endOffset()
+		}
+		headerFlags = h.Flags
+		header := FromHeader(h)
 		headerSize := make([]byte, 4)
 		binary.LittleEndian.PutUint32(headerSize, uint32(len(header)))
 
-		file, err = openFileRandom(path, os.O_RDWR|os.O_APPEND|os.O_EXCL|os.O_CREATE)
+		file, err = openFileRandom(path, flags|os.O_CREATE)
 		if err != nil {
 			return nil, err
 		}
@@ -114,93 +198,360 @@ func OpenIndex(path string, primary primary.PrimaryStorage, indexSizeBits uint8)
 			return nil, err
 		}
 		length = types.Position(len(header) + len(headerSize))
-		buckets, err = NewBuckets(indexSizeBits)
+		allocated = length
+	} else {
 		if err != nil {
 			return nil, err
 		}
-		sizeBuckets, err = NewSizeBuckets(indexSizeBits)
+		scanned, err := scanIndex(path, indexSizeBits, buckets, c.checkpointInterval > 0)
 		if err != nil {
+			_ = buckets.Close()
 			return nil, err
 		}
-	} else {
+		if (c.segmentSize > 0 || scanned.segments != nil) && (c.preallocate > 0 || scanned.header.flagsOffset() == 0) {
+			_ = buckets.Close()
+			return nil, types.ErrSegmentedIndex
+		}
+		keys, occupied = scanned.keys, scanned.occupied
+		torn = scanned.torn
+		manifest = scanned.segments
+		checkpointed = scanned.checkpointed
+		endOffset = scanned.header.endOffset()
+		headerFlags = scanned.header.Flags
+		// Keys that were written before aren't complete, the index doesn't store full keys.
+		if missing := featureFlags(c) &^ headerFlags &^ FlagFullKeys; missing != 0 && scanned.header.flagsOffset() != 0 {
+			// The features that are used from now on need to be announced before they are.
+			headerFlags |= missing
+			if err := writeHeaderFlags(path, scanned.header.flagsOffset(), headerFlags); err != nil {
+				_ = buckets.Close()
+				return nil, err
+			}
+		}
+		length = scanned.size
+		if scanned.torn.Dropped > 0 {
+			// Appends continue behind the last complete record list.
+			if err := truncateSegments(path, manifest, scanned.torn.Offset); err != nil {
+				_ = buckets.Close()
+				return nil, err
+			}
+			length = scanned.torn.Offset
+		}
+		if scanned.end != 0 && c.preallocate == 0 {
+			// Appends go to the end of the file, the preallocated space needs to go.
+			if err := truncateSegments(path, manifest, scanned.end); err != nil {
+				_ = buckets.Close()
+				return nil, err
+			}
+			length = scanned.end
+		}
+		allocated = length
+		if scanned.end != 0 {
+			length = scanned.end
+		}
+		file, err = openFileRandom(path, flags)
 		if err != nil {
 			return nil, err
 		}
-		buckets, sizeBuckets, err = scanIndex(path, indexSizeBits)
-		if err != nil {
+		if c.preallocate > 0 {
+			if _, err := file.Seek(int64(length), io.SeekStart); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+		}
+	}
+	var indexFile indexFile = file
+	var segments *segmentedFile
+	if c.segmentSize > 0 || manifest != nil {
+		if segments, err = openSegments(path, file, manifest, flags); err != nil {
+			_ = buckets.Close()
 			return nil, err
 		}
-		file, err = openFileRandom(path, os.O_RDWR|os.O_APPEND|os.O_EXCL)
-		if err != nil {
+		indexFile = segments
+	}
+	var listCache *listCache
+	if c.listCacheSize > 0 {
+		listCache = newListCache(c.listCacheSize)
+	}
+	idx := &Index{
+		sizeBits: indexSizeBits,
+		buckets:  buckets,
+		file:     indexFile,
+		writer:   bufio.NewWriterSize(indexFile, indexBufferSize),
+		Primary:  primary,
+		curPool:  make(bucketPool, BucketPoolSize),
+		nextPool: make(bucketPool, BucketPoolSize),
+		length:   length,
+		keys:     keys,
+		occupied: occupied,
+
+		curChildren:        make(childPool),
+		nextChildren:       make(childPool),
+		overflowSize:       c.overflowSize,
+		deltaSize:          c.deltaSize,
+		flushedLength:      length,
+		seekTableThreshold: c.seekTableThreshold,
+		minKeyLength:       c.minKeyLength,
+		fullKeys:           c.fullKeys || headerFlags&FlagFullKeys != 0,
+		keyChecksums:       c.keyChecksums,
+		valueSizes:         c.valueSizes,
+		preallocate:        c.preallocate,
+		allocated:          allocated,
+		endOffset:          endOffset,
+		flags:              headerFlags,
+		listChecksums:      c.listChecksums,
+		torn:               torn,
+		segments:           segments,
+		segmentSize:        c.segmentSize,
+		checkpointInterval: c.checkpointInterval,
+		journal:            c.journal,
+		listCache:          listCache,
+		checkpointed:       checkpointed,
+		openedFrom:         checkpointed,
+		flushedKeys:        keys,
+		flushedOccupied:    occupied,
+		countsFlushed:      true,
+	}
+	if c.wal {
+		// The changes are replayed before new ones are logged.
+		if idx.replayed, err = idx.replayLog(path); err != nil {
+			_ = idx.Close()
+			return nil, err
+		}
+		if idx.wal, err = openWriteAheadLog(path); err != nil {
+			_ = idx.Close()
 			return nil, err
 		}
-		length = types.Position(stat.Size())
 	}
-	return &Index{
-		indexSizeBits,
-		buckets,
-		sizeBuckets,
-		file,
-		bufio.NewWriterSize(file, indexBufferSize),
-		primary,
-		sync.RWMutex{},
-		0,
-		make(bucketPool, BucketPoolSize),
-		make(bucketPool, BucketPoolSize),
-		length,
-	}, nil
+	return idx, nil
+}
+
+func newBucketTable(path string, indexSizeBits uint8, c config) (BucketTable, error) {
+	if c.residentBucketPages > 0 {
+		return NewPagedBucketTable(path+".buckets", indexSizeBits, c.residentBucketPages)
+	}
+	return NewMemBucketTable(indexSizeBits)
 }
 
-func scanIndex(path string, indexSizeBits uint8) (Buckets, SizeBuckets, error) {
+// Number of buckets whose key counts scanIndex keeps before it reads them from the index file again.
+const maxScanCounts = 1 << 16
+
+// scanResult describes an index file that was read by scanIndex.
+type scanResult struct {
+	header Header
+	// Number of keys and non-empty buckets
+	keys, occupied uint64
+	// End of the record lists if the file continues with preallocated space, zero otherwise
+	end types.Position
+	// Incomplete record list at the end of the file, if any
+	torn TornTail
+	// End of the index including preallocated space
+	size types.Position
+	// Segments after the first one, nil if the index isn't segmented
+	segments []segment
+	// Position of the checkpoint the scan started at, zero if it read the whole index
+	checkpointed types.Position
+}
+
+// TornTail describes an incomplete record list at the end of the index file, as a crash during a
+// flush leaves behind. It's cut off when the index is opened.
+type TornTail struct {
+	// End of the last complete record list, the file is truncated to it
+	Offset types.Position
+	// Number of bytes behind the offset that were cut off, including preallocated space
+	Dropped int64
+}
+
+// scanIndex reads the whole index and fills the bucket table with the latest record list of every
+// bucket. The segments of a segmented index are read in order, only the last one may end with an
+// incomplete record list. If `fromCheckpoint` is set and there is a checkpoint that matches the
+// index, the bucket table is filled from it and only the record lists behind it are read.
+func scanIndex(path string, indexSizeBits uint8, buckets BucketTable, fromCheckpoint bool) (scanResult, error) {
+	manifest, err := readManifest(path)
+	if err != nil {
+		return scanResult{}, err
+	}
+	var cp *checkpoint
+	if fromCheckpoint {
+		if cp, err = readCheckpoint(path, indexSizeBits); err != nil {
+			return scanResult{}, err
+		}
+	}
 	// this is a single sequential read across the whole index
 	file, err := openFileForScan(path)
+	if err != nil {
+		return scanResult{}, err
+	}
 	defer func() {
 		_ = file.Close()
 	}()
 	header, bytesRead, err := ReadHeader(file)
 	if err != nil {
-		return nil, nil, err
+		return scanResult{}, err
 	}
-	if header.BucketsBits != indexSizeBits {
-		return nil, nil, types.ErrIndexWrongBitSize{header.BucketsBits, indexSizeBits}
+	if err := header.validate(indexSizeBits); err != nil {
+		return scanResult{}, err
 	}
-	buckets, err := NewBuckets(indexSizeBits)
+	result := scanResult{header: header, segments: manifest}
+	// Every record list replaces the previous one of the same bucket, hence the number of keys
+	// of the previous one is needed to keep the total up to date. The counts of recently read
+	// record lists are kept, the others are read from the previous record list of the bucket,
+	// e.g. one of the checkpoint.
+	counts := make(map[BucketIndex]uint32)
+	reader, err := openSegmentsForRead(path, manifest)
 	if err != nil {
-		return nil, nil, err
+		return scanResult{}, err
 	}
-	sizeBuckets, err := NewSizeBuckets(indexSizeBits)
-	if err != nil {
-		return nil, nil, err
+	defer func() {
+		_ = reader.Close()
+	}()
+	if cp != nil && !cp.matches(reader, bytesRead) {
+		cp = nil
 	}
-	buffered := bufio.NewReader(file)
-	iter := NewIndexIter(buffered, types.Position(bytesRead))
-	for {
-		data, pos, err, done := iter.Next()
-		if done == true {
-			break
+	if cp != nil {
+		if err := cp.apply(buckets); err != nil {
+			return scanResult{}, err
 		}
-		if err == io.EOF {
-			// The file is corrupt. Though it's not a problem, just take the data we
-			// are able to use and move on.
-			if _, err := file.Seek(0, 2); err != nil {
-				return nil, nil, err
+		result.keys, result.occupied = cp.keys, cp.occupied
+		result.checkpointed = cp.pos
+	}
+	previousCount := func(bucket BucketIndex) (uint32, error) {
+		if count, ok := counts[bucket]; ok {
+			return count, nil
+		}
+		offset, size, err := buckets.Get(bucket)
+		if err != nil || offset == 0 {
+			return 0, err
+		}
+		data := make([]byte, size)
+		if _, err := reader.ReadAt(data, int64(offset)); err != nil {
+			return 0, err
+		}
+		return recordCount(data), nil
+	}
+	scanSegment := func(file *os.File, base types.Position, start types.Position, last bool) error {
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if cp != nil && cp.pos > start {
+			// The record lists before the checkpoint are part of it.
+			start = cp.pos
+			if _, err := file.Seek(int64(start-base), io.SeekStart); err != nil {
+				return err
 			}
-			break
 		}
+		buffered := bufio.NewReader(file)
+		iter := NewIndexIter(buffered, start)
+		iter.size = base + types.Position(stat.Size())
+		result.size = iter.size
+		// End of the last complete record list
+		good := start
+		for {
+			data, pos, err, done := iter.Next()
+			if done == true {
+				return nil
+			}
+			if err == nil && len(data) == 0 {
+				if !last {
+					return types.ErrIndexCorrupt(good)
+				}
+				// Record lists are never empty, the rest of the file is preallocated space.
+				result.end = pos - types.Position(SizePrefixSize)
+				return nil
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF || isCorrupt(err) && atEnd(buffered) {
+				if !last {
+					// Segments are synced before the next one is started.
+					return types.ErrIndexCorrupt(good)
+				}
+				// The process died while the last record list was written, it's dropped. A record
+				// list that doesn't match its checksum is only torn if nothing follows it.
+				result.torn = TornTail{Offset: good, Dropped: int64(iter.size - good)}
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			good = iter.pos
+			if listMarker(data[BucketPrefixSize:]) == overflowChildMarker {
+				// Child lists are found through the directory of their bucket.
+				continue
+			}
+			bucketPrefix := BucketIndex(binary.LittleEndian.Uint32(data))
+			previous, err := previousCount(bucketPrefix)
+			if err != nil {
+				return err
+			}
+			if err := buckets.Put(bucketPrefix, pos, types.Size(len(data))); err != nil {
+				return err
+			}
+			count := recordCount(data)
+			if previous == 0 && count > 0 {
+				result.occupied++
+			} else if previous > 0 && count == 0 {
+				// All keys of the bucket were removed.
+				result.occupied--
+			}
+			result.keys = result.keys - uint64(previous) + uint64(count)
+			if len(counts) >= maxScanCounts {
+				// The memory used doesn't grow with the number of buckets.
+				counts = make(map[BucketIndex]uint32)
+			}
+			counts[bucketPrefix] = count
+		}
+	}
+	// Segments that end before the checkpoint are skipped.
+	covered := func(n int) bool {
+		return cp != nil && n < len(manifest) && manifest[n].base <= cp.pos
+	}
+	if !covered(0) {
+		if err := scanSegment(file, 0, types.Position(bytesRead), len(manifest) == 0); err != nil {
+			return scanResult{}, err
+		}
+	}
+	for n, seg := range manifest {
+		if covered(n + 1) {
+			continue
+		}
+		file, err := openFileForScan(segmentPath(path, seg.number))
+		if err != nil {
+			return scanResult{}, err
+		}
+		err = scanSegment(file, seg.base, seg.base, n == len(manifest)-1)
+		_ = file.Close()
 		if err != nil {
-			return nil, nil, err
+			return scanResult{}, err
 		}
-		bucketPrefix := BucketIndex(binary.LittleEndian.Uint32(data))
-		buckets.Put(bucketPrefix, pos)
-		sizeBuckets.Put(bucketPrefix, types.Size(len(data)))
 	}
-	return buckets, sizeBuckets, nil
+	return result, nil
+}
+
+func isCorrupt(err error) bool {
+	_, ok := err.(types.ErrIndexCorrupt)
+	return ok
+}
+
+// atEnd returns whether the reader is at the end of the record lists, i.e. at the end of the file
+// or of the data before preallocated space.
+func atEnd(reader io.Reader) bool {
+	size, err := ReadSizePrefix(reader)
+	return err != nil || size == 0
 }
 
 // Put a key together with a file offset into the index.
 //
 // The key needs to be a cryptographically secure hash and at least 4 bytes long.
 func (i *Index) Put(key []byte, location types.Block) error {
+	return i.put(key, location, nil)
+}
+
+// PutWithSize puts a key into the index like Put, together with the size of its value if the index
+// stores value sizes, see ValueSizes.
+func (i *Index) PutWithSize(key []byte, location types.Block, valueSize types.Size) error {
+	return i.put(key, location, &valueSize)
+}
+
+func (i *Index) put(key []byte, location types.Block, valueSize *types.Size) error {
 	// Get record list and bucket index
 	bucket, err := i.getBucketIndex(key)
 	if err != nil {
@@ -208,22 +559,26 @@ func (i *Index) Put(key []byte, location types.Block) error {
 	}
 	i.bucketLk.Lock()
 	defer i.bucketLk.Unlock()
-	records, err := i.getRecordsFromBucket(bucket)
-	if err != nil {
-		return err
-	}
 
 	// The key doesn't need the prefix that was used to find the right bucket. For simplicty
 	// only full bytes are trimmed off.
 	indexKey := StripBucketPrefix(key, i.sizeBits)
+	records, ref, err := i.getRecordsForKey(bucket, indexKey)
+	if err != nil {
+		return err
+	}
+	entry := i.newEntry(key, location, valueSize)
 
 	// No records stored in that bucket yet
 	var newData []byte
-	if records == nil {
+	if records.Empty() {
 		// As it's the first key a single byte is enough as it doesn't need to be distinguised
 		// from other keys.
-		trimmedIndexKey := indexKey[:1]
-		newData = EncodeKeyPosition(KeyPositionPair{trimmedIndexKey, location})
+		trimmedIndexKey := i.trimKey(indexKey, 0)
+		newData = EncodeKeyPosition(entry.withKey(trimmedIndexKey))
+		if i.othersEmpty(ref) {
+			i.occupied++
+		}
 	} else {
 		// Read the record list from disk and insert the new key
 		pos, prevRecord, has := records.FindKeyPosition(indexKey)
@@ -246,21 +601,21 @@ func (i *Index) Put(key []byte, location types.Block) error {
 				return nil
 			}
 
-			trimmedPrevKey := prevKey[:keyTrimPos+1]
-			trimmedIndexKey := indexKey[:keyTrimPos+1]
+			trimmedPrevKey := i.trimKey(prevKey, keyTrimPos)
+			trimmedIndexKey := i.trimKey(indexKey, keyTrimPos)
 			var keys []KeyPositionPair
 
 			// Replace the existing previous key (which is too short) with a new one and
 			// also insert the new key.
 			if bytes.Compare(trimmedPrevKey, trimmedIndexKey) == -1 {
 				keys = []KeyPositionPair{
-					{trimmedPrevKey, prevRecord.Block},
-					{trimmedIndexKey, location},
+					prevRecord.withKey(trimmedPrevKey),
+					entry.withKey(trimmedIndexKey),
 				}
 			} else {
 				keys = []KeyPositionPair{
-					{trimmedIndexKey, location},
-					{trimmedPrevKey, prevRecord.Block},
+					entry.withKey(trimmedIndexKey),
+					prevRecord.withKey(trimmedPrevKey),
 				}
 			}
 			newData = records.PutKeys(keys, prevRecord.Pos, pos)
@@ -297,17 +652,52 @@ func (i *Index) Put(key []byte, location types.Block) error {
 			// We cannot trim beyond the key length
 			keyTrimPos := min(minPrefix, len(indexKey)-1)
 
-			trimmedIndexKey := indexKey[:keyTrimPos+1]
-			newData = records.PutKeys([]KeyPositionPair{{trimmedIndexKey, location}}, pos, pos)
+			trimmedIndexKey := i.trimKey(indexKey, keyTrimPos)
+			newData = records.PutKeys([]KeyPositionPair{entry.withKey(trimmedIndexKey)}, pos, pos)
 		}
 	}
-	i.outstandingWork += types.Work(len(newData) + BucketPrefixSize + SizePrefixSize)
-	i.nextPool[bucket] = newData
+	i.logChange(walSet, key, location, valueSize)
+	i.keys++
+	i.setRecords(ref, newData)
 	return nil
 }
 
+// trimKey returns the prefix of an index key that is stored, it ends at the given position, but
+// is at least as long as the configured minimum key length (or the whole key if it is shorter).
+// It's never longer than `MaxKeyLength`.
+func (i *Index) trimKey(indexKey []byte, trimPos int) []byte {
+	if i.fullKeys {
+		return indexKey[:min(len(indexKey), MaxKeyLength)]
+	}
+	return indexKey[:min(min(max(trimPos+1, i.minKeyLength), len(indexKey)), MaxKeyLength)]
+}
+
+// newEntry returns the record of a key without the key itself, with a checksum and the value size
+// if the index stores them.
+func (i *Index) newEntry(key []byte, location types.Block, valueSize *types.Size) KeyPositionPair {
+	entry := KeyPositionPair{Block: location}
+	if i.keyChecksums {
+		entry.Checksum = KeyChecksum(key)
+	}
+	if i.valueSizes && valueSize != nil {
+		entry.ValueSize = *valueSize
+		entry.HasValueSize = true
+	}
+	return entry
+}
+
 // Update a key together with a file offset into the index.
 func (i *Index) Update(key []byte, location types.Block) error {
+	return i.update(key, location, nil)
+}
+
+// UpdateWithSize updates a key like Update, together with the size of its new value if the index
+// stores value sizes, see ValueSizes.
+func (i *Index) UpdateWithSize(key []byte, location types.Block, valueSize types.Size) error {
+	return i.update(key, location, &valueSize)
+}
+
+func (i *Index) update(key []byte, location types.Block, valueSize *types.Size) error {
 	// Get record list and bucket index
 	bucket, err := i.getBucketIndex(key)
 	if err != nil {
@@ -315,14 +705,14 @@ func (i *Index) Update(key []byte, location types.Block) error {
 	}
 	i.bucketLk.Lock()
 	defer i.bucketLk.Unlock()
-	records, err := i.getRecordsFromBucket(bucket)
-	if err != nil {
-		return err
-	}
 
 	// The key doesn't need the prefix that was used to find the right bucket. For simplicty
 	// only full bytes are trimmed off.
 	indexKey := StripBucketPrefix(key, i.sizeBits)
+	records, ref, err := i.getRecordsForKey(bucket, indexKey)
+	if err != nil {
+		return err
+	}
 
 	var newData []byte
 	// If no records stored in that bucket yet it means there is no key
@@ -337,14 +727,138 @@ func (i *Index) Update(key []byte, location types.Block) error {
 		}
 		// We want to overwrite the key so no need to do anything else.
 		// Update key in position.
-		newData = records.PutKeys([]KeyPositionPair{{r.Key, location}}, r.Pos, r.NextPos())
+		newData = records.PutKeys([]KeyPositionPair{i.newEntry(key, location, valueSize).withKey(r.Key)}, r.Pos, r.NextPos())
 	}
 
-	i.outstandingWork += types.Work(len(newData) + BucketPrefixSize + SizePrefixSize)
-	i.nextPool[bucket] = newData
+	i.logChange(walSet, key, location, valueSize)
+	i.setRecords(ref, newData)
 	return nil
 }
 
+// Remove removes a key from the index. It returns false if there is no record that matches the
+// key.
+//
+// As the index only stores prefixes, the matching record may belong to a different key, callers
+// need to make sure it's the key's own record, see `Get`. The prefixes of the neighbouring records
+// are shortened if they only needed to be that long to tell them apart from the removed key.
+func (i *Index) Remove(key []byte) (bool, error) {
+	// Get record list and bucket index
+	bucket, err := i.getBucketIndex(key)
+	if err != nil {
+		return false, err
+	}
+	i.bucketLk.Lock()
+	defer i.bucketLk.Unlock()
+	indexKey := StripBucketPrefix(key, i.sizeBits)
+	records, ref, err := i.getRecordsForKey(bucket, indexKey)
+	if err != nil {
+		return false, err
+	}
+
+	r := records.GetRecord(indexKey)
+	if r == nil {
+		return false, nil
+	}
+	// An empty record list is written as well, it replaces the previous one of the bucket.
+	newData := i.removeRecord(records, r.Pos)
+	i.logChange(walRemove, key, types.Block{}, nil)
+	i.keys--
+	if len(newData) == 0 && i.othersEmpty(ref) {
+		i.occupied--
+	}
+
+	i.setRecords(ref, newData)
+	return true, nil
+}
+
+// RemoveRecord removes the record of a bucket that stores exactly the given key prefix and block,
+// e.g. one that a check found to be broken. It returns false if there is no such record.
+//
+// Unlike Remove it doesn't need the full key. Hence the removal isn't recorded in the write-ahead
+// log, a crash before the next flush brings the record back.
+func (i *Index) RemoveRecord(bucket BucketIndex, key []byte, location types.Block) (bool, error) {
+	i.bucketLk.Lock()
+	defer i.bucketLk.Unlock()
+	records, ref, err := i.getRecordsForKey(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	iter := records.Iter()
+	for !iter.Done() {
+		r := iter.Next()
+		if !bytes.Equal(r.Key, key) || r.Block != location {
+			continue
+		}
+		newData := i.removeRecord(records, r.Pos)
+		i.keys--
+		if len(newData) == 0 && i.othersEmpty(ref) {
+			i.occupied--
+		}
+		i.setRecords(ref, newData)
+		return true, nil
+	}
+	return false, nil
+}
+
+// removeRecord returns the record list without the record at the given position, see
+// compactRecords.
+func (i *Index) removeRecord(records RecordList, pos int) []byte {
+	var pairs []KeyPositionPair
+	var removed []bool
+	iter := records.Iter()
+	for !iter.Done() {
+		record := iter.Next()
+		pairs = append(pairs, record.KeyPositionPair)
+		removed = append(removed, record.Pos == pos)
+	}
+	return i.compactRecords(pairs, removed)
+}
+
+// compactRecords returns the record list of the given records except the removed ones. A key may
+// have been stored longer than needed to distinguish it from a removed neighbour, hence the keys
+// of the records next to a removed one are trimmed to the shortest prefix that distinguishes them
+// from their new neighbours.
+func (i *Index) compactRecords(records []KeyPositionPair, removed []bool) []byte {
+	kept := make([]KeyPositionPair, 0, len(records))
+	// Whether the kept record at the same position was next to a removed one
+	var trim []bool
+	afterRemoved := false
+	for n, record := range records {
+		if removed[n] {
+			if len(trim) > 0 {
+				trim[len(trim)-1] = true
+			}
+			afterRemoved = true
+			continue
+		}
+		kept = append(kept, record)
+		trim = append(trim, afterRemoved)
+		afterRemoved = false
+	}
+	var data []byte
+	for n, record := range kept {
+		if trim[n] {
+			// The neighbours may be trimmed as well, but not shorter than what distinguishes
+			// them from this key.
+			trimPos := 0
+			if n > 0 {
+				trimPos = FirstNonCommonByte(record.Key, kept[n-1].Key)
+			}
+			if n+1 < len(kept) {
+				trimPos = max(trimPos, FirstNonCommonByte(record.Key, kept[n+1].Key))
+			}
+			record = record.withKey(i.trimKey(record.Key, trimPos))
+		}
+		data = AddKeyPosition(data, record)
+	}
+	return data
+}
+
+// Bucket returns the bucket the given index key belongs to.
+func (i *Index) Bucket(key []byte) (BucketIndex, error) {
+	return i.getBucketIndex(key)
+}
+
 func (i *Index) getBucketIndex(key []byte) (BucketIndex, error) {
 	if len(key) < 4 {
 		return 0, types.ErrKeyTooShort
@@ -357,31 +871,50 @@ func (i *Index) getBucketIndex(key []byte) (BucketIndex, error) {
 	return prefix & leadingBits, nil
 }
 
-// getRecordsFromBucket returns the recordList and bucket the key belongs to.
-func (i *Index) getRecordsFromBucket(bucket BucketIndex) (RecordList, error) {
-	// Get the index file offset of the record list the key is in.
-	cached, indexOffset, recordListSize, err := i.readBucketInfo(bucket)
-	if err != nil {
-		return nil, err
-	}
-	var records RecordList
-	if cached != nil {
-		records = NewRecordListRaw(cached)
-	} else {
-		records, err = i.readDiskBuckets(bucket, indexOffset, recordListSize)
+func (i *Index) flushBucket(bucket BucketIndex, newData []byte) (types.Block, types.Work, error) {
+	// Write new data to disk. The record list is prefixed with bucket they are in. This is
+	// needed in order to reconstruct the in-memory buckets from the index itself.
+	// TODO vmx 2020-11-25: This should be an error and not a panic
+	if i.deltaSize > 0 && len(newData) > i.deltaSize {
+		delta, ok, err := i.encodeDelta(bucket, newData)
 		if err != nil {
-			return nil, err
+			return types.Block{}, 0, err
+		}
+		if ok {
+			return i.writeList(bucket, delta)
 		}
 	}
-	return records, nil
+	if i.seekTableThreshold > 0 && len(newData) > i.seekTableThreshold {
+		newData = encodeSeekTable(newData)
+	}
+	return i.writeList(bucket, newData)
 }
 
-func (i *Index) flushBucket(bucket BucketIndex, newData []byte) (types.Block, types.Work, error) {
-	// Write new data to disk. The record list is prefixed with bucket they are in. This is
-	// needed in order to reconstruct the in-memory buckets from the index itself.
-	// TODO vmx 2020-11-25: This should be an error and not a panic
+// writeList appends the data of a record list to the index file as it is, see flushBucket.
+func (i *Index) writeList(bucket BucketIndex, newData []byte) (types.Block, types.Work, error) {
+	if len(newData)+BucketPrefixSize > MaxRecordListSize {
+		return types.Block{}, 0, types.ErrRecordListTooLarge
+	}
+	toWrite := types.Position(len(newData) + BucketPrefixSize + SizePrefixSize)
+	sizePrefix := uint32(len(newData)) + uint32(BucketPrefixSize)
+	if i.listChecksums {
+		toWrite += types.Position(ListChecksumSize)
+		sizePrefix |= listChecksumFlag
+	}
+	if i.segmentSize > 0 {
+		// Record lists don't span segments.
+		if err := i.rotateSegment(toWrite); err != nil {
+			return types.Block{}, 0, err
+		}
+	}
+	if i.preallocate > 0 {
+		// The space needs to be there before the writer hands any of the data to the OS.
+		if err := i.grow(i.length + toWrite); err != nil {
+			return types.Block{}, 0, err
+		}
+	}
 	newDataSize := make([]byte, SizePrefixSize)
-	binary.LittleEndian.PutUint32(newDataSize, uint32(len(newData))+uint32(BucketPrefixSize))
+	binary.LittleEndian.PutUint32(newDataSize, sizePrefix)
 	if _, err := i.writer.Write(newDataSize); err != nil {
 		return types.Block{}, 0, err
 	}
@@ -394,9 +927,16 @@ func (i *Index) flushBucket(bucket BucketIndex, newData []byte) (types.Block, ty
 	if _, err := i.writer.Write(newData); err != nil {
 		return types.Block{}, 0, err
 	}
+	if i.listChecksums {
+		checksum := make([]byte, ListChecksumSize)
+		binary.LittleEndian.PutUint32(checksum, listChecksum(bucketPrefixBuffer, newData))
+		if _, err := i.writer.Write(checksum); err != nil {
+			return types.Block{}, 0, err
+		}
+	}
 	length := i.length
-	toWrite := types.Position(len(newData) + BucketPrefixSize + SizePrefixSize)
-	i.length += toWrite
+	// The length is read concurrently by Size()
+	atomic.AddUint64((*uint64)(&i.length), uint64(toWrite))
 	// Fsyncs are expensive
 	//self.file.syncData()?;
 
@@ -406,81 +946,175 @@ func (i *Index) flushBucket(bucket BucketIndex, newData []byte) (types.Block, ty
 		types.Work(toWrite), nil
 }
 
+// grow preallocates the file in extents until it's larger than `end`. The space is filled with
+// zeros, which also reserves it on filesystems that don't allocate blocks of sparse files, and
+// stays larger than a size prefix, so that the scan on open finds the end of the data.
+func (i *Index) grow(end types.Position) error {
+	if end+types.Position(SizePrefixSize) <= i.allocated {
+		return nil
+	}
+	extent := types.Position(i.preallocate)
+	allocated := (end + types.Position(SizePrefixSize) + extent - 1) / extent * extent
+	if _, err := i.file.WriteAt(make([]byte, allocated-i.allocated), int64(i.allocated)); err != nil {
+		return err
+	}
+	i.allocated = allocated
+	return nil
+}
+
+// writeHeaderEnd updates the end field of the header, if there is one, to the end of the flushed
+// data.
+func (i *Index) writeHeaderEnd() error {
+	if i.endOffset == 0 || i.preallocate == 0 {
+		return nil
+	}
+	end := make([]byte, types.OffBytesLen)
+	binary.LittleEndian.PutUint64(end, uint64(i.flushedLength))
+	_, err := i.file.WriteAt(end, i.endOffset)
+	return err
+}
+
 type bucketBlock struct {
 	bucket BucketIndex
 	blk    types.Block
 }
 
-func (i *Index) commit() (types.Work, error) {
+// Number of record lists that are written between checks whether a commit was cancelled.
+const commitCheckInterval = 1024
+
+func (i *Index) commit(ctx context.Context) (types.Work, error) {
 	i.bucketLk.Lock()
 	nextPool := i.curPool
 	i.curPool = i.nextPool
 	i.nextPool = nextPool
+	nextChildren := i.curChildren
+	i.curChildren = i.nextChildren
+	i.nextChildren = nextChildren
 	i.outstandingWork = 0
+	// The logged changes up to here are written by this commit.
+	var logged int64
+	if i.wal != nil {
+		logged = i.wal.logged
+	}
+	// The counts include the changes that are written by this commit, and no others.
+	keys, occupied := i.keys, i.occupied
 	i.bucketLk.Unlock()
-	if len(i.curPool) == 0 {
+	if len(i.curPool) == 0 && len(i.curChildren) == 0 {
+		i.commitLog(logged)
 		return 0, nil
 	}
+	i.countsFlushed = false
 	blks := make([]bucketBlock, 0, len(i.curPool))
 	var work types.Work
+	var cancelled error
 	for bucket, data := range i.curPool {
-		blk, newWork, err := i.flushBucket(bucket, data)
+		if len(blks)%commitCheckInterval == 0 {
+			if cancelled = ctx.Err(); cancelled != nil {
+				break
+			}
+		}
+		blk, newWork, err := i.flushRecords(bucket, data)
 		if err != nil {
 			return 0, err
 		}
 		blks = append(blks, bucketBlock{bucket, blk})
 		work += newWork
 	}
+	if cancelled == nil {
+		for bucket, changed := range i.groupChildren() {
+			if len(blks)%commitCheckInterval == 0 {
+				if cancelled = ctx.Err(); cancelled != nil {
+					break
+				}
+			}
+			blk, newWork, err := i.flushOverflow(bucket, changed)
+			if err != nil {
+				return 0, err
+			}
+			blks = append(blks, bucketBlock{bucket, blk})
+			work += newWork
+		}
+	}
+	// Hand the data over to the OS, so that it can be read from the file.
+	if err := i.writer.Flush(); err != nil {
+		return 0, err
+	}
+	i.flushedLength = i.length
+	if err := i.recordJournal(blks, i.curPool); err != nil {
+		return 0, err
+	}
 	i.bucketLk.Lock()
 	defer i.bucketLk.Unlock()
 	for _, blk := range blks {
-		bucket := blk.bucket
-		pos := blk.blk.Offset
-		size := blk.blk.Size
-		if err := i.buckets.Put(bucket, pos); err != nil {
-			return 0, err
+		if i.listCache != nil {
+			// The replaced record list isn't read anymore.
+			if offset, _, err := i.buckets.Get(blk.bucket); err == nil {
+				i.listCache.remove(offset)
+			}
 		}
-		if err := i.sizeBuckets.Put(bucket, size); err != nil {
+		if err := i.buckets.Put(blk.bucket, blk.blk.Offset, blk.blk.Size); err != nil {
 			return 0, err
 		}
 	}
+	if cancelled != nil {
+		// The record lists that weren't written are outstanding again, unless they were
+		// replaced in the meantime.
+		for _, blk := range blks {
+			delete(i.curPool, blk.bucket)
+		}
+		for bucket, data := range i.curPool {
+			if _, ok := i.nextPool[bucket]; !ok {
+				i.nextPool[bucket] = data
+				i.outstandingWork += types.Work(len(data) + BucketPrefixSize + SizePrefixSize)
+			}
+		}
+		written := make(map[BucketIndex]bool, len(blks))
+		for _, blk := range blks {
+			written[blk.bucket] = true
+		}
+		for ref, data := range i.curChildren {
+			if _, ok := i.nextChildren[ref]; ok || written[ref.bucket] {
+				continue
+			}
+			if _, ok := i.nextPool[ref.bucket]; !ok {
+				i.nextChildren[ref] = data
+				i.outstandingWork += types.Work(len(data) + BucketPrefixSize + SizePrefixSize)
+			}
+		}
+		i.curPool = make(bucketPool, BucketPoolSize)
+		i.curChildren = make(childPool)
+		return work, cancelled
+	}
+	// The buckets point to the data on disk now, the cached copy isn't needed anymore.
+	i.curPool = make(bucketPool, BucketPoolSize)
+	i.curChildren = make(childPool)
+	i.commitLog(logged)
+	i.flushedKeys, i.flushedOccupied, i.countsFlushed = keys, occupied, true
 
 	return work, nil
 }
 
-func (i *Index) readBucketInfo(bucket BucketIndex) ([]byte, types.Position, types.Size, error) {
-
-	data, ok := i.nextPool[bucket]
-	if ok {
-		return data, 0, 0, nil
-	}
-	data, ok = i.curPool[bucket]
-	if ok {
-		return data, 0, 0, nil
-	}
-	indexOffset, err := i.buckets.Get(bucket)
-	if err != nil {
-		return nil, 0, 0, err
-	}
-	recordListSize, err := i.sizeBuckets.Get(bucket)
-	if err != nil {
-		return nil, 0, 0, err
-	}
-	return nil, indexOffset, recordListSize, nil
-}
-
-func (i *Index) readDiskBuckets(bucket BucketIndex, indexOffset types.Position, recordListSize types.Size) (RecordList, error) {
+// readDiskBuckets reads the record list at the given location and returns the records of the
+// key, the ones of its child list if the bucket overflows. A nil key returns all records then.
+func (i *Index) readDiskBuckets(indexKey []byte, indexOffset types.Position, recordListSize types.Size) (RecordList, SeekTable, error) {
 	if indexOffset == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 	// Read the record list from disk and get the file offset of that key in the primary
 	// storage.
-	data := make([]byte, recordListSize)
-	_, err := i.file.ReadAt(data, int64(indexOffset))
+	data, err := i.readList(indexOffset, recordListSize)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return NewRecordList(data), nil
+	if dir := overflowDir(data); dir != nil {
+		if indexKey == nil {
+			records, err := i.readOverflow(BucketIndex(binary.LittleEndian.Uint32(data)), dir, false)
+			return records, nil, err
+		}
+		return i.readChild(dir, childOf(indexKey))
+	}
+	records, table := NewSeekRecordList(data)
+	return records, table, nil
 }
 
 // Get the file offset in the primary storage of a key.
@@ -491,38 +1125,140 @@ func (i *Index) Get(key []byte) (types.Block, bool, error) {
 		return types.Block{}, false, err
 	}
 
-	// Here we just nead an RLock, there won't be changes over buckets.
-	// This is why we don't use getRecordsFromBuckets to wrap only this
-	// line of code in the lock
-	i.bucketLk.RLock()
-	cached, indexOffset, recordListSize, err := i.readBucketInfo(bucket)
-	i.bucketLk.RUnlock()
+	// The key doesn't need the prefix that was used to find the right bucket. For simplicty
+	// only full bytes are trimmed off.
+	indexKey := StripBucketPrefix(key, i.sizeBits)
+
+	records, table, err := i.readSeekRecords(bucket, indexKey)
 	if err != nil {
 		return types.Block{}, false, err
 	}
-	var records RecordList
-	if cached != nil {
-		records = NewRecordListRaw(cached)
-	} else {
-		records, err = i.readDiskBuckets(bucket, indexOffset, recordListSize)
-		if err != nil {
-			return types.Block{}, false, err
-		}
-	}
 	if records == nil {
 		return types.Block{}, false, nil
 	}
 
-	// The key doesn't need the prefix that was used to find the right bucket. For simplicty
-	// only full bytes are trimmed off.
+	fileOffset, found := records.getFrom(table.Seek(records, indexKey), indexKey)
+	return fileOffset, found, nil
+}
+
+// GetChecked returns the file offset in the primary storage of a key like Get. If the index can
+// tell whether the matching record belongs to the key, `checked` is true and `found` tells whether
+// the key is stored without reading the primary storage, see CheckRecord.
+func (i *Index) GetChecked(key []byte) (blk types.Block, found bool, checked bool, err error) {
+	record, found, err := i.GetRecord(key)
+	if err != nil || !found {
+		return record.Block, found, false, err
+	}
+	found, checked = i.CheckRecord(record, key)
+	if !checked {
+		return record.Block, true, false, nil
+	}
+	return record.Block, found, true, nil
+}
+
+// CheckRecord returns whether a record that matches a key belongs to the key, if the index can
+// tell without reading the primary storage. That's the case if the index stores full keys, see
+// FullKeys, or if the record stores a checksum of the full key, see KeyChecksums. A key that isn't
+// stored is only reported as found by a checksum if it collides with the one of the stored key
+// (with a probability of 2^-32). `checked` is false if the primary storage needs to be read.
+func (i *Index) CheckRecord(record Record, key []byte) (found bool, checked bool) {
+	// Keys longer than a record can store are cut like trimmed ones.
+	if indexKey := StripBucketPrefix(key, i.sizeBits); i.flags&FlagFullKeys != 0 && len(indexKey) <= MaxKeyLength {
+		return bytes.Equal(record.Key, indexKey), true
+	}
+	if record.Checksum != 0 {
+		return record.Checksum == KeyChecksum(key), true
+	}
+	return false, false
+}
+
+// GetRecord returns the record that matches a key. Like with Get, the record may belong to a
+// different key with the same prefix.
+func (i *Index) GetRecord(key []byte) (Record, bool, error) {
+	bucket, err := i.getBucketIndex(key)
+	if err != nil {
+		return Record{}, false, err
+	}
 	indexKey := StripBucketPrefix(key, i.sizeBits)
+	records, table, err := i.readSeekRecords(bucket, indexKey)
+	if err != nil || records == nil {
+		return Record{}, false, err
+	}
+	record, found := records.getRecordFrom(table.Seek(records, indexKey), indexKey)
+	return record, found, nil
+}
 
-	fileOffset, found := records.Get(indexKey)
+// GetFlushed returns the file offset in the primary storage of a key, like Get, but only considers
+// record lists that were flushed to the index file. Keys that were put since the last flush are
+// either not found or found with their previous offset.
+func (i *Index) GetFlushed(key []byte) (types.Block, bool, error) {
+	bucket, err := i.getBucketIndex(key)
+	if err != nil {
+		return types.Block{}, false, err
+	}
+	i.bucketLk.RLock()
+	indexOffset, recordListSize, err := i.buckets.Get(bucket)
+	i.bucketLk.RUnlock()
+	if err != nil {
+		return types.Block{}, false, err
+	}
+	indexKey := StripBucketPrefix(key, i.sizeBits)
+	records, table, err := i.readDiskBuckets(indexKey, indexOffset, recordListSize)
+	if err != nil || records == nil {
+		return types.Block{}, false, err
+	}
+	fileOffset, found := records.getFrom(table.Seek(records, indexKey), indexKey)
 	return fileOffset, found, nil
 }
 
+// readRecords returns all records of a bucket for reading.
+func (i *Index) readRecords(bucket BucketIndex) (RecordList, error) {
+	i.bucketLk.RLock()
+	defer i.bucketLk.RUnlock()
+	return i.fullRecords(bucket)
+}
+
+// readSeekRecords returns the record list of a bucket for reading the given key, together with its
+// seek table if it has one. If the bucket overflows it's the child list of the key.
+func (i *Index) readSeekRecords(bucket BucketIndex, indexKey []byte) (RecordList, SeekTable, error) {
+	// Here we just nead an RLock, there won't be changes over buckets.
+	// This is why we don't use getRecordsForKey to wrap only this
+	// line of code in the lock
+	i.bucketLk.RLock()
+	cached, ok := i.pendingRecords(bucket, indexKey)
+	var indexOffset types.Position
+	var recordListSize types.Size
+	var err error
+	if !ok {
+		indexOffset, recordListSize, err = i.buckets.Get(bucket)
+	}
+	i.bucketLk.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		return NewRecordListRaw(cached), nil, nil
+	}
+	return i.readDiskBuckets(indexKey, indexOffset, recordListSize)
+}
+
+// TornTail returns the incomplete record list that was cut off the end of the index file when it
+// was opened, if there was one.
+func (i *Index) TornTail() (TornTail, bool) {
+	return i.torn, i.torn.Dropped > 0
+}
+
+// Flush writes all buffered record lists to the index file. The data isn't synced to disk until
+// Sync is called.
 func (i *Index) Flush() (types.Work, error) {
-	return i.commit()
+	return i.commit(context.Background())
+}
+
+// FlushContext is like Flush, but stops writing record lists once the context is done. The record
+// lists that were written are kept, the others remain outstanding and the context's error is
+// returned.
+func (i *Index) FlushContext(ctx context.Context) (types.Work, error) {
+	return i.commit(ctx)
 }
 
 func (i *Index) Sync() error {
@@ -532,16 +1268,85 @@ func (i *Index) Sync() error {
 	if err := i.file.Sync(); err != nil {
 		return err
 	}
+	// The end is synced with the next sync, the scan on open doesn't depend on it.
+	if err := i.writeHeaderEnd(); err != nil {
+		return err
+	}
+	if i.wal != nil {
+		if err := i.wal.truncate(); err != nil {
+			return err
+		}
+	}
 	i.bucketLk.Lock()
 	i.curPool = make(bucketPool, BucketPoolSize)
 	i.bucketLk.Unlock()
-	return nil
+	return i.checkpoint(false)
 }
 
+// Close closes the index. A preallocated file is trimmed to the end of the flushed data.
 func (i *Index) Close() error {
+	if i.wal != nil {
+		if err := i.closeLog(); err != nil {
+			_ = i.buckets.Close()
+			_ = i.file.Close()
+			return err
+		}
+	}
+	if i.checkpointInterval > 0 {
+		// The checkpoint must not cover data that isn't on disk.
+		err := i.file.Sync()
+		if err == nil {
+			err = i.checkpoint(true)
+		}
+		if err != nil {
+			_ = i.buckets.Close()
+			_ = i.file.Close()
+			return err
+		}
+	}
+	if err := i.buckets.Close(); err != nil {
+		return err
+	}
+	if i.preallocate > 0 {
+		if err := i.file.Truncate(int64(i.flushedLength)); err != nil {
+			_ = i.file.Close()
+			return err
+		}
+		if err := i.writeHeaderEnd(); err != nil {
+			_ = i.file.Close()
+			return err
+		}
+	}
 	return i.file.Close()
 }
 
+// FlushedSize returns the size of the index file up to the end of the last successful flush. Data
+// beyond it is incomplete if a flush failed. It must not be called concurrently with Flush.
+func (i *Index) FlushedSize() types.Position {
+	return i.flushedLength
+}
+
+// Count returns the number of keys in the index, including the ones that aren't flushed yet.
+func (i *Index) Count() uint64 {
+	i.bucketLk.RLock()
+	defer i.bucketLk.RUnlock()
+	return i.keys
+}
+
+// OccupiedBuckets returns the number of buckets that contain at least one key, together with the
+// total number of buckets.
+func (i *Index) OccupiedBuckets() (uint64, uint64) {
+	i.bucketLk.RLock()
+	defer i.bucketLk.RUnlock()
+	return i.occupied, 1 << i.sizeBits
+}
+
+// Size returns the size of the index file in bytes, including data that is buffered but not
+// synced yet.
+func (i *Index) Size() types.Position {
+	return types.Position(atomic.LoadUint64((*uint64)(&i.length)))
+}
+
 func (i *Index) OutstandingWork() types.Work {
 	i.bucketLk.RLock()
 	defer i.bucketLk.RUnlock()
@@ -557,23 +1362,42 @@ type IndexIter struct {
 	index io.Reader
 	// The current position within the index
 	pos types.Position
+	// Size of the index if known, record lists that claim to extend beyond are incomplete
+	size types.Position
 }
 
 func NewIndexIter(index io.Reader, pos types.Position) *IndexIter {
-	return &IndexIter{index, pos}
+	return &IndexIter{index: index, pos: pos}
 }
 
+// Next returns the next record list without the checksum that may follow it. If the checksum
+// doesn't match, `types.ErrIndexCorrupt` is returned.
 func (iter *IndexIter) Next() ([]byte, types.Position, error, bool) {
 	size, err := ReadSizePrefix(iter.index)
 	switch err {
 	case nil:
+		checked := size&listChecksumFlag != 0
+		size &^= listChecksumFlag
 		pos := iter.pos + types.Position(SizePrefixSize)
+		if iter.size != 0 && pos+types.Position(size) > iter.size {
+			return nil, 0, io.ErrUnexpectedEOF, false
+		}
 		iter.pos += types.Position(SizePrefixSize) + types.Position(size)
 		data := make([]byte, size)
 		_, err := io.ReadFull(iter.index, data)
 		if err != nil {
 			return nil, 0, err, false
 		}
+		if checked {
+			iter.pos += types.Position(ListChecksumSize)
+			checksum := make([]byte, ListChecksumSize)
+			if _, err := io.ReadFull(iter.index, checksum); err != nil {
+				return nil, 0, err, false
+			}
+			if !checkList(data, checksum) {
+				return nil, 0, types.ErrIndexCorrupt(pos), false
+			}
+		}
 		return data, pos, nil, false
 	case io.EOF:
 		return nil, 0, nil, true
@@ -582,7 +1406,20 @@ func (iter *IndexIter) Next() ([]byte, types.Position, error, bool) {
 	}
 }
 
-// Only reads the size prefix of the data and returns it.
+// listChecksum returns the checksum of a record list that is written with the given bucket prefix.
+func listChecksum(bucketPrefix []byte, data []byte) uint32 {
+	checksum := crc32.Update(0, castagnoliTable, bucketPrefix)
+	return crc32.Update(checksum, castagnoliTable, data)
+}
+
+// checkList returns whether the checksum matches the record list data, which starts with the
+// bucket prefix.
+func checkList(data []byte, checksum []byte) bool {
+	return listChecksum(data[:BucketPrefixSize], data[BucketPrefixSize:]) == binary.LittleEndian.Uint32(checksum)
+}
+
+// Only reads the size prefix of the data and returns it. It may have the flag set that marks
+// record lists with a checksum.
 func ReadSizePrefix(reader io.Reader) (uint32, error) {
 	sizeBuffer := make([]byte, SizePrefixSize)
 	_, err := io.ReadFull(reader, sizeBuffer)
@@ -592,25 +1429,6 @@ func ReadSizePrefix(reader io.Reader) (uint32, error) {
 	return binary.LittleEndian.Uint32(sizeBuffer), nil
 }
 
-// Returns the headet together with the bytes read.
-//
-// The bytes read include all the bytes that were read by this function. Hence it also includes
-// the 4-byte size prefix of the header besides the size of the header data itself.
-func ReadHeader(file *os.File) (Header, types.Position, error) {
-	headerSizeBuffer := make([]byte, SizePrefixSize)
-	_, err := io.ReadFull(file, headerSizeBuffer)
-	if err != nil {
-		return Header{}, 0, err
-	}
-	headerSize := binary.LittleEndian.Uint32(headerSizeBuffer)
-	headerBytes := make([]byte, headerSize)
-	_, err = io.ReadFull(file, headerBytes)
-	if err != nil {
-		return Header{}, 0, err
-	}
-	return FromBytes(headerBytes), types.Position(SizePrefixSize) + types.Position(headerSize), nil
-}
-
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -1,8 +1,11 @@
 package index_test
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"testing"
@@ -32,7 +35,7 @@ func assertHeader(t *testing.T, indexPath string, bucketsBits uint8) {
 	indexData, err := ioutil.ReadFile(indexPath)
 	require.NoError(t, err)
 	headerSize := binary.LittleEndian.Uint32(indexData)
-	require.Equal(t, headerSize, uint32(2))
+	require.Equal(t, headerSize, uint32(8))
 	headerData := indexData[len(indexData)-int(headerSize):]
 	header := index.FromBytes(headerData)
 	require.Equal(t, header.Version, index.IndexVersion)
@@ -423,3 +426,815 @@ func TestIndexHeader(t *testing.T) {
 		assertHeader(t, indexPath, bucketBits)
 	}
 }
+
+func TestIndexPagedBuckets(t *testing.T) {
+	const bucketBits uint8 = 16
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+
+	var entries [][2][]byte
+	for n := 0; n < 200; n++ {
+		key := []byte{byte(n), byte(n >> 3), byte(n * 7), 4, 5, 6, 7, 8}
+		entries = append(entries, [2][]byte{key, {byte(n)}})
+	}
+	primaryStorage := inmemory.NewInmemory(entries)
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits, index.PagedBuckets(2))
+	require.NoError(t, err)
+	for n, entry := range entries {
+		err = i.Put(entry[0], types.Block{Offset: types.Position(n), Size: 1})
+		require.NoError(t, err)
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Sync())
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, bucketBits, index.PagedBuckets(2))
+	require.NoError(t, err)
+	defer i.Close()
+	for n, entry := range entries {
+		blk, found, err := i.Get(entry[0])
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Block{Offset: types.Position(n), Size: 1}, blk)
+	}
+}
+
+func TestBucketUsage(t *testing.T) {
+	const bucketBits uint8 = 4
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+
+	// Two keys in bucket 1, one in bucket 2, the second one isn't flushed
+	keys := [][]byte{{1, 1, 2, 3}, {1, 2, 2, 3}, {2, 1, 2, 3}}
+	var entries [][2][]byte
+	for _, key := range keys {
+		entries = append(entries, [2][]byte{key, {1}})
+	}
+	primaryStorage := inmemory.NewInmemory(entries)
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	defer i.Close()
+	require.NoError(t, i.Put(keys[0], types.Block{Offset: 0, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Put(keys[1], types.Block{Offset: 1, Size: 1}))
+	require.NoError(t, i.Put(keys[2], types.Block{Offset: 2, Size: 1}))
+
+	usage, err := i.BucketUsage()
+	require.NoError(t, err)
+	require.Equal(t, bucketBits, usage.Bits)
+	require.Len(t, usage.Records, 16)
+	require.Equal(t, uint32(2), usage.Records[1])
+	require.Equal(t, uint32(1), usage.Records[2])
+	require.Equal(t, uint32(0), usage.Records[3])
+	require.NotZero(t, usage.Bytes[1])
+	require.Zero(t, usage.Bytes[3])
+
+	var buf bytes.Buffer
+	_, err = usage.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 1+16*8, buf.Len())
+	read, err := index.ReadBucketUsage(&buf)
+	require.NoError(t, err)
+	require.Equal(t, usage, read)
+}
+
+func TestIndexStats(t *testing.T) {
+	const bucketBits uint8 = 4
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+
+	// Three keys in bucket 1 that need longer prefixes, one in bucket 2, the last one isn't
+	// flushed
+	keys := [][]byte{{1, 1, 2, 3}, {1, 1, 3, 3}, {1, 2, 2, 3}, {2, 1, 2, 3}}
+	var entries [][2][]byte
+	for _, key := range keys {
+		entries = append(entries, [2][]byte{key, {1}})
+	}
+	primaryStorage := inmemory.NewInmemory(entries)
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	defer i.Close()
+	for n, key := range keys[:3] {
+		require.NoError(t, i.Put(key, types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Put(keys[3], types.Block{Offset: 3, Size: 1}))
+
+	stats, err := i.Stats()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), stats.Buckets)
+	require.Equal(t, uint64(14), stats.EmptyBuckets)
+	require.Equal(t, uint64(4), stats.Records)
+	require.Equal(t, []uint64{14, 1, 0, 1}, stats.Lengths)
+	usage, err := i.BucketUsage()
+	require.NoError(t, err)
+	require.Equal(t, uint64(usage.Bytes[1]+usage.Bytes[2]), stats.Bytes)
+	require.Equal(t, uint64(usage.Bytes[1]), stats.MaxBytes)
+	require.Equal(t, float64(stats.Bytes)/2, stats.AverageBytes())
+	// The keys of bucket 1 are distinguished by their second and third byte.
+	require.Equal(t, uint64(3+3+2+1), stats.KeyBytes)
+	require.Equal(t, 9.0/4, stats.AverageKeyLength())
+}
+
+func TestIndexMinKeyLength(t *testing.T) {
+	const bucketBits uint8 = 24
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits, index.MinKeyLength(4))
+	require.NoError(t, err)
+	defer i.Close()
+
+	keyLengths := func() []int {
+		_, err = i.Flush()
+		require.NoError(t, err)
+		var lengths []int
+		err := i.ForEachRecord(func(_ index.BucketIndex, record index.Record) error {
+			lengths = append(lengths, len(record.Key))
+			return nil
+		})
+		require.NoError(t, err)
+		return lengths
+	}
+
+	// The first key of the bucket is stored with the minimum length instead of a single byte.
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.Equal(t, []int{4}, keyLengths())
+
+	// A key that shares the first byte with the stored one is told apart by the index alone.
+	_, found, err := i.Get([]byte{1, 2, 3, 4, 9, 6, 7, 8, 9, 10})
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// Keys that need a longer prefix to be distinguished are not cut to the minimum length.
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	require.Equal(t, []int{4, 4}, keyLengths())
+}
+
+func TestIndexFullKeys(t *testing.T) {
+	const bucketBits uint8 = 8
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 11}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+
+	// Records of an index that was created with the option are checked by the index alone.
+	i, err := index.OpenIndex(filepath.Join(tempDir, "full.index"), primaryStorage, bucketBits, index.FullKeys())
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	blk, found, checked, err := i.GetChecked(key1)
+	require.NoError(t, err)
+	require.True(t, checked)
+	require.True(t, found)
+	require.Equal(t, types.Block{Offset: 0, Size: 1}, blk)
+	_, found, _, err = i.GetChecked(key2)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.ForEachRecord(func(_ index.BucketIndex, record index.Record) error {
+		require.Len(t, record.Key, len(key1)-1)
+		return nil
+	}))
+	require.NoError(t, i.Close())
+
+	// The index keeps storing full keys without the option.
+	i, err = index.OpenIndex(filepath.Join(tempDir, "full.index"), primaryStorage, bucketBits)
+	require.NoError(t, err)
+	_, found, checked, err = i.GetChecked(key2)
+	require.NoError(t, err)
+	require.True(t, checked)
+	require.True(t, found)
+	require.NoError(t, i.Close())
+
+	// An index with trimmed keys doesn't trust its records when the option is set later.
+	i, err = index.OpenIndex(filepath.Join(tempDir, "trimmed.index"), primaryStorage, bucketBits)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+	i, err = index.OpenIndex(filepath.Join(tempDir, "trimmed.index"), primaryStorage, bucketBits, index.FullKeys())
+	require.NoError(t, err)
+	_, found, checked, err = i.GetChecked(key1)
+	require.NoError(t, err)
+	require.False(t, checked)
+	require.True(t, found)
+	require.NoError(t, i.Close())
+}
+
+func TestIndexKeyChecksums(t *testing.T) {
+	const bucketBits uint8 = 24
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	key3 := []byte{2, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+
+	// A record that was written without checksum can't be checked.
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, bucketBits, index.KeyChecksums())
+	require.NoError(t, err)
+	defer i.Close()
+	blk, found, checked, err := i.GetChecked(key3)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.False(t, checked)
+	require.Equal(t, types.Block{Offset: 2, Size: 1}, blk)
+
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	check := func() {
+		blk, found, checked, err := i.GetChecked(key1)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.True(t, checked)
+		require.Equal(t, types.Block{Offset: 0, Size: 1}, blk)
+
+		// A key that matches the stored prefix is told apart by its checksum.
+		_, found, checked, err = i.GetChecked([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 11})
+		require.NoError(t, err)
+		require.False(t, found)
+		require.True(t, checked)
+	}
+	check()
+	_, err = i.Flush()
+	require.NoError(t, err)
+	check()
+
+	// The checksum is kept when the record of a key is trimmed anew to tell it apart from
+	// another one.
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	check()
+	_, found, checked, err = i.GetChecked(key2)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.True(t, checked)
+	require.NoError(t, i.Update(key1, types.Block{Offset: 3, Size: 1}))
+	blk, found, checked, err = i.GetChecked(key1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.True(t, checked)
+	require.Equal(t, types.Block{Offset: 3, Size: 1}, blk)
+}
+
+func TestIndexLongKeysWithoutChecksums(t *testing.T) {
+	// Keys of 200 bytes are stored completely, without checksums, next to short ones.
+	key1 := make([]byte, 201)
+	key2 := make([]byte, 201)
+	key3 := []byte{1, 255, 3, 4}
+	for n := range key1 {
+		key1[n], key2[n] = 1, 1
+	}
+	key2[200] = 2
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, index.MinKeyLength(200))
+	require.NoError(t, err)
+	for n, key := range [][]byte{key1, key2, key3} {
+		require.NoError(t, i.Put(key, types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	defer i.Close()
+	for n, key := range [][]byte{key1, key2, key3} {
+		blk, found, err := i.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Block{Offset: types.Position(n), Size: 1}, blk)
+	}
+	require.NoError(t, i.ForEachRecord(func(_ index.BucketIndex, record index.Record) error {
+		require.Zero(t, record.Checksum)
+		require.False(t, record.HasValueSize)
+		return nil
+	}))
+	require.Equal(t, uint64(3), i.Count())
+}
+
+func TestIndexValueSizes(t *testing.T) {
+	const bucketBits uint8 = 24
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits, index.KeyChecksums(), index.ValueSizes())
+	require.NoError(t, err)
+	defer i.Close()
+
+	valueSize := func(key []byte) (types.Size, bool) {
+		record, found, err := i.GetRecord(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, index.KeyChecksum(key), record.Checksum)
+		return record.ValueSize, record.HasValueSize
+	}
+
+	require.NoError(t, i.PutWithSize(key1, types.Block{Offset: 0, Size: 1}, 1000))
+	require.NoError(t, i.PutWithSize(key2, types.Block{Offset: 1, Size: 1}, 0))
+	// Records without size can be mixed with the others.
+	key3 := []byte{1, 2, 3, 4, 7}
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	size, ok := valueSize(key1)
+	require.True(t, ok)
+	require.Equal(t, types.Size(1000), size)
+	size, ok = valueSize(key2)
+	require.True(t, ok)
+	require.Equal(t, types.Size(0), size)
+	_, ok = valueSize(key3)
+	require.False(t, ok)
+
+	// The size of the previous value is dropped on update unless a new one is given.
+	require.NoError(t, i.Update(key1, types.Block{Offset: 3, Size: 1}))
+	_, ok = valueSize(key1)
+	require.False(t, ok)
+	require.NoError(t, i.UpdateWithSize(key1, types.Block{Offset: 4, Size: 1}, 2000))
+	size, ok = valueSize(key1)
+	require.True(t, ok)
+	require.Equal(t, types.Size(2000), size)
+
+	// Rewriting the index keeps the sizes.
+	_, err = i.Flush()
+	require.NoError(t, err)
+	rewritten := filepath.Join(tempDir, "rewritten.index")
+	require.NoError(t, i.Rewrite(rewritten, func(blk types.Block) (types.Block, bool, error) {
+		return blk, true, nil
+	}))
+	ri, err := index.OpenIndex(rewritten, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	defer ri.Close()
+	record, found, err := ri.GetRecord(key1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.True(t, record.HasValueSize)
+	require.Equal(t, types.Size(2000), record.ValueSize)
+}
+
+func TestIndexPreallocate(t *testing.T) {
+	const bucketBits uint8 = 24
+	const extent = 4096
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	readHeader := func() index.Header {
+		file, err := os.Open(indexPath)
+		require.NoError(t, err)
+		defer file.Close()
+		header, _, err := index.ReadHeader(file)
+		require.NoError(t, err)
+		return header
+	}
+	fileSize := func() int64 {
+		info, err := os.Stat(indexPath)
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits, index.Preallocate(extent))
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Sync())
+	require.Equal(t, int64(extent), fileSize())
+	require.True(t, int64(i.Size()) < extent)
+	require.Equal(t, i.Size(), readHeader().End)
+
+	// Without closing, as after a crash, the end of the data is found again.
+	i2, err := index.OpenIndex(indexPath, primaryStorage, bucketBits, index.Preallocate(extent))
+	require.NoError(t, err)
+	require.Equal(t, i.Size(), i2.Size())
+	blk, found, err := i2.Get(key1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, types.Block{Offset: 0, Size: 1}, blk)
+	require.NoError(t, i2.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i2.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i2.Sync())
+
+	// Closing trims the file.
+	require.NoError(t, i2.Close())
+	require.Equal(t, int64(i2.Size()), fileSize())
+	require.Equal(t, i2.Size(), readHeader().End)
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	defer i.Close()
+	for _, key := range [][]byte{key1, key2} {
+		_, found, err := i.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+}
+
+func TestIndexCompact(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	key3 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}, {key1, {0x50}}})
+	for _, options := range [][]index.Option{
+		nil,
+		{index.Preallocate(4096), index.RecordListChecksums()},
+	} {
+		tempDir, err := ioutil.TempDir("", "sth")
+		require.NoError(t, err)
+		indexPath := filepath.Join(tempDir, "storethehash.index")
+		i, err := index.OpenIndex(indexPath, primaryStorage, 8, options...)
+		require.NoError(t, err)
+		require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+		require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+		_, err = i.Flush()
+		require.NoError(t, err)
+		// Every update leaves the previous record list behind.
+		for n := 0; n < 10; n++ {
+			require.NoError(t, i.Update(key1, types.Block{Offset: 3, Size: types.Size(n + 1)}))
+			_, err = i.Flush()
+			require.NoError(t, err)
+		}
+		require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+		size := i.Size()
+
+		check := func(i *index.Index) {
+			for key, blk := range map[string]types.Block{
+				string(key1): {Offset: 3, Size: 10},
+				string(key2): {Offset: 1, Size: 1},
+				string(key3): {Offset: 2, Size: 1},
+			} {
+				found, ok, err := i.Get([]byte(key))
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.Equal(t, blk, found)
+			}
+			require.Equal(t, uint64(3), i.Count())
+		}
+		shrunk, err := i.Compact()
+		require.NoError(t, err)
+		require.True(t, shrunk > 0)
+		require.True(t, i.Size() < size)
+		check(i)
+		_, err = os.Stat(indexPath + ".compact")
+		require.True(t, os.IsNotExist(err))
+
+		// The index continues with the new file.
+		require.NoError(t, i.Update(key2, types.Block{Offset: 1, Size: 1}))
+		_, err = i.Flush()
+		require.NoError(t, err)
+		require.NoError(t, i.Close())
+		i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+		require.NoError(t, err)
+		check(i)
+		require.NoError(t, i.Close())
+	}
+}
+
+func TestIndexCountsOnOpen(t *testing.T) {
+	// More buckets than the scan on open keeps the key counts of are replaced.
+	const bucketBits uint8 = 24
+	const keys = 70000
+	key := func(n int) []byte {
+		return []byte{byte(n >> 16), byte(n >> 8), byte(n), 4, 5, 6, 7, 8, 9, 10}
+	}
+	primaryStorage := inmemory.NewInmemory(nil)
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	for n := 0; n < keys; n++ {
+		require.NoError(t, i.Put(key(n), types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	for n := 0; n < 100; n++ {
+		removed, err := i.Remove(key(n))
+		require.NoError(t, err)
+		require.True(t, removed)
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	defer i.Close()
+	require.Equal(t, uint64(keys-100), i.Count())
+	occupied, _ := i.OccupiedBuckets()
+	require.Equal(t, uint64(keys-100), occupied)
+}
+
+func TestIndexRemove(t *testing.T) {
+	const bucketBits uint8 = 24
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+
+	removed, err := i.Remove(key1)
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Equal(t, uint64(1), i.Count())
+	blk, found, err := i.Get(key2)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, types.Block{Offset: 1, Size: 1}, blk)
+	// The prefix of key2 doesn't need to tell it apart from key1 anymore, it's shortened to a
+	// single byte, which also matches key1.
+	prefix, _, err := i.Iter().Next()
+	require.NoError(t, err)
+	require.Equal(t, key2[:4], prefix)
+	blk, found, err = i.Get(key1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, types.Block{Offset: 1, Size: 1}, blk)
+
+	// Removing the last key of a bucket leaves it empty.
+	removed, err = i.Remove(key2)
+	require.NoError(t, err)
+	require.True(t, removed)
+	removed, err = i.Remove(key2)
+	require.NoError(t, err)
+	require.False(t, removed)
+	occupied, _ := i.OccupiedBuckets()
+	require.Zero(t, occupied)
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+
+	// The removals are read back on open, and the empty bucket can be filled again.
+	i, err = index.OpenIndex(indexPath, primaryStorage, bucketBits)
+	require.NoError(t, err)
+	defer i.Close()
+	require.Zero(t, i.Count())
+	occupied, _ = i.OccupiedBuckets()
+	require.Zero(t, occupied)
+	for _, key := range [][]byte{key1, key2} {
+		_, found, err := i.Get(key)
+		require.NoError(t, err)
+		require.False(t, found)
+	}
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	occupied, _ = i.OccupiedBuckets()
+	require.Equal(t, uint64(1), occupied)
+	_, found, err = i.Get(key2)
+	require.NoError(t, err)
+	require.True(t, found)
+}
+
+func TestTornTail(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+
+	for _, damage := range []string{"truncate", "checksum", "size"} {
+		indexPath := filepath.Join(tempDir, damage+".index")
+		i, err := index.OpenIndex(indexPath, primaryStorage, 8, index.RecordListChecksums())
+		require.NoError(t, err)
+		require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+		_, err = i.Flush()
+		require.NoError(t, err)
+		good := i.Size()
+		require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+		_, err = i.Flush()
+		require.NoError(t, err)
+		require.NoError(t, i.Close())
+
+		// Damage the last record list like a crash in the middle of writing it would.
+		size := int64(i.Size())
+		switch damage {
+		case "truncate":
+			size -= 3
+			require.NoError(t, os.Truncate(indexPath, size))
+		case "checksum":
+			file, err := os.OpenFile(indexPath, os.O_RDWR, 0)
+			require.NoError(t, err)
+			_, err = file.WriteAt([]byte{0, 0, 0, 0}, size-4)
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+		case "size":
+			file, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0)
+			require.NoError(t, err)
+			_, err = file.Write([]byte{0xff, 0xff, 0xff, 0x7f, 1, 2})
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+			good = types.Position(size)
+			size += 6
+		}
+
+		i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.RecordListChecksums())
+		require.NoError(t, err, damage)
+		torn, ok := i.TornTail()
+		require.True(t, ok, damage)
+		require.Equal(t, index.TornTail{Offset: good, Dropped: size - int64(good)}, torn, damage)
+		require.Equal(t, good, i.Size())
+		_, found, err := i.Get(key1)
+		require.NoError(t, err)
+		require.True(t, found)
+		_, found, err = i.Get(key2)
+		require.NoError(t, err)
+		require.Equal(t, damage == "size", found, damage)
+
+		// The index continues behind the last complete record list.
+		if found {
+			require.NoError(t, i.Update(key2, types.Block{Offset: 2, Size: 1}))
+		} else {
+			require.NoError(t, i.Put(key2, types.Block{Offset: 2, Size: 1}))
+		}
+		_, err = i.Flush()
+		require.NoError(t, err)
+		require.NoError(t, i.Close())
+		i, err = index.OpenIndex(indexPath, primaryStorage, 8)
+		require.NoError(t, err)
+		_, ok = i.TornTail()
+		require.False(t, ok)
+		blk, found, err := i.Get(key2)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Block{Offset: 2, Size: 1}, blk)
+		require.NoError(t, i.Close())
+	}
+}
+
+// Positions in the primary storage beyond 4 GiB are stored with all their bits, and blocks can be as
+// large as MaxBlockSize.
+func TestIndexLargePositions(t *testing.T) {
+	blocks := map[string]types.Block{
+		string([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}): {Offset: 1<<32 + 1, Size: 1},
+		string([]byte{2, 2, 3, 4, 5, 6, 7, 8, 9, 10}): {Offset: 1 << 40, Size: types.MaxBlockSize},
+		string([]byte{3, 2, 3, 4, 5, 6, 7, 8, 9, 10}): {Offset: math.MaxUint64 - types.MaxBlockSize, Size: types.MaxBlockSize},
+	}
+	primaryStorage := inmemory.NewInmemory(nil)
+	for _, options := range [][]index.Option{
+		nil,
+		{index.PagedBuckets(1), index.ValueSizes(), index.KeyChecksums()},
+	} {
+		tempDir, err := ioutil.TempDir("", "sth")
+		require.NoError(t, err)
+		indexPath := filepath.Join(tempDir, "storethehash.index")
+		i, err := index.OpenIndex(indexPath, primaryStorage, 8, options...)
+		require.NoError(t, err)
+		for key, blk := range blocks {
+			require.NoError(t, i.PutWithSize([]byte(key), blk, types.MaxBlockSize))
+		}
+		_, err = i.Flush()
+		require.NoError(t, err)
+		require.NoError(t, i.Close())
+
+		i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+		require.NoError(t, err)
+		for key, blk := range blocks {
+			record, found, err := i.GetRecord([]byte(key))
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, blk, record.Block)
+			if record.HasValueSize {
+				require.Equal(t, types.Size(types.MaxBlockSize), record.ValueSize)
+			}
+		}
+		require.NoError(t, i.Close())
+	}
+}
+
+func TestIndexIter(t *testing.T) {
+	key1 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key3 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, index.ValueSizes())
+	require.NoError(t, err)
+	defer i.Close()
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	// Records that aren't flushed yet are iterated as well.
+	require.NoError(t, i.PutWithSize(key3, types.Block{Offset: 2, Size: 1}, 7))
+
+	type entry struct {
+		key    []byte
+		bucket index.BucketIndex
+		blk    types.Block
+	}
+	var entries []entry
+	iter := i.Iter()
+	for {
+		prefix, blk, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		for _, key := range [][]byte{key1, key2, key3} {
+			if bytes.HasPrefix(key, prefix) {
+				entries = append(entries, entry{key, iter.Bucket(), blk})
+			}
+		}
+		if blk.Offset == 2 {
+			require.True(t, iter.Record().HasValueSize)
+			require.Equal(t, types.Size(7), iter.Record().ValueSize)
+		}
+	}
+	// The prefixes distinguish the keys, the buckets come in order.
+	require.Equal(t, []entry{
+		{key2, 1, types.Block{Offset: 1, Size: 1}},
+		{key3, 1, types.Block{Offset: 2, Size: 1}},
+		{key1, 9, types.Block{Offset: 0, Size: 1}},
+	}, entries)
+	_, _, err = iter.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestIndexRemoveShortensNeighbours(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	key3 := []byte{1, 2, 3, 8, 5, 6, 7, 8, 9, 10}
+	key4 := []byte{1, 2, 5, 8, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}, {key4, {0x50}}})
+	prefixes := func(i *index.Index) [][]byte {
+		var prefixes [][]byte
+		iter := i.Iter()
+		for {
+			prefix, _, err := iter.Next()
+			if err == io.EOF {
+				return prefixes
+			}
+			require.NoError(t, err)
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	defer i.Close()
+	for n, key := range [][]byte{key1, key2, key3, key4} {
+		require.NoError(t, i.Put(key, types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	require.Equal(t, [][]byte{key1[:7], key2[:7], key3[:4], key4[:3]}, prefixes(i))
+
+	// Only the neighbours of the removed key are shortened, as far as the other neighbours allow.
+	_, err = i.Remove(key2)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{key1[:4], key3[:4], key4[:3]}, prefixes(i))
+	_, err = i.Flush()
+	require.NoError(t, err)
+
+	// Records that a rewrite drops shorten their neighbours the same way.
+	rewritePath := indexPath + ".rewrite"
+	require.NoError(t, i.Rewrite(rewritePath, func(blk types.Block) (types.Block, bool, error) {
+		return blk, blk.Offset != 2, nil
+	}))
+	rewritten, err := index.OpenIndex(rewritePath, primaryStorage, 8)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	require.Equal(t, [][]byte{key1[:3], key4[:3]}, prefixes(rewritten))
+	for key, offset := range map[string]types.Position{string(key1): 0, string(key4): 3} {
+		blk, found, err := rewritten.Get([]byte(key))
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, offset, blk.Offset)
+	}
+}
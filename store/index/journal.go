@@ -0,0 +1,217 @@
+package index
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Update is the new record list of a bucket that a flush wrote to the index.
+type Update struct {
+	Bucket BucketIndex
+	// Records of the bucket without the bucket prefix, see RecordList. Empty if all keys of the
+	// bucket were removed.
+	Records []byte
+}
+
+// Journal receives the record lists that the index writes, see ReplicationJournal.
+type Journal interface {
+	// Record is called once the record lists of a flush were written to the index file, in the
+	// order they were written. The updates must not be modified. A flush fails with the error
+	// that is returned.
+	Record(updates []Update) error
+}
+
+// ChannelJournal is a journal that sends the updates of every flush to a channel. The flush
+// waits until they're received.
+type ChannelJournal chan<- []Update
+
+func (j ChannelJournal) Record(updates []Update) error {
+	j <- updates
+	return nil
+}
+
+// A journal file is a sequence of entries:
+//
+//	|    4 bytes    | 1 byte |  4 bytes   | Variable size | 4 bytes  |
+//	| Size of entry |  Kind  | Bucket     |    Records    | Checksum |
+//
+// The size covers the fields from the kind up to the records, the checksum is a CRC32 of them.
+// Every flush is a number of updates that is followed by a commit, whose bucket and records are
+// empty.
+const journalHeaderSize = 1 + BucketPrefixSize
+
+// Kinds of journal entries.
+const (
+	journalUpdate byte = iota + 1
+	journalCommit
+)
+
+// FileJournal is a journal that appends the updates to a file, which a follower reads with a
+// JournalReader, also while it's written. The file isn't synced, a follower is a replica that
+// can be created again. It grows until it's removed.
+type FileJournal struct {
+	file *os.File
+}
+
+var _ Journal = &FileJournal{}
+
+// OpenFileJournal opens the journal file at the given path for appending, it's created if it
+// doesn't exist.
+func OpenFileJournal(path string) (*FileJournal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{file: file}, nil
+}
+
+func (j *FileJournal) Record(updates []Update) error {
+	var data []byte
+	for _, update := range updates {
+		data = appendJournalEntry(data, journalUpdate, update.Bucket, update.Records)
+	}
+	data = appendJournalEntry(data, journalCommit, 0, nil)
+	// A single write, a follower never sees a commit before its updates.
+	_, err := j.file.Write(data)
+	return err
+}
+
+// Close closes the journal file.
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
+
+func appendJournalEntry(data []byte, kind byte, bucket BucketIndex, records []byte) []byte {
+	entry := make([]byte, SizePrefixSize+journalHeaderSize+len(records)+ListChecksumSize)
+	binary.LittleEndian.PutUint32(entry, uint32(journalHeaderSize+len(records)))
+	body := entry[SizePrefixSize : SizePrefixSize+journalHeaderSize+len(records)]
+	body[0] = kind
+	binary.LittleEndian.PutUint32(body[1:], uint32(bucket))
+	copy(body[journalHeaderSize:], records)
+	binary.LittleEndian.PutUint32(entry[SizePrefixSize+len(body):], crc32.Checksum(body, castagnoliTable))
+	return append(data, entry...)
+}
+
+// JournalReader reads the flushes from a journal file that may still be written, see FileJournal.
+type JournalReader struct {
+	file *os.File
+	// Position of the first entry that wasn't returned yet
+	pos int64
+}
+
+// OpenJournalReader opens the journal file at the given path for reading from the start.
+func OpenJournalReader(path string) (*JournalReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JournalReader{file: file}, nil
+}
+
+// Next returns the updates of the next flush in the journal. It returns `io.EOF` if the journal
+// doesn't contain a complete flush beyond the ones that were returned, Next can be called again
+// once more was written. A journal entry that doesn't match its checksum is reported with
+// `types.ErrIndexCorrupt`.
+func (r *JournalReader) Next() ([]Update, error) {
+	var updates []Update
+	pos := r.pos
+	header := make([]byte, SizePrefixSize)
+	for {
+		if _, err := r.file.ReadAt(header, pos); err != nil {
+			return nil, eofIfIncomplete(err)
+		}
+		size := int(binary.LittleEndian.Uint32(header))
+		if size < journalHeaderSize {
+			return nil, types.ErrIndexCorrupt(pos)
+		}
+		entry := make([]byte, size+ListChecksumSize)
+		if _, err := r.file.ReadAt(entry, pos+int64(SizePrefixSize)); err != nil {
+			return nil, eofIfIncomplete(err)
+		}
+		body := entry[:size]
+		if crc32.Checksum(body, castagnoliTable) != binary.LittleEndian.Uint32(entry[size:]) {
+			return nil, types.ErrIndexCorrupt(pos)
+		}
+		pos += int64(SizePrefixSize + len(entry))
+		if body[0] == journalCommit {
+			r.pos = pos
+			return updates, nil
+		}
+		updates = append(updates, Update{
+			Bucket:  BucketIndex(binary.LittleEndian.Uint32(body[1:])),
+			Records: body[journalHeaderSize:],
+		})
+	}
+}
+
+// Close closes the journal file.
+func (r *JournalReader) Close() error {
+	return r.file.Close()
+}
+
+// eofIfIncomplete returns io.EOF for a read that ended within an entry that isn't written
+// completely yet.
+func eofIfIncomplete(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// recordJournal passes the record lists that a commit wrote to the journal, if the index has one.
+func (i *Index) recordJournal(blks []bucketBlock, pool bucketPool) error {
+	if i.journal == nil || len(blks) == 0 {
+		return nil
+	}
+	updates := make([]Update, len(blks))
+	for n, blk := range blks {
+		records, ok := pool[blk.bucket]
+		if !ok {
+			// The child lists of an overflowing bucket were written, the update contains all
+			// of its records.
+			var err error
+			if records, _, err = i.readDiskBuckets(nil, blk.blk.Offset, blk.blk.Size); err != nil {
+				return err
+			}
+		}
+		updates[n] = Update{Bucket: blk.bucket, Records: records}
+	}
+	return i.journal.Record(updates)
+}
+
+// ApplyUpdates replaces the record lists of buckets with the ones of the updates, e.g. to keep a
+// replica of an index up to date with the journal of that index, see ReplicationJournal. The replica needs
+// to have the same number of bucket bits, and access to the same primary storage or a copy of it.
+// The record lists are written by the next flush, like the ones of Put.
+func (i *Index) ApplyUpdates(updates []Update) error {
+	i.bucketLk.Lock()
+	defer i.bucketLk.Unlock()
+	for _, update := range updates {
+		if uint64(update.Bucket) >= 1<<i.sizeBits {
+			return types.ErrOutOfBounds
+		}
+		records, err := i.fullRecords(update.Bucket)
+		if err != nil {
+			return err
+		}
+		previous := records.Count()
+		count := NewRecordListRaw(update.Records).Count()
+		if previous == 0 && count > 0 {
+			i.occupied++
+		} else if previous > 0 && count == 0 {
+			i.occupied--
+		}
+		i.keys = i.keys - uint64(previous) + uint64(count)
+		i.outstandingWork += types.Work(len(update.Records) + BucketPrefixSize + SizePrefixSize)
+		i.nextPool[update.Bucket] = update.Records
+		// The record list replaces the child lists of the bucket, if it overflows.
+		for child := 0; child < 256; child++ {
+			delete(i.nextChildren, childIndex{update.Bucket, byte(child)})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package index_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationJournal(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	key3 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	journalPath := filepath.Join(tempDir, "storethehash.journal")
+	journal, err := index.OpenFileJournal(journalPath)
+	require.NoError(t, err)
+	i, err := index.OpenIndex(filepath.Join(tempDir, "storethehash.index"), primaryStorage, 8, index.ReplicationJournal(journal))
+	require.NoError(t, err)
+	replica, err := index.OpenIndex(filepath.Join(tempDir, "replica.index"), primaryStorage, 8)
+	require.NoError(t, err)
+	reader, err := index.OpenJournalReader(journalPath)
+	require.NoError(t, err)
+	follow := func() {
+		for {
+			updates, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, replica.ApplyUpdates(updates))
+		}
+		_, err := replica.Flush()
+		require.NoError(t, err)
+	}
+	check := func(expected map[string]types.Block) {
+		for key, blk := range expected {
+			found, ok, err := replica.Get([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, blk, found)
+		}
+		require.Equal(t, uint64(len(expected)), replica.Count())
+		require.Equal(t, i.Count(), replica.Count())
+	}
+
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	follow()
+	check(map[string]types.Block{
+		string(key1): {Offset: 0, Size: 1},
+		string(key2): {Offset: 1, Size: 1},
+		string(key3): {Offset: 2, Size: 1},
+	})
+
+	_, err = i.Remove(key3)
+	require.NoError(t, err)
+	require.NoError(t, i.Update(key1, types.Block{Offset: 3, Size: 2}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	// A flush that is still being written isn't returned.
+	file, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{30, 0, 0, 0, 1})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	follow()
+	check(map[string]types.Block{
+		string(key1): {Offset: 3, Size: 2},
+		string(key2): {Offset: 1, Size: 1},
+	})
+	occupied, _ := replica.OccupiedBuckets()
+	require.Equal(t, uint64(1), occupied)
+
+	require.NoError(t, reader.Close())
+	require.NoError(t, replica.Close())
+	require.NoError(t, i.Close())
+	require.NoError(t, journal.Close())
+
+	// The updates of a flush can be received from a channel as well.
+	updates := make(chan []index.Update, 1)
+	i, err = index.OpenIndex(filepath.Join(tempDir, "channel.index"), primaryStorage, 8, index.ReplicationJournal(index.ChannelJournal(updates)))
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	flushed := <-updates
+	require.Len(t, flushed, 1)
+	require.Equal(t, index.BucketIndex(9), flushed[0].Bucket)
+	require.NoError(t, i.Close())
+}
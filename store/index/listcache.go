@@ -0,0 +1,109 @@
+package index
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// listCache keeps recently read record lists in memory, keyed by their offset in the index file.
+// Lists are evicted in least-recently-used order once their total size exceeds the capacity.
+//
+// A flushed record list never changes, a bucket that is rewritten gets a list at a new offset.
+// The offset therefore identifies the generation of a bucket, the cache only needs to be cleared
+// when offsets are reused, i.e. when the index file is compacted.
+type listCache struct {
+	lk       sync.Mutex
+	capacity int64
+	size     int64
+	lists    map[types.Position]*list.Element
+	// Lists ordered by last use, the most recently used first
+	lru          *list.List
+	hits, misses uint64
+}
+
+type cachedList struct {
+	offset types.Position
+	data   []byte
+}
+
+func newListCache(capacity int64) *listCache {
+	return &listCache{
+		capacity: capacity,
+		lists:    make(map[types.Position]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns a copy of the record list at the given offset, with its bucket prefix.
+func (c *listCache) get(offset types.Position) ([]byte, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	elem, ok := c.lists[offset]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return append([]byte(nil), elem.Value.(*cachedList).data...), true
+}
+
+// put adds a copy of the record list at the given offset. Lists larger than the capacity aren't
+// cached.
+func (c *listCache) put(offset types.Position, data []byte) {
+	if int64(len(data)) > c.capacity {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if _, ok := c.lists[offset]; ok {
+		return
+	}
+	c.lists[offset] = c.lru.PushFront(&cachedList{offset, append([]byte(nil), data...)})
+	c.size += int64(len(data))
+	for c.size > c.capacity {
+		c.evict(c.lru.Back())
+	}
+}
+
+// remove drops the record list at the given offset, if it's cached.
+func (c *listCache) remove(offset types.Position) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if elem, ok := c.lists[offset]; ok {
+		c.evict(elem)
+	}
+}
+
+// evict removes a list, it must be called with the lock held.
+func (c *listCache) evict(elem *list.Element) {
+	evicted := c.lru.Remove(elem).(*cachedList)
+	delete(c.lists, evicted.offset)
+	c.size -= int64(len(evicted.data))
+}
+
+// clear removes all lists.
+func (c *listCache) clear() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.lists = make(map[types.Position]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *listCache) stats() (uint64, uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.hits, c.misses
+}
+
+// ListCacheStats returns the number of record list reads that were served by the cache and the
+// number of those that read the index file, see ListCache. Both are zero without a cache.
+func (i *Index) ListCacheStats() (hits uint64, misses uint64) {
+	if i.listCache == nil {
+		return 0, 0
+	}
+	return i.listCache.stats()
+}
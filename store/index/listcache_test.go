@@ -0,0 +1,53 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListCache(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	i, err := index.OpenIndex(filepath.Join(tempDir, "storethehash.index"), primaryStorage, 8, index.ListCache(1<<20))
+	require.NoError(t, err)
+	defer i.Close()
+	get := func(key []byte, expected types.Block) {
+		blk, found, err := i.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, expected, blk)
+	}
+
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	// Only the first read of the bucket reads the index file.
+	get(key1, types.Block{Offset: 0, Size: 1})
+	get(key2, types.Block{Offset: 1, Size: 1})
+	hits, misses := i.ListCacheStats()
+	require.Equal(t, uint64(1), hits)
+	require.Equal(t, uint64(1), misses)
+
+	// A bucket that is rewritten is read again.
+	require.NoError(t, i.Update(key1, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	get(key1, types.Block{Offset: 2, Size: 1})
+	get(key2, types.Block{Offset: 1, Size: 1})
+
+	// Compaction moves the record lists, the cached ones aren't used anymore.
+	_, err = i.Compact()
+	require.NoError(t, err)
+	get(key1, types.Block{Offset: 2, Size: 1})
+	get(key2, types.Block{Offset: 1, Size: 1})
+}
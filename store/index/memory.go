@@ -0,0 +1,236 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// memoryFile is an index file that is kept in memory, see OpenMemoryIndex. Writes go to the
+// current position like the ones of a file, which is the end unless it was moved by Seek.
+type memoryFile struct {
+	lk sync.RWMutex
+	// Path the data is written to on Close, empty if it isn't
+	name string
+	data []byte
+	pos  int64
+}
+
+func newMemoryFile(name string, data []byte) *memoryFile {
+	return &memoryFile{name: name, data: data, pos: int64(len(data))}
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lk.RLock()
+	defer f.lk.RUnlock()
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.writeAt(p, off), nil
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	n := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, nil
+}
+
+// writeAt writes the data at the given offset, growing the file as needed. It must be called with
+// the lock held.
+func (f *memoryFile) writeAt(p []byte, off int64) int {
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p)
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.writeAt(nil, size)
+	}
+	return nil
+}
+
+func (f *memoryFile) Sync() error {
+	return nil
+}
+
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+// Close writes the data to the file at the path of the index, if it has one.
+func (f *memoryFile) Close() error {
+	if f.name == "" {
+		return nil
+	}
+	f.lk.RLock()
+	defer f.lk.RUnlock()
+	return writeFileAtomic(f.name, f.data)
+}
+
+// OpenMemoryIndex opens an index that keeps its buckets and record lists in memory only, e.g. for
+// tests, ephemeral caches or benchmarks that shouldn't depend on the disk.
+//
+// If `path` is empty the index starts empty and is gone once it's closed. Otherwise the index file
+// at that path is loaded if there is one, and Close writes the index to it, so that it can be
+// opened again with OpenMemoryIndex or OpenIndex. Nothing is written before Close.
+//
+// Options that manage files next to the index (PagedBuckets, Preallocate, Segments, Checkpoints,
+// WriteAheadLog and Migrate) aren't supported and return `types.ErrMemoryIndex`, the same
+// applies to loading a segmented or preallocated index file.
+func OpenMemoryIndex(path string, primary primary.PrimaryStorage, indexSizeBits uint8, options ...Option) (*Index, error) {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
+	if c.residentBucketPages > 0 || c.preallocate > 0 || c.segmentSize > 0 || c.checkpointInterval > 0 ||
+		c.wal || c.migrate != nil {
+		return nil, types.ErrMemoryIndex
+	}
+	buckets, err := NewMemBucketTable(indexSizeBits)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	var keys, occupied uint64
+	var headerFlags HeaderFlags
+	var torn TornTail
+	if path != "" {
+		data, err = ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if data == nil {
+		h := NewHeader(indexSizeBits)
+		h.Flags = featureFlags(c)
+		header := FromHeader(h)
+		data = make([]byte, SizePrefixSize, SizePrefixSize+len(header))
+		binary.LittleEndian.PutUint32(data, uint32(len(header)))
+		data = append(data, header...)
+		headerFlags = h.Flags
+	} else {
+		scanned, err := scanIndex(path, indexSizeBits, buckets, false)
+		if err != nil {
+			return nil, err
+		}
+		if scanned.segments != nil || scanned.end != 0 {
+			return nil, types.ErrMemoryIndex
+		}
+		keys, occupied = scanned.keys, scanned.occupied
+		torn = scanned.torn
+		headerFlags = scanned.header.Flags
+		// Keys that were written before aren't complete, the index doesn't store full keys.
+		if missing := featureFlags(c) &^ headerFlags &^ FlagFullKeys; missing != 0 && scanned.header.flagsOffset() != 0 {
+			headerFlags |= missing
+			binary.LittleEndian.PutUint16(data[scanned.header.flagsOffset():], uint16(headerFlags))
+		}
+		if torn.Dropped > 0 {
+			data = data[:torn.Offset]
+		}
+	}
+	file := newMemoryFile(path, data)
+	length := types.Position(len(data))
+	var listCache *listCache
+	if c.listCacheSize > 0 {
+		listCache = newListCache(c.listCacheSize)
+	}
+	return &Index{
+		sizeBits: indexSizeBits,
+		buckets:  buckets,
+		file:     file,
+		writer:   bufio.NewWriterSize(file, indexBufferSize),
+		Primary:  primary,
+		curPool:  make(bucketPool, BucketPoolSize),
+		nextPool: make(bucketPool, BucketPoolSize),
+		length:   length,
+		keys:     keys,
+		occupied: occupied,
+
+		curChildren:        make(childPool),
+		nextChildren:       make(childPool),
+		overflowSize:       c.overflowSize,
+		deltaSize:          c.deltaSize,
+		flushedLength:      length,
+		seekTableThreshold: c.seekTableThreshold,
+		minKeyLength:       c.minKeyLength,
+		fullKeys:           c.fullKeys || headerFlags&FlagFullKeys != 0,
+		keyChecksums:       c.keyChecksums,
+		valueSizes:         c.valueSizes,
+		allocated:          length,
+		flags:              headerFlags,
+		listChecksums:      c.listChecksums,
+		torn:               torn,
+		journal:            c.journal,
+		listCache:          listCache,
+		flushedKeys:        keys,
+		flushedOccupied:    occupied,
+		countsFlushed:      true,
+	}, nil
+}
+
+// compactMemory rewrites an index that is kept in memory, see Compact.
+func (i *Index) compactMemory(old *memoryFile) (int64, error) {
+	file := newMemoryFile(old.name, nil)
+	var placed []bucketBlock
+	length, err := i.rewrite(file, i.flags, func(blk types.Block) (types.Block, bool, error) {
+		return blk, true, nil
+	}, func(bucket BucketIndex, blk types.Block) {
+		placed = append(placed, bucketBlock{bucket, blk})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := i.placeBuckets(placed); err != nil {
+		return 0, err
+	}
+	shrunk := int64(i.length) - int64(length)
+	i.file = file
+	i.writer = bufio.NewWriterSize(file, indexBufferSize)
+	i.length = length
+	i.flushedLength = length
+	i.allocated = length
+	if i.listCache != nil {
+		i.listCache.clear()
+	}
+	return shrunk, nil
+}
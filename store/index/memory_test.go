@@ -0,0 +1,87 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryIndex(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	key3 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	check := func(i *index.Index, expected map[string]types.Block) {
+		for key, blk := range expected {
+			found, ok, err := i.Get([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, blk, found)
+		}
+		require.Equal(t, uint64(len(expected)), i.Count())
+	}
+
+	// Without a path nothing is written at all.
+	i, err := index.OpenMemoryIndex("", primaryStorage, 8)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Update(key1, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	shrunk, err := i.Compact()
+	require.NoError(t, err)
+	require.True(t, shrunk > 0)
+	check(i, map[string]types.Block{
+		string(key1): {Offset: 2, Size: 1},
+		string(key2): {Offset: 1, Size: 1},
+	})
+	require.NoError(t, i.Close())
+
+	// With a path the index is written on Close and can be opened from disk.
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err = index.OpenMemoryIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Sync())
+	_, err = os.Stat(indexPath)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenMemoryIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	check(i, map[string]types.Block{
+		string(key1): {Offset: 0, Size: 1},
+		string(key3): {Offset: 2, Size: 1},
+	})
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	check(i, map[string]types.Block{
+		string(key1): {Offset: 0, Size: 1},
+		string(key2): {Offset: 1, Size: 1},
+		string(key3): {Offset: 2, Size: 1},
+	})
+	require.NoError(t, i.Close())
+
+	// Options that need files next to the index aren't supported.
+	_, err = index.OpenMemoryIndex("", primaryStorage, 8, index.WriteAheadLog())
+	require.Equal(t, types.ErrMemoryIndex, err)
+}
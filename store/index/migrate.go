@@ -0,0 +1,118 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the index while UpgradeHeader rewrites it.
+const upgradeSuffix = ".upgrade"
+
+// MigrationFunc migrates the index file at `path`, whose header has an older version than
+// IndexVersion, see Migrate.
+type MigrationFunc func(path string, header Header) error
+
+// migrateIndex calls `migrate` if the index at the given path has an older header version.
+func migrateIndex(path string, migrate MigrationFunc) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header, _, err := ReadHeader(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if header.Version >= IndexVersion {
+		return nil
+	}
+	return migrate(path, header)
+}
+
+// UpgradeHeader is a MigrationFunc that rewrites the index with the header of the current version.
+// The record lists are copied as they are. The feature flags of the new header start out empty and
+// are set for the features the index is opened with.
+func UpgradeHeader(path string, header Header) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, bytesRead, err := ReadHeader(src)
+	if err != nil {
+		return err
+	}
+
+	upgraded := NewHeader(header.BucketsBits)
+	if header.End != 0 {
+		// The end moves with the record lists.
+		upgraded.End = 1
+		headerSize := types.Position(SizePrefixSize + len(FromHeader(upgraded)))
+		upgraded.End = header.End - bytesRead + headerSize
+		upgraded.Flags |= FlagPreallocated
+	}
+	data := FromHeader(upgraded)
+	upgradePath := path + upgradeSuffix
+	dst, err := os.OpenFile(upgradePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	err = writeUpgraded(dst, data, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(upgradePath)
+		return err
+	}
+	return os.Rename(upgradePath, path)
+}
+
+// writeUpgraded writes the header data followed by the rest of `src` to `dst` and syncs it.
+func writeUpgraded(dst *os.File, header []byte, src io.Reader) error {
+	writer := bufio.NewWriterSize(dst, indexBufferSize)
+	headerSize := make([]byte, SizePrefixSize)
+	binary.LittleEndian.PutUint32(headerSize, uint32(len(header)))
+	if _, err := writer.Write(headerSize); err != nil {
+		return err
+	}
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, src); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// writeHeaderFlags replaces the feature flags in the header of the index at the given path, which
+// are at `offset`.
+func writeHeaderFlags(path string, offset int64, flags HeaderFlags) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, uint16(flags))
+	if _, err := file.WriteAt(data, offset); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,276 @@
+package index
+
+type config struct {
+	residentBucketPages int
+	seekTableThreshold  int
+	minKeyLength        int
+	keyChecksums        bool
+	valueSizes          bool
+	preallocate         int64
+	migrate             MigrationFunc
+	listChecksums       bool
+	wal                 bool
+	segmentSize         int64
+	checkpointInterval  int64
+	journal             Journal
+	overflowSize        int
+	deltaSize           int
+	fullKeys            bool
+	listCacheSize       int64
+}
+
+// Option configures how an index is opened.
+type Option func(*config)
+
+// Settings are the values a list of options sets, see OptionSettings. Two lists configure an index
+// the same way if their settings are equal, whatever the order or number of options. Of the options
+// whose values can't be compared, Migrate and ReplicationJournal, only whether they are set is
+// recorded.
+type Settings struct {
+	residentBucketPages int
+	seekTableThreshold  int
+	minKeyLength        int
+	keyChecksums        bool
+	valueSizes          bool
+	preallocate         int64
+	migrate             bool
+	listChecksums       bool
+	wal                 bool
+	segmentSize         int64
+	checkpointInterval  int64
+	journal             bool
+	overflowSize        int
+	deltaSize           int
+	fullKeys            bool
+	listCacheSize       int64
+}
+
+// OptionSettings applies the options and returns the settings they result in.
+func OptionSettings(options ...Option) Settings {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
+	return Settings{
+		residentBucketPages: c.residentBucketPages,
+		seekTableThreshold:  c.seekTableThreshold,
+		minKeyLength:        c.minKeyLength,
+		keyChecksums:        c.keyChecksums,
+		valueSizes:          c.valueSizes,
+		preallocate:         c.preallocate,
+		migrate:             c.migrate != nil,
+		listChecksums:       c.listChecksums,
+		wal:                 c.wal,
+		segmentSize:         c.segmentSize,
+		checkpointInterval:  c.checkpointInterval,
+		journal:             c.journal != nil,
+		overflowSize:        c.overflowSize,
+		deltaSize:           c.deltaSize,
+		fullKeys:            c.fullKeys,
+		listCacheSize:       c.listCacheSize,
+	}
+}
+
+// PagedBuckets keeps at most `residentPages` pages of the bucket table in memory and pages the
+// rest out to a file next to the index (`<index path>.buckets`).
+//
+// Lookups of buckets that aren't resident need an extra disk read, in exchange the memory usage
+// of the bucket table is bounded by `residentPages * BucketsPerPage * 12` bytes instead of growing
+// with the number of buckets.
+func PagedBuckets(residentPages int) Option {
+	return func(c *config) {
+		c.residentBucketPages = residentPages
+	}
+}
+
+// SeekTableThreshold stores record lists that are larger than `threshold` bytes with a seek table,
+// which bounds the number of records a lookup needs to scan. See `SeekTable`.
+//
+// Indexes written with seek tables can't be read by versions that don't support them. By default
+// no seek tables are written.
+func SeekTableThreshold(threshold int) Option {
+	return func(c *config) {
+		c.seekTableThreshold = threshold
+	}
+}
+
+// MinKeyLength stores at least `length` bytes of every index key (after the bucket prefix), even if
+// a shorter prefix would distinguish it from the other keys of its bucket.
+//
+// By default keys are trimmed to the shortest distinguishing prefix, a single byte for the first
+// key of a bucket. A lookup of a key that isn't stored but shares that prefix has to read the
+// primary storage to find out that it's a different key. Longer prefixes make the index larger, in
+// exchange such lookups are answered by the index alone. The option only affects keys that are
+// written after it is set.
+func MinKeyLength(length int) Option {
+	return func(c *config) {
+		c.minKeyLength = length
+	}
+}
+
+// FullKeys stores every index key completely instead of its shortest distinguishing prefix, i.e.
+// like MinKeyLength with the length of the keys.
+//
+// If the index is created with the option, a lookup of a key that matches a record tells whether
+// the key is stored without reading the primary storage, see `Index.CheckRecord`. An index that
+// contains trimmed keys doesn't gain that property by setting the option later, though its new
+// keys are stored completely. Records grow by the bytes of the keys that aren't needed to tell
+// them apart. By default keys are trimmed.
+func FullKeys() Option {
+	return func(c *config) {
+		c.fullKeys = true
+	}
+}
+
+// ListCache keeps up to `size` bytes of recently read record lists in memory, so that lookups of
+// keys in hot buckets don't read the index file again. Lists are evicted in least-recently-used
+// order, the list of a bucket is dropped when the bucket is rewritten. By default no lists are
+// cached.
+func ListCache(size int64) Option {
+	return func(c *config) {
+		c.listCacheSize = size
+	}
+}
+
+// KeyChecksums stores a checksum of the full key in every record, see `Index.GetChecked`.
+//
+// Lookups that only need to know whether a key is stored are then answered by the index alone,
+// instead of reading the primary storage to compare the full key. Every record grows by
+// `ChecksumBytes`. Records that were written without checksum stay readable, the option only
+// affects keys that are written after it is set.
+func KeyChecksums() Option {
+	return func(c *config) {
+		c.keyChecksums = true
+	}
+}
+
+// ValueSizes stores the size of the value in every record that is written with a size, see
+// `Index.PutWithSize`.
+//
+// Together with KeyChecksums, the size of a value is then known without reading the primary
+// storage at all. Every record grows by `ValueSizeBytes`. Like KeyChecksums, the option only
+// affects keys that are written after it is set.
+func ValueSizes() Option {
+	return func(c *config) {
+		c.valueSizes = true
+	}
+}
+
+// Preallocate grows the index file in extents of `extent` bytes ahead of the appended record lists,
+// which keeps the file contiguous on filesystems that fragment files that grow in small appends.
+//
+// The preallocated space is filled with zeros and the end of the data is found again when the
+// index is opened. Indexes that are created with the option also track the end in their header.
+// The file is trimmed to the end of the data when the index is closed. By default the file isn't
+// preallocated.
+func Preallocate(extent int64) Option {
+	return func(c *config) {
+		c.preallocate = extent
+	}
+}
+
+// Migrate calls `migrate` before an index whose header has an older version than IndexVersion is
+// opened, e.g. UpgradeHeader to rewrite it with the current header. The index is opened once the
+// function returns, an error is passed on.
+//
+// By default, indexes with an older header are opened as they are and keep their header.
+func Migrate(migrate MigrationFunc) Option {
+	return func(c *config) {
+		c.migrate = migrate
+	}
+}
+
+// RecordListChecksums writes a checksum behind every record list, which is verified whenever the
+// record list is read, including the scan when the index is opened. A record list that doesn't
+// match its checksum is reported with `types.ErrIndexCorrupt` instead of returning garbage
+// positions.
+//
+// Every record list grows by `ListChecksumSize` bytes. Record lists that were written without
+// checksum stay readable, the option only affects record lists that are written after it is set.
+func RecordListChecksums() Option {
+	return func(c *config) {
+		c.listChecksums = true
+	}
+}
+
+// WriteAheadLog records every change of the index in a log next to it (`<index path>.wal`) before
+// the change is applied to the bucket table. `Index.SyncLog` writes the log, the changes it contains
+// are applied again when the index is opened, unless a synced flush wrote them to the index file.
+//
+// This closes the window in which a crash loses the index entries of data that is already in the
+// primary storage, as long as the log is synced before the primary storage is flushed, which the
+// store does with `store.WriteAheadLog`. Changes whose data didn't reach the primary storage are
+// skipped on replay. By default there is no log.
+func WriteAheadLog() Option {
+	return func(c *config) {
+		c.wal = true
+	}
+}
+
+// Segments splits the index file into segments of at most `size` bytes. The first segment is the
+// file at the index path, the following ones are numbered (`<index path>.001`, …) and listed in a
+// manifest (`<index path>.segments`). Once a segment is full it's synced and never written again,
+// hence backups can copy sealed segments once, and Compact removes the segments that only contain
+// replaced record lists instead of rewriting the index.
+//
+// Segmented indexes can't be preallocated and need a header with feature flags. By default the index
+// is a single file.
+func Segments(size int64) Option {
+	return func(c *config) {
+		c.segmentSize = size
+	}
+}
+
+// Checkpoints writes the bucket table to a checkpoint next to the index (`<index path>.checkpoint`)
+// whenever the index grew by `interval` bytes since the last one, on Sync, and when the index is
+// closed. Opening the index then only needs to read the record lists behind the checkpoint instead
+// of the whole index file.
+//
+// A checkpoint contains the location of every non-empty bucket, i.e. it's up to 16 bytes per
+// bucket. It's ignored if it doesn't match the index, which is then read completely. By default no
+// checkpoints are written.
+func Checkpoints(interval int64) Option {
+	return func(c *config) {
+		c.checkpointInterval = interval
+	}
+}
+
+// Overflow splits the record list of a bucket that grows larger than `size` bytes by the next byte
+// of the keys into up to 256 child lists. Inserts into the bucket then only rewrite the child list
+// they change and a small directory of the child lists, instead of the whole record list. This
+// bounds the write amplification of buckets that get many more keys than others, e.g. because of
+// skewed keys.
+//
+// Child lists aren't merged again if the bucket shrinks, unless the index is compacted. By default
+// record lists aren't split.
+func Overflow(size int) Option {
+	return func(c *config) {
+		c.overflowSize = size
+	}
+}
+
+// Deltas writes record lists that are larger than `size` bytes as deltas against the last version
+// of the list that was written completely. A delta contains the records that were inserted or
+// replaced since, and is merged into the complete version when the record list is read. Once the
+// delta grows larger than a quarter of the complete version, the record list is written completely
+// again. This reduces the amount of data that is written for inserts into large buckets, at the cost
+// of reading two record lists for them.
+//
+// Compacting the index writes all record lists completely. By default no deltas are written.
+func Deltas(size int) Option {
+	return func(c *config) {
+		c.deltaSize = size
+	}
+}
+
+// ReplicationJournal passes the record lists that every flush writes to the journal, e.g. a
+// FileJournal that a follower tails to keep a replica of the index up to date with ApplyUpdates.
+// The index isn't journaled by default.
+//
+// The journal only covers flushes. A replica needs to be created again when the index is replaced
+// by a garbage collection or a rebuild, or its primary storage changes positions.
+func ReplicationJournal(journal Journal) Option {
+	return func(c *config) {
+		c.journal = journal
+	}
+}
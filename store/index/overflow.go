@@ -0,0 +1,418 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// The record list of a bucket that exceeds the size set with Overflow is split by the first byte
+// of the index keys into up to 256 child lists. The bucket then points to an overflow directory,
+// a record list that starts with a marker record and contains a record per child list:
+//
+//	|   13 bytes    |                       Repeated                        |
+//	|    Marker     | Offset of child | Size of child | Child byte | Count  |
+//
+// The records of the directory are regular records, whose key is the child byte and whose value
+// size is the number of keys in the child list. A child list is written with the prefix of its
+// bucket and a marker of its own, followed by its records (with a seek table, if it's large enough).
+// Inserts only rewrite the child list they change and the directory.
+//
+// Markers are records with an empty key, like the start of a seek table, but with an offset that
+// seek tables never use.
+const (
+	overflowMarker      types.Position = math.MaxUint64
+	overflowChildMarker types.Position = math.MaxUint64 - 1
+)
+
+// Size of a marker record.
+const markerSize = FileOffsetBytes + FileSizeBytes + KeySizeBytes
+
+// childIndex identifies a child list of an overflowing bucket.
+type childIndex struct {
+	bucket BucketIndex
+	child  byte
+}
+
+// childPool contains the child lists that weren't flushed yet, like bucketPool.
+type childPool map[childIndex][]byte
+
+// listRef is the record list that a key is stored in, the one of its bucket or a child list.
+type listRef struct {
+	bucket BucketIndex
+	// Child list, -1 for the record list of the bucket
+	child int
+	// Directory of the bucket if it overflows
+	dir RecordList
+}
+
+// listMarker returns the marker a record list without its bucket prefix starts with, zero if it
+// has none.
+func listMarker(records []byte) types.Position {
+	if len(records) < markerSize || records[markerSize-1] != 0 {
+		return 0
+	}
+	return types.Position(binary.LittleEndian.Uint64(records))
+}
+
+// overflowDir returns the directory of a record list as it's stored on disk, nil if the bucket
+// doesn't overflow.
+func overflowDir(data []byte) RecordList {
+	records := data[BucketPrefixSize:]
+	if listMarker(records) != overflowMarker {
+		return nil
+	}
+	return RecordList(records[markerSize:])
+}
+
+// childOf returns the child list of an index key.
+func childOf(indexKey []byte) byte {
+	if len(indexKey) == 0 {
+		return 0
+	}
+	return indexKey[0]
+}
+
+// recordCount returns the number of keys of a record list as it's stored on disk. Child lists are
+// counted by their directory.
+func recordCount(data []byte) uint32 {
+	switch listMarker(data[BucketPrefixSize:]) {
+	case overflowChildMarker:
+		return 0
+	case deltaMarker:
+		return deltaCount(data[BucketPrefixSize:])
+	case overflowMarker:
+		var count uint32
+		iter := overflowDir(data).Iter()
+		for !iter.Done() {
+			count += uint32(iter.Next().ValueSize)
+		}
+		return count
+	}
+	return NewRecordList(data).Count()
+}
+
+// child returns the location of a child list in the directory.
+func (dir RecordList) child(child byte) (types.Block, bool) {
+	iter := dir.Iter()
+	for !iter.Done() {
+		record := iter.Next()
+		if record.Key[0] == child {
+			return record.Block, true
+		}
+	}
+	return types.Block{}, false
+}
+
+// readList reads the record list at the given location, including its bucket prefix. A delta is
+// returned merged into its base, see Deltas.
+func (i *Index) readList(indexOffset types.Position, recordListSize types.Size) ([]byte, error) {
+	if i.listCache != nil {
+		if data, ok := i.listCache.get(indexOffset); ok {
+			return data, nil
+		}
+	}
+	// The size prefix tells whether a checksum follows, hence it's read along.
+	buf := make([]byte, SizePrefixSize+int(recordListSize)+ListChecksumSize)
+	n, err := i.file.ReadAt(buf, int64(indexOffset)-int64(SizePrefixSize))
+	if err != nil && !(err == io.EOF && n >= SizePrefixSize+int(recordListSize)) {
+		return nil, err
+	}
+	data := buf[SizePrefixSize : SizePrefixSize+int(recordListSize)]
+	if binary.LittleEndian.Uint32(buf)&listChecksumFlag != 0 {
+		if n < len(buf) || !checkList(data, buf[len(buf)-ListChecksumSize:]) {
+			return nil, types.ErrIndexCorrupt(indexOffset)
+		}
+	}
+	if listMarker(data[BucketPrefixSize:]) == deltaMarker {
+		if data, err = i.mergeDelta(data); err != nil {
+			return nil, err
+		}
+	}
+	if i.listCache != nil {
+		i.listCache.put(indexOffset, data)
+	}
+	return data, nil
+}
+
+// readChild returns a child list of a directory that was flushed, nil if there is none.
+func (i *Index) readChild(dir RecordList, child byte) (RecordList, SeekTable, error) {
+	blk, ok := dir.child(child)
+	if !ok {
+		return nil, nil, nil
+	}
+	data, err := i.readList(blk.Offset, blk.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, table := seekRecords(RecordList(data[BucketPrefixSize+markerSize:]))
+	return records, table, nil
+}
+
+// readOverflow returns the records of all child lists of a directory in order. If `pending` is
+// set, the child lists that weren't flushed yet are used instead of the ones of the directory, the
+// bucket lock must be held then.
+func (i *Index) readOverflow(bucket BucketIndex, dir RecordList, pending bool) (RecordList, error) {
+	var records RecordList
+	for child := 0; child < 256; child++ {
+		if pending {
+			if data, ok := i.pendingChild(childIndex{bucket, byte(child)}); ok {
+				records = append(records, data...)
+				continue
+			}
+		}
+		data, _, err := i.readChild(dir, byte(child))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, data...)
+	}
+	return records, nil
+}
+
+// pendingChild returns a child list that wasn't flushed yet. The bucket lock must be held.
+func (i *Index) pendingChild(ref childIndex) ([]byte, bool) {
+	if data, ok := i.nextChildren[ref]; ok {
+		return data, true
+	}
+	data, ok := i.curChildren[ref]
+	return data, ok
+}
+
+// pendingRecords returns the record list a key is stored in if it wasn't flushed yet. The bucket
+// lock must be held.
+func (i *Index) pendingRecords(bucket BucketIndex, indexKey []byte) ([]byte, bool) {
+	if data, ok := i.nextPool[bucket]; ok {
+		return data, true
+	}
+	if data, ok := i.curPool[bucket]; ok {
+		return data, true
+	}
+	return i.pendingChild(childIndex{bucket, childOf(indexKey)})
+}
+
+// getRecordsForKey returns the record list a key is stored in for a change, together with a
+// reference to the list, see setRecords. The bucket lock must be held.
+func (i *Index) getRecordsForKey(bucket BucketIndex, indexKey []byte) (RecordList, listRef, error) {
+	ref := listRef{bucket: bucket, child: -1}
+	if data, ok := i.nextPool[bucket]; ok {
+		return NewRecordListRaw(data), ref, nil
+	}
+	if data, ok := i.curPool[bucket]; ok {
+		return NewRecordListRaw(data), ref, nil
+	}
+	indexOffset, recordListSize, err := i.buckets.Get(bucket)
+	if err != nil || indexOffset == 0 {
+		return nil, ref, err
+	}
+	data, err := i.readList(indexOffset, recordListSize)
+	if err != nil {
+		return nil, ref, err
+	}
+	ref.dir = overflowDir(data)
+	if ref.dir == nil {
+		records, _ := NewSeekRecordList(data)
+		return records, ref, nil
+	}
+	ref.child = int(childOf(indexKey))
+	if data, ok := i.pendingChild(childIndex{bucket, byte(ref.child)}); ok {
+		return NewRecordListRaw(data), ref, nil
+	}
+	records, _, err := i.readChild(ref.dir, byte(ref.child))
+	return records, ref, err
+}
+
+// setRecords replaces the record list that a reference of getRecordsForKey points to. The bucket
+// lock must be held.
+func (i *Index) setRecords(ref listRef, data []byte) {
+	i.outstandingWork += types.Work(len(data) + BucketPrefixSize + SizePrefixSize)
+	if ref.child < 0 {
+		i.nextPool[ref.bucket] = data
+		return
+	}
+	i.nextChildren[childIndex{ref.bucket, byte(ref.child)}] = data
+}
+
+// othersEmpty returns whether the bucket of a record list has no keys in any other record list,
+// i.e. whether the bucket is empty if the list is. The bucket lock must be held.
+func (i *Index) othersEmpty(ref listRef) bool {
+	if ref.child < 0 {
+		return true
+	}
+	var flushed [256]bool
+	iter := ref.dir.Iter()
+	for !iter.Done() {
+		flushed[iter.Next().Key[0]] = true
+	}
+	for child := 0; child < 256; child++ {
+		if child == ref.child {
+			continue
+		}
+		if data, ok := i.pendingChild(childIndex{ref.bucket, byte(child)}); ok {
+			if len(data) > 0 {
+				return false
+			}
+			continue
+		}
+		if flushed[child] {
+			return false
+		}
+	}
+	return true
+}
+
+// fullRecords returns all records of a bucket, the ones of its child lists if it overflows. The
+// bucket lock must be held.
+func (i *Index) fullRecords(bucket BucketIndex) (RecordList, error) {
+	if data, ok := i.nextPool[bucket]; ok {
+		return NewRecordListRaw(data), nil
+	}
+	if data, ok := i.curPool[bucket]; ok {
+		return NewRecordListRaw(data), nil
+	}
+	indexOffset, recordListSize, err := i.buckets.Get(bucket)
+	if err != nil || indexOffset == 0 {
+		return nil, err
+	}
+	data, err := i.readList(indexOffset, recordListSize)
+	if err != nil {
+		return nil, err
+	}
+	if dir := overflowDir(data); dir != nil {
+		return i.readOverflow(bucket, dir, true)
+	}
+	records, _ := NewSeekRecordList(data)
+	return records, nil
+}
+
+// flushRecords writes the record list of a bucket like flushBucket, split into child lists if it
+// exceeds the size set with Overflow.
+func (i *Index) flushRecords(bucket BucketIndex, data []byte) (types.Block, types.Work, error) {
+	if i.overflowSize == 0 || len(data) <= i.overflowSize {
+		return i.flushBucket(bucket, data)
+	}
+	children := make(map[byte][]byte)
+	iter := RecordList(data).Iter()
+	for !iter.Done() {
+		record := iter.Next()
+		child := childOf(record.Key)
+		children[child] = AddKeyPosition(children[child], record.KeyPositionPair)
+	}
+	return i.flushChildren(bucket, nil, children)
+}
+
+// flushChildren writes the changed child lists of a bucket and its new directory, which replaces
+// the given one. The bucket is written as empty record list if no child list has keys left.
+func (i *Index) flushChildren(bucket BucketIndex, dir RecordList, changed map[byte][]byte) (types.Block, types.Work, error) {
+	var entries [256]*KeyPositionPair
+	iter := dir.Iter()
+	for !iter.Done() {
+		record := iter.Next()
+		entries[record.Key[0]] = &record.KeyPositionPair
+	}
+	var work types.Work
+	for child := 0; child < 256; child++ {
+		records, ok := changed[byte(child)]
+		if !ok {
+			continue
+		}
+		entries[child] = nil
+		if len(records) == 0 {
+			continue
+		}
+		if i.seekTableThreshold > 0 && len(records) > i.seekTableThreshold {
+			records = encodeSeekTable(records)
+		}
+		marker := EncodeKeyPosition(KeyPositionPair{Block: types.Block{Offset: overflowChildMarker}})
+		blk, newWork, err := i.writeList(bucket, append(marker, records...))
+		if err != nil {
+			return types.Block{}, 0, err
+		}
+		work += newWork
+		entries[child] = &KeyPositionPair{
+			Key:          []byte{byte(child)},
+			Block:        blk,
+			ValueSize:    types.Size(RecordList(changed[byte(child)]).Count()),
+			HasValueSize: true,
+		}
+	}
+	data := EncodeKeyPosition(KeyPositionPair{Block: types.Block{Offset: overflowMarker}})
+	empty := true
+	for _, entry := range entries {
+		if entry != nil {
+			data = AddKeyPosition(data, *entry)
+			empty = false
+		}
+	}
+	if empty {
+		data = nil
+	}
+	blk, newWork, err := i.writeList(bucket, data)
+	return blk, work + newWork, err
+}
+
+// groupChildren returns the child lists of the pool that is committed by bucket.
+func (i *Index) groupChildren() map[BucketIndex]map[byte][]byte {
+	grouped := make(map[BucketIndex]map[byte][]byte)
+	for ref, data := range i.curChildren {
+		if grouped[ref.bucket] == nil {
+			grouped[ref.bucket] = make(map[byte][]byte)
+		}
+		grouped[ref.bucket][ref.child] = data
+	}
+	return grouped
+}
+
+// flushOverflow writes the changed child lists of a bucket that overflows, see flushChildren.
+func (i *Index) flushOverflow(bucket BucketIndex, changed map[byte][]byte) (types.Block, types.Work, error) {
+	i.bucketLk.RLock()
+	indexOffset, recordListSize, err := i.buckets.Get(bucket)
+	i.bucketLk.RUnlock()
+	if err != nil {
+		return types.Block{}, 0, err
+	}
+	var dir RecordList
+	if indexOffset != 0 {
+		data, err := i.readList(indexOffset, recordListSize)
+		if err != nil {
+			return types.Block{}, 0, err
+		}
+		dir = overflowDir(data)
+	}
+	if dir == nil {
+		return types.Block{}, 0, fmt.Errorf("bucket %d has child lists, but doesn't overflow", bucket)
+	}
+	return i.flushChildren(bucket, dir, changed)
+}
+
+// listReferences returns the locations of the record lists that a bucket's record list refers to,
+// the child lists if the bucket overflows or the base of a delta.
+func (i *Index) listReferences(indexOffset types.Position, recordListSize types.Size) ([]types.Position, error) {
+	if int(recordListSize) < BucketPrefixSize+markerSize {
+		return nil, nil
+	}
+	start := make([]byte, min(int(recordListSize), BucketPrefixSize+deltaHeaderSize))
+	if _, err := i.file.ReadAt(start, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	switch listMarker(start[BucketPrefixSize:]) {
+	case deltaMarker:
+		return []types.Position{deltaBase(start[BucketPrefixSize:]).Offset}, nil
+	case overflowMarker:
+	default:
+		return nil, nil
+	}
+	data, err := i.readList(indexOffset, recordListSize)
+	if err != nil {
+		return nil, err
+	}
+	var locations []types.Position
+	iter := overflowDir(data).Iter()
+	for !iter.Done() {
+		locations = append(locations, iter.Next().Block.Offset)
+	}
+	return locations, nil
+}
@@ -0,0 +1,107 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverflow(t *testing.T) {
+	// All keys are in bucket 7, they are spread over 8 child lists by their second byte.
+	var keys [][]byte
+	var data [][2][]byte
+	for n := 0; n < 200; n++ {
+		key := []byte{7, byte(n % 8), byte(n / 8), 4, 5, 6, 7, 8, 9, 10}
+		keys = append(keys, key)
+		data = append(data, [2][]byte{key, {byte(n)}})
+	}
+	primaryStorage := inmemory.NewInmemory(data)
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	options := []index.Option{index.Overflow(256), index.SeekTableThreshold(64)}
+	check := func(i *index.Index, from int, to int) {
+		for n := from; n < to; n++ {
+			found, ok, err := i.Get(keys[n])
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, types.Block{Offset: types.Position(n), Size: 1}, found)
+		}
+		require.Equal(t, uint64(to-from), i.Count())
+		var count int
+		require.NoError(t, i.ForEachRecord(func(bucket index.BucketIndex, record index.Record) error {
+			require.Equal(t, index.BucketIndex(7), bucket)
+			count++
+			return nil
+		}))
+		require.Equal(t, to-from, count)
+	}
+
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	for n := 0; n < 100; n++ {
+		require.NoError(t, i.Put(keys[n], types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	check(i, 0, 100)
+
+	// An insert only rewrites the child list of the key and the directory.
+	size := i.Size()
+	require.NoError(t, i.Put(keys[100], types.Block{Offset: 100, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.True(t, i.Size()-size < 512)
+	for n := 101; n < 200; n++ {
+		require.NoError(t, i.Put(keys[n], types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	check(i, 0, 200)
+	_, err = i.Flush()
+	require.NoError(t, err)
+	check(i, 0, 200)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	check(i, 0, 200)
+	occupied, _ := i.OccupiedBuckets()
+	require.Equal(t, uint64(1), occupied)
+	for n := 0; n < 100; n++ {
+		removed, err := i.Remove(keys[n])
+		require.NoError(t, err)
+		require.True(t, removed)
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	check(i, 100, 200)
+	_, err = i.Compact()
+	require.NoError(t, err)
+	check(i, 100, 200)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	check(i, 100, 200)
+	for n := 100; n < 200; n++ {
+		removed, err := i.Remove(keys[n])
+		require.NoError(t, err)
+		require.True(t, removed)
+	}
+	occupied, _ = i.OccupiedBuckets()
+	require.Zero(t, occupied)
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, options...)
+	require.NoError(t, err)
+	require.Zero(t, i.Count())
+	occupied, _ = i.OccupiedBuckets()
+	require.Zero(t, occupied)
+	require.NoError(t, i.Close())
+}
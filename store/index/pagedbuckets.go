@@ -0,0 +1,136 @@
+package index
+
+import (
+	"container/list"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Number of buckets that are stored in a single page of a paged bucket table.
+const BucketsPerPage = 512
+
+// Size of a single bucket entry in the page file: 8 bytes offset + 4 bytes size.
+const bucketEntrySize = types.OffBytesLen + types.SizeBytesLen
+
+const bucketPageSize = BucketsPerPage * bucketEntrySize
+
+type bucketPage struct {
+	num   int64
+	data  []byte
+	dirty bool
+}
+
+// pagedBucketTable is a bucket table that only keeps the most recently used pages in memory.
+//
+// All other pages live in a file next to the index. The file is rebuilt whenever the index is
+// opened, hence it doesn't need to survive crashes.
+type pagedBucketTable struct {
+	lk            sync.Mutex
+	file          *os.File
+	numBuckets    uint64
+	residentPages int
+	pages         map[int64]*list.Element
+	lru           *list.List
+}
+
+// NewPagedBucketTable returns a bucket table that is backed by the file at the given path and
+// keeps at most `residentPages` pages of `BucketsPerPage` buckets in memory.
+//
+// Any existing file at that path is truncated.
+func NewPagedBucketTable(path string, indexSizeBits uint8, residentPages int) (BucketTable, error) {
+	if indexSizeBits > 32 {
+		return nil, types.ErrIndexTooLarge
+	}
+	if residentPages < 1 {
+		residentPages = 1
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &pagedBucketTable{
+		file:          file,
+		numBuckets:    1 << indexSizeBits,
+		residentPages: residentPages,
+		pages:         make(map[int64]*list.Element, residentPages),
+		lru:           list.New(),
+	}, nil
+}
+
+func (t *pagedBucketTable) Get(index BucketIndex) (types.Position, types.Size, error) {
+	if uint64(index) >= t.numBuckets {
+		return 0, 0, types.ErrOutOfBounds
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	page, err := t.page(int64(index) / BucketsPerPage)
+	if err != nil {
+		return 0, 0, err
+	}
+	entry := page.data[(int(index)%BucketsPerPage)*bucketEntrySize:]
+	return types.Position(binary.LittleEndian.Uint64(entry)),
+		types.Size(binary.LittleEndian.Uint32(entry[types.OffBytesLen:])), nil
+}
+
+func (t *pagedBucketTable) Put(index BucketIndex, offset types.Position, size types.Size) error {
+	if uint64(index) >= t.numBuckets {
+		return types.ErrOutOfBounds
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	page, err := t.page(int64(index) / BucketsPerPage)
+	if err != nil {
+		return err
+	}
+	entry := page.data[(int(index)%BucketsPerPage)*bucketEntrySize:]
+	binary.LittleEndian.PutUint64(entry, uint64(offset))
+	binary.LittleEndian.PutUint32(entry[types.OffBytesLen:], uint32(size))
+	page.dirty = true
+	return nil
+}
+
+func (t *pagedBucketTable) Close() error {
+	return t.file.Close()
+}
+
+// page returns the page with the given number, loading it from disk and evicting the least
+// recently used page if needed. It must be called with the lock held.
+func (t *pagedBucketTable) page(num int64) (*bucketPage, error) {
+	if elem, ok := t.pages[num]; ok {
+		t.lru.MoveToFront(elem)
+		return elem.Value.(*bucketPage), nil
+	}
+
+	var page *bucketPage
+	if t.lru.Len() >= t.residentPages {
+		// Reuse the buffer of the evicted page.
+		elem := t.lru.Back()
+		page = elem.Value.(*bucketPage)
+		if page.dirty {
+			if _, err := t.file.WriteAt(page.data, page.num*bucketPageSize); err != nil {
+				return nil, err
+			}
+		}
+		t.lru.Remove(elem)
+		delete(t.pages, page.num)
+	} else {
+		page = &bucketPage{data: make([]byte, bucketPageSize)}
+	}
+
+	page.num = num
+	page.dirty = false
+	// Pages that were never written are beyond the end of the file and are all zeros.
+	n, err := t.file.ReadAt(page.data, num*bucketPageSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for i := n; i < len(page.data); i++ {
+		page.data[i] = 0
+	}
+	t.pages[num] = t.lru.PushFront(page)
+	return page, nil
+}
@@ -3,6 +3,7 @@ package index
 import (
 	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 
 	"github.com/hannahhoward/go-storethehash/store/types"
@@ -20,12 +21,62 @@ const FileSizeBytes int = 4
 // KeySizeBytes is key length slot, a one byte prefix
 const KeySizeBytes int = 1
 
+// ChecksumBytes is the byte size of the checksum of the full key, see `KeyChecksum`
+const ChecksumBytes int = 4
+
+// ValueSizeBytes is the byte size of the size of the value
+const ValueSizeBytes int = 4
+
+// Flags in the key length slot of records that are followed by a checksum of the full key and by
+// the size of the value respectively.
+//
+// Keys of 64 bytes or more don't fit next to the flags. The key length slot of their records holds
+// `longKeyMarker`, followed by a byte with the flags and a byte with the key length. The marker is
+// the slot of an empty key with both flags, which no record has.
+const (
+	checksumFlag  byte = 0x80
+	valueSizeFlag byte = 0x40
+	flagsMask          = checksumFlag | valueSizeFlag
+	longKeyMarker      = flagsMask
+)
+
+// Longest key whose length fits next to the flags in the key length slot.
+const maxShortKeyLength = int(valueSizeFlag) - 1
+
+// Size of the flags and the key length that follow the marker of a record with a long key.
+const longKeyBytes = 2
+
+// MaxKeyLength is the length of the longest key a record can store.
+const MaxKeyLength = 255
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 // KeyPositionPair contains a key, which is the unique prefix of the actual key, and the value
 // which is a file offset.
 type KeyPositionPair struct {
 	Key []byte
 	// The file offset where the full key and its value is actually stored.
 	Block types.Block
+	// Checksum of the full key, zero if the record doesn't store one
+	Checksum uint32
+	// Size of the value, only set if HasValueSize is
+	ValueSize    types.Size
+	HasValueSize bool
+}
+
+// withKey returns the pair with the key replaced.
+func (kp KeyPositionPair) withKey(key []byte) KeyPositionPair {
+	kp.Key = key
+	return kp
+}
+
+// KeyChecksum returns the checksum of a full key that is stored in its record. It is never zero.
+func KeyChecksum(key []byte) uint32 {
+	checksum := crc32.Checksum(key, castagnoliTable)
+	if checksum == 0 {
+		return 1
+	}
+	return checksum
 }
 
 // Record is a KeyPositionPair plus the actual position of the record in the record list
@@ -48,8 +99,12 @@ type Record struct {
 type RecordList []byte
 
 // NewRecordList returns an iterable RecordList from the given byte array
+//
+// The data is a record list as it is stored on disk, i.e. prefixed with the bucket and possibly a
+// seek table, both are skipped.
 func NewRecordList(data []byte) RecordList {
-	return RecordList(data[BucketPrefixSize:])
+	records, _ := NewSeekRecordList(data)
+	return records
 }
 
 // NewRecordList returns an iterable RecordList from the given byte array
@@ -105,17 +160,29 @@ func (rl RecordList) PutKeys(keys []KeyPositionPair, start int, end int) []byte
 // match, it's not guaranteed. Once the key is retieved from the primary storage it needs to
 // be checked if it actually matches.
 func (rl RecordList) Get(key []byte) (types.Block, bool) {
+	return rl.getFrom(0, key)
+}
+
+// getFrom is like Get, but starts the search at the given position. The position must be the start
+// of a record that sorts before any record that could match the key.
+func (rl RecordList) getFrom(pos int, key []byte) (types.Block, bool) {
+	record, matched := rl.getRecordFrom(pos, key)
+	return record.Block, matched
+}
+
+// getRecordFrom is like getFrom, but returns the whole matching record.
+func (rl RecordList) getRecordFrom(pos int, key []byte) (Record, bool) {
 	// Several prefixes can match a `key`, we are only interested in the last one that
 	// matches, hence keep a match around until we can be sure it's the last one.
-	rli := &RecordListIter{rl, 0}
-	var blk types.Block
+	rli := &RecordListIter{rl, pos}
+	var match Record
 	var matched bool
 	for !rli.Done() {
 		record := rli.Next()
 		// The stored prefix of the key needs to match the requested key.
 		if bytes.HasPrefix(key, record.Key) {
 			matched = true
-			blk = record.Block
+			match = record
 		} else if bytes.Compare(record.Key, key) == 1 {
 			// No keys from here on can possibly match, hence stop iterating. If we had a prefix
 			// match, return that, else return none
@@ -123,7 +190,7 @@ func (rl RecordList) Get(key []byte) (types.Block, bool) {
 		}
 	}
 
-	return blk, matched
+	return match, matched
 }
 
 // GetRecord returns the full record for a key in the recordList
@@ -154,13 +221,34 @@ func (rl RecordList) GetRecord(key []byte) *Record {
 func (rl RecordList) ReadRecord(pos int) Record {
 	sizeOffset := pos + FileOffsetBytes + FileSizeBytes
 	size := rl[int(sizeOffset)]
-	return Record{
-		pos,
-		KeyPositionPair{rl[sizeOffset+KeySizeBytes : sizeOffset+KeySizeBytes+int(size)], types.Block{
-			Offset: types.Position(binary.LittleEndian.Uint64(rl[pos:])),
-			Size:   types.Size(binary.LittleEndian.Uint32(rl[pos+FileOffsetBytes:])),
-		}},
+	flags := size & flagsMask
+	keyStart := sizeOffset + KeySizeBytes
+	keyEnd := keyStart + int(size&^flagsMask)
+	if size == longKeyMarker {
+		flags = rl[keyStart]
+		keyStart += longKeyBytes
+		keyEnd = keyStart + int(rl[keyStart-1])
+	}
+	record := Record{
+		Pos: pos,
+		KeyPositionPair: KeyPositionPair{
+			Key: rl[keyStart:keyEnd],
+			Block: types.Block{
+				Offset: types.Position(binary.LittleEndian.Uint64(rl[pos:])),
+				Size:   types.Size(binary.LittleEndian.Uint32(rl[pos+FileOffsetBytes:])),
+			},
+		},
+	}
+	extPos := keyEnd
+	if flags&checksumFlag != 0 {
+		record.Checksum = binary.LittleEndian.Uint32(rl[extPos:])
+		extPos += ChecksumBytes
 	}
+	if flags&valueSizeFlag != 0 {
+		record.ValueSize = types.Size(binary.LittleEndian.Uint32(rl[extPos:]))
+		record.HasValueSize = true
+	}
+	return record
 }
 
 // Len returns the byte length of the record list.
@@ -168,6 +256,17 @@ func (rl RecordList) Len() int {
 	return len(rl)
 }
 
+// Count returns the number of records in the record list.
+func (rl RecordList) Count() uint32 {
+	var count uint32
+	rli := rl.Iter()
+	for !rli.Done() {
+		rli.Next()
+		count++
+	}
+	return count
+}
+
 // Empty eturns true if the record list is empty.
 func (rl RecordList) Empty() bool {
 	return len(rl) == 0
@@ -195,13 +294,23 @@ func (rli *RecordListIter) Done() bool {
 func (rli *RecordListIter) Next() Record {
 	record := rli.records.ReadRecord(rli.pos)
 	// Prepare the internal state for the next call
-	rli.pos += FileOffsetBytes + FileSizeBytes + KeySizeBytes + len(record.Key)
+	rli.pos = record.NextPos()
 	return record
 }
 
 // NextPos returns the position of the next record.
 func (r *Record) NextPos() int {
-	return r.Pos + FileOffsetBytes + FileSizeBytes + KeySizeBytes + len(r.Key)
+	pos := r.Pos + FileOffsetBytes + FileSizeBytes + KeySizeBytes + len(r.Key)
+	if len(r.Key) > maxShortKeyLength {
+		pos += longKeyBytes
+	}
+	if r.Checksum != 0 {
+		pos += ChecksumBytes
+	}
+	if r.HasValueSize {
+		pos += ValueSizeBytes
+	}
+	return pos
 }
 
 // AddKeyPosition extends record data with an encoded key and a file offset.
@@ -209,21 +318,49 @@ func (r *Record) NextPos() int {
 // The format is:
 //
 // ```text
-//     |         8 bytes        |      1 byte     | Variable size < 256 bytes |
-//     | Pointer to actual data | Size of the key |            Key            |
+//     |         8 bytes        |      1 byte     | Variable size < 256 bytes |     4 bytes      |    4 bytes    |
+//     | Pointer to actual data | Size of the key |            Key            | Checksum of the  | Size of the   |
+//     |                        |                 |                           | full key, if set | value, if set |
 // ```
+//
+// If the record has a checksum, the highest bit of the key size is set, if it has the size of the
+// value, the second highest. The size of keys of 64 bytes or more is preceded by a marker and a
+// byte with those flags, see `longKeyMarker`. Keys must not be longer than `MaxKeyLength`.
 func AddKeyPosition(data []byte, keyPos KeyPositionPair) []byte {
-	size := byte(len(keyPos.Key))
+	var flags byte
+	withChecksum := keyPos.Checksum != 0
+	if withChecksum {
+		flags |= checksumFlag
+	}
+	withValueSize := keyPos.HasValueSize
+	if withValueSize {
+		flags |= valueSizeFlag
+	}
+	size := []byte{flags | byte(len(keyPos.Key))}
+	if len(keyPos.Key) > maxShortKeyLength {
+		size = []byte{longKeyMarker, flags, byte(len(keyPos.Key))}
+	}
 	offsetBytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(offsetBytes, uint64(keyPos.Block.Offset))
 	sizeBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(sizeBytes, uint32(keyPos.Block.Size))
-	return append(append(append(append(data, offsetBytes...), sizeBytes...), size), keyPos.Key...)
+	data = append(append(append(append(data, offsetBytes...), sizeBytes...), size...), keyPos.Key...)
+	if withChecksum {
+		checksumBytes := make([]byte, ChecksumBytes)
+		binary.LittleEndian.PutUint32(checksumBytes, keyPos.Checksum)
+		data = append(data, checksumBytes...)
+	}
+	if withValueSize {
+		valueSizeBytes := make([]byte, ValueSizeBytes)
+		binary.LittleEndian.PutUint32(valueSizeBytes, uint32(keyPos.ValueSize))
+		data = append(data, valueSizeBytes...)
+	}
+	return data
 }
 
 // EncodeKeyPosition a key and and offset into a single record
 func EncodeKeyPosition(keyPos KeyPositionPair) []byte {
-	encoded := make([]byte, 0, FileOffsetBytes+FileSizeBytes+KeySizeBytes+len(keyPos.Key))
+	encoded := make([]byte, 0, FileOffsetBytes+FileSizeBytes+KeySizeBytes+longKeyBytes+len(keyPos.Key)+ChecksumBytes+ValueSizeBytes)
 	return AddKeyPosition(encoded, keyPos)
 }
 
@@ -13,7 +13,7 @@ func TestEncodeKeyPosition(t *testing.T) {
 	key := []byte("abcdefg")
 	offset := 4326
 	size := 64
-	encoded := index.EncodeKeyPosition(index.KeyPositionPair{key, types.Block{Offset: types.Position(offset), Size: types.Size(size)}})
+	encoded := index.EncodeKeyPosition(index.KeyPositionPair{Key: key, Block: types.Block{Offset: types.Position(offset), Size: types.Size(size)}})
 	require.Equal(t,
 		encoded,
 		[]byte{
@@ -66,13 +66,44 @@ func TestRecordListIterator(t *testing.T) {
 	require.Equal(t, npos, nr.Pos)
 }
 
+func TestRecordListLongKeys(t *testing.T) {
+	// Every key length is stored with and without the optional fields, the records following
+	// them must be read back unchanged as well.
+	var pairs []index.KeyPositionPair
+	for length := 1; length <= index.MaxKeyLength; length++ {
+		key := make([]byte, length)
+		for n := range key {
+			key[n] = byte(length)
+		}
+		pairs = append(pairs,
+			index.KeyPositionPair{Key: key, Block: types.Block{Offset: types.Position(length), Size: 1}},
+			index.KeyPositionPair{Key: key, Block: types.Block{Offset: types.Position(length), Size: 2}, Checksum: uint32(length)},
+			index.KeyPositionPair{Key: key, Block: types.Block{Offset: types.Position(length), Size: 3}, ValueSize: 7, HasValueSize: true},
+			index.KeyPositionPair{Key: key, Block: types.Block{Offset: types.Position(length), Size: 4}, Checksum: uint32(length), ValueSize: 7, HasValueSize: true},
+		)
+	}
+	var data []byte
+	for _, pair := range pairs {
+		data = index.AddKeyPosition(data, pair)
+	}
+	records := index.NewRecordListRaw(data)
+	iter := records.Iter()
+	for _, pair := range pairs {
+		require.False(t, iter.Done())
+		record := iter.Next()
+		require.Equal(t, pair, record.KeyPositionPair)
+		require.Equal(t, len(index.EncodeKeyPosition(pair)), record.NextPos()-record.Pos)
+	}
+	require.True(t, iter.Done())
+}
+
 func TestRecordListFindKeyPosition(t *testing.T) {
 	// Create data
 	keys := []string{"a", "ac", "b", "d", "de", "dn", "nky", "xrlfg"}
 	// Encode them into records list
 	var data []byte
 	for i, key := range keys {
-		encoded := index.EncodeKeyPosition(index.KeyPositionPair{[]byte(key), types.Block{Offset: types.Position(i), Size: types.Size(i)}})
+		encoded := index.EncodeKeyPosition(index.KeyPositionPair{Key: []byte(key), Block: types.Block{Offset: types.Position(i), Size: types.Size(i)}})
 		data = append(data, encoded...)
 	}
 	// The record list have the bits that were used to determine the bucket as prefix
@@ -127,7 +158,7 @@ func TestRecordListFindKeyPosition(t *testing.T) {
 // Validate that the new key was properly added
 func assertAddKey(t *testing.T, records index.RecordList, key []byte) {
 	pos, _, _ := records.FindKeyPosition(key)
-	newData := records.PutKeys([]index.KeyPositionPair{{key, types.Block{Offset: types.Position(773), Size: types.Size(48)}}}, pos, pos)
+	newData := records.PutKeys([]index.KeyPositionPair{{Key: key, Block: types.Block{Offset: types.Position(773), Size: types.Size(48)}}}, pos, pos)
 	// The record list have the bits that were used to determine the bucket as prefix
 	prefixedNewData := append([]byte{0, 0, 0, 0}, newData...)
 	newRecords := index.NewRecordList(prefixedNewData)
@@ -145,7 +176,7 @@ func TestRecordListAddKeyWithoutReplacing(t *testing.T) {
 	// Encode them into records list
 	var data []byte
 	for i, key := range keys {
-		encoded := index.EncodeKeyPosition(index.KeyPositionPair{[]byte(key), types.Block{Offset: types.Position(i), Size: types.Size(i)}})
+		encoded := index.EncodeKeyPosition(index.KeyPositionPair{Key: []byte(key), Block: types.Block{Offset: types.Position(i), Size: types.Size(i)}})
 		data = append(data, encoded...)
 	}
 	// The record list have the bits that were used to determine the bucket as prefix
@@ -186,7 +217,7 @@ func assertAddKeyAndReplacePrev(t *testing.T, records index.RecordList, key []by
 	pos, prevRecord, hasPrev := records.FindKeyPosition(key)
 	require.True(t, hasPrev)
 
-	keys := []index.KeyPositionPair{{newPrevKey, prevRecord.Block}, {key, types.Block{Offset: types.Position(773), Size: types.Size(48)}}}
+	keys := []index.KeyPositionPair{{Key: newPrevKey, Block: prevRecord.Block}, {Key: key, Block: types.Block{Offset: types.Position(773), Size: types.Size(48)}}}
 	newData := records.PutKeys(keys, prevRecord.Pos, pos)
 	// The record list have the bits that were used to determine the bucket as prefix
 	prefixedNewData := append([]byte{0, 0, 0, 0}, newData...)
@@ -217,7 +248,7 @@ func TestRecordListAddKeyAndReplacePrev(t *testing.T) {
 	// Encode them into records list
 	var data []byte
 	for i, key := range keys {
-		encoded := index.EncodeKeyPosition(index.KeyPositionPair{[]byte(key), types.Block{Offset: types.Position(i), Size: types.Size(i)}})
+		encoded := index.EncodeKeyPosition(index.KeyPositionPair{Key: []byte(key), Block: types.Block{Offset: types.Position(i), Size: types.Size(i)}})
 		data = append(data, encoded...)
 	}
 	// The record list have the bits that were used to determine the bucket as prefix
@@ -253,7 +284,7 @@ func TestRecordListGetKey(t *testing.T) {
 	// Encode them into records list
 	var data []byte
 	for i, key := range keys {
-		encoded := index.EncodeKeyPosition(index.KeyPositionPair{[]byte(key), types.Block{Offset: types.Position(i), Size: types.Size(i)}})
+		encoded := index.EncodeKeyPosition(index.KeyPositionPair{Key: []byte(key), Block: types.Block{Offset: types.Position(i), Size: types.Size(i)}})
 		data = append(data, encoded...)
 	}
 	// The record list have the bits that were used to determine the bucket as prefix
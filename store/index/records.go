@@ -0,0 +1,110 @@
+package index
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// ForEachRecord calls `fn` for every record of the index in bucket order, including the records
+// that haven't been flushed yet. It stops at the first error `fn` returns.
+func (i *Index) ForEachRecord(fn func(bucket BucketIndex, record Record) error) error {
+	numBuckets := uint64(1) << i.sizeBits
+	for bucket := uint64(0); bucket < numBuckets; bucket++ {
+		records, err := i.readRecords(BucketIndex(bucket))
+		if err != nil {
+			return err
+		}
+		iter := records.Iter()
+		for !iter.Done() {
+			if err := fn(BucketIndex(bucket), iter.Next()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ForEachBucketRecord calls `fn` for every record of a bucket, including the records that haven't
+// been flushed yet. It stops at the first error `fn` returns.
+func (i *Index) ForEachBucketRecord(bucket BucketIndex, fn func(record Record) error) error {
+	records, err := i.readRecords(bucket)
+	if err != nil {
+		return err
+	}
+	iter := records.Iter()
+	for !iter.Done() {
+		if err := fn(iter.Next()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordMatches returns whether a record of the given bucket may belong to the given index key,
+// i.e. whether a Get of the key could return the record.
+func (i *Index) RecordMatches(bucket BucketIndex, record Record, indexKey []byte) bool {
+	keyBucket, err := i.getBucketIndex(indexKey)
+	if err != nil || keyBucket != bucket {
+		return false
+	}
+	return bytes.HasPrefix(StripBucketPrefix(indexKey, i.sizeBits), record.Key)
+}
+
+// RecordIter iterates over the records of an index in bucket order, see Index.Iter.
+type RecordIter struct {
+	index   *Index
+	bucket  uint64
+	records *RecordListIter
+	record  Record
+}
+
+// Iter returns an iterator over the records of the index in bucket order, including the records
+// that haven't been flushed yet. Only the index is read, not the primary storage, hence the keys
+// are the prefixes of the index keys that the records store.
+//
+// A bucket is read when the iterator gets to it, changes of buckets that were visited already
+// aren't seen.
+func (i *Index) Iter() *RecordIter {
+	return &RecordIter{index: i}
+}
+
+// Next returns the stored prefix of the index key and the block of the next record. It returns
+// `io.EOF` after the last record.
+func (it *RecordIter) Next() ([]byte, types.Block, error) {
+	numBuckets := uint64(1) << it.index.sizeBits
+	for it.records == nil || it.records.Done() {
+		if it.records != nil {
+			it.bucket++
+		}
+		if it.bucket >= numBuckets {
+			return nil, types.Block{}, io.EOF
+		}
+		records, err := it.index.readRecords(BucketIndex(it.bucket))
+		if err != nil {
+			return nil, types.Block{}, err
+		}
+		it.records = records.Iter()
+	}
+	it.record = it.records.Next()
+	// The bytes of the key that the bucket covers completely aren't stored in the record.
+	prefixBytes := int(it.index.sizeBits / 8)
+	prefix := make([]byte, prefixBytes+len(it.record.Key))
+	for b := 0; b < prefixBytes; b++ {
+		prefix[b] = byte(it.bucket >> (8 * b))
+	}
+	copy(prefix[prefixBytes:], it.record.Key)
+	return prefix, it.record.Block, nil
+}
+
+// Bucket returns the bucket of the record that was returned by the last call to Next.
+func (it *RecordIter) Bucket() BucketIndex {
+	return BucketIndex(it.bucket)
+}
+
+// Record returns the record that was returned by the last call to Next, which also contains the
+// checksum of the key and the size of the value if it stores them.
+func (it *RecordIter) Record() Record {
+	return it.record
+}
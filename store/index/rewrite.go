@@ -0,0 +1,100 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Rewrite writes a new index file to the given path. It contains only the current record list of
+// every bucket, with every block replaced by the one `remap` returns for it. Records for which
+// `remap` returns false are dropped.
+//
+// The new file is synced before Rewrite returns. All data needs to be flushed before and the index
+// must not be modified while it is rewritten. On error the new file is removed.
+func (i *Index) Rewrite(path string, remap func(types.Block) (types.Block, bool, error)) error {
+	file, err := openFileRandom(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	// The record lists are copied, but the file is neither preallocated nor segmented.
+	if _, err := i.rewrite(file, i.flags&^(FlagPreallocated|FlagSegments), remap, nil); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// rewrite writes the header with the given flags and the remapped record lists to the file, see
+// Rewrite. `placed` is called with the location of every record list that is written, if given.
+// It returns the size of the file.
+func (i *Index) rewrite(file indexFile, flags HeaderFlags, remap func(types.Block) (types.Block, bool, error), placed func(BucketIndex, types.Block)) (types.Position, error) {
+	h := NewHeader(i.sizeBits)
+	h.Flags = flags
+	header := FromHeader(h)
+	headerSize := make([]byte, SizePrefixSize)
+	binary.LittleEndian.PutUint32(headerSize, uint32(len(header)))
+	if _, err := file.Write(headerSize); err != nil {
+		return 0, err
+	}
+	if _, err := file.Write(header); err != nil {
+		return 0, err
+	}
+	// The new index shares the settings of this one, its record lists are written the same way.
+	dst := &Index{
+		sizeBits: i.sizeBits,
+		file:     file,
+		writer:   bufio.NewWriterSize(file, indexBufferSize),
+		length:   types.Position(len(header) + len(headerSize)),
+
+		seekTableThreshold: i.seekTableThreshold,
+		minKeyLength:       i.minKeyLength,
+		fullKeys:           i.fullKeys,
+		keyChecksums:       i.keyChecksums,
+		valueSizes:         i.valueSizes,
+		flags:              h.Flags,
+		listChecksums:      i.listChecksums,
+		overflowSize:       i.overflowSize,
+	}
+	for bucket := uint64(0); bucket < 1<<i.sizeBits; bucket++ {
+		records, err := i.readRecords(BucketIndex(bucket))
+		if err != nil {
+			return 0, err
+		}
+		if records == nil || records.Empty() {
+			continue
+		}
+		var pairs []KeyPositionPair
+		var removed []bool
+		iter := records.Iter()
+		for !iter.Done() {
+			pair := iter.Next().KeyPositionPair
+			blk, keep, err := remap(pair.Block)
+			if err != nil {
+				return 0, err
+			}
+			pair.Block = blk
+			pairs = append(pairs, pair)
+			removed = append(removed, !keep)
+		}
+		// The keys next to dropped records may get shorter.
+		data := dst.compactRecords(pairs, removed)
+		if len(data) == 0 {
+			continue
+		}
+		blk, _, err := dst.flushRecords(BucketIndex(bucket), data)
+		if err != nil {
+			return 0, err
+		}
+		if placed != nil {
+			placed(BucketIndex(bucket), blk)
+		}
+	}
+	if err := dst.writer.Flush(); err != nil {
+		return 0, err
+	}
+	return dst.length, file.Sync()
+}
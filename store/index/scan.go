@@ -0,0 +1,105 @@
+package index
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+type scanEntry struct {
+	key []byte
+	blk types.Block
+}
+
+// Scan calls `fn` for every key within the range [start, end) in ascending key order. A nil `end`
+// means that the range is unbounded.
+//
+// The index only stores key prefixes, hence the full keys are read from the primary storage. The
+// keys passed to `fn` are index keys (see `PrimaryStorage.IndexKey`).
+//
+// Buckets are determined by the first bytes of a key, so keys that share those bytes are spread
+// over several buckets if the number of bucket bits isn't a multiple of 8. The records of those
+// buckets are merged before they are passed on to `fn`.
+func (i *Index) Scan(start []byte, end []byte, fn func(key []byte, blk types.Block) error) error {
+	// Number of leading key bytes that are fully covered by the bucket bits. All keys with the
+	// same leading bytes form a group, groups are visited in lexicographic order.
+	groupBytes := int(i.sizeBits / 8)
+	bucketsPerGroup := 1 << (i.sizeBits % 8)
+
+	first := groupNumber(start, groupBytes)
+	last := uint64(1)<<(8*groupBytes) - 1
+	if end != nil {
+		last = groupNumber(end, groupBytes)
+	}
+
+	var entries []scanEntry
+	for group := first; group <= last; group++ {
+		entries = entries[:0]
+		// The bucket index is the little-endian interpretation of the key, whereas groups are
+		// numbered in big-endian order, hence the bytes need to be swapped.
+		var base BucketIndex
+		for b := 0; b < groupBytes; b++ {
+			base |= BucketIndex((group>>(8*(groupBytes-1-b)))&0xff) << (8 * b)
+		}
+		for n := 0; n < bucketsPerGroup; n++ {
+			bucket := base | BucketIndex(n)<<(8*groupBytes)
+			records, err := i.readRecords(bucket)
+			if err != nil {
+				return err
+			}
+			iter := records.Iter()
+			for !iter.Done() {
+				record := iter.Next()
+				key, err := i.Primary.GetIndexKey(record.Block)
+				if err != nil {
+					return err
+				}
+				if bytes.Compare(key, start) < 0 || (end != nil && bytes.Compare(key, end) >= 0) {
+					continue
+				}
+				entries = append(entries, scanEntry{key, record.Block})
+			}
+		}
+		sort.Slice(entries, func(a, b int) bool {
+			return bytes.Compare(entries[a].key, entries[b].key) < 0
+		})
+		for _, entry := range entries {
+			if err := fn(entry.key, entry.blk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ScanPrefix calls `fn` for every key that starts with the given prefix in ascending key order.
+func (i *Index) ScanPrefix(prefix []byte, fn func(key []byte, blk types.Block) error) error {
+	return i.Scan(prefix, PrefixEnd(prefix), fn)
+}
+
+// PrefixEnd returns the smallest key that is larger than all keys with the given prefix. It
+// returns nil if there is no such key, i.e. the prefix consists of 0xff bytes only.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for n := len(end) - 1; n >= 0; n-- {
+		if end[n] < 0xff {
+			end[n]++
+			return end[:n+1]
+		}
+	}
+	return nil
+}
+
+// groupNumber returns the first `groupBytes` bytes of the key as big-endian number. Missing bytes
+// are treated as zeros.
+func groupNumber(key []byte, groupBytes int) uint64 {
+	var group uint64
+	for b := 0; b < groupBytes; b++ {
+		group <<= 8
+		if b < len(key) {
+			group |= uint64(key[b])
+		}
+	}
+	return group
+}
@@ -0,0 +1,81 @@
+package index_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func initScanIndex(t *testing.T, bucketBits uint8, n int) (*index.Index, [][]byte) {
+	var entries [][2][]byte
+	var keys [][]byte
+	for len(keys) < n {
+		key := make([]byte, 8)
+		rand.Read(key)
+		// Make sure some keys share a prefix.
+		key[0] = byte(len(keys) % 4)
+		entries = append(entries, [2][]byte{key, {0x10}})
+		keys = append(keys, key)
+	}
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	i, err := index.OpenIndex(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(entries), bucketBits)
+	require.NoError(t, err)
+	for n, key := range keys {
+		require.NoError(t, i.Put(key, types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	sort.Slice(keys, func(a, b int) bool { return bytes.Compare(keys[a], keys[b]) < 0 })
+	return i, keys
+}
+
+func collectScan(t *testing.T, scan func(fn func([]byte, types.Block) error) error) [][]byte {
+	var found [][]byte
+	err := scan(func(key []byte, _ types.Block) error {
+		found = append(found, key)
+		return nil
+	})
+	require.NoError(t, err)
+	return found
+}
+
+func TestScan(t *testing.T) {
+	for _, bucketBits := range []uint8{4, 12, 16} {
+		i, keys := initScanIndex(t, bucketBits, 200)
+
+		found := collectScan(t, func(fn func([]byte, types.Block) error) error {
+			return i.Scan(nil, nil, fn)
+		})
+		require.Equal(t, keys, found, "full scan returns all keys in order")
+
+		start, end := keys[20], keys[150]
+		found = collectScan(t, func(fn func([]byte, types.Block) error) error {
+			return i.Scan(start, end, fn)
+		})
+		require.Equal(t, keys[20:150], found, "range scan returns [start, end)")
+
+		var expected [][]byte
+		for _, key := range keys {
+			if key[0] == 2 {
+				expected = append(expected, key)
+			}
+		}
+		found = collectScan(t, func(fn func([]byte, types.Block) error) error {
+			return i.ScanPrefix([]byte{2}, fn)
+		})
+		require.Equal(t, expected, found, "prefix scan returns keys with the prefix")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte{1, 3}, index.PrefixEnd([]byte{1, 2}))
+	require.Equal(t, []byte{2}, index.PrefixEnd([]byte{1, 0xff}))
+	require.Nil(t, index.PrefixEnd([]byte{0xff, 0xff}))
+}
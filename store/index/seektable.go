@@ -0,0 +1,87 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// Number of records between two entries of a seek table.
+const SeekTableInterval = 16
+
+// Size of a single seek table entry.
+const seekEntrySize = 4
+
+// SeekTable contains the positions of every `SeekTableInterval`-th record of a record list.
+//
+// Lookups in large record lists use it to jump close to the key instead of scanning the whole
+// list. Record lists that exceed the threshold set with `SeekTableThreshold` are stored with a seek
+// table in front of the records:
+//
+// ```text
+//     |                  Once                 |              Once              |    Repeated   |
+//     |                                       |                                |               |
+//     | 8 bytes |     4 bytes     |  1 byte   |          Variable size         | Variable size |
+//     |  Zero   | Size of table   |   Zero    | Record positions (4 bytes each) |     Record    |
+// ```
+//
+// The table is introduced by a record with an empty key. Stored keys are never empty, hence record
+// lists without a seek table stay readable.
+type SeekTable []uint32
+
+// NewSeekRecordList returns the record list and the seek table (if any) of the record list data as
+// it is stored on disk.
+func NewSeekRecordList(data []byte) (RecordList, SeekTable) {
+	return seekRecords(RecordList(data[BucketPrefixSize:]))
+}
+
+// seekRecords returns the records and the seek table (if any) of a record list without its bucket
+// prefix.
+func seekRecords(records RecordList) (RecordList, SeekTable) {
+	if records.Empty() || records[FileOffsetBytes+FileSizeBytes] != 0 {
+		return records, nil
+	}
+	tableSize := int(binary.LittleEndian.Uint32(records[FileOffsetBytes:]))
+	start := FileOffsetBytes + FileSizeBytes + KeySizeBytes
+	table := make(SeekTable, tableSize/seekEntrySize)
+	for n := range table {
+		table[n] = binary.LittleEndian.Uint32(records[start+n*seekEntrySize:])
+	}
+	return records[start+tableSize:], table
+}
+
+// Seek returns the position of the record at which a lookup for the key should start.
+func (st SeekTable) Seek(rl RecordList, key []byte) int {
+	// Find the first entry that sorts after the key, the lookup starts at the one before.
+	//
+	// Stored keys are never a prefix of another stored key, hence any record that matches the
+	// key as prefix can't be located before a record that sorts lower than the key.
+	n := sort.Search(len(st), func(n int) bool {
+		return bytes.Compare(rl.ReadRecord(int(st[n])).Key, key) > 0
+	})
+	if n == 0 {
+		return 0
+	}
+	return int(st[n-1])
+}
+
+// encodeSeekTable prefixes the records with a seek table.
+func encodeSeekTable(records RecordList) []byte {
+	var table []uint32
+	iter := records.Iter()
+	for n := 0; !iter.Done(); n++ {
+		pos := iter.pos
+		iter.Next()
+		if n%SeekTableInterval == 0 {
+			table = append(table, uint32(pos))
+		}
+	}
+	tableSize := len(table) * seekEntrySize
+	data := make([]byte, FileOffsetBytes+FileSizeBytes+KeySizeBytes+tableSize, FileOffsetBytes+FileSizeBytes+KeySizeBytes+tableSize+len(records))
+	binary.LittleEndian.PutUint32(data[FileOffsetBytes:], uint32(tableSize))
+	start := FileOffsetBytes + FileSizeBytes + KeySizeBytes
+	for n, pos := range table {
+		binary.LittleEndian.PutUint32(data[start+n*seekEntrySize:], pos)
+	}
+	return append(data, records...)
+}
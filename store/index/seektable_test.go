@@ -0,0 +1,84 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeekTable(t *testing.T) {
+	const bucketBits uint8 = 8
+	var entries [][2][]byte
+	for n := 0; n < 1000; n++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		entries = append(entries, [2][]byte{key, {byte(n)}})
+	}
+	primaryStorage := inmemory.NewInmemory(entries)
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	i, err := index.OpenIndex(indexPath, primaryStorage, bucketBits, index.SeekTableThreshold(64))
+	require.NoError(t, err)
+	for n, entry := range entries {
+		require.NoError(t, i.Put(entry[0], types.Block{Offset: types.Position(n), Size: 1}))
+	}
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Sync())
+
+	assertEntries := func(i *index.Index) {
+		for n, entry := range entries {
+			blk, found, err := i.Get(entry[0])
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, types.Block{Offset: types.Position(n), Size: 1}, blk)
+		}
+		missing := append([]byte{}, entries[0][0]...)
+		missing[9]++
+		blk, found, err := i.Get(missing)
+		require.NoError(t, err)
+		if found {
+			// Only a prefix is stored, hence a similar key may be found, but never the wrong block.
+			require.Equal(t, types.Block{Offset: 0, Size: 1}, blk)
+		}
+	}
+	assertEntries(i)
+	require.NoError(t, i.Close())
+
+	// The record lists on disk carry seek tables
+	file, err := os.Open(indexPath)
+	require.NoError(t, err)
+	defer file.Close()
+	_, bytesRead, err := index.ReadHeader(file)
+	require.NoError(t, err)
+	iter := index.NewIndexIter(file, bytesRead)
+	var tables int
+	for {
+		data, _, err, done := iter.Next()
+		require.NoError(t, err)
+		if done {
+			break
+		}
+		records, table := index.NewSeekRecordList(data)
+		if records.Len() > 64 {
+			require.Equal(t, (int(records.Count())+index.SeekTableInterval-1)/index.SeekTableInterval, len(table))
+			tables++
+		} else {
+			require.Empty(t, table)
+		}
+	}
+	require.NotZero(t, tables)
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, bucketBits, index.SeekTableThreshold(64))
+	require.NoError(t, err)
+	defer i.Close()
+	assertEntries(i)
+}
@@ -0,0 +1,438 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the manifest of a segmented index, see Segments.
+const manifestSuffix = ".segments"
+
+// The manifest lists the segments after the first one, which is the file at the index path and
+// starts with the header:
+//
+//	|         4 bytes        |      4 bytes      |       8 bytes      | … |
+//	| Number of the segments | Number of segment | Position of segment | … |
+//
+// A segment holds the record lists from its position in the index on up to the position of the
+// next one. Segments that are dropped leave a gap. Record lists never span segments.
+const manifestEntrySize = 4 + types.OffBytesLen
+
+// indexFile is the file the record lists are written to, either a plain file or the segments of a
+// segmented index.
+type indexFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.WriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Name() string
+}
+
+// segment is a file of a segmented index.
+type segment struct {
+	number uint32
+	// Position of the start of the segment in the index
+	base types.Position
+	file *os.File
+}
+
+// segmentPath returns the path of the file of the segment with the given number.
+func segmentPath(path string, number uint32) string {
+	if number == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%03d", path, number)
+}
+
+// readManifest returns the segments after the first one that the manifest of the index at the given
+// path lists, without opening them. It returns nil if there is no manifest.
+func readManifest(path string) ([]segment, error) {
+	data, err := ioutil.ReadFile(path + manifestSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 || len(data) != 4+int(binary.LittleEndian.Uint32(data))*manifestEntrySize {
+		return nil, fmt.Errorf("malformed segment manifest of index %s", path)
+	}
+	segments := make([]segment, binary.LittleEndian.Uint32(data))
+	for n := range segments {
+		entry := data[4+n*manifestEntrySize:]
+		segments[n].number = binary.LittleEndian.Uint32(entry)
+		segments[n].base = types.Position(binary.LittleEndian.Uint64(entry[4:]))
+	}
+	return segments, nil
+}
+
+// writeManifest replaces the manifest atomically with one that lists the given segments, except
+// the first one.
+func writeManifest(path string, segments []segment) error {
+	data := make([]byte, 4+(len(segments)-1)*manifestEntrySize)
+	binary.LittleEndian.PutUint32(data, uint32(len(segments)-1))
+	for n, seg := range segments[1:] {
+		entry := data[4+n*manifestEntrySize:]
+		binary.LittleEndian.PutUint32(entry, seg.number)
+		binary.LittleEndian.PutUint64(entry[4:], uint64(seg.base))
+	}
+	return writeFileAtomic(path+manifestSuffix, data)
+}
+
+// segmentNumbers returns the numbers of the segment files next to the index at the given path,
+// except the first one, whether the manifest lists them or not.
+func segmentNumbers(path string) ([]uint32, error) {
+	matches, err := filepath.Glob(path + ".[0-9][0-9][0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var numbers []uint32
+	for _, match := range matches {
+		number, err := strconv.ParseUint(strings.TrimPrefix(match, path+"."), 10, 32)
+		if err != nil || number == 0 {
+			continue
+		}
+		numbers = append(numbers, uint32(number))
+	}
+	return numbers, nil
+}
+
+// RemoveSegments removes the segments of the index at the given path except the first one, which
+// is the file at the path, together with the manifest. The index must not be open. It's used
+// before the file at the path is replaced by a new index.
+func RemoveSegments(path string) error {
+	if err := os.Remove(path + manifestSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	numbers, err := segmentNumbers(path)
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if err := os.Remove(segmentPath(path, number)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameIndex moves the index at `from`, together with its segments and its checkpoint, to `to`.
+// The segments and the checkpoint of an index that was at `to` are removed. The first segment is moved last, a crash before leaves the
+// index at `to` incomplete if it's segmented, the store rebuilds it from the primary storage then.
+func RenameIndex(from string, to string) error {
+	if err := RemoveSegments(to); err != nil {
+		return err
+	}
+	if err := removeCheckpoint(to); err != nil {
+		return err
+	}
+	if err := os.Rename(from+checkpointSuffix, to+checkpointSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	numbers, err := segmentNumbers(from)
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if err := os.Rename(segmentPath(from, number), segmentPath(to, number)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(from+manifestSuffix, to+manifestSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// segmentedFile is the file of a segmented index. Positions are those of the index, the data is
+// appended to the last segment.
+type segmentedFile struct {
+	path string
+	// Protects the list of segments, which changes when segments are added or dropped
+	lk       sync.RWMutex
+	segments []segment
+}
+
+var _ indexFile = &segmentedFile{}
+
+// openSegments opens the segments of an index whose first segment `first` is already open. Segment
+// files that the manifest doesn't list are left overs of a crash, they are removed.
+func openSegments(path string, first *os.File, manifest []segment, flag int) (*segmentedFile, error) {
+	f := &segmentedFile{
+		path:     path,
+		segments: append([]segment{{file: first}}, manifest...),
+	}
+	listed := make(map[uint32]bool, len(manifest))
+	for _, seg := range manifest {
+		listed[seg.number] = true
+	}
+	numbers, err := segmentNumbers(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, number := range numbers {
+		if listed[number] {
+			continue
+		}
+		if err := os.Remove(segmentPath(path, number)); err != nil {
+			return nil, err
+		}
+	}
+	for n := range f.segments[1:] {
+		seg := &f.segments[n+1]
+		if seg.file, err = openFileRandom(segmentPath(path, seg.number), flag); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// openSegmentsForRead opens the index at the given path and the segments the manifest lists for
+// reading. The index doesn't need to be segmented.
+func openSegmentsForRead(path string, manifest []segment) (*segmentedFile, error) {
+	f := &segmentedFile{
+		path:     path,
+		segments: append([]segment{{}}, manifest...),
+	}
+	for n := range f.segments {
+		seg := &f.segments[n]
+		file, err := os.Open(segmentPath(path, seg.number))
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		seg.file = file
+	}
+	return f, nil
+}
+
+// find returns the segment that contains the given position. It must be called with lk held.
+func (f *segmentedFile) find(off int64) segment {
+	n := sort.Search(len(f.segments), func(n int) bool {
+		return int64(f.segments[n].base) > off
+	})
+	if n == 0 {
+		return f.segments[0]
+	}
+	return f.segments[n-1]
+}
+
+// last returns the segment that is appended to.
+func (f *segmentedFile) last() segment {
+	f.lk.RLock()
+	defer f.lk.RUnlock()
+	return f.segments[len(f.segments)-1]
+}
+
+func (f *segmentedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lk.RLock()
+	seg := f.find(off)
+	f.lk.RUnlock()
+	return seg.file.ReadAt(p, off-int64(seg.base))
+}
+
+func (f *segmentedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lk.RLock()
+	seg := f.find(off)
+	f.lk.RUnlock()
+	return seg.file.WriteAt(p, off-int64(seg.base))
+}
+
+func (f *segmentedFile) Write(p []byte) (int, error) {
+	return f.last().file.Write(p)
+}
+
+func (f *segmentedFile) Seek(offset int64, whence int) (int64, error) {
+	seg := f.last()
+	if whence == io.SeekStart {
+		offset -= int64(seg.base)
+	}
+	pos, err := seg.file.Seek(offset, whence)
+	return pos + int64(seg.base), err
+}
+
+func (f *segmentedFile) Sync() error {
+	return f.last().file.Sync()
+}
+
+func (f *segmentedFile) Truncate(size int64) error {
+	seg := f.last()
+	return seg.file.Truncate(size - int64(seg.base))
+}
+
+func (f *segmentedFile) Name() string {
+	return f.path
+}
+
+func (f *segmentedFile) Close() error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	var err error
+	for _, seg := range f.segments {
+		if seg.file == nil {
+			continue
+		}
+		if closeErr := seg.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// rotate seals the last segment and starts a new one at the given position, which must be the end
+// of the last one. The new segment is listed in the manifest before anything is written to it.
+func (f *segmentedFile) rotate(base types.Position) error {
+	last := f.last()
+	if err := last.file.Sync(); err != nil {
+		return err
+	}
+	next := segment{number: last.number + 1, base: base}
+	path := segmentPath(f.path, next.number)
+	file, err := openFileRandom(path, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	next.file = file
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	segments := append(f.segments[:len(f.segments):len(f.segments)], next)
+	if err := writeManifest(f.path, segments); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	f.segments = segments
+	return nil
+}
+
+// drop removes the sealed segments for which `dead` returns true, the first and the last segment
+// are always kept. It returns the number of bytes that were removed.
+func (f *segmentedFile) drop(dead func(seg segment) bool) (int64, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	kept := []segment{f.segments[0]}
+	var dropped []segment
+	for n, seg := range f.segments[1:] {
+		if n+2 < len(f.segments) && dead(seg) {
+			dropped = append(dropped, seg)
+		} else {
+			kept = append(kept, seg)
+		}
+	}
+	if len(dropped) == 0 {
+		return 0, nil
+	}
+	// The manifest goes first, a segment that isn't listed is removed on open.
+	if err := writeManifest(f.path, kept); err != nil {
+		return 0, err
+	}
+	f.segments = kept
+	var size int64
+	for _, seg := range dropped {
+		if stat, err := seg.file.Stat(); err == nil {
+			size += stat.Size()
+		}
+		_ = seg.file.Close()
+		if err := os.Remove(segmentPath(f.path, seg.number)); err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+// truncateSegments truncates the index at the given path to the given position, which is within
+// its last segment.
+func truncateSegments(path string, manifest []segment, size types.Position) error {
+	var last segment
+	if len(manifest) > 0 {
+		last = manifest[len(manifest)-1]
+	}
+	return os.Truncate(segmentPath(path, last.number), int64(size-last.base))
+}
+
+// TruncateIndex cuts the index at the given path off at the given position, e.g. at the end of its
+// last successful flush, see `Index.FlushedSize`. The position is mapped to the segment that
+// contains it, later segments are removed. The index must not be open.
+func TruncateIndex(path string, size types.Position) error {
+	manifest, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	keep := 0
+	for keep < len(manifest) && manifest[keep].base <= size {
+		keep++
+	}
+	if keep < len(manifest) {
+		// The manifest stops listing the segments before they are removed.
+		if err := writeManifest(path, append([]segment{{}}, manifest[:keep]...)); err != nil {
+			return err
+		}
+		for _, seg := range manifest[keep:] {
+			if err := os.Remove(segmentPath(path, seg.number)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return truncateSegments(path, manifest[:keep], size)
+}
+
+// rotateSegment starts a new segment if a record list of the given size doesn't fit into the last
+// one anymore. A record list that is larger than a segment gets a segment of its own.
+func (i *Index) rotateSegment(size types.Position) error {
+	last := i.segments.last()
+	if i.length == last.base || int64(i.length-last.base+size) <= i.segmentSize {
+		return nil
+	}
+	// The record lists of the last segment go to its file before it's sealed.
+	if err := i.writer.Flush(); err != nil {
+		return err
+	}
+	return i.segments.rotate(i.length)
+}
+
+// dropSegments removes the sealed segments that no bucket refers to anymore, see Compact.
+func (i *Index) dropSegments() (int64, error) {
+	// The child lists of overflowing buckets and the bases of deltas are live as well.
+	var positions []types.Position
+	for bucket := uint64(0); bucket < 1<<i.sizeBits; bucket++ {
+		offset, size, err := i.buckets.Get(BucketIndex(bucket))
+		if err != nil {
+			return 0, err
+		}
+		if offset == 0 {
+			continue
+		}
+		children, err := i.listReferences(offset, size)
+		if err != nil {
+			return 0, err
+		}
+		positions = append(append(positions, offset), children...)
+	}
+	live := make(map[uint32]bool)
+	i.segments.lk.RLock()
+	for _, pos := range positions {
+		live[i.segments.find(int64(pos)).number] = true
+	}
+	i.segments.lk.RUnlock()
+	return i.segments.drop(func(seg segment) bool {
+		return !live[seg.number]
+	})
+}
+
+// Segmented returns whether the index file is split into segments, see Segments.
+func (i *Index) Segmented() bool {
+	return i.segments != nil
+}
@@ -0,0 +1,118 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegments(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{1, 2, 3, 4, 5, 6, 9, 8, 9, 10}
+	key3 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	check := func(i *index.Index, size types.Size) {
+		for key, blk := range map[string]types.Block{
+			string(key1): {Offset: 3, Size: size},
+			string(key2): {Offset: 1, Size: 1},
+			string(key3): {Offset: 2, Size: 1},
+		} {
+			found, ok, err := i.Get([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, blk, found)
+		}
+		require.Equal(t, uint64(3), i.Count())
+	}
+
+	_, err = index.OpenIndex(indexPath, primaryStorage, 8, index.Segments(64), index.Preallocate(4096))
+	require.Equal(t, types.ErrSegmentedIndex, err)
+
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, index.Segments(64))
+	require.NoError(t, err)
+	require.True(t, i.Segmented())
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	// Every update leaves the previous record list behind, the segments fill up.
+	for n := 0; n < 10; n++ {
+		require.NoError(t, i.Update(key1, types.Block{Offset: 3, Size: types.Size(n + 1)}))
+		_, err = i.Flush()
+		require.NoError(t, err)
+	}
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.True(t, exists(indexPath+".segments"))
+	require.True(t, exists(indexPath+".001"))
+	require.True(t, exists(indexPath+".002"))
+	check(i, 10)
+	size := i.Size()
+	require.NoError(t, i.Close())
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.Segments(64))
+	require.NoError(t, err)
+	check(i, 10)
+	require.Equal(t, size, i.Size())
+	// The segments with the outdated record lists are removed, positions stay the same.
+	dropped, err := i.Compact()
+	require.NoError(t, err)
+	require.True(t, dropped > 0)
+	require.False(t, exists(indexPath+".001"))
+	require.Equal(t, size, i.Size())
+	check(i, 10)
+	require.NoError(t, i.Update(key1, types.Block{Offset: 3, Size: 11}))
+	_, err = i.Flush()
+	require.NoError(t, err)
+	require.NoError(t, i.Close())
+
+	// A record list that was cut off at the end of the last segment is dropped.
+	manifest, err := ioutil.ReadFile(indexPath + ".segments")
+	require.NoError(t, err)
+	matches, err := filepath.Glob(indexPath + ".0*")
+	require.NoError(t, err)
+	last := matches[len(matches)-1]
+	file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{30, 0, 0, 0, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	// A segment that isn't in the manifest was left behind by a crash during rotation.
+	require.NoError(t, ioutil.WriteFile(indexPath+".999", []byte{1}, 0o644))
+
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.Segments(64))
+	require.NoError(t, err)
+	torn, ok := i.TornTail()
+	require.True(t, ok)
+	require.Equal(t, int64(7), torn.Dropped)
+	require.False(t, exists(indexPath+".999"))
+	check(i, 11)
+	require.NoError(t, i.Close())
+	unchanged, err := ioutil.ReadFile(indexPath + ".segments")
+	require.NoError(t, err)
+	require.Equal(t, manifest, unchanged)
+
+	// A new index at the path doesn't pick up the old segments.
+	require.NoError(t, os.Remove(indexPath))
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8)
+	require.NoError(t, err)
+	require.False(t, i.Segmented())
+	require.Zero(t, i.Count())
+	require.NoError(t, i.Close())
+	require.False(t, exists(indexPath+".segments"))
+	require.False(t, exists(last))
+}
@@ -0,0 +1,52 @@
+package index
+
+// Snapshot returns a read-only view of the index as it is on disk at the time of the call. Record
+// lists that are buffered and not flushed yet aren't part of the snapshot.
+//
+// The snapshot has its own copy of the bucket table, which takes as much memory as an in-memory
+// bucket table of the index, also if the index uses paged buckets. It shares the file and the
+// primary storage with the index, so it can only be used as long as the index is open. It must
+// not be written to, flushed or closed.
+func (i *Index) Snapshot() (*Index, error) {
+	buckets, err := NewMemBucketTable(i.sizeBits)
+	if err != nil {
+		return nil, err
+	}
+	i.bucketLk.RLock()
+	defer i.bucketLk.RUnlock()
+	if mem, ok := i.buckets.(*memBucketTable); ok {
+		snapshot := buckets.(*memBucketTable)
+		copy(snapshot.buckets, mem.buckets)
+		copy(snapshot.sizeBuckets, mem.sizeBuckets)
+	} else {
+		for bucket := uint64(0); bucket < 1<<i.sizeBits; bucket++ {
+			offset, size, err := i.buckets.Get(BucketIndex(bucket))
+			if err != nil {
+				return nil, err
+			}
+			if offset == 0 {
+				continue
+			}
+			if err := buckets.Put(BucketIndex(bucket), offset, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &Index{
+		sizeBits: i.sizeBits,
+		flags:    i.flags,
+		buckets:  buckets,
+		file:     i.file,
+		segments: i.segments,
+		Primary:  i.Primary,
+		curPool:  make(bucketPool),
+		nextPool: make(bucketPool),
+		length:   i.Size(),
+	}, nil
+}
+
+// ReadRawAt reads the raw data of the index file at the given offset, see `io.ReaderAt`. Only
+// data that was flushed can be read.
+func (i *Index) ReadRawAt(p []byte, off int64) (int, error) {
+	return i.file.ReadAt(p, off)
+}
@@ -0,0 +1,158 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// BucketUsage holds the number of records and the size of the records of every bucket, indexed by
+// bucket.
+type BucketUsage struct {
+	// Number of bits used for the buckets
+	Bits    uint8
+	Records []uint32
+	Bytes   []uint32
+}
+
+// BucketUsage returns the number of records and bytes of every bucket, including the ones that
+// aren't flushed yet. It reads every record list of the index.
+func (i *Index) BucketUsage() (BucketUsage, error) {
+	numBuckets := uint64(1) << i.sizeBits
+	usage := BucketUsage{
+		Bits:    i.sizeBits,
+		Records: make([]uint32, numBuckets),
+		Bytes:   make([]uint32, numBuckets),
+	}
+	for bucket := uint64(0); bucket < numBuckets; bucket++ {
+		records, err := i.readRecords(BucketIndex(bucket))
+		if err != nil {
+			return BucketUsage{}, err
+		}
+		usage.Records[bucket] = records.Count()
+		usage.Bytes[bucket] = uint32(records.Len())
+	}
+	return usage, nil
+}
+
+// Stats describes how the keys of an index are distributed over its buckets, see `Index.Stats`.
+type Stats struct {
+	// Number of buckets, and of those without records
+	Buckets      uint64
+	EmptyBuckets uint64
+	// Number of records
+	Records uint64
+	// Number of buckets by the number of records in their record list, i.e. `Lengths[n]` buckets
+	// have n records. The last element is for the longest record list.
+	Lengths []uint64
+	// Size of all record lists, and of the largest one
+	Bytes    uint64
+	MaxBytes uint64
+	// Size of the key prefixes that the records store
+	KeyBytes uint64
+}
+
+// Stats returns the distribution of the record list lengths and sizes over the buckets, including
+// the records that aren't flushed yet. It reads every record list of the index.
+//
+// Long record lists make lookups slow, if there are many of them compared to the number of empty
+// buckets the index should get more bucket bits. A few very long ones point to keys that aren't
+// distributed evenly.
+func (i *Index) Stats() (Stats, error) {
+	numBuckets := uint64(1) << i.sizeBits
+	stats := Stats{Buckets: numBuckets, Lengths: []uint64{0}}
+	for bucket := uint64(0); bucket < numBuckets; bucket++ {
+		records, err := i.readRecords(BucketIndex(bucket))
+		if err != nil {
+			return Stats{}, err
+		}
+		var count int
+		iter := records.Iter()
+		for !iter.Done() {
+			stats.KeyBytes += uint64(len(iter.Next().Key))
+			count++
+		}
+		for len(stats.Lengths) <= count {
+			stats.Lengths = append(stats.Lengths, 0)
+		}
+		stats.Lengths[count]++
+		if count == 0 {
+			stats.EmptyBuckets++
+		}
+		stats.Records += uint64(count)
+		size := uint64(records.Len())
+		stats.Bytes += size
+		if size > stats.MaxBytes {
+			stats.MaxBytes = size
+		}
+	}
+	return stats, nil
+}
+
+// AverageBytes returns the average size of the record lists of the buckets that aren't empty.
+func (s Stats) AverageBytes() float64 {
+	if s.Buckets == s.EmptyBuckets {
+		return 0
+	}
+	return float64(s.Bytes) / float64(s.Buckets-s.EmptyBuckets)
+}
+
+// AverageKeyLength returns the average length of the key prefixes that the records store.
+func (s Stats) AverageKeyLength() float64 {
+	if s.Records == 0 {
+		return 0
+	}
+	return float64(s.KeyBytes) / float64(s.Records)
+}
+
+// WriteTo writes the usage in a compact binary format. It starts with a single byte for the
+// number of bits, followed by the number of records and bytes of every bucket as 4-byte
+// little-endian integers.
+func (u BucketUsage) WriteTo(w io.Writer) (int64, error) {
+	writer := bufio.NewWriter(w)
+	n, err := writer.Write([]byte{u.Bits})
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	buf := make([]byte, 8)
+	for bucket := range u.Records {
+		binary.LittleEndian.PutUint32(buf, u.Records[bucket])
+		binary.LittleEndian.PutUint32(buf[4:], u.Bytes[bucket])
+		n, err := writer.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, writer.Flush()
+}
+
+// ReadBucketUsage reads usage that was written by `BucketUsage.WriteTo`.
+func ReadBucketUsage(r io.Reader) (BucketUsage, error) {
+	reader := bufio.NewReader(r)
+	bits, err := reader.ReadByte()
+	if err != nil {
+		return BucketUsage{}, err
+	}
+	if bits > 32 {
+		return BucketUsage{}, types.ErrIndexTooLarge
+	}
+	numBuckets := uint64(1) << bits
+	usage := BucketUsage{
+		Bits:    bits,
+		Records: make([]uint32, numBuckets),
+		Bytes:   make([]uint32, numBuckets),
+	}
+	buf := make([]byte, 8)
+	for bucket := uint64(0); bucket < numBuckets; bucket++ {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return BucketUsage{}, err
+		}
+		usage.Records[bucket] = binary.LittleEndian.Uint32(buf)
+		usage.Bytes[bucket] = binary.LittleEndian.Uint32(buf[4:])
+	}
+	return usage, nil
+}
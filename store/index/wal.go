@@ -0,0 +1,244 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the write-ahead log next to the index, see WriteAheadLog.
+const walSuffix = ".wal"
+
+// The write-ahead log is a sequence of changes:
+//
+//	|    4 bytes     |  1 byte   |   8 bytes    |  4 bytes   |     1 byte     |  4 bytes   | Variable size |  4 bytes |
+//	| Size of change | Operation | Block offset | Block size | Has value size | Value size |   Index key   | Checksum |
+//
+// The size covers the fields from the operation up to the key, the checksum is a CRC32 of them. A
+// change that is cut off or doesn't match its checksum ends the log.
+const walHeaderSize = 1 + types.OffBytesLen + types.SizeBytesLen + 1 + types.SizeBytesLen
+
+// Operations of the write-ahead log.
+const (
+	// The key is stored at the block, i.e. it was put or updated.
+	walSet byte = iota + 1
+	// The key was removed.
+	walRemove
+)
+
+// writeAheadLog records the changes of an index before they are written to the index file.
+type writeAheadLog struct {
+	lk   sync.Mutex
+	file *os.File
+	// Changes that weren't written to the file yet, protected by the bucketLk of the index
+	pending []byte
+	// Bytes of changes that were logged in total, protected by the bucketLk of the index
+	logged int64
+	// Bytes of changes that were written to the file in total, protected by lk
+	written int64
+	// Bytes of changes in total whose record lists were written by a commit that completed,
+	// accessed atomically
+	committed int64
+	// Total at the start of the file, protected by lk
+	start int64
+}
+
+func openWriteAheadLog(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path+walSuffix, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: file}, nil
+}
+
+// logChange adds a change to the write-ahead log if the index has one. It must be called with
+// bucketLk held for writing, before the change is put into the pool.
+func (i *Index) logChange(op byte, key []byte, location types.Block, valueSize *types.Size) {
+	w := i.wal
+	if w == nil {
+		return
+	}
+	size := walHeaderSize + len(key)
+	data := make([]byte, SizePrefixSize+size+ListChecksumSize)
+	binary.LittleEndian.PutUint32(data, uint32(size))
+	change := data[SizePrefixSize : SizePrefixSize+size]
+	change[0] = op
+	binary.LittleEndian.PutUint64(change[1:], uint64(location.Offset))
+	binary.LittleEndian.PutUint32(change[1+types.OffBytesLen:], uint32(location.Size))
+	if valueSize != nil {
+		change[1+types.OffBytesLen+types.SizeBytesLen] = 1
+		binary.LittleEndian.PutUint32(change[2+types.OffBytesLen+types.SizeBytesLen:], uint32(*valueSize))
+	}
+	copy(change[walHeaderSize:], key)
+	binary.LittleEndian.PutUint32(data[SizePrefixSize+size:], crc32.Checksum(change, castagnoliTable))
+	w.pending = append(w.pending, data...)
+	w.logged += int64(len(data))
+}
+
+// SyncLog writes the changes that were logged since the last call to the write-ahead log and syncs
+// it, see WriteAheadLog. It does nothing if the index has no write-ahead log.
+func (i *Index) SyncLog() error {
+	w := i.wal
+	if w == nil {
+		return nil
+	}
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	i.bucketLk.Lock()
+	pending := w.pending
+	w.pending = nil
+	i.bucketLk.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	if _, err := w.file.Write(pending); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.written += int64(len(pending))
+	return nil
+}
+
+// commitLog notes that a commit wrote the record lists of the changes that were logged up to the
+// given total.
+func (i *Index) commitLog(logged int64) {
+	if i.wal != nil {
+		atomic.StoreInt64(&i.wal.committed, logged)
+	}
+}
+
+// truncate empties the write-ahead log once the index file contains all changes of it. It must be
+// called after the index file was synced.
+func (w *writeAheadLog) truncate() error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if w.written == w.start || atomic.LoadInt64(&w.committed) < w.written {
+		return nil
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.start = w.written
+	return nil
+}
+
+// closeLog closes the write-ahead log. It's removed if the index file contains all logged changes,
+// otherwise the outstanding changes are written to it, so that they're replayed on open.
+func (i *Index) closeLog() error {
+	w := i.wal
+	i.bucketLk.RLock()
+	clean := atomic.LoadInt64(&w.committed) == w.logged && len(i.nextPool) == 0 && len(i.nextChildren) == 0
+	i.bucketLk.RUnlock()
+	if !clean {
+		if err := i.SyncLog(); err != nil {
+			_ = w.file.Close()
+			return err
+		}
+		return w.file.Close()
+	}
+	if err := i.file.Sync(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.file.Name())
+}
+
+// replayLog applies the changes of the write-ahead log at the given path to the index, makes them
+// durable and empties the log. Changes whose block doesn't contain the key in the primary storage
+// are skipped, their value didn't reach the primary storage before the crash. The log ends at the
+// first incomplete change. It returns the number of changes that were applied.
+func (i *Index) replayLog(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path + walSuffix)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var replayed uint64
+	for len(data) >= SizePrefixSize {
+		size := int(binary.LittleEndian.Uint32(data))
+		if size < walHeaderSize || len(data) < SizePrefixSize+size+ListChecksumSize {
+			break
+		}
+		change := data[SizePrefixSize : SizePrefixSize+size]
+		if crc32.Checksum(change, castagnoliTable) != binary.LittleEndian.Uint32(data[SizePrefixSize+size:]) {
+			break
+		}
+		data = data[SizePrefixSize+size+ListChecksumSize:]
+
+		blk := types.Block{
+			Offset: types.Position(binary.LittleEndian.Uint64(change[1:])),
+			Size:   types.Size(binary.LittleEndian.Uint32(change[1+types.OffBytesLen:])),
+		}
+		var valueSize *types.Size
+		if change[1+types.OffBytesLen+types.SizeBytesLen] == 1 {
+			size := types.Size(binary.LittleEndian.Uint32(change[2+types.OffBytesLen+types.SizeBytesLen:]))
+			valueSize = &size
+		}
+		applied, err := i.replayChange(change[0], change[walHeaderSize:], blk, valueSize)
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			replayed++
+		}
+	}
+	if _, err := i.Flush(); err != nil {
+		return 0, err
+	}
+	if err := i.Sync(); err != nil {
+		return 0, err
+	}
+	return replayed, os.Truncate(path+walSuffix, 0)
+}
+
+// replayChange applies a change of the write-ahead log. The result is the same if the change is
+// already part of the index.
+func (i *Index) replayChange(op byte, key []byte, blk types.Block, valueSize *types.Size) (bool, error) {
+	existing, found, err := i.Get(key)
+	if err != nil {
+		return false, err
+	}
+	// As the index only stores prefixes, the record found may belong to a different key.
+	if found {
+		found = i.storesKey(key, existing)
+	}
+	switch {
+	case op == walRemove && found:
+		_, err := i.Remove(key)
+		return true, err
+	case op != walSet || !i.storesKey(key, blk):
+		return false, nil
+	case found:
+		return true, i.update(key, blk, valueSize)
+	default:
+		return true, i.put(key, blk, valueSize)
+	}
+}
+
+// storesKey returns whether the primary storage contains the given index key at the block.
+func (i *Index) storesKey(key []byte, blk types.Block) bool {
+	indexKey, err := i.Primary.GetIndexKey(blk)
+	return err == nil && bytes.Equal(indexKey, key)
+}
+
+// ReplayedChanges returns the number of changes that were replayed from the write-ahead log when the
+// index was opened, see WriteAheadLog.
+func (i *Index) ReplayedChanges() uint64 {
+	return i.replayed
+}
@@ -0,0 +1,83 @@
+package index_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key2 := []byte{9, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key3 := []byte{17, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	key4 := []byte{25, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	primaryStorage := inmemory.NewInmemory([][2][]byte{{key1, {0x20}}, {key2, {0x30}}, {key3, {0x40}}})
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	walPath := indexPath + ".wal"
+	walSize := func() int64 {
+		info, err := os.Stat(walPath)
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	i, err := index.OpenIndex(indexPath, primaryStorage, 8, index.WriteAheadLog())
+	require.NoError(t, err)
+	require.NoError(t, i.Put(key1, types.Block{Offset: 0, Size: 1}))
+	require.NoError(t, i.Put(key2, types.Block{Offset: 1, Size: 1}))
+	require.NoError(t, i.SyncLog())
+	require.NotZero(t, walSize())
+	_, err = i.Flush()
+	require.NoError(t, err)
+	// The log is emptied once the index file is synced.
+	require.NoError(t, i.Sync())
+	require.Zero(t, walSize())
+
+	require.NoError(t, i.Put(key3, types.Block{Offset: 2, Size: 1}))
+	_, err = i.Remove(key1)
+	require.NoError(t, err)
+	// The value of the key didn't reach the primary storage.
+	require.NoError(t, i.Put(key4, types.Block{Offset: 3, Size: 1}))
+	require.NoError(t, i.SyncLog())
+	// A change that was cut off by the crash is ignored.
+	file, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{30, 0, 0, 0, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// Without closing, as after a crash before the index was flushed, the changes are replayed.
+	i2, err := index.OpenIndex(indexPath, primaryStorage, 8, index.WriteAheadLog())
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), i2.ReplayedChanges())
+	require.Zero(t, walSize())
+	check := func(i *index.Index) {
+		for n, key := range [][]byte{key1, key2, key3, key4} {
+			blk, found, err := i.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, n == 1 || n == 2, found, n)
+			if found {
+				require.Equal(t, types.Block{Offset: types.Position(n), Size: 1}, blk)
+			}
+		}
+		require.Equal(t, uint64(2), i.Count())
+	}
+	check(i2)
+
+	// Closing removes the log, the index contains all changes.
+	require.NoError(t, i2.Close())
+	_, err = os.Stat(walPath)
+	require.True(t, os.IsNotExist(err))
+	i, err = index.OpenIndex(indexPath, primaryStorage, 8, index.WriteAheadLog())
+	require.NoError(t, err)
+	defer i.Close()
+	require.Zero(t, i.ReplayedChanges())
+	check(i)
+}
@@ -0,0 +1,109 @@
+// Package ipfsmetrics reports the measurements of a store through go-metrics-interface, the
+// metrics abstraction of the IPFS ecosystem.
+//
+// Daemons like go-ipfs inject their metrics implementation (usually Prometheus) into
+// go-metrics-interface, the metrics of a store then show up next to the ones of the daemon:
+//
+//	s, err := store.OpenStore(path, primary, bits, interval, burst,
+//		store.WithMetrics(ipfsmetrics.New(metrics.CtxScope(ctx, "ipfs.blockstore"))))
+//
+// Without an injected implementation, all measurements are discarded.
+package ipfsmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+// Prefix of the names of all metrics, within the scope of the context passed to New.
+const Prefix = "storethehash"
+
+// Buckets of the latency histograms in seconds.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Metrics implements `store.Metrics` with go-metrics-interface.
+type Metrics struct {
+	puts            metrics.Counter
+	putBytes        metrics.Counter
+	putLatency      metrics.Histogram
+	getHits         metrics.Counter
+	getMisses       metrics.Counter
+	getLatency      metrics.Histogram
+	flushes         metrics.Counter
+	flushErrors     metrics.Counter
+	flushedWork     metrics.Counter
+	flushLatency    metrics.Histogram
+	throttles       metrics.Counter
+	throttleWait    metrics.Histogram
+	outstandingWork metrics.Gauge
+	retries         metrics.Counter
+}
+
+// New creates the metrics of a store within the metrics scope of the context, see
+// `metrics.CtxScope`. The metrics must only be created once per scope.
+func New(ctx context.Context) *Metrics {
+	newMetric := func(name string, help string) metrics.Creator {
+		return metrics.NewCtx(ctx, Prefix+"."+name, help)
+	}
+	return &Metrics{
+		puts:            newMetric("put.total", "Number of values that were stored").Counter(),
+		putBytes:        newMetric("put.bytes.total", "Size of the keys and values that were stored").Counter(),
+		putLatency:      newMetric("put.latency.seconds", "Time a put took, including throttling").Histogram(latencyBuckets),
+		getHits:         newMetric("get.hit.total", "Number of gets of keys that were found").Counter(),
+		getMisses:       newMetric("get.miss.total", "Number of gets of keys that weren't found").Counter(),
+		getLatency:      newMetric("get.latency.seconds", "Time a get took").Histogram(latencyBuckets),
+		flushes:         newMetric("flush.total", "Number of flushes").Counter(),
+		flushErrors:     newMetric("flush.error.total", "Number of flushes that failed").Counter(),
+		flushedWork:     newMetric("flush.work.bytes.total", "Work that was written by flushes").Counter(),
+		flushLatency:    newMetric("flush.latency.seconds", "Time a flush took").Histogram(latencyBuckets),
+		throttles:       newMetric("throttle.total", "Number of times a writer was throttled").Counter(),
+		throttleWait:    newMetric("throttle.wait.seconds", "Time a throttled writer waited").Histogram(latencyBuckets),
+		outstandingWork: newMetric("outstanding.work.bytes", "Work that waits to be flushed").Gauge(),
+		retries:         newMetric("retry.total", "Number of operations that were retried after a transient error").Counter(),
+	}
+}
+
+func (m *Metrics) ObservePut(bytes int, elapsed time.Duration) {
+	m.puts.Inc()
+	m.putBytes.Add(float64(bytes))
+	m.putLatency.Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) ObserveGet(hit bool, elapsed time.Duration) {
+	if hit {
+		m.getHits.Inc()
+	} else {
+		m.getMisses.Inc()
+	}
+	m.getLatency.Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) ObserveFlush(work types.Work, elapsed time.Duration, err error) {
+	m.flushes.Inc()
+	if err != nil {
+		m.flushErrors.Inc()
+		return
+	}
+	m.flushedWork.Add(float64(work))
+	m.flushLatency.Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) ObserveThrottle(wait time.Duration) {
+	m.throttles.Inc()
+	m.throttleWait.Observe(wait.Seconds())
+}
+
+func (m *Metrics) SetOutstandingWork(work types.Work) {
+	m.outstandingWork.Set(float64(work))
+}
+
+func (m *Metrics) ObserveRetry(string, error) {
+	m.retries.Inc()
+}
+
+var _ store.Metrics = &Metrics{}
+var _ store.RetryMetrics = &Metrics{}
@@ -0,0 +1,94 @@
+package ipfsmetrics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/ipfsmetrics"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder keeps the last value of every metric by name.
+type recorder struct {
+	lk     sync.Mutex
+	values map[string]float64
+}
+
+type recordedMetric struct {
+	r    *recorder
+	name string
+}
+
+func (m recordedMetric) Set(v float64) {
+	m.r.lk.Lock()
+	defer m.r.lk.Unlock()
+	m.r.values[m.name] = v
+}
+
+func (m recordedMetric) Add(v float64) {
+	m.r.lk.Lock()
+	defer m.r.lk.Unlock()
+	m.r.values[m.name] += v
+}
+
+func (m recordedMetric) Inc()              { m.Add(1) }
+func (m recordedMetric) Dec()              { m.Add(-1) }
+func (m recordedMetric) Sub(v float64)     { m.Add(-v) }
+func (m recordedMetric) Observe(v float64) { m.Add(1) }
+
+func (m recordedMetric) Counter() metrics.Counter                    { return m }
+func (m recordedMetric) Gauge() metrics.Gauge                        { return m }
+func (m recordedMetric) Histogram([]float64) metrics.Histogram       { return m }
+func (m recordedMetric) Summary(metrics.SummaryOpts) metrics.Summary { return m }
+
+func (r *recorder) get(name string) float64 {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.values[name]
+}
+
+func TestMetrics(t *testing.T) {
+	r := &recorder{values: make(map[string]float64)}
+	require.NoError(t, metrics.InjectImpl(func(name string, _ string) metrics.Creator {
+		return recordedMetric{r, name}
+	}))
+
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	ctx := metrics.CtxScope(context.Background(), "test")
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, 24, time.Second,
+		store.DefaultBurstRate, store.WithMetrics(ipfsmetrics.New(ctx)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	putBytes := 0
+	for _, blk := range blks[:2] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+		putBytes += len(blk.Cid().Bytes()) + len(blk.RawData())
+	}
+	for _, blk := range blks {
+		_, _, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+	}
+	require.True(t, r.get("test.storethehash.outstanding.work.bytes") > 0)
+	s.Flush()
+
+	require.Equal(t, float64(2), r.get("test.storethehash.put.total"))
+	require.Equal(t, float64(putBytes), r.get("test.storethehash.put.bytes.total"))
+	require.Equal(t, float64(2), r.get("test.storethehash.get.hit.total"))
+	require.Equal(t, float64(1), r.get("test.storethehash.get.miss.total"))
+	require.Equal(t, float64(1), r.get("test.storethehash.flush.total"))
+	require.True(t, r.get("test.storethehash.flush.work.bytes.total") > 0)
+	require.Equal(t, float64(0), r.get("test.storethehash.outstanding.work.bytes"))
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Order determines the order in which Iterate passes on the entries of a store.
+type Order int
+
+const (
+	// PhysicalOrder visits the entries in the order of their position in the primary storage,
+	// which reads it sequentially. The tiered primary storage passes on the small tier first.
+	// This is the default.
+	PhysicalOrder Order = iota
+	// DigestOrder visits the entries in ascending order of their index keys, i.e. the digests of
+	// the CIDs for the CID primary storage, by walking the buckets of the index like Scan.
+	DigestOrder
+	// InsertionOrder visits the entries in the order they were last put. With `EntryMetadata`,
+	// the insertion times are used. Otherwise it's the same as PhysicalOrder, which matches the
+	// insertion order as long as the primary storage is only appended to, i.e. until GC rewrites
+	// it.
+	InsertionOrder
+)
+
+type iterConfig struct {
+	order Order
+}
+
+// IterOption configures an iteration, see Iterate.
+type IterOption func(*iterConfig)
+
+// IterOrder sets the order in which the entries are visited.
+func IterOrder(order Order) IterOption {
+	return func(c *iterConfig) {
+		c.order = order
+	}
+}
+
+// iterEntry is an entry of the primary storage that Iterate visits.
+type iterEntry struct {
+	blk      types.Block
+	inserted time.Time
+}
+
+// Iterate calls `fn` with the key and value of every entry of the store, in physical order unless
+// IterOrder says otherwise. All orders are deterministic for a given state of the files, export
+// pipelines and reconciliation protocols can rely on them. Entries are passed on like by Get, e.g.
+// expired ones are skipped. It stops at the first error `fn` returns.
+//
+// Physical and insertion order need to sort the locations of all entries in memory, about 24 bytes
+// per entry. Writes wait while `fn` is called, like with Scan.
+func (s *Store) Iterate(fn func(key []byte, value []byte) error, options ...IterOption) error {
+	var c iterConfig
+	for _, option := range options {
+		option(&c)
+	}
+	if c.order == DigestOrder {
+		return s.Scan(nil, nil, fn)
+	}
+
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	// Several keys may refer to the same entry, e.g. aliases, it is visited once.
+	seen := make(map[types.Block]struct{})
+	var entries []iterEntry
+	err := s.index.ForEachRecord(func(_ index.BucketIndex, record index.Record) error {
+		if _, ok := seen[record.Block]; ok {
+			return nil
+		}
+		seen[record.Block] = struct{}{}
+		entries = append(entries, iterEntry{blk: record.Block})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].blk.Offset < entries[b].blk.Offset
+	})
+	if c.order == InsertionOrder && s.metadata {
+		for n := range entries {
+			_, data, err := s.index.Primary.Get(entries[n].blk)
+			if err != nil {
+				return err
+			}
+			meta, _, err := decodeMeta(data)
+			if err != nil {
+				return err
+			}
+			entries[n].inserted = meta.Inserted
+		}
+		// Entries that were put at the same time stay in physical order.
+		sort.SliceStable(entries, func(a, b int) bool {
+			return entries[a].inserted.Before(entries[b].inserted)
+		})
+	}
+
+	for _, entry := range entries {
+		key, data, err := s.index.Primary.Get(entry.blk)
+		if err != nil {
+			return err
+		}
+		var value []byte
+		var found bool
+		if s.chained() {
+			value, found, err = s.chainValue(data)
+		} else {
+			value, found, err = s.decodeValue(data)
+		}
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
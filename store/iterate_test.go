@@ -0,0 +1,72 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterateOrder(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, 8, defaultSyncInterval, defaultBurstRate, store.EntryMetadata())
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// An updated entry is moved to the end.
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), []byte("updated")))
+	s.Flush()
+
+	keys := func(options ...store.IterOption) [][]byte {
+		var keys [][]byte
+		require.NoError(t, s.Iterate(func(key []byte, _ []byte) error {
+			keys = append(keys, key)
+			return nil
+		}, options...))
+		return keys
+	}
+	var inserted [][]byte
+	for _, blk := range blks[1:] {
+		inserted = append(inserted, blk.Cid().Bytes())
+	}
+	inserted = append(inserted, blks[0].Cid().Bytes())
+	require.Equal(t, inserted, keys())
+	require.Equal(t, inserted, keys(store.IterOrder(store.InsertionOrder)))
+
+	var digests [][]byte
+	require.NoError(t, s.Scan(nil, nil, func(key []byte, _ []byte) error {
+		digests = append(digests, key)
+		return nil
+	}))
+	require.Equal(t, digests, keys(store.IterOrder(store.DigestOrder)))
+	require.Len(t, digests, len(blks))
+
+	// GC rewrites the entries in index order, which changes the physical order but not the
+	// insertion order.
+	require.NoError(t, s.GC(context.Background()))
+	require.Equal(t, inserted, keys(store.IterOrder(store.InsertionOrder)))
+	physical := keys(store.IterOrder(store.PhysicalOrder))
+	require.Len(t, physical, len(blks))
+	require.NotEqual(t, inserted, physical)
+
+	// Values are passed on like by Get.
+	require.NoError(t, s.Iterate(func(key []byte, value []byte) error {
+		if bytes.Equal(key, blks[0].Cid().Bytes()) {
+			require.Equal(t, []byte("updated"), value)
+		}
+		return nil
+	}))
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/sketch"
+)
+
+// KeySketch returns a HyperLogLog sketch of the index keys of the store with the given precision,
+// together with the number of index keys per prefix of `prefixBits` bits, see package `sketch`.
+//
+// Index keys are digests for the CID primary storage, hence the sketches of stores can be
+// combined to estimate how many blocks they share. Building the sketch reads the key of every
+// entry from the primary storage, it's meant to be exported and analyzed elsewhere instead of
+// being built on every request.
+func (s *Store) KeySketch(precision uint8, prefixBits uint8) (*sketch.Sketch, error) {
+	sk, err := sketch.New(precision, prefixBits)
+	if err != nil {
+		return nil, err
+	}
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	err = s.index.ForEachRecord(func(_ index.BucketIndex, record index.Record) error {
+		indexKey, err := s.index.Primary.GetIndexKey(record.Block)
+		if err != nil {
+			return err
+		}
+		sk.Add(indexKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
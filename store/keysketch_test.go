@@ -0,0 +1,52 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/sketch"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySketch(t *testing.T) {
+	open := func() *store.Store {
+		tempDir, err := ioutil.TempDir("", "sth")
+		require.NoError(t, err)
+		primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+		require.NoError(t, err)
+		s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s1 := open()
+	defer s1.Close()
+	s2 := open()
+	defer s2.Close()
+
+	// The stores share 100 of their 300 blocks.
+	blks := testutil.GenerateBlocksOfSize(500, 10)
+	for _, blk := range blks[:300] {
+		require.NoError(t, s1.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	for _, blk := range blks[200:] {
+		require.NoError(t, s2.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	sk1, err := s1.KeySketch(sketch.DefaultPrecision, 4)
+	require.NoError(t, err)
+	sk2, err := s2.KeySketch(sketch.DefaultPrecision, 4)
+	require.NoError(t, err)
+	var total uint64
+	for _, count := range sk1.Prefixes.Counts {
+		total += count
+	}
+	require.Equal(t, uint64(300), total)
+	require.InDelta(t, 300, sk1.HLL.Estimate(), 10)
+	overlap, err := sketch.EstimateOverlap(sk1.HLL, sk2.HLL)
+	require.NoError(t, err)
+	require.InDelta(t, 100, overlap, 20)
+}
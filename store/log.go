@@ -0,0 +1,19 @@
+package store
+
+// Logger receives the log messages of a store. The methods match the ones of zap's SugaredLogger,
+// hence loggers of go-log and zap can be used directly. `keysAndValues` are alternating keys and
+// values that add context to the message.
+type Logger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// nopLogger discards all messages, it is used if no logger is set.
+type nopLogger struct{}
+
+func (nopLogger) Debugw(string, ...interface{}) {}
+func (nopLogger) Infow(string, ...interface{})  {}
+func (nopLogger) Warnw(string, ...interface{})  {}
+func (nopLogger) Errorw(string, ...interface{}) {}
@@ -0,0 +1,79 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingLogger struct {
+	lk       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) log(level string, msg string) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.messages = append(l.messages, level+": "+msg)
+}
+
+func (l *recordingLogger) Debugw(msg string, _ ...interface{}) { l.log("debug", msg) }
+func (l *recordingLogger) Infow(msg string, _ ...interface{})  { l.log("info", msg) }
+func (l *recordingLogger) Warnw(msg string, _ ...interface{})  { l.log("warn", msg) }
+func (l *recordingLogger) Errorw(msg string, _ ...interface{}) { l.log("error", msg) }
+
+func TestLogger(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	logger := &recordingLogger{}
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval,
+			defaultBurstRate, store.WithLogger(logger))
+		require.NoError(t, err)
+		return s
+	}
+
+	s := open()
+	for _, blk := range testutil.GenerateBlocksOfSize(5, 100) {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.GC(context.Background()))
+	require.NoError(t, s.Close())
+
+	require.NoError(t, ioutil.WriteFile(indexPath+".gc", []byte("partial"), 0o644))
+	require.NoError(t, ioutil.WriteFile(dataPath+".gc", []byte("partial"), 0o644))
+	s = open()
+	require.NoError(t, s.Close())
+
+	require.Equal(t, []string{
+		"info: replaced files with compacted ones",
+		"info: rolling back interrupted GC",
+	}, logger.messages)
+}
+
+func TestNilLogger(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits,
+		defaultSyncInterval, defaultBurstRate, store.WithLogger(nil))
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.GC(context.Background()))
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,75 @@
+package store
+
+import "github.com/hannahhoward/go-storethehash/store/types"
+
+// MergeResult reports what MergeStores did.
+type MergeResult struct {
+	// Number of entries that were written to the destination
+	Copied uint64
+	// Number of entries that weren't written, as their key was already present in the destination
+	// or was put into it while merging
+	Skipped uint64
+}
+
+type mergeConfig struct {
+	source string
+}
+
+// MergeOption configures MergeStores.
+type MergeOption func(*mergeConfig)
+
+// MergeSource sets the name of the source that is recorded for the copied entries, see
+// `Store.Stat`. It defaults to the path of the index of the source store.
+func MergeSource(name string) MergeOption {
+	return func(c *mergeConfig) {
+		c.source = name
+	}
+}
+
+// MergeStores copies all entries of `src` whose key isn't present in `dst` yet into `dst`. Entries
+// whose key is present are left as they are in `dst`, even if the values differ.
+//
+// The live entries of `src` are read from its primary storage in index order, older values of keys
+// that were updated are not copied. Both stores stay usable while merging, entries that are put
+// into `src` meanwhile may or may not be copied. `dst` is flushed before MergeStores returns.
+//
+// The source of every copied entry is recorded in `dst`.
+func MergeStores(dst *Store, src *Store, options ...MergeOption) (MergeResult, error) {
+	c := mergeConfig{source: src.path}
+	for _, option := range options {
+		option(&c)
+	}
+	var result MergeResult
+	if dst.sharedStore == src.sharedStore {
+		return result, nil
+	}
+	err := src.Scan(nil, nil, func(key []byte, value []byte) error {
+		has, err := dst.Has(key)
+		if err != nil {
+			return err
+		}
+		if has {
+			result.Skipped++
+			return nil
+		}
+		// The key may be put into dst meanwhile, its value is kept then.
+		err = dst.PutIfAbsent(key, value)
+		if err == types.ErrKeyExists {
+			result.Skipped++
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := dst.recordSource(key, c.source); err != nil {
+			return err
+		}
+		result.Copied++
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	dst.Flush()
+	return result, dst.Err()
+}
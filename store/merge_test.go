@@ -0,0 +1,99 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeStores(t *testing.T) {
+	dst, err := initStore(t)
+	require.NoError(t, err)
+	defer dst.Close()
+	src, err := initStore(t)
+	require.NoError(t, err)
+	defer src.Close()
+
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	for _, blk := range blks[:10] {
+		require.NoError(t, dst.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	for _, blk := range blks[5:] {
+		require.NoError(t, src.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// Keys that are present in dst keep their value.
+	require.NoError(t, src.Put(blks[5].Cid().Bytes(), []byte("updated")))
+	src.Flush()
+
+	result, err := store.MergeStores(dst, src, store.MergeSource("shard-1"))
+	require.NoError(t, err)
+	require.Equal(t, store.MergeResult{Copied: 10, Skipped: 5}, result)
+	require.Equal(t, uint64(20), dst.Stats().Keys)
+	for n, blk := range blks {
+		value, found, err := dst.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+		stat, found, err := dst.Stat(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Size(len(blk.RawData())), stat.Size)
+		if n < 10 {
+			require.Equal(t, "", stat.Source)
+		} else {
+			require.Equal(t, "shard-1", stat.Source)
+		}
+	}
+
+	// Writing a copied entry directly drops its provenance.
+	require.NoError(t, dst.Put(blks[10].Cid().Bytes(), []byte("updated")))
+	stat, _, err := dst.Stat(blks[10].Cid().Bytes())
+	require.NoError(t, err)
+	require.Equal(t, "", stat.Source)
+
+	// GC keeps the sources of the copied entries that are still stored.
+	require.NoError(t, dst.Delete(blks[11].Cid().Bytes()))
+	require.NoError(t, dst.GC(context.Background()))
+	for _, blk := range blks[12:] {
+		stat, found, err := dst.Stat(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, "shard-1", stat.Source)
+	}
+	stat, _, err = dst.Stat(blks[10].Cid().Bytes())
+	require.NoError(t, err)
+	require.Equal(t, "", stat.Source)
+}
+
+func TestMergeSameStore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	defer s.Close()
+	other := open()
+	defer other.Close()
+	for _, blk := range testutil.GenerateBlocksOfSize(5, 100) {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	// Both handles refer to the same store, nothing is written.
+	result, err := store.MergeStores(s, other)
+	require.NoError(t, err)
+	require.Equal(t, store.MergeResult{}, result)
+}
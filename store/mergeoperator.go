@@ -0,0 +1,34 @@
+package store
+
+// MergeOperator combines the value of a Put with the value that is already stored under the key,
+// e.g. to implement counters, set unions or last-writer-wins registers without a read-modify-write
+// loop on the caller's side.
+//
+// Merge is called with the existing value and the value that was passed to Put, the result is
+// stored instead of the latter. It isn't called when the key has no value yet, or its value
+// expired, then the value of the Put is stored as is. Puts of the same key are serialized while
+// the operator runs, it shouldn't block. An error fails the Put and leaves the stored value as is.
+type MergeOperator interface {
+	Merge(key []byte, existing []byte, value []byte) ([]byte, error)
+}
+
+// MergeFunc adapts a function to a `MergeOperator`.
+type MergeFunc func(key []byte, existing []byte, value []byte) ([]byte, error)
+
+func (f MergeFunc) Merge(key []byte, existing []byte, value []byte) ([]byte, error) {
+	return f(key, existing, value)
+}
+
+// merge combines the value of a Put with the stored data of the key, which is decoded first in
+// expiry mode and with entry metadata.
+func (s *Store) merge(key []byte, stored []byte, value []byte) ([]byte, error) {
+	existing := stored
+	if s.expiry || s.metadata {
+		var live bool
+		var err error
+		if existing, live, err = s.decodeValue(stored); err != nil || !live {
+			return value, err
+		}
+	}
+	return s.mergeOperator.Merge(key, existing, value)
+}
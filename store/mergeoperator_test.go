@@ -0,0 +1,69 @@
+package store_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+// counter adds the 8 byte integers of all puts of a key.
+var counter = store.MergeFunc(func(_ []byte, existing []byte, value []byte) ([]byte, error) {
+	if len(existing) != 8 || len(value) != 8 {
+		return nil, errors.New("not a counter")
+	}
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, binary.LittleEndian.Uint64(existing)+binary.LittleEndian.Uint64(value))
+	return sum, nil
+})
+
+func TestMergeOperator(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	s, err := store.OpenStore(indexPath, inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.WithMergeOperator(counter))
+	require.NoError(t, err)
+	defer s.Close()
+
+	key := []byte("counter-key")
+	one := make([]byte, 8)
+	binary.LittleEndian.PutUint64(one, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				require.NoError(t, s.Put(key, one))
+			}
+		}()
+	}
+	wg.Wait()
+	value, found, err := s.Get(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(400), binary.LittleEndian.Uint64(value))
+
+	// A failing merge leaves the value as is.
+	require.Error(t, s.Put(key, []byte("x")))
+	value, _, err = s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(400), binary.LittleEndian.Uint64(value))
+}
+
+func TestMergeOperatorMultiValue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	_, err = store.OpenStore(indexPath, inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.WithMergeOperator(counter), store.MultiValue())
+	require.Equal(t, types.ErrMultiValue, err)
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// With entry metadata, every value is stored with a header that holds the time it was put in
+// nanoseconds since the Unix epoch and the flags that were passed to PutWithFlags. In expiry mode,
+// the expiration time follows the metadata.
+//
+//	|      8 bytes     | 1 byte |  Variable size  |
+//	|  Insertion time  | Flags  |      Value      |
+const metaHeaderSize = 9
+
+// Meta is the metadata of an entry, see `EntryMetadata`.
+type Meta struct {
+	// Time the value was put
+	Inserted time.Time
+	// Flags that were passed to PutWithFlags, zero for values that were put otherwise
+	Flags byte
+}
+
+func encodeMeta(meta Meta, value []byte) []byte {
+	data := make([]byte, metaHeaderSize+len(value))
+	binary.LittleEndian.PutUint64(data, uint64(meta.Inserted.UnixNano()))
+	data[8] = meta.Flags
+	copy(data[metaHeaderSize:], value)
+	return data
+}
+
+// decodeMeta splits the data of an entry into its metadata and the rest of the data.
+func decodeMeta(data []byte) (Meta, []byte, error) {
+	if len(data) < metaHeaderSize {
+		return Meta{}, nil, fmt.Errorf("value of %d bytes is too short for an entry with metadata", len(data))
+	}
+	meta := Meta{
+		Inserted: time.Unix(0, int64(binary.LittleEndian.Uint64(data))),
+		Flags:    data[8],
+	}
+	return meta, data[metaHeaderSize:], nil
+}
+
+// decodeValue returns the value of the data of an entry without its metadata, or false if it
+// expired in expiry mode.
+func (s *Store) decodeValue(data []byte) ([]byte, bool, error) {
+	if s.metadata {
+		var err error
+		if _, data, err = decodeMeta(data); err != nil {
+			return nil, false, err
+		}
+	}
+	if s.expiry {
+		return unexpired(data)
+	}
+	return data, true, nil
+}
+
+// GetMeta returns the metadata of the entry of a key, e.g. to audit when it was written. The store
+// needs to be opened with the `EntryMetadata` option.
+func (s *Store) GetMeta(key []byte) (Meta, bool, error) {
+	if !s.metadata {
+		return Meta{}, false, types.ErrNoMetadata
+	}
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return Meta{}, false, err
+	}
+	data, found, err := s.getCached(key, nil)
+	if err != nil || !found {
+		return Meta{}, false, err
+	}
+	meta, rest, err := decodeMeta(data)
+	if err != nil {
+		return Meta{}, false, err
+	}
+	if s.expiry {
+		// An expired entry has no metadata either.
+		if _, found, err = unexpired(rest); err != nil || !found {
+			return Meta{}, false, err
+		}
+	}
+	return meta, true, nil
+}
+
+// PutWithFlags stores a value like Put, together with the given flags, which GetMeta returns. The
+// meaning of the flags is up to the application. The store needs to be opened with the
+// `EntryMetadata` option.
+func (s *Store) PutWithFlags(key []byte, value []byte, flags byte) error {
+	if !s.metadata {
+		return types.ErrNoMetadata
+	}
+	return s.observePut(key, value, false, time.Time{}, flags)
+}
@@ -0,0 +1,106 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, store.EntryMetadata(), store.Expiry(0))
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+
+	before := time.Now()
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.NoError(t, s.PutWithFlags(blks[1].Cid().Bytes(), blks[1].RawData(), 0x5))
+	require.NoError(t, s.PutExpiring(blks[2].Cid().Bytes(), blks[2].RawData(), time.Now().Add(-time.Second)))
+	after := time.Now()
+
+	check := func(s *store.Store) {
+		for n, blk := range blks[:2] {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, blk.RawData(), value)
+			size, found, err := s.GetSize(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, types.Size(len(blk.RawData())), size)
+
+			meta, found, err := s.GetMeta(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.True(t, found)
+			require.False(t, meta.Inserted.Before(before.Truncate(0)))
+			require.False(t, meta.Inserted.After(after))
+			require.Equal(t, byte(n*0x5), meta.Flags)
+		}
+		// Expired entries have no metadata.
+		_, found, err := s.GetMeta(blks[2].Cid().Bytes())
+		require.NoError(t, err)
+		require.False(t, found)
+
+		scanned := 0
+		require.NoError(t, s.Scan(nil, nil, func(_ []byte, value []byte) error {
+			scanned++
+			// Values are passed on without their metadata.
+			require.Len(t, value, 100)
+			return nil
+		}))
+		require.Equal(t, 2, scanned)
+	}
+	check(s)
+
+	// Putting the same value again keeps its insertion time, changing its flags doesn't.
+	meta, _, err := s.GetMeta(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.Equal(t, types.ErrKeyExists, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	unchanged, _, err := s.GetMeta(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, meta.Inserted.Equal(unchanged.Inserted))
+	require.NoError(t, s.PutWithFlags(blks[0].Cid().Bytes(), blks[0].RawData(), 1))
+	changed, _, err := s.GetMeta(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.Equal(t, byte(1), changed.Flags)
+	require.False(t, changed.Inserted.Before(meta.Inserted))
+	require.NoError(t, s.PutWithFlags(blks[0].Cid().Bytes(), blks[0].RawData(), 0))
+	require.Equal(t, types.ErrKeyExists, s.PutWithFlags(blks[0].Cid().Bytes(), blks[0].RawData(), 0))
+	after = time.Now()
+
+	// The metadata survives reopening and GC.
+	s.Flush()
+	require.NoError(t, s.Close())
+	s = open()
+	defer s.Close()
+	check(s)
+	require.NoError(t, s.GC(context.Background()))
+	check(s)
+}
+
+func TestEntryMetadataNotEnabled(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+	_, _, err = s.GetMeta(key)
+	require.Equal(t, types.ErrNoMetadata, err)
+	require.Equal(t, types.ErrNoMetadata, s.PutWithFlags(key, []byte("value"), 1))
+}
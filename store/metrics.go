@@ -0,0 +1,28 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Metrics receives measurements of a store, e.g. to export them to Prometheus. Set it with the
+// `WithMetrics` option.
+//
+// The methods are called concurrently by all readers and writers of the store, they need to be
+// cheap.
+type Metrics interface {
+	// ObservePut is called after a Put stored a value, with the size of the key and value in
+	// bytes and the time the Put took, including the time it was throttled.
+	ObservePut(bytes int, elapsed time.Duration)
+	// ObserveGet is called after a Get, with whether the key was found and the time it took.
+	ObserveGet(hit bool, elapsed time.Duration)
+	// ObserveFlush is called after every flush with the work it wrote to the files, the time it
+	// took and the error it failed with, if any.
+	ObserveFlush(work types.Work, elapsed time.Duration, err error)
+	// ObserveThrottle is called when a writer is throttled by the rate limiter, with the time it
+	// has to wait.
+	ObserveThrottle(wait time.Duration)
+	// SetOutstandingWork is called whenever the work that waits to be flushed changes.
+	SetOutstandingWork(work types.Work)
+}
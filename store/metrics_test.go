@@ -0,0 +1,114 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingMetrics struct {
+	lk          sync.Mutex
+	puts        int
+	putBytes    int
+	hits        int
+	misses      int
+	flushes     int
+	flushedWork types.Work
+	throttles   int
+	outstanding types.Work
+}
+
+func (m *recordingMetrics) ObservePut(bytes int, _ time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.puts++
+	m.putBytes += bytes
+}
+
+func (m *recordingMetrics) ObserveGet(hit bool, _ time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *recordingMetrics) ObserveFlush(work types.Work, _ time.Duration, err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if err == nil {
+		m.flushes++
+		m.flushedWork += work
+	}
+}
+
+func (m *recordingMetrics) ObserveThrottle(time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.throttles++
+}
+
+func (m *recordingMetrics) SetOutstandingWork(work types.Work) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.outstanding = work
+}
+
+// alwaysThrottle makes every writer wait briefly.
+type alwaysThrottle struct{}
+
+func (alwaysThrottle) Allow(types.Work) time.Duration {
+	return time.Nanosecond
+}
+
+func (alwaysThrottle) OnFlush(types.Work, time.Duration) {}
+
+func TestMetrics(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	metrics := &recordingMetrics{}
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits,
+		defaultSyncInterval, defaultBurstRate, store.WithMetrics(metrics), store.RateLimit(alwaysThrottle{}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	putBytes := 0
+	for _, blk := range blks[:4] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+		putBytes += len(blk.Cid().Bytes()) + len(blk.RawData())
+	}
+	// Unchanged values aren't counted.
+	require.Equal(t, types.ErrKeyExists, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	for _, blk := range blks {
+		_, _, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+	}
+	metrics.lk.Lock()
+	require.True(t, metrics.outstanding > 0)
+	metrics.lk.Unlock()
+	s.Flush()
+
+	metrics.lk.Lock()
+	defer metrics.lk.Unlock()
+	require.Equal(t, 4, metrics.puts)
+	require.Equal(t, putBytes, metrics.putBytes)
+	require.Equal(t, 4, metrics.hits)
+	require.Equal(t, 1, metrics.misses)
+	require.Equal(t, 1, metrics.flushes)
+	require.True(t, metrics.flushedWork > 0)
+	require.Equal(t, types.Work(0), metrics.outstanding)
+	require.Equal(t, 4, metrics.throttles)
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Cache keeps the values that were read in memory, up to `size` bytes of keys and
+// values in total, the least recently used ones are dropped first. Values larger than a quarter of
+// the cache aren't cached.
+//
+// The cache assumes that it sees all writes of the store below it. Reads with options, e.g.
+// `store.ReadStale`, bypass the cache. Values are cached by the key they were read with. The store
+// treats keys with the same index key as one, e.g. CIDs with the same multihash, a write of one of
+// them doesn't drop the values cached under the others. Such keys need to be written and read in a
+// single form.
+func Cache(size int64) Middleware {
+	return func(next Store) Store {
+		return &cacheStore{
+			next:    next,
+			maxSize: size,
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		}
+	}
+}
+
+type cacheStore struct {
+	next    Store
+	lk      sync.Mutex
+	size    int64
+	maxSize int64
+	entries map[string]*list.Element
+	lru     *list.List
+	// Generation of the cache, it's incremented by every write so that the results of reads that
+	// overlapped with writes aren't cached.
+	generation uint64
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+// get returns the cached value of a key.
+func (cs *cacheStore) get(key []byte) ([]byte, bool) {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	elem, ok := cs.entries[string(key)]
+	if !ok {
+		return nil, false
+	}
+	cs.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+// add caches the value of a key unless a write happened since `generation`.
+func (cs *cacheStore) add(key []byte, value []byte, generation uint64) {
+	size := int64(len(key) + len(value))
+	if size > cs.maxSize/4 {
+		return
+	}
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	if generation != cs.generation {
+		return
+	}
+	if elem, ok := cs.entries[string(key)]; ok {
+		cs.remove(elem)
+	}
+	cs.entries[string(key)] = cs.lru.PushFront(&cacheEntry{key: string(key), value: value})
+	cs.size += size
+	for cs.size > cs.maxSize {
+		cs.remove(cs.lru.Back())
+	}
+}
+
+// invalidate drops the cached value of a key before and after it's written, reads that started
+// earlier don't cache what they read.
+func (cs *cacheStore) invalidate(key []byte) {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	cs.generation++
+	if elem, ok := cs.entries[string(key)]; ok {
+		cs.remove(elem)
+	}
+}
+
+// remove drops a cached value, it must be called with the lock held.
+func (cs *cacheStore) remove(elem *list.Element) {
+	entry := cs.lru.Remove(elem).(*cacheEntry)
+	delete(cs.entries, entry.key)
+	cs.size -= int64(len(entry.key) + len(entry.value))
+}
+
+func (cs *cacheStore) currentGeneration() uint64 {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	return cs.generation
+}
+
+func (cs *cacheStore) Get(key []byte, options ...store.ReadOption) ([]byte, bool, error) {
+	if len(options) > 0 {
+		return cs.next.Get(key, options...)
+	}
+	if value, ok := cs.get(key); ok {
+		return value, true, nil
+	}
+	generation := cs.currentGeneration()
+	value, found, err := cs.next.Get(key)
+	if err == nil && found {
+		cs.add(key, value, generation)
+	}
+	return value, found, err
+}
+
+func (cs *cacheStore) Has(key []byte) (bool, error) {
+	if _, ok := cs.get(key); ok {
+		return true, nil
+	}
+	return cs.next.Has(key)
+}
+
+func (cs *cacheStore) GetSize(key []byte) (types.Size, bool, error) {
+	if value, ok := cs.get(key); ok {
+		return types.Size(len(value)), true, nil
+	}
+	return cs.next.GetSize(key)
+}
+
+func (cs *cacheStore) Put(key []byte, value []byte) error {
+	cs.invalidate(key)
+	// A read while the write is in flight may still see the old value.
+	defer cs.invalidate(key)
+	return cs.next.Put(key, value)
+}
+
+func (cs *cacheStore) Delete(key []byte) error {
+	cs.invalidate(key)
+	defer cs.invalidate(key)
+	return cs.next.Delete(key)
+}
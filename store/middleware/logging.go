@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Logging logs every operation at debug level and those that fail at warn level.
+// `types.ErrKeyExists` isn't considered a failure.
+func Logging(log store.Logger) Middleware {
+	return func(next Store) Store {
+		return &loggingStore{next: next, log: log}
+	}
+}
+
+type loggingStore struct {
+	next Store
+	log  store.Logger
+}
+
+func (ls *loggingStore) observe(op string, key []byte, start time.Time, err error) {
+	if err != nil && err != types.ErrKeyExists {
+		ls.log.Warnw("store operation failed", "op", op, "key", key, "err", err)
+		return
+	}
+	ls.log.Debugw("store operation", "op", op, "key", key, "elapsed", time.Since(start))
+}
+
+func (ls *loggingStore) Get(key []byte, options ...store.ReadOption) ([]byte, bool, error) {
+	start := time.Now()
+	value, found, err := ls.next.Get(key, options...)
+	ls.observe("get", key, start, err)
+	return value, found, err
+}
+
+func (ls *loggingStore) Has(key []byte) (bool, error) {
+	start := time.Now()
+	has, err := ls.next.Has(key)
+	ls.observe("has", key, start, err)
+	return has, err
+}
+
+func (ls *loggingStore) GetSize(key []byte) (types.Size, bool, error) {
+	start := time.Now()
+	size, found, err := ls.next.GetSize(key)
+	ls.observe("get_size", key, start, err)
+	return size, found, err
+}
+
+func (ls *loggingStore) Put(key []byte, value []byte) error {
+	start := time.Now()
+	err := ls.next.Put(key, value)
+	ls.observe("put", key, start, err)
+	return err
+}
+
+func (ls *loggingStore) Delete(key []byte) error {
+	start := time.Now()
+	err := ls.next.Delete(key)
+	ls.observe("delete", key, start, err)
+	return err
+}
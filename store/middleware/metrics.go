@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store"
+)
+
+// Metrics reports the Gets and Puts that pass the middleware to `metrics`, measuring the time
+// everything below it took, e.g. a cache.
+func Metrics(metrics store.Metrics) Middleware {
+	return func(next Store) Store {
+		return &metricsStore{Store: next, metrics: metrics}
+	}
+}
+
+type metricsStore struct {
+	Store
+	metrics store.Metrics
+}
+
+func (ms *metricsStore) Get(key []byte, options ...store.ReadOption) ([]byte, bool, error) {
+	start := time.Now()
+	value, found, err := ms.Store.Get(key, options...)
+	if err == nil {
+		ms.metrics.ObserveGet(found, time.Since(start))
+	}
+	return value, found, err
+}
+
+func (ms *metricsStore) Put(key []byte, value []byte) error {
+	start := time.Now()
+	err := ms.Store.Put(key, value)
+	if err == nil {
+		ms.metrics.ObservePut(len(key)+len(value), time.Since(start))
+	}
+	return err
+}
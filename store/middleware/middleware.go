@@ -0,0 +1,37 @@
+// Package middleware layers cross-cutting behaviour, e.g. metrics, logging, retries or caching,
+// over a store without modifying it.
+//
+// A middleware wraps a Store and returns another one, middlewares are composed with Chain:
+//
+//	s := middleware.Chain(st, middleware.Logging(logger), middleware.Cache(64<<20))
+package middleware
+
+import (
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Store is the interface of the key-value operations of a store that middlewares wrap.
+// `*store.Store` implements it.
+type Store interface {
+	Get(key []byte, options ...store.ReadOption) ([]byte, bool, error)
+	Has(key []byte) (bool, error)
+	GetSize(key []byte) (types.Size, bool, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+}
+
+// Middleware returns a Store that adds some behaviour to `next`, which it calls to do the actual
+// operations.
+type Middleware func(next Store) Store
+
+// Chain wraps `s` in the given middlewares. The first middleware is the outermost one, it sees
+// every operation first.
+func Chain(s Store, middlewares ...Middleware) Store {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		s = middlewares[i](s)
+	}
+	return s
+}
+
+var _ Store = &store.Store{}
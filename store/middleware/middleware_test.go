@@ -0,0 +1,194 @@
+package middleware_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/middleware"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T) *store.Store {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(nil), 8, time.Second, 4*1024*1024)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// countingStore counts the Gets that reach the store and fails the first `failures` of them.
+type countingStore struct {
+	middleware.Store
+	gets     int
+	failures int
+}
+
+func (cs *countingStore) Get(key []byte, options ...store.ReadOption) ([]byte, bool, error) {
+	cs.gets++
+	if cs.failures > 0 {
+		cs.failures--
+		return nil, false, syscall.EAGAIN
+	}
+	return cs.Store.Get(key, options...)
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	tag := func(name string) middleware.Middleware {
+		return func(next middleware.Store) middleware.Store {
+			order = append(order, name)
+			return next
+		}
+	}
+	middleware.Chain(openStore(t), tag("outer"), tag("inner"))
+	// The innermost middleware wraps the store first.
+	require.Equal(t, []string{"inner", "outer"}, order)
+}
+
+func TestCache(t *testing.T) {
+	counting := &countingStore{Store: openStore(t)}
+	s := middleware.Chain(counting, middleware.Cache(1<<20))
+
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	key := blks[0].Cid().Bytes()
+	require.NoError(t, s.Put(key, blks[0].RawData()))
+	for n := 0; n < 3; n++ {
+		value, found, err := s.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blks[0].RawData(), value)
+	}
+	require.Equal(t, 1, counting.gets)
+
+	// Writes invalidate the cached value.
+	require.NoError(t, s.Put(key, []byte("updated")))
+	value, _, err := s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+	require.NoError(t, s.Delete(key))
+	has, err := s.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+// blockingStore blocks Puts until `release` is closed, after closing `started`.
+type blockingStore struct {
+	middleware.Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingStore) Put(key []byte, value []byte) error {
+	close(bs.started)
+	<-bs.release
+	return bs.Store.Put(key, value)
+}
+
+func TestCacheConcurrentPut(t *testing.T) {
+	st := openStore(t)
+	blocking := &blockingStore{Store: st, started: make(chan struct{}), release: make(chan struct{})}
+	s := middleware.Chain(blocking, middleware.Cache(1<<20))
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+	require.NoError(t, st.Put(key, []byte("old")))
+
+	done := make(chan error)
+	go func() {
+		done <- s.Put(key, []byte("new"))
+	}()
+	<-blocking.started
+	// The read while the put is in flight sees the old value, which isn't kept afterwards.
+	value, _, err := s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), value)
+	close(blocking.release)
+	require.NoError(t, <-done)
+	value, _, err = s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), value)
+}
+
+func TestRetry(t *testing.T) {
+	counting := &countingStore{Store: openStore(t), failures: 2}
+	s := middleware.Chain(counting, middleware.Retry(store.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+	require.NoError(t, s.Put(key, []byte("value")))
+	value, found, err := s.Get(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, 3, counting.gets)
+
+	// Errors that aren't transient are returned right away.
+	counting.gets = 0
+	s = middleware.Chain(&failingStore{Store: counting}, middleware.Retry(store.DefaultRetryPolicy))
+	_, _, err = s.Get(key)
+	require.Equal(t, errBroken, err)
+}
+
+var errBroken = errors.New("broken")
+
+type failingStore struct {
+	middleware.Store
+}
+
+func (fs *failingStore) Get([]byte, ...store.ReadOption) ([]byte, bool, error) {
+	return nil, false, errBroken
+}
+
+// recordingMetrics counts the operations it observes.
+type recordingMetrics struct {
+	puts, hits, misses int
+}
+
+func (rm *recordingMetrics) ObservePut(int, time.Duration) { rm.puts++ }
+func (rm *recordingMetrics) ObserveGet(hit bool, _ time.Duration) {
+	if hit {
+		rm.hits++
+	} else {
+		rm.misses++
+	}
+}
+func (rm *recordingMetrics) ObserveFlush(types.Work, time.Duration, error) {}
+func (rm *recordingMetrics) ObserveThrottle(time.Duration)                 {}
+func (rm *recordingMetrics) SetOutstandingWork(types.Work)                 {}
+
+// recordingLogger collects the messages logged at warn level.
+type recordingLogger struct {
+	debugs, warnings int
+}
+
+func (rl *recordingLogger) Debugw(string, ...interface{}) { rl.debugs++ }
+func (rl *recordingLogger) Infow(string, ...interface{})  {}
+func (rl *recordingLogger) Warnw(string, ...interface{})  { rl.warnings++ }
+func (rl *recordingLogger) Errorw(string, ...interface{}) {}
+
+func TestMetricsAndLogging(t *testing.T) {
+	metrics := &recordingMetrics{}
+	logger := &recordingLogger{}
+	s := middleware.Chain(openStore(t), middleware.Metrics(metrics), middleware.Logging(logger))
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.Equal(t, types.ErrKeyExists, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	_, _, err := s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	_, _, err = s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	_, err = s.Has([]byte{})
+	require.Error(t, err)
+
+	require.Equal(t, 1, metrics.puts)
+	require.Equal(t, 1, metrics.hits)
+	require.Equal(t, 1, metrics.misses)
+	require.Equal(t, 4, logger.debugs)
+	require.Equal(t, 1, logger.warnings)
+}
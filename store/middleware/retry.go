@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Retry retries reads that fail with a transient error according to `policy`, see
+// `store.RetryPolicy`. Writes aren't retried: a write that failed may have been partially applied,
+// the caller has to decide whether to repeat it.
+func Retry(policy store.RetryPolicy) Middleware {
+	return func(next Store) Store {
+		return &retryStore{Store: next, policy: policy}
+	}
+}
+
+type retryStore struct {
+	Store
+	policy store.RetryPolicy
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't transient, or the attempts of
+// the policy are used up.
+func (rs *retryStore) retry(fn func() error) error {
+	retryable := rs.policy.Retryable
+	if retryable == nil {
+		retryable = store.IsTransient
+	}
+	backoff := rs.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= rs.policy.MaxAttempts || !retryable(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; rs.policy.MaxBackoff > 0 && backoff > rs.policy.MaxBackoff {
+			backoff = rs.policy.MaxBackoff
+		}
+	}
+}
+
+func (rs *retryStore) Get(key []byte, options ...store.ReadOption) ([]byte, bool, error) {
+	var value []byte
+	var found bool
+	err := rs.retry(func() error {
+		var err error
+		value, found, err = rs.Store.Get(key, options...)
+		return err
+	})
+	return value, found, err
+}
+
+func (rs *retryStore) Has(key []byte) (bool, error) {
+	var has bool
+	err := rs.retry(func() error {
+		var err error
+		has, err = rs.Store.Has(key)
+		return err
+	})
+	return has, err
+}
+
+func (rs *retryStore) GetSize(key []byte) (types.Size, bool, error) {
+	var size types.Size
+	var found bool
+	err := rs.retry(func() error {
+		var err error
+		size, found, err = rs.Store.GetSize(key)
+		return err
+	})
+	return size, found, err
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// In multi-value mode, every value is stored with a header that links it to the entry of the
+// previous value of the same key. The first value of a key links to an empty block.
+//
+//	|      8 bytes      |     4 bytes     |  Variable size  |
+//	|  Previous offset  |  Previous size  |      Value      |
+//
+// The highest bit of the previous size marks tombstones, which remove all earlier occurrences of
+// their value from the chain.
+const chainHeaderSize = types.OffBytesLen + types.SizeBytesLen
+
+const tombstoneFlag = uint32(1) << 31
+
+func encodeChained(prev types.Block, value []byte, tombstone bool) []byte {
+	data := make([]byte, chainHeaderSize+len(value))
+	binary.LittleEndian.PutUint64(data, uint64(prev.Offset))
+	size := uint32(prev.Size)
+	if tombstone {
+		size |= tombstoneFlag
+	}
+	binary.LittleEndian.PutUint32(data[types.OffBytesLen:], size)
+	copy(data[chainHeaderSize:], value)
+	return data
+}
+
+func decodeChained(data []byte) (types.Block, []byte, bool, error) {
+	if len(data) < chainHeaderSize {
+		return types.Block{}, nil, false, fmt.Errorf("value of %d bytes is too short for a multi-value entry", len(data))
+	}
+	size := binary.LittleEndian.Uint32(data[types.OffBytesLen:])
+	prev := types.Block{
+		Offset: types.Position(binary.LittleEndian.Uint64(data)),
+		Size:   types.Size(size &^ tombstoneFlag),
+	}
+	return prev, data[chainHeaderSize:], size&tombstoneFlag != 0, nil
+}
+
+// GetValues returns all values of a key in the order they were put. Without the `MultiValue`
+// option, the single value of the key is returned.
+func (s *Store) GetValues(key []byte) ([][]byte, bool, error) {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return nil, false, err
+	}
+	data, found, err := get(s.index, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	if s.appendable {
+		if data, found, err = joinedValue(s.index.Primary, data); err != nil || !found {
+			return nil, false, err
+		}
+		return [][]byte{data}, true, nil
+	}
+	if !s.multiValue {
+		if s.expiry || s.metadata {
+			if data, found, err = s.decodeValue(data); err != nil || !found {
+				return nil, false, err
+			}
+		}
+		return [][]byte{data}, true, nil
+	}
+
+	values, err := liveValues(s.index.Primary, data, 0)
+	if err != nil || len(values) == 0 {
+		return nil, false, err
+	}
+	// The values were collected from the most recent one backwards.
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+	return values, true, nil
+}
+
+// PutValue adds a value to the values of a key, e.g. a provider record of a multihash, which
+// GetValues returns together with all earlier ones. It needs the `MultiValue` option, otherwise
+// `types.ErrNoMultiValue` is returned.
+func (s *Store) PutValue(key []byte, value []byte) error {
+	if !s.multiValue {
+		return types.ErrNoMultiValue
+	}
+	return s.observePut(key, value, false, time.Time{}, 0)
+}
+
+// PutValueIfAbsent adds a value to the values of a key, unless the key already has an equal value,
+// in which case `types.ErrKeyExists` is returned. The check and the put are atomic with respect to
+// other puts of the key. Like PutValue, it needs the `MultiValue` option.
+func (s *Store) PutValueIfAbsent(key []byte, value []byte) error {
+	if !s.multiValue {
+		return types.ErrNoMultiValue
+	}
+	return s.observePut(key, value, true, time.Time{}, 0)
+}
+
+// RemoveValue removes a value from the values of a key in multi-value mode. All values that are
+// equal to it are removed, it returns false if there was none. Once all its values are removed, the
+// key isn't found anymore.
+//
+// The removal is written as tombstone, the space of the removed values is reclaimed by GC.
+func (s *Store) RemoveValue(key []byte, value []byte) (bool, error) {
+	if !s.multiValue {
+		return false, types.ErrNoMultiValue
+	}
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return false, err
+	}
+	unlock, err := s.lockChain(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	indexKey, blk, found, err := lookup(s.index, key)
+	if err != nil || !found {
+		return false, err
+	}
+	data, found, err := readValue(s.index, indexKey, blk)
+	if err != nil || !found {
+		return false, err
+	}
+	has, err := chainHasValue(s.index.Primary, data, value)
+	if err != nil || !has {
+		return false, err
+	}
+	tombstone, err := s.index.Primary.Put(key, encodeChained(blk, value, true))
+	if err != nil {
+		return false, err
+	}
+	if err := s.index.Update(indexKey, tombstone); err != nil {
+		return false, err
+	}
+	s.noteIndexChange(indexKey)
+	return true, s.settle(types.Work(len(key) + len(value)))
+}
+
+// lockChain locks the chain of values of a key and returns the function that unlocks it.
+func (s *Store) lockChain(key []byte) (func(), error) {
+	indexKey, err := s.index.Primary.IndexKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexKey) == 0 {
+		return nil, types.ErrKeyTooShort
+	}
+	lk := &s.chainLks[indexKey[len(indexKey)-1]]
+	lk.Lock()
+	return lk.Unlock, nil
+}
+
+// liveValues returns the values of the chain starting at `data` that weren't removed, the most
+// recent one first. It stops after `limit` values unless `limit` is zero.
+func liveValues(primaryStorage primary.PrimaryStorage, data []byte, limit int) ([][]byte, error) {
+	var values [][]byte
+	var removed [][]byte
+	for {
+		prev, value, tombstone, err := decodeChained(data)
+		if err != nil {
+			return nil, err
+		}
+		if tombstone {
+			removed = append(removed, value)
+		} else if !containsValue(removed, value) {
+			values = append(values, value)
+			if len(values) == limit {
+				return values, nil
+			}
+		}
+		if prev.Size == 0 {
+			return values, nil
+		}
+		_, data, err = primaryStorage.Get(prev)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// latestValue returns the most recent value of the chain starting at `data` that wasn't removed.
+func latestValue(primaryStorage primary.PrimaryStorage, data []byte) ([]byte, bool, error) {
+	values, err := liveValues(primaryStorage, data, 1)
+	if err != nil || len(values) == 0 {
+		return nil, false, err
+	}
+	return values[0], true, nil
+}
+
+// chainHasValue returns whether the chain starting at `data` contains the given value.
+func chainHasValue(primaryStorage primary.PrimaryStorage, data []byte, value []byte) (bool, error) {
+	values, err := liveValues(primaryStorage, data, 0)
+	return containsValue(values, value), err
+}
+
+func containsValue(values [][]byte, value []byte) bool {
+	for _, v := range values {
+		if bytes.Equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compactChain writes the values of the chain whose most recent entry is stored at `blk` into the
+// compaction, without the removed values and tombstones. It returns the location of the new most
+// recent entry, or false if all values were removed.
+func compactChain(primaryStorage primary.PrimaryStorage, compaction primary.CompactionWriter, blk types.Block) (types.Block, bool, error) {
+	key, data, err := primaryStorage.Get(blk)
+	if err != nil {
+		return types.Block{}, false, err
+	}
+	values, err := liveValues(primaryStorage, data, 0)
+	if err != nil || len(values) == 0 {
+		return types.Block{}, false, err
+	}
+	var prev types.Block
+	for i := len(values) - 1; i >= 0; i-- {
+		if prev, err = compaction.Put(key, encodeChained(prev, values[i], false)); err != nil {
+			return types.Block{}, false, err
+		}
+	}
+	return prev, true, nil
+}
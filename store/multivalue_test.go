@@ -0,0 +1,216 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiValue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	openStore := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, store.MultiValue())
+		require.NoError(t, err)
+		return s
+	}
+
+	s := openStore()
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	key := blks[0].Cid().Bytes()
+	values := [][]byte{[]byte("provider-1"), []byte("provider-2"), []byte("provider-3")}
+	for _, value := range values {
+		require.NoError(t, s.Put(key, value))
+	}
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+
+	check := func() {
+		stored, found, err := s.GetValues(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, values, stored)
+
+		// The most recent value is the value of the key.
+		value, found, err := s.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, values[2], value)
+		size, found, err := s.GetSize(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, types.Size(len(values[2])), size)
+
+		stored, found, err = s.GetValues(blks[1].Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, [][]byte{blks[1].RawData()}, stored)
+	}
+	check()
+
+	s.Flush()
+	require.NoError(t, s.Close())
+	s = openStore()
+	defer s.Close()
+	check()
+
+	_, found, err := s.GetValues(testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestPutValue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	open := func(name string, options ...store.Option) *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, name+".data"))
+		require.NoError(t, err)
+		s, err := store.OpenStore(filepath.Join(tempDir, name+".index"), primary, defaultIndexSizeBits,
+			defaultSyncInterval, defaultBurstRate, options...)
+		require.NoError(t, err)
+		return s
+	}
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+
+	s := open("multi", store.MultiValue())
+	defer s.Close()
+	require.NoError(t, s.PutValue(key, []byte("provider-1")))
+	require.NoError(t, s.PutValue(key, []byte("provider-2")))
+	values, found, err := s.GetValues(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, [][]byte{[]byte("provider-1"), []byte("provider-2")}, values)
+
+	// A store that keeps a single value per key doesn't accumulate values.
+	single := open("single")
+	defer single.Close()
+	require.Equal(t, types.ErrNoMultiValue, single.PutValue(key, []byte("provider-1")))
+	require.Equal(t, types.ErrNoMultiValue, single.PutValueIfAbsent(key, []byte("provider-1")))
+	_, err = single.RemoveValue(key, []byte("provider-1"))
+	require.Equal(t, types.ErrNoMultiValue, err)
+	_, found, err = single.Get(key)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestRemoveValue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, store.MultiValue())
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	key := blks[0].Cid().Bytes()
+	other := blks[1].Cid().Bytes()
+	for _, value := range []string{"provider-1", "provider-2", "provider-1", "provider-3"} {
+		require.NoError(t, s.Put(key, []byte(value)))
+	}
+	require.NoError(t, s.Put(other, []byte("provider-1")))
+
+	// All equal values are removed.
+	removed, err := s.RemoveValue(key, []byte("provider-1"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	removed, err = s.RemoveValue(key, []byte("provider-1"))
+	require.NoError(t, err)
+	require.False(t, removed)
+	values, found, err := s.GetValues(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, [][]byte{[]byte("provider-2"), []byte("provider-3")}, values)
+
+	// The most recent value that wasn't removed is the value of the key.
+	removed, err = s.RemoveValue(key, []byte("provider-3"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	value, found, err := s.Get(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("provider-2"), value)
+
+	// A removed value can be added again.
+	require.NoError(t, s.PutValueIfAbsent(key, []byte("provider-1")))
+	values, _, err = s.GetValues(key)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("provider-2"), []byte("provider-1")}, values)
+
+	// GC rewrites the chains without the removed values and drops keys without values.
+	removed, err = s.RemoveValue(other, []byte("provider-1"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	has, err := s.Has(other)
+	require.NoError(t, err)
+	require.False(t, has)
+	sizeBefore := s.Stats().PrimarySize
+	require.NoError(t, s.GC(context.Background()))
+	require.True(t, s.Stats().PrimarySize < sizeBefore)
+	require.Equal(t, uint64(1), s.Stats().Keys)
+	values, found, err = s.GetValues(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, [][]byte{[]byte("provider-2"), []byte("provider-1")}, values)
+	_, found, err = s.GetValues(other)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestPutValueIfAbsent(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, store.MultiValue())
+	require.NoError(t, err)
+	defer s.Close()
+
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+	require.NoError(t, s.PutValueIfAbsent(key, []byte("provider-1")))
+	require.NoError(t, s.PutValueIfAbsent(key, []byte("provider-2")))
+	require.Equal(t, types.ErrKeyExists, s.PutValueIfAbsent(key, []byte("provider-1")))
+	require.Equal(t, types.ErrKeyExists, s.PutValueIfAbsent(key, []byte("provider-2")))
+
+	// Concurrent puts of the same value add it once.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.PutValueIfAbsent(key, []byte("provider-3"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+		} else {
+			require.Equal(t, types.ErrKeyExists, err)
+		}
+	}
+	require.Equal(t, 1, added)
+
+	values, found, err := s.GetValues(key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, [][]byte{[]byte("provider-1"), []byte("provider-2"), []byte("provider-3")}, values)
+}
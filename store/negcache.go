@@ -0,0 +1,110 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// negativeCache remembers index keys that were recently looked up and not found, so that repeated
+// lookups of the same absent key don't read the index again. It holds up to a fixed number of
+// keys, the least recently used one is evicted first.
+//
+// A Put removes its key. A miss is only added if no Put happened since the lookup started, which
+// is tracked by a generation that every Put increases, see add.
+type negativeCache struct {
+	lk         sync.Mutex
+	capacity   int
+	entries    map[string]*list.Element
+	lru        *list.List
+	generation uint64
+	hits       uint64
+}
+
+func newNegativeCache(capacity int) *negativeCache {
+	return &negativeCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// has returns whether the key is known to be absent, together with the generation to pass to add
+// if it isn't.
+func (c *negativeCache) has(indexKey []byte) (bool, uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	elem, ok := c.entries[string(indexKey)]
+	if ok {
+		c.hits++
+		c.lru.MoveToFront(elem)
+	}
+	return ok, c.generation
+}
+
+// add remembers that the key wasn't found by a lookup that started at the given generation.
+func (c *negativeCache) add(indexKey []byte, generation uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if generation != c.generation {
+		// The key may have been put after the lookup.
+		return
+	}
+	if _, ok := c.entries[string(indexKey)]; ok {
+		return
+	}
+	c.entries[string(indexKey)] = c.lru.PushFront(string(indexKey))
+	if c.lru.Len() > c.capacity {
+		delete(c.entries, c.lru.Remove(c.lru.Back()).(string))
+	}
+}
+
+// remove forgets the key, it must be called after the key was written to the index.
+func (c *negativeCache) remove(indexKey []byte) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.generation++
+	if elem, ok := c.entries[string(indexKey)]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, string(indexKey))
+	}
+}
+
+func (c *negativeCache) hitCount() uint64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.hits
+}
+
+// knownAbsent returns true if the bloom filter or the negative cache rule out that the key is
+// stored. Otherwise it returns the generation of the negative cache to pass to rememberAbsent.
+func (s *Store) knownAbsent(key []byte) (bool, uint64, error) {
+	if absent, err := s.bloomAbsent(key); err != nil || absent {
+		return absent, 0, err
+	}
+	if s.negCache == nil {
+		return false, 0, nil
+	}
+	indexKey, err := s.index.Primary.IndexKey(key)
+	if err != nil {
+		return false, 0, err
+	}
+	absent, generation := s.negCache.has(indexKey)
+	return absent, generation, nil
+}
+
+// rememberAbsent adds a key that wasn't found to the negative cache, see knownAbsent.
+func (s *Store) rememberAbsent(key []byte, generation uint64) {
+	if s.negCache == nil {
+		return
+	}
+	if indexKey, err := s.index.Primary.IndexKey(key); err == nil {
+		s.negCache.add(indexKey, generation)
+	}
+}
+
+// forgetAbsent removes a key that was written from the negative cache.
+func (s *Store) forgetAbsent(indexKey []byte) {
+	if s.negCache != nil {
+		s.negCache.remove(indexKey)
+	}
+}
@@ -0,0 +1,50 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegativeCache(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	s, err := store.OpenStore(indexPath, inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.NegativeCache(2))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	has := func(i int) bool {
+		has, err := s.Has(blks[i].Cid().Bytes())
+		require.NoError(t, err)
+		return has
+	}
+	require.False(t, has(1))
+	require.False(t, has(1))
+	_, found, err := s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Equal(t, uint64(2), s.Stats().NegativeCacheHits)
+	require.True(t, has(0))
+
+	// A put removes the key from the cache.
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+	require.True(t, has(1))
+
+	// The least recently used key is evicted.
+	require.False(t, has(2))
+	require.False(t, has(3))
+	require.False(t, has(2))
+	require.False(t, has(4))
+	require.Equal(t, uint64(3), s.Stats().NegativeCacheHits)
+	require.False(t, has(3))
+	require.Equal(t, uint64(3), s.Stats().NegativeCacheHits)
+}
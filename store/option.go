@@ -0,0 +1,358 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+type config struct {
+	indexOptions   []index.Option
+	autoBurstRate  bool
+	ctx            context.Context
+	limiter        RateLimiter
+	durability     DurabilityLevel
+	policy         Policy
+	metrics        Metrics
+	logger         Logger
+	multiValue     bool
+	expiry         bool
+	sweepInterval  time.Duration
+	bloomKeys      uint64
+	mergeOperator  MergeOperator
+	cacheSize      int64
+	negCacheSize   int
+	trackAccess    bool
+	maxPausedWork  types.Work
+	retryPolicy    RetryPolicy
+	verifyPercent  float64
+	degrade        bool
+	slowThreshold  time.Duration
+	slowEntries    int
+	denyEmpty      bool
+	appendable     bool
+	metadata       bool
+	growAverage    float64
+	growMaxBits    uint8
+	compactMode    bool
+	rebuildCorrupt bool
+	wal            bool
+	scrubInterval  time.Duration
+	scrubRepair    bool
+}
+
+// Option configures optional behaviour of a store.
+type Option func(*config)
+
+// IndexOptions passes options through to the index of the store.
+func IndexOptions(options ...index.Option) Option {
+	return func(c *config) {
+		c.indexOptions = append(c.indexOptions, options...)
+	}
+}
+
+// AutoBurstRate calibrates the burst rate of the default rate limiter from the measured flush
+// throughput instead of using the fixed value passed to OpenStore, see
+// `TokenBucket.AutoCalibrate`.
+func AutoBurstRate() Option {
+	return func(c *config) {
+		c.autoBurstRate = true
+	}
+}
+
+// RateLimit replaces the default token bucket rate limiter. Use `NoRateLimit{}` to never throttle
+// writers.
+func RateLimit(limiter RateLimiter) Option {
+	return func(c *config) {
+		c.limiter = limiter
+	}
+}
+
+// Context sets a parent context for the background work of the store. Cancelling it stops the
+// background flusher and any other background task, as closing the store does. The store still
+// needs to be closed to release its files.
+func Context(ctx context.Context) Option {
+	return func(c *config) {
+		c.ctx = ctx
+	}
+}
+
+// DurabilityLevel determines when writes are persisted.
+type DurabilityLevel int
+
+const (
+	// Buffered keeps writes in memory until the next background flush. Writes done within the
+	// last sync interval are lost on a crash.
+	Buffered DurabilityLevel = iota
+	// FlushOnPut writes every Put to the files before it returns, so that it survives a crash of
+	// the process. The files are synced to disk by the background flusher.
+	FlushOnPut
+	// SyncOnPut writes every Put to the files and syncs them to disk before it returns, so that it
+	// survives a crash of the machine. This is considerably slower than the other levels.
+	SyncOnPut
+)
+
+// Durability sets when writes are persisted, the default is `Buffered`.
+func Durability(level DurabilityLevel) Option {
+	return func(c *config) {
+		c.durability = level
+	}
+}
+
+// EvictionPolicy sets the policy that selects the entries that are removed by `Store.Evict`.
+func EvictionPolicy(policy Policy) Option {
+	return func(c *config) {
+		c.policy = policy
+	}
+}
+
+// WithMetrics sets where the store reports its measurements to.
+func WithMetrics(metrics Metrics) Option {
+	return func(c *config) {
+		c.metrics = metrics
+	}
+}
+
+// WithLogger sets where the store logs to. Failures of background work, recovery actions and slow
+// flushes are logged, by default nothing is. A nil logger logs nothing, as if none was set.
+func WithLogger(logger Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// MultiValue makes Put and PutValue append values to the list of values of a key instead of
+// replacing the value, see `Store.GetValues`.
+//
+// Every value is stored in its own entry of the primary storage, which links to the entry of the
+// previous value of the same key. The index refers to the most recent value, hence Get, GetSize and
+// Scan return that one. The option needs to be set whenever the store is opened. GC and Evict
+// rewrite the values of every key, which needs a compaction that implements
+// `primary.CompactionWriter`.
+func MultiValue() Option {
+	return func(c *config) {
+		c.multiValue = true
+	}
+}
+
+// Expiry stores every value together with an expiration time, see `Store.PutExpiring`. Expired
+// entries are treated as missing by all reads. Values that are put with Put never expire.
+//
+// Every `sweepInterval`, up to 65536 buckets of the index are checked for expired entries, which
+// are removed from the index, each sweep continues where the previous one stopped. Their space is
+// reclaimed by the next GC, or by `Store.SweepExpired`, which removes expired entries and rewrites
+// the files right away. Pass zero to only remove them when
+// SweepExpired is called. The option needs to be set whenever the store is opened, it can't be
+// combined with `MultiValue`.
+func Expiry(sweepInterval time.Duration) Option {
+	return func(c *config) {
+		c.expiry = true
+		c.sweepInterval = sweepInterval
+	}
+}
+
+// BloomFilter keeps a bloom filter of the stored keys, sized for `expectedKeys` keys, so that most
+// lookups of keys that aren't stored are answered without reading the index, see package `bloom`.
+//
+// The filter is persisted next to the index and updated incrementally, it's only built from a scan
+// of the index when it doesn't exist yet. Its size is fixed once it's created, a filter that holds
+// far more keys than expected yields more false positives but no wrong results.
+func BloomFilter(expectedKeys uint64) Option {
+	return func(c *config) {
+		c.bloomKeys = expectedKeys
+	}
+}
+
+// WithMergeOperator sets the operator that combines the value of a Put with the existing value of
+// the key, see `MergeOperator`. It can't be combined with `MultiValue`.
+func WithMergeOperator(op MergeOperator) Option {
+	return func(c *config) {
+		c.mergeOperator = op
+	}
+}
+
+// ValueCache keeps up to `size` bytes of recently read entries of the primary storage in memory,
+// so that Get serves hot values without reading the storage. Entries are evicted in
+// least-recently-used order. The cache is cleared when GC or Evict move the entries.
+func ValueCache(size int64) Option {
+	return func(c *config) {
+		c.cacheSize = size
+	}
+}
+
+// NegativeCache remembers up to `entries` keys that were recently looked up and not found, so that
+// repeated Get, Has and GetSize calls for the same absent key don't read the index again. A Put of
+// a key removes it from the cache.
+func NegativeCache(entries int) Option {
+	return func(c *config) {
+		c.negCacheSize = entries
+	}
+}
+
+// TrackAccess records when every key was last read or written, see `Store.AccessStats`. The times
+// are kept in memory only, they are lost when the store is closed.
+func TrackAccess() Option {
+	return func(c *config) {
+		c.trackAccess = true
+	}
+}
+
+// MaxPausedWork sets how much work writers can buffer while sync is paused before they wait for it
+// to be resumed, see `Store.PauseSync`. It defaults to the burst rate passed to OpenStore.
+func MaxPausedWork(work types.Work) Option {
+	return func(c *config) {
+		c.maxPausedWork = work
+	}
+}
+
+// WithRetryPolicy retries reads of the index and the primary storage, as well as syncs of the
+// files, that fail with a transient error, instead of failing the operation right away. Retries are
+// counted in `Stats.Retries` and reported to metrics that implement `RetryMetrics`.
+//
+// Writes are not retried, they are buffered and a failed flush poisons the store as before.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *config) {
+		c.retryPolicy = policy
+	}
+}
+
+// VerifyCompaction checks `percent` percent of the entries, picked at random, after GC, Evict or
+// SweepExpired compacted the files and before the old files are replaced. The sampled entries are
+// looked up in the rewritten index and read from the compacted copy, their values are compared with
+// checksums taken before they were moved. If any of them doesn't match, the compaction is aborted
+// with `types.ErrCompactionVerification` and the old files are kept.
+//
+// The compaction of the primary storage needs to implement `primary.CompactionReader`. Stores in
+// multi-value mode rewrite their values instead of moving them, they aren't verified.
+func VerifyCompaction(percent float64) Option {
+	return func(c *config) {
+		c.verifyPercent = percent
+	}
+}
+
+// DegradeOnWriteError makes a failed write degrade the store to read-only mode instead of failing
+// it. While degraded, Get, Has and GetSize keep serving the data that was flushed before the
+// failure, all other operations fail with the error of the write. The mode is reported in
+// `Stats.Degraded` and to metrics that implement `DegradationMetrics`, Reopen recovers the store.
+//
+// Without it, a failed flush poisons the store and reads fail as well.
+func DegradeOnWriteError() Option {
+	return func(c *config) {
+		c.degrade = true
+	}
+}
+
+// SlowQueryLog keeps the `entries` most recent Gets and Puts that took at least `threshold` in a
+// ring buffer, together with the time they spent in each phase, see `Store.SlowQueries`. They are
+// also reported to metrics that implement `SlowQueryMetrics`.
+func SlowQueryLog(threshold time.Duration, entries int) Option {
+	return func(c *config) {
+		c.slowThreshold = threshold
+		c.slowEntries = entries
+	}
+}
+
+// AllowEmptyValues sets whether values may be empty, which they may by default. Some applications
+// store empty values as markers of existence, for others they are the result of a bug. With
+// `allow` unset, writes of empty values fail with `types.ErrEmptyValue`.
+func AllowEmptyValues(allow bool) Option {
+	return func(c *config) {
+		c.denyEmpty = !allow
+	}
+}
+
+// Appendable lets values grow with `Store.Append`, e.g. logs of provenance records that are kept
+// per key, without rewriting what was stored before.
+//
+// Every value is stored as a chain of segments in the primary storage, each one links to the
+// previous segment of the same value. Get, GetSize and Scan return all segments joined, Put replaces
+// the whole chain. The option needs to be set whenever the store is opened and can't be combined
+// with `MultiValue`, `Expiry` or a merge operator. GC and Evict rewrite the segments of every key,
+// which needs a compaction that implements `primary.CompactionWriter`.
+func Appendable() Option {
+	return func(c *config) {
+		c.appendable = true
+	}
+}
+
+// EntryMetadata stores the time every value was put and a byte of user flags together with it, see
+// `Store.GetMeta` and `Store.PutWithFlags`. The metadata takes 9 bytes per entry. The option needs
+// to be set whenever the store is opened and can't be combined with `MultiValue` or `Appendable`.
+func EntryMetadata() Option {
+	return func(c *config) {
+		c.metadata = true
+	}
+}
+
+// AutoGrowIndex grows the index by a bucket bit, see `Store.GrowIndex`, whenever its occupied
+// buckets hold more than `maxAverage` keys on average, up to `maxBits` bits. The background flusher
+// checks after every flush, hence the store needs to be started.
+//
+// With the option, the store is opened with the number of bits the index has if it was grown
+// beyond the number passed to OpenStore, so the latter remains the initial size of the index.
+func AutoGrowIndex(maxAverage float64, maxBits uint8) Option {
+	return func(c *config) {
+		c.growAverage = maxAverage
+		c.growMaxBits = maxBits
+	}
+}
+
+// CompactMode sets up the store for small embedded deployments, e.g. CLIs and mobile or edge
+// binaries, that want the file format without the machinery of a long running daemon:
+//   - the index has at most `CompactIndexBits` bucket bits, unless it already exists with more
+//   - Start doesn't start any background goroutine, there is no background flusher, expiry sweep
+//     or index growth
+//   - writers are never throttled, see `NoRateLimit`
+//
+// Writes are buffered until Flush or Close is called, or until they are committed by a durability
+// level like `FlushOnPut`. Further options, e.g. caches, shouldn't be added to keep the memory
+// usage small.
+func CompactMode() Option {
+	return func(c *config) {
+		c.compactMode = true
+	}
+}
+
+// RebuildCorruptIndex rebuilds the index from the primary storage, see RebuildIndex, if it is
+// found to be corrupt while the store is opened. That needs an index with checksums, see
+// `index.RecordListChecksums`, and a primary storage that supports rebuilding. Without the option,
+// opening the store fails with `types.ErrIndexCorrupt`.
+//
+// Corruption that is found later, by reads, is returned to the caller.
+func RebuildCorruptIndex() Option {
+	return func(c *config) {
+		c.rebuildCorrupt = true
+	}
+}
+
+// WriteAheadLog logs the changes of the index before the primary storage is flushed, see
+// `index.WriteAheadLog`. Without it, a crash after the primary storage was flushed but before the
+// index was loses the index entries of the flushed data, unless the index is rebuilt. With it, they
+// are replayed when the store is opened. Every flush syncs the log once more.
+func WriteAheadLog() Option {
+	return func(c *config) {
+		c.wal = true
+	}
+}
+
+// BackgroundScrub checks the index every `interval` once the store is started, see `Store.Scrub`,
+// which also repairs what it can if `repair` is set. The scrubber pauses between batches of buckets
+// to leave the disk to reads and writes. Problems are logged as errors.
+func BackgroundScrub(interval time.Duration, repair bool) Option {
+	return func(c *config) {
+		c.scrubInterval = interval
+		c.scrubRepair = repair
+	}
+}
+
+// withWriteAheadLog returns the options of the index of the store, which adds the write-ahead log
+// if it's enabled. Indexes that are written on the side, e.g. by GC or growth, don't have one, they
+// are synced before they replace the index.
+func withWriteAheadLog(options []index.Option, wal bool) []index.Option {
+	if !wal {
+		return options
+	}
+	return append(options[:len(options):len(options)], index.WriteAheadLog())
+}
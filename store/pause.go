@@ -0,0 +1,57 @@
+package store
+
+import "github.com/hannahhoward/go-storethehash/store/types"
+
+// PauseSync stops all writes to the files of the store until ResumeSync is called, e.g. while a
+// snapshot of the underlying volume is taken. It waits for a running flush to finish.
+//
+// Reads keep working. Writes are buffered in memory as usual, regardless of the durability level,
+// until the outstanding work exceeds the limit set with `MaxPausedWork`, then writers wait until
+// the store is resumed. Operations that need to write the files, like GC, Evict and Snapshot, fail
+// with `types.ErrSyncPaused` in the meantime. Closing the store resumes it.
+func (s *Store) PauseSync() {
+	s.flushLk.Lock()
+	defer s.flushLk.Unlock()
+	s.pauseLk.Lock()
+	s.paused = true
+	s.pauseLk.Unlock()
+}
+
+// ResumeSync resumes writing the files after PauseSync and flushes the writes that accumulated in
+// the meantime. Writers that waited are released.
+func (s *Store) ResumeSync() error {
+	s.resume()
+	_, err := s.FlushResult()
+	return err
+}
+
+func (s *Store) resume() {
+	s.pauseLk.Lock()
+	s.paused = false
+	s.pauseLk.Unlock()
+	s.pauseCond.Broadcast()
+}
+
+// syncPaused returns whether writing the files is paused. A commit must not start if it is, see
+// PauseSync.
+func (s *Store) syncPaused() bool {
+	s.pauseLk.Lock()
+	defer s.pauseLk.Unlock()
+	return s.paused
+}
+
+// waitWhilePaused blocks while writing the files is paused and the outstanding work exceeds the
+// limit.
+func (s *Store) waitWhilePaused() {
+	s.pauseLk.Lock()
+	defer s.pauseLk.Unlock()
+	for s.paused && s.outstandingWork() > s.maxPausedWork {
+		s.pauseCond.Wait()
+	}
+}
+
+// isPaused returns whether an error only reports that writing the files is paused, which doesn't
+// affect the state of the store.
+func isPaused(err error) bool {
+	return err == types.ErrSyncPaused
+}
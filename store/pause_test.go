@@ -0,0 +1,72 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseSync(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.Durability(store.FlushOnPut), store.MaxPausedWork(1000))
+	require.NoError(t, err)
+	defer s.Close()
+	dataSize := func() int64 {
+		info, err := os.Stat(dataPath)
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	blks := testutil.GenerateBlocksOfSize(4, 400)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	size := dataSize()
+	require.NotZero(t, size)
+
+	s.PauseSync()
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+	s.Flush()
+	require.Equal(t, size, dataSize())
+	// Reads still see the writes.
+	value, found, err := s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[1].RawData(), value)
+	require.Equal(t, types.ErrSyncPaused, s.GC(context.Background()))
+	require.NoError(t, s.Err())
+
+	// Writers wait once the limit is exceeded.
+	require.NoError(t, s.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+	done := make(chan error)
+	go func() {
+		done <- s.Put(blks[3].Cid().Bytes(), blks[3].RawData())
+	}()
+	select {
+	case <-done:
+		t.Fatal("put did not wait for the store to be resumed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(t, size, dataSize())
+
+	require.NoError(t, s.ResumeSync())
+	require.NoError(t, <-done)
+	require.True(t, dataSize() > size)
+	for _, blk := range blks {
+		has, err := s.Has(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Policy decides which entries are removed when space needs to be freed, see `Store.Evict`.
+//
+// OnPut and OnGet are called concurrently by all readers and writers of the store, they need to be
+// cheap.
+type Policy interface {
+	// OnPut is called after a value of the given size was stored under the given key.
+	OnPut(key []byte, size types.Size)
+	// OnGet is called after the value of a key was read.
+	OnGet(key []byte)
+	// SelectEvictionCandidates returns the keys that should be removed in order to free at least
+	// `bytes` bytes. `entries` calls its argument for every entry of the store with its key and the
+	// size of its value, it stops when the function returns an error.
+	SelectEvictionCandidates(bytes int64, entries EntryIterator) ([][]byte, error)
+}
+
+// EntryIterator calls `fn` for every entry of a store, see `Policy.SelectEvictionCandidates`.
+type EntryIterator func(fn func(key []byte, size types.Size) error) error
+
+// Evict removes the entries that the policy of the store selects in order to free at least `bytes`
+// bytes and reclaims their space.
+//
+// Evicting entries rewrites the files the same way GC does, see there for the requirements. A
+// policy needs to be set with the `EvictionPolicy` option.
+func (s *Store) Evict(ctx context.Context, bytes int64) error {
+	if s.policy == nil {
+		return types.ErrNoPolicy
+	}
+	candidates, err := s.policy.SelectEvictionCandidates(bytes, func(fn func(key []byte, size types.Size) error) error {
+		return s.Scan(nil, nil, func(key []byte, value []byte) error {
+			return fn(key, types.Size(len(value)))
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	s.swapLk.RLock()
+	primaryStorage := s.index.Primary
+	s.swapLk.RUnlock()
+	evict := make(map[string]struct{}, len(candidates))
+	for _, key := range candidates {
+		indexKey, err := primaryStorage.IndexKey(key)
+		if err != nil {
+			return err
+		}
+		evict[string(indexKey)] = struct{}{}
+	}
+	return s.compact(ctx, func(blk types.Block) (bool, error) {
+		indexKey, err := s.index.Primary.GetIndexKey(blk)
+		if err != nil {
+			return false, err
+		}
+		_, ok := evict[string(indexKey)]
+		return ok, nil
+	})
+}
+
+// LRU is a policy that evicts the least recently used entries first.
+//
+// Only reads and writes since the store was opened are tracked. Entries that weren't used since
+// then are evicted before all others.
+type LRU struct {
+	lk      sync.Mutex
+	entries map[string]*list.Element
+	// Keys ordered by last use, the most recently used first
+	lru *list.List
+}
+
+// NewLRU returns a least-recently-used policy.
+func NewLRU() *LRU {
+	return &LRU{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (p *LRU) OnPut(key []byte, _ types.Size) {
+	p.touch(key)
+}
+
+func (p *LRU) OnGet(key []byte) {
+	p.touch(key)
+}
+
+func (p *LRU) touch(key []byte) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if elem, ok := p.entries[string(key)]; ok {
+		p.lru.MoveToFront(elem)
+		return
+	}
+	p.entries[string(key)] = p.lru.PushFront(string(key))
+}
+
+func (p *LRU) SelectEvictionCandidates(bytes int64, entries EntryIterator) ([][]byte, error) {
+	var candidates [][]byte
+	var freed int64
+	used := make(map[string]types.Size)
+	// Entries that weren't used at all go first.
+	err := entries(func(key []byte, size types.Size) error {
+		p.lk.Lock()
+		_, ok := p.entries[string(key)]
+		p.lk.Unlock()
+		if ok {
+			used[string(key)] = size
+			return nil
+		}
+		if freed < bytes {
+			candidates = append(candidates, key)
+			freed += int64(size)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for elem := p.lru.Back(); elem != nil && freed < bytes; {
+		key := elem.Value.(string)
+		prev := elem.Prev()
+		if size, ok := used[key]; ok {
+			candidates = append(candidates, []byte(key))
+			freed += int64(size)
+		}
+		// The key is either evicted or not stored anymore.
+		delete(p.entries, key)
+		p.lru.Remove(elem)
+		elem = prev
+	}
+	return candidates, nil
+}
+
+var _ Policy = &LRU{}
@@ -0,0 +1,54 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvictLRU(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits,
+		defaultSyncInterval, defaultBurstRate, store.EvictionPolicy(store.NewLRU()))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// Reading the first two blocks makes the third and fourth one the least recently used.
+	for _, blk := range blks[:2] {
+		_, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+	s.Flush()
+	before := s.Stats().PrimarySize
+
+	require.NoError(t, s.Evict(context.Background(), 200))
+	for n, blk := range blks {
+		has, err := s.Has(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.Equal(t, n != 2 && n != 3, has)
+	}
+	require.Equal(t, uint64(3), s.Stats().Keys)
+	require.Equal(t, before*3/5, s.Stats().PrimarySize)
+}
+
+func TestEvictNoPolicy(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, types.ErrNoPolicy, s.Evict(context.Background(), 1))
+}
@@ -2,12 +2,17 @@ package cidprimary
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"io"
 	"os"
 	"sync"
 
+	"github.com/hannahhoward/go-storethehash/store/filelock"
 	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/readahead"
 	"github.com/hannahhoward/go-storethehash/store/types"
 	"github.com/ipfs/go-cid"
 	util "github.com/ipld/go-car/util"
@@ -16,14 +21,27 @@ import (
 
 const CIDSizePrefix = 4
 
+var errInvalidCID = errors.New("invalid CID prefix")
+
 // A primary storage that is CID aware.
 type CIDPrimary struct {
+	path              string
 	file              *os.File
 	writer            *bufio.Writer
 	length            types.Position
 	outstandingWork   types.Work
 	curPool, nextPool blockPool
-	poolLk            sync.RWMutex
+	// End of the data that was completely handed over to the OS
+	flushedLength types.Position
+	poolLk        sync.RWMutex
+	// Location of the entry of every stored value by its digest, protected by poolLk. It's nil
+	// unless values are deduplicated.
+	digests map[[sha256.Size]byte]types.Block
+
+	// writeLk serializes the writes to the file by commits and PutFrom.
+	writeLk sync.Mutex
+	// Lock of the file against other processes
+	lock *filelock.Lock
 }
 
 const blockBufferSize = 32 * 4096
@@ -32,6 +50,8 @@ const blockPoolSize = 1024
 type blockRecord struct {
 	key   []byte
 	value []byte
+	// Set if the record is written as reference to an entry with the same value
+	ref *valueRef
 }
 type blockPool struct {
 	refs   map[types.Block]int
@@ -45,55 +65,73 @@ func newBlockPool() blockPool {
 	}
 }
 
-func OpenCIDPrimary(path string) (*CIDPrimary, error) {
+func OpenCIDPrimary(path string, options ...Option) (*CIDPrimary, error) {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
+	lock, err := filelock.Acquire(path)
+	if err != nil {
+		return nil, err
+	}
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
 	if err != nil {
+		_ = lock.Release()
 		return nil, err
 	}
 	length, err := file.Seek(0, os.SEEK_END)
 	if err != nil {
+		_ = lock.Release()
 		return nil, err
 	}
-	return &CIDPrimary{
+	cp := &CIDPrimary{
+		lock:     lock,
+		path:     path,
 		file:     file,
 		writer:   bufio.NewWriterSize(file, blockBufferSize),
 		length:   types.Position(length),
 		curPool:  newBlockPool(),
 		nextPool: newBlockPool(),
-	}, nil
+
+		flushedLength: types.Position(length),
+	}
+	if c.dedup {
+		if err := cp.loadDigests(); err != nil {
+			_ = file.Close()
+			_ = lock.Release()
+			return nil, err
+		}
+	}
+	return cp, nil
 }
 
-func (cp *CIDPrimary) getCached(blk types.Block) ([]byte, []byte, error) {
+// getCached returns the entry at the given block from the write pools, if it wasn't written to the
+// file yet. The value of an entry may be empty, hence whether it was found is returned separately.
+func (cp *CIDPrimary) getCached(blk types.Block) ([]byte, []byte, bool, error) {
 	cp.poolLk.RLock()
 	defer cp.poolLk.RUnlock()
 	idx, ok := cp.nextPool.refs[blk]
 	if ok {
 		br := cp.nextPool.blocks[idx]
-		return br.key, br.value, nil
+		return br.key, br.value, true, nil
 	}
 	idx, ok = cp.curPool.refs[blk]
 	if ok {
 		br := cp.curPool.blocks[idx]
-		return br.key, br.value, nil
+		return br.key, br.value, true, nil
 	}
 	if blk.Offset >= cp.length {
-		return nil, nil, types.ErrOutOfBounds
+		return nil, nil, false, types.ErrOutOfBounds
 	}
-	return nil, nil, nil
+	return nil, nil, false, nil
 }
 
 func (cp *CIDPrimary) Get(blk types.Block) (key []byte, value []byte, err error) {
-	key, value, err = cp.getCached(blk)
-	if err != nil {
-		return
+	key, value, cached, err := cp.getCached(blk)
+	if err != nil || cached {
+		return key, value, err
 	}
-	if key != nil && value != nil {
-		return
-	}
-	read := make([]byte, CIDSizePrefix+int(blk.Size))
-	cp.file.ReadAt(read, int64(blk.Offset))
-	c, value, err := readNode(read[4:])
-	return c.Bytes(), value, err
+	return readEntry(cp.file, blk)
 }
 
 // readNode extracts the Cid from the data read and splits key and value.
@@ -106,27 +144,61 @@ func readNode(data []byte) (cid.Cid, []byte, error) {
 	return c, data[n:], nil
 }
 
+// Put stores a key-value pair.
+//
+// If values are deduplicated and the same value is already stored, only the key together with a
+// reference to the existing value is written. The returned block is the location of that
+// reference, so that the index still points to an entry with the given key.
 func (cp *CIDPrimary) Put(key []byte, value []byte) (types.Block, error) {
+	if int64(len(value)) > cp.MaxValueSize(key) {
+		return types.Block{}, types.ErrValueTooLarge
+	}
 	cp.poolLk.Lock()
 	defer cp.poolLk.Unlock()
 	length := cp.length
+	record := blockRecord{key: key, value: value}
 	size := len(key) + len(value)
+	var digest [sha256.Size]byte
+	// Referencing values that are smaller than a reference doesn't save anything.
+	dedup := cp.digests != nil && len(value) > refSize
+	if dedup {
+		digest = sha256.Sum256(value)
+		if target, ok := cp.digests[digest]; ok {
+			record.ref = &valueRef{target, types.Size(len(value))}
+			size = len(key) + refSize
+		}
+	}
 	cp.length += CIDSizePrefix + types.Position(size)
 	blk := types.Block{Offset: length, Size: types.Size(size)}
+	if dedup && record.ref == nil {
+		cp.digests[digest] = blk
+	}
 	cp.nextPool.refs[blk] = len(cp.nextPool.blocks)
-	cp.nextPool.blocks = append(cp.nextPool.blocks, blockRecord{key, value})
+	cp.nextPool.blocks = append(cp.nextPool.blocks, record)
 	cp.outstandingWork += types.Work(size + CIDSizePrefix)
 	return blk, nil
 }
 
-func (cp *CIDPrimary) flushBlock(key []byte, value []byte) (types.Work, error) {
-	size := len(key) + len(value)
+// MaxValueSize returns the length of the longest value that can be stored under the given key, see
+// `primary.ValueLimiter`. The highest bit of the size of an entry marks references, see `refFlag`.
+func (cp *CIDPrimary) MaxValueSize(key []byte) int64 {
+	return refFlag - 1 - int64(len(key))
+}
+
+func (cp *CIDPrimary) flushBlock(record blockRecord) (types.Work, error) {
+	value := record.value
+	var flag uint32
+	if record.ref != nil {
+		value = encodeRef(*record.ref)
+		flag = refFlag
+	}
+	size := len(record.key) + len(value)
 	sizeBuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(sizeBuf, uint32(size))
+	binary.LittleEndian.PutUint32(sizeBuf, uint32(size)|flag)
 	if _, err := cp.writer.Write(sizeBuf); err != nil {
 		return 0, err
 	}
-	if _, err := cp.writer.Write(key); err != nil {
+	if _, err := cp.writer.Write(record.key); err != nil {
 		return 0, err
 	}
 	if _, err := cp.writer.Write(value); err != nil {
@@ -148,32 +220,114 @@ func (cp *CIDPrimary) IndexKey(key []byte) ([]byte, error) {
 	return decoded.Digest, nil
 }
 
+// GetIndexKey returns the index key of the entry stored at the given block.
+//
+// Only the CID is read from disk, not the value, which matters for stores with large values.
 func (cp *CIDPrimary) GetIndexKey(blk types.Block) ([]byte, error) {
-	key, _, err := cp.Get(blk)
+	key, _, cached, err := cp.getCached(blk)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		return cp.IndexKey(key)
+	}
+	key, err = cp.readKey(blk)
 	if err != nil {
 		return nil, err
 	}
 	return cp.IndexKey(key)
 }
 
+// readKey reads only the CID of the entry stored at the given block from disk.
+func (cp *CIDPrimary) readKey(blk types.Block) ([]byte, error) {
+	offset := int64(blk.Offset) + CIDSizePrefix
+	peek := make([]byte, keyPeekSize)
+	if int(blk.Size) < len(peek) {
+		peek = peek[:blk.Size]
+	}
+	if _, err := cp.file.ReadAt(peek, offset); err != nil {
+		return nil, err
+	}
+	keyLen, ok, err := cidLength(peek)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && len(peek) < int(blk.Size) {
+		// The CID didn't fit into the peeked bytes, read the whole entry instead.
+		peek = make([]byte, blk.Size)
+		if _, err := cp.file.ReadAt(peek, offset); err != nil {
+			return nil, err
+		}
+		keyLen, ok, err = cidLength(peek)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return peek[:keyLen], nil
+}
+
+// Number of bytes read from disk to determine the CID of an entry. It covers CIDs with digests of
+// up to 56 bytes, longer CIDs need a second read.
+const keyPeekSize = 64
+
+// cidLength returns the byte length of the CID the given data starts with. It returns false if
+// `data` is too short to contain the whole CID.
+func cidLength(data []byte) (int, bool, error) {
+	// CIDv0 is a bare sha2-256 multihash
+	if len(data) >= 2 && data[0] == multihash.SHA2_256 && data[1] == 32 {
+		return 34, len(data) >= 34, nil
+	}
+	// CIDv1 is <version><codec><multihash code><digest length><digest>
+	pos := 0
+	var digestLen uint64
+	for n := 0; n < 4; n++ {
+		value, read := binary.Uvarint(data[pos:])
+		if read == 0 {
+			return 0, false, nil
+		}
+		if read < 0 {
+			return 0, false, errInvalidCID
+		}
+		pos += read
+		digestLen = value
+	}
+	keyLen := pos + int(digestLen)
+	return keyLen, keyLen <= len(data), nil
+}
+
 func (cp *CIDPrimary) commit() (types.Work, error) {
+	cp.writeLk.Lock()
+	defer cp.writeLk.Unlock()
 	cp.poolLk.Lock()
 	nextPool := cp.curPool
 	cp.curPool = cp.nextPool
 	cp.nextPool = nextPool
 	cp.outstandingWork = 0
+	// The blocks that are committed end here.
+	length := cp.length
 	cp.poolLk.Unlock()
 	if len(cp.curPool.blocks) == 0 {
 		return 0, nil
 	}
 	var work types.Work
 	for _, record := range cp.curPool.blocks {
-		blockWork, err := cp.flushBlock(record.key, record.value)
+		blockWork, err := cp.flushBlock(record)
 		if err != nil {
 			return 0, err
 		}
 		work += blockWork
 	}
+	// Hand the data over to the OS, so that it can be read from the file.
+	if err := cp.writer.Flush(); err != nil {
+		return 0, err
+	}
+	cp.poolLk.Lock()
+	cp.curPool = newBlockPool()
+	cp.flushedLength = length
+	cp.poolLk.Unlock()
 	return work, nil
 }
 
@@ -182,6 +336,8 @@ func (cp *CIDPrimary) Flush() (types.Work, error) {
 }
 
 func (cp *CIDPrimary) Sync() error {
+	cp.writeLk.Lock()
+	defer cp.writeLk.Unlock()
 	if err := cp.writer.Flush(); err != nil {
 		return err
 	}
@@ -195,7 +351,62 @@ func (cp *CIDPrimary) Sync() error {
 }
 
 func (cp *CIDPrimary) Close() error {
-	return cp.file.Close()
+	err := cp.file.Close()
+	if lockErr := cp.lock.Release(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// Path returns the path of the data file, see `primary.Pather`.
+func (cp *CIDPrimary) Path() string {
+	return cp.path
+}
+
+// Warmup reads the data file into the page cache, see `primary.Warmer`.
+func (cp *CIDPrimary) Warmup(ctx context.Context) (int64, error) {
+	return readahead.File(ctx, cp.path)
+}
+
+// Reopen discards all entries that weren't flushed, truncates the file to the end of the last
+// successful flush and reopens it. The entries that were put since are gone.
+func (cp *CIDPrimary) Reopen() error {
+	cp.poolLk.Lock()
+	defer cp.poolLk.Unlock()
+	// The file is replaced anyway, an error of the failed write may show up here again.
+	_ = cp.file.Close()
+	if err := os.Truncate(cp.path, int64(cp.flushedLength)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(cp.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	cp.file = file
+	cp.writer = bufio.NewWriterSize(file, blockBufferSize)
+	cp.length = cp.flushedLength
+	cp.outstandingWork = 0
+	cp.curPool = newBlockPool()
+	cp.nextPool = newBlockPool()
+	if cp.digests != nil {
+		// Digests of discarded values must not be referenced.
+		return cp.loadDigests()
+	}
+	return nil
+}
+
+func (cp *CIDPrimary) Size() types.Position {
+	cp.poolLk.RLock()
+	defer cp.poolLk.RUnlock()
+	return cp.length
+}
+
+func (cp *CIDPrimary) ReadRawAt(p []byte, off int64) (int, error) {
+	// The file is replaced by a compaction.
+	cp.poolLk.RLock()
+	file := cp.file
+	cp.poolLk.RUnlock()
+	return file.ReadAt(p, off)
 }
 
 func (cp *CIDPrimary) OutstandingWork() types.Work {
@@ -207,13 +418,19 @@ func (cp *CIDPrimary) Iter() (primary.PrimaryStorageIter, error) {
 	return NewCIDPrimaryIter(cp.file), nil
 }
 
+// IterFrom iterates over the entries from the one at the given offset on.
+func (cp *CIDPrimary) IterFrom(pos types.Position) (primary.PrimaryStorageIter, error) {
+	return &CIDPrimaryIter{reader: cp.file, pos: pos}, nil
+}
+
 func NewCIDPrimaryIter(reader *os.File) *CIDPrimaryIter {
-	return &CIDPrimaryIter{reader, 0}
+	return &CIDPrimaryIter{reader: reader}
 }
 
 type CIDPrimaryIter struct {
 	reader *os.File
 	pos    types.Position
+	blk    types.Block
 }
 
 func (cpi *CIDPrimaryIter) Next() ([]byte, []byte, error) {
@@ -223,19 +440,34 @@ func (cpi *CIDPrimaryIter) Next() ([]byte, []byte, error) {
 
 		return nil, nil, err
 	}
-	cpi.pos += CIDSizePrefix
-	size := binary.LittleEndian.Uint32(sizeBuff)
-	read := make([]byte, int(size))
-	_, err = cpi.reader.ReadAt(read, int64(cpi.pos))
-	cpi.pos += types.Position(size)
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
-		return nil, nil, err
+	blk := types.Block{
+		Offset: cpi.pos,
+		Size:   types.Size(binary.LittleEndian.Uint32(sizeBuff) &^ refFlag),
+	}
+	cpi.pos += CIDSizePrefix + types.Position(blk.Size)
+	cpi.blk = blk
+	key, value, err := readEntry(cpi.reader, blk)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	c, value, err := readNode(read)
-	return c.Bytes(), value, err
+	return key, value, err
+}
+
+// Block returns the position of the entry that was returned by the last call to Next.
+func (cpi *CIDPrimaryIter) Block() types.Block {
+	return cpi.blk
 }
 
 var _ primary.PrimaryStorage = &CIDPrimary{}
+var _ primary.Sizer = &CIDPrimary{}
+var _ primary.IterFromer = &CIDPrimary{}
+var _ primary.ValueSizer = &CIDPrimary{}
+var _ primary.Backuper = &CIDPrimary{}
+var _ primary.ValueLimiter = &CIDPrimary{}
+var _ primary.Reopener = &CIDPrimary{}
+var _ primary.Warmer = &CIDPrimary{}
+var _ primary.Pather = &CIDPrimary{}
+var _ primary.Aliaser = &CIDPrimary{}
+var _ primary.Streamer = &CIDPrimary{}
+var _ primary.StreamWriter = &CIDPrimary{}
+var _ primary.BlockIter = &CIDPrimaryIter{}
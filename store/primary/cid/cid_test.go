@@ -12,6 +12,7 @@ import (
 	"github.com/hannahhoward/go-storethehash/store/types"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 )
 
@@ -125,3 +126,116 @@ func TestIndexGet(t *testing.T) {
 		require.Equal(t, expectedBlk.RawData(), blk.RawData())
 	}
 }
+
+func TestGetIndexKey(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primaryPath := filepath.Join(tempDir, "storethehash.primary")
+	primaryStorage, err := cidprimary.OpenCIDPrimary(primaryPath)
+	require.NoError(t, err)
+
+	blks := testutil.GenerateBlocksOfSize(3, 1000)
+	var cids []cid.Cid
+	for _, blk := range blks {
+		cids = append(cids, blk.Cid())
+	}
+	// A CIDv0 and a CID with a digest that is longer than the bytes peeked from disk
+	cids = append(cids, cid.NewCidV0(blks[0].Cid().Hash()))
+	longHash, err := multihash.Sum(blks[1].RawData(), multihash.SHA2_512, -1)
+	require.NoError(t, err)
+	cids = append(cids, cid.NewCidV1(cid.Raw, longHash))
+	// A value that is shorter than the bytes peeked from disk
+	cids = append(cids, blks[2].Cid())
+
+	var locs []types.Block
+	for n, c := range cids {
+		value := blks[n%len(blks)].RawData()
+		if n == len(cids)-1 {
+			value = []byte{1}
+		}
+		loc, err := primaryStorage.Put(c.Bytes(), value)
+		require.NoError(t, err)
+		locs = append(locs, loc)
+	}
+
+	checkIndexKeys := func() {
+		for n, loc := range locs {
+			expected, err := primaryStorage.IndexKey(cids[n].Bytes())
+			require.NoError(t, err)
+			indexKey, err := primaryStorage.GetIndexKey(loc)
+			require.NoError(t, err)
+			require.Equal(t, expected, indexKey)
+		}
+	}
+	// from memory before flush
+	checkIndexKeys()
+	_, err = primaryStorage.Flush()
+	require.NoError(t, err)
+	require.NoError(t, primaryStorage.Sync())
+	// from disk after flush
+	checkIndexKeys()
+}
+
+func TestDedup(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primaryPath := filepath.Join(tempDir, "storethehash.primary")
+	primaryStorage, err := cidprimary.OpenCIDPrimary(primaryPath, cidprimary.Dedup())
+	require.NoError(t, err)
+
+	// The same data under CIDs with different digests
+	blk := testutil.GenerateBlocksOfSize(1, 1000)[0]
+	otherHash, err := multihash.Sum(blk.RawData(), multihash.SHA2_512, -1)
+	require.NoError(t, err)
+	other := cid.NewCidV1(cid.Raw, otherHash)
+
+	first, err := primaryStorage.Put(blk.Cid().Bytes(), blk.RawData())
+	require.NoError(t, err)
+	second, err := primaryStorage.Put(other.Bytes(), blk.RawData())
+	require.NoError(t, err)
+	require.True(t, int(second.Size) < len(other.Bytes())+len(blk.RawData()))
+
+	check := func(p *cidprimary.CIDPrimary) {
+		for _, entry := range []struct {
+			loc types.Block
+			key []byte
+		}{{first, blk.Cid().Bytes()}, {second, other.Bytes()}} {
+			key, value, err := p.Get(entry.loc)
+			require.NoError(t, err)
+			require.Equal(t, entry.key, key)
+			require.Equal(t, blk.RawData(), value)
+			size, err := p.ValueSize(entry.loc, entry.key)
+			require.NoError(t, err)
+			require.Equal(t, types.Size(len(blk.RawData())), size)
+		}
+	}
+	// from memory before flush
+	check(primaryStorage)
+	_, err = primaryStorage.Flush()
+	require.NoError(t, err)
+	require.NoError(t, primaryStorage.Sync())
+	// from disk after flush
+	check(primaryStorage)
+
+	iter, err := primaryStorage.Iter()
+	require.NoError(t, err)
+	for _, expected := range [][]byte{blk.Cid().Bytes(), other.Bytes()} {
+		key, value, err := iter.Next()
+		require.NoError(t, err)
+		require.Equal(t, expected, key)
+		require.Equal(t, blk.RawData(), value)
+	}
+	_, _, err = iter.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, primaryStorage.Close())
+
+	// The digests are restored when the storage is opened again.
+	primaryStorage, err = cidprimary.OpenCIDPrimary(primaryPath, cidprimary.Dedup())
+	require.NoError(t, err)
+	defer primaryStorage.Close()
+	check(primaryStorage)
+	third := cid.NewCidV1(cid.DagProtobuf, otherHash)
+	loc, err := primaryStorage.Put(third.Bytes(), blk.RawData())
+	require.NoError(t, err)
+	require.Equal(t, second.Size, loc.Size)
+}
@@ -0,0 +1,189 @@
+package cidprimary
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// compactionPath returns the path of the compacted copy of the primary storage at `path`.
+func compactionPath(path string) string {
+	return path + ".gc"
+}
+
+type cidCompaction struct {
+	cp     *CIDPrimary
+	file   *os.File
+	writer *bufio.Writer
+	length types.Position
+	// New locations of the moved entries, an entry may be moved by its own key as well as by
+	// references to it.
+	moved map[types.Block]types.Block
+}
+
+func (cp *CIDPrimary) Compact() (primary.Compaction, error) {
+	file, err := os.OpenFile(compactionPath(cp.path), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &cidCompaction{
+		cp:     cp,
+		file:   file,
+		writer: bufio.NewWriterSize(file, blockBufferSize),
+		moved:  make(map[types.Block]types.Block),
+	}, nil
+}
+
+func (cp *CIDPrimary) DiscardCompaction() (bool, error) {
+	err := os.Remove(compactionPath(cp.path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FinishCompaction replaces the file with the compacted copy of an interrupted compaction, see
+// `primary.CompactionFinisher`.
+func (cp *CIDPrimary) FinishCompaction() (bool, error) {
+	cp.poolLk.Lock()
+	defer cp.poolLk.Unlock()
+	if err := os.Rename(compactionPath(cp.path), cp.path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_ = cp.file.Close()
+	file, err := os.OpenFile(cp.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return false, err
+	}
+	length, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = file.Close()
+		return false, err
+	}
+	cp.file = file
+	cp.writer = bufio.NewWriterSize(file, blockBufferSize)
+	cp.length = types.Position(length)
+	cp.flushedLength = types.Position(length)
+	cp.outstandingWork = 0
+	cp.curPool = newBlockPool()
+	cp.nextPool = newBlockPool()
+	if cp.digests != nil {
+		return true, cp.loadDigests()
+	}
+	return true, nil
+}
+
+func (c *cidCompaction) Move(blk types.Block) (types.Block, error) {
+	if moved, ok := c.moved[blk]; ok {
+		return moved, nil
+	}
+	// The entry is copied as is, including its size prefix.
+	data := make([]byte, CIDSizePrefix+int(blk.Size))
+	if _, err := c.cp.file.ReadAt(data, int64(blk.Offset)); err != nil {
+		return types.Block{}, err
+	}
+	if binary.LittleEndian.Uint32(data)&refFlag != 0 {
+		// The referenced entry needs to be kept as well.
+		key, ref, err := readRef(data[CIDSizePrefix:])
+		if err != nil {
+			return types.Block{}, err
+		}
+		if ref.target, err = c.Move(ref.target); err != nil {
+			return types.Block{}, err
+		}
+		copy(data[CIDSizePrefix+len(key):], encodeRef(ref))
+	}
+	if _, err := c.writer.Write(data); err != nil {
+		return types.Block{}, err
+	}
+	moved := types.Block{Offset: c.length, Size: blk.Size}
+	c.length += types.Position(len(data))
+	c.moved[blk] = moved
+	return moved, nil
+}
+
+func (c *cidCompaction) Put(key []byte, value []byte) (types.Block, error) {
+	size := len(key) + len(value)
+	sizeBuf := make([]byte, CIDSizePrefix)
+	binary.LittleEndian.PutUint32(sizeBuf, uint32(size))
+	for _, data := range [][]byte{sizeBuf, key, value} {
+		if _, err := c.writer.Write(data); err != nil {
+			return types.Block{}, err
+		}
+	}
+	blk := types.Block{Offset: c.length, Size: types.Size(size)}
+	c.length += types.Position(CIDSizePrefix + size)
+	return blk, nil
+}
+
+// Get reads an entry from the compacted copy, see `primary.CompactionReader`.
+func (c *cidCompaction) Get(blk types.Block) ([]byte, []byte, error) {
+	if err := c.writer.Flush(); err != nil {
+		return nil, nil, err
+	}
+	return readEntry(c.file, blk)
+}
+
+// Sync makes the compacted copy durable, see `primary.CompactionSyncer`.
+func (c *cidCompaction) Sync() error {
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+func (c *cidCompaction) Commit() error {
+	if err := c.Sync(); err != nil {
+		return err
+	}
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+
+	cp := c.cp
+	cp.poolLk.Lock()
+	defer cp.poolLk.Unlock()
+	if err := os.Rename(compactionPath(cp.path), cp.path); err != nil {
+		return err
+	}
+	if err := cp.file.Close(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(cp.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	cp.file = file
+	cp.writer = bufio.NewWriterSize(file, blockBufferSize)
+	cp.length = c.length
+	cp.flushedLength = c.length
+	// Values whose entries weren't moved are gone.
+	for digest, blk := range cp.digests {
+		if moved, ok := c.moved[blk]; ok {
+			cp.digests[digest] = moved
+		} else {
+			delete(cp.digests, digest)
+		}
+	}
+	return nil
+}
+
+func (c *cidCompaction) Abort() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(compactionPath(c.cp.path))
+}
+
+var _ primary.Compactor = &CIDPrimary{}
+var _ primary.CompactionFinisher = &CIDPrimary{}
+var _ primary.CompactionSyncer = &cidCompaction{}
+var _ primary.CompactionWriter = &cidCompaction{}
+var _ primary.CompactionReader = &cidCompaction{}
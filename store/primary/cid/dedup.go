@@ -0,0 +1,181 @@
+package cidprimary
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+	util "github.com/ipld/go-car/util"
+)
+
+// Flag in the size prefix of an entry that references the value of another entry instead of
+// containing it.
+//
+// The format of such a reference entry is:
+//
+// ```text
+//     |      4 bytes        | Variable size |  8 bytes  |  4 bytes  |      4 bytes    |
+//     | Size with flag set  |      CID      |  Offset   |   Size    | Length of value |
+//     |                     |               | of the entry that has the value         |
+// ```
+const refFlag = 1 << 31
+
+// Size of a reference entry without the CID.
+const refSize = types.OffBytesLen + types.SizeBytesLen + types.SizeBytesLen
+
+type valueRef struct {
+	// The entry that contains the value
+	target types.Block
+	// The length of the value
+	length types.Size
+}
+
+func encodeRef(ref valueRef) []byte {
+	data := make([]byte, refSize)
+	binary.LittleEndian.PutUint64(data, uint64(ref.target.Offset))
+	binary.LittleEndian.PutUint32(data[types.OffBytesLen:], uint32(ref.target.Size))
+	binary.LittleEndian.PutUint32(data[types.OffBytesLen+types.SizeBytesLen:], uint32(ref.length))
+	return data
+}
+
+// readRef splits the data of a reference entry into the key and the reference.
+func readRef(data []byte) ([]byte, valueRef, error) {
+	_, n, err := util.ReadCid(data)
+	if err != nil {
+		return nil, valueRef{}, err
+	}
+	if len(data)-n != refSize {
+		return nil, valueRef{}, io.ErrUnexpectedEOF
+	}
+	ref := data[n:]
+	return data[:n], valueRef{
+		target: types.Block{
+			Offset: types.Position(binary.LittleEndian.Uint64(ref)),
+			Size:   types.Size(binary.LittleEndian.Uint32(ref[types.OffBytesLen:])),
+		},
+		length: types.Size(binary.LittleEndian.Uint32(ref[types.OffBytesLen+types.SizeBytesLen:])),
+	}, nil
+}
+
+// readEntry reads the entry at the given block from the file and returns its key and value. The
+// value of a reference entry is read from the entry it references.
+func readEntry(file *os.File, blk types.Block) ([]byte, []byte, error) {
+	read := make([]byte, CIDSizePrefix+int(blk.Size))
+	if _, err := file.ReadAt(read, int64(blk.Offset)); err != nil {
+		return nil, nil, err
+	}
+	if binary.LittleEndian.Uint32(read)&refFlag == 0 {
+		c, value, err := readNode(read[CIDSizePrefix:])
+		return c.Bytes(), value, err
+	}
+	key, ref, err := readRef(read[CIDSizePrefix:])
+	if err != nil {
+		return nil, nil, err
+	}
+	_, value, err := readEntry(file, ref.target)
+	return key, value, err
+}
+
+// loadDigests reads the digests of all values that are stored in the file.
+func (cp *CIDPrimary) loadDigests() error {
+	cp.digests = make(map[[sha256.Size]byte]types.Block)
+	file, err := os.Open(cp.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, blockBufferSize)
+	var pos types.Position
+	for {
+		size, err := readSizePrefix(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		blk := types.Block{Offset: pos, Size: types.Size(size &^ refFlag)}
+		pos += CIDSizePrefix + types.Position(blk.Size)
+		data := make([]byte, blk.Size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				// An incomplete entry at the end of the file, it isn't referenced.
+				return nil
+			}
+			return err
+		}
+		if size&refFlag != 0 {
+			continue
+		}
+		_, value, err := readNode(data)
+		if err != nil {
+			return err
+		}
+		if len(value) > refSize {
+			cp.digests[sha256.Sum256(value)] = blk
+		}
+	}
+}
+
+func readSizePrefix(reader io.Reader) (uint32, error) {
+	sizeBuf := make([]byte, CIDSizePrefix)
+	if _, err := io.ReadFull(reader, sizeBuf); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(sizeBuf), nil
+}
+
+// PutAlias stores a reference entry for the given key that refers to the value of the entry at
+// `target`, see `primary.Aliaser`. Reference entries are written for aliases whether or not values
+// are deduplicated.
+func (cp *CIDPrimary) PutAlias(key []byte, target types.Block) (types.Block, error) {
+	_, value, err := cp.Get(target)
+	if err != nil {
+		return types.Block{}, err
+	}
+	cp.poolLk.Lock()
+	defer cp.poolLk.Unlock()
+	size := len(key) + refSize
+	blk := types.Block{Offset: cp.length, Size: types.Size(size)}
+	cp.length += CIDSizePrefix + types.Position(size)
+	cp.nextPool.refs[blk] = len(cp.nextPool.blocks)
+	cp.nextPool.blocks = append(cp.nextPool.blocks, blockRecord{
+		key:   key,
+		value: value,
+		ref:   &valueRef{target, types.Size(len(value))},
+	})
+	cp.outstandingWork += types.Work(size + CIDSizePrefix)
+	return blk, nil
+}
+
+// ValueSize returns the length of the value stored at the given block. A reference entry is
+// resolved, the length of the value it refers to is returned rather than that of the reference,
+// which is recorded in the entry.
+func (cp *CIDPrimary) ValueSize(blk types.Block, key []byte) (types.Size, error) {
+	cp.poolLk.RLock()
+	for _, pool := range []blockPool{cp.nextPool, cp.curPool} {
+		if idx, ok := pool.refs[blk]; ok {
+			length := types.Size(len(pool.blocks[idx].value))
+			cp.poolLk.RUnlock()
+			return length, nil
+		}
+	}
+	cp.poolLk.RUnlock()
+
+	sizeBuf := make([]byte, CIDSizePrefix)
+	if _, err := cp.file.ReadAt(sizeBuf, int64(blk.Offset)); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(sizeBuf)&refFlag == 0 {
+		return blk.Size - types.Size(len(key)), nil
+	}
+	lengthBuf := make([]byte, types.SizeBytesLen)
+	end := int64(blk.Offset) + CIDSizePrefix + int64(blk.Size)
+	if _, err := cp.file.ReadAt(lengthBuf, end-int64(len(lengthBuf))); err != nil {
+		return 0, err
+	}
+	return types.Size(binary.LittleEndian.Uint32(lengthBuf)), nil
+}
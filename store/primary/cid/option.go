@@ -0,0 +1,20 @@
+package cidprimary
+
+type config struct {
+	dedup bool
+}
+
+// Option configures how a CID primary storage is opened.
+type Option func(*config)
+
+// Dedup stores values that are already stored under a different key only once, see
+// `CIDPrimary.Put`. References are resolved when they are read, the value and its length are
+// those of the referenced entry, see `CIDPrimary.ValueSize`.
+//
+// The digests of all stored values are kept in memory and are read from the file whenever the
+// storage is opened. A storage that was written with this option must always be opened with it.
+func Dedup() Option {
+	return func(c *config) {
+		c.dedup = true
+	}
+}
@@ -0,0 +1,135 @@
+package cidprimary
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+	util "github.com/ipld/go-car/util"
+)
+
+// maxCIDSize bounds the number of bytes that are read to decode the CID of an entry. CIDs with
+// common hash functions are well below.
+const maxCIDSize = 256
+
+// GetStream returns the key of the entry at the given block together with a reader of its value,
+// see `primary.Streamer`. Only the CID is read up front, the value is read from the file as the
+// reader is consumed. Values that aren't flushed yet are returned from memory.
+func (cp *CIDPrimary) GetStream(blk types.Block) ([]byte, io.ReadCloser, int64, error) {
+	key, value, cached, err := cp.getCached(blk)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if cached {
+		return key, ioutil.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+	}
+	return streamEntry(cp.file, blk)
+}
+
+func streamEntry(file *os.File, blk types.Block) ([]byte, io.ReadCloser, int64, error) {
+	headSize := int(blk.Size)
+	if headSize > maxCIDSize {
+		headSize = maxCIDSize
+	}
+	head := make([]byte, CIDSizePrefix+headSize)
+	if _, err := file.ReadAt(head, int64(blk.Offset)); err != nil {
+		return nil, nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(head)&refFlag != 0 {
+		// References are small, the value is streamed from the entry they refer to.
+		data := make([]byte, CIDSizePrefix+int(blk.Size))
+		if _, err := file.ReadAt(data, int64(blk.Offset)); err != nil {
+			return nil, nil, 0, err
+		}
+		key, ref, err := readRef(data[CIDSizePrefix:])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		_, value, size, err := streamEntry(file, ref.target)
+		return key, value, size, err
+	}
+	c, n, err := util.ReadCid(head[CIDSizePrefix:])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	size := int64(blk.Size) - int64(n)
+	value := io.NewSectionReader(file, int64(blk.Offset)+CIDSizePrefix+int64(n), size)
+	return c.Bytes(), ioutil.NopCloser(value), size, nil
+}
+
+// PutFrom writes an entry whose value is read from `r` straight to the file, see
+// `primary.StreamWriter`. Entries that were put before and aren't flushed yet are flushed first.
+// Puts and reads of unflushed entries wait until the value is written.
+//
+// If values are deduplicated, the digest of the value is recorded, but the value is always written
+// in full.
+func (cp *CIDPrimary) PutFrom(key []byte, r io.Reader, size int64) (types.Block, error) {
+	if size < 0 || size > cp.MaxValueSize(key) {
+		return types.Block{}, types.ErrOutOfBounds
+	}
+	cp.writeLk.Lock()
+	defer cp.writeLk.Unlock()
+	cp.poolLk.Lock()
+	defer cp.poolLk.Unlock()
+
+	// The pending entries were promised the positions before this one.
+	for _, record := range cp.nextPool.blocks {
+		if _, err := cp.flushBlock(record); err != nil {
+			return types.Block{}, err
+		}
+	}
+	if err := cp.writer.Flush(); err != nil {
+		return types.Block{}, err
+	}
+	cp.nextPool = newBlockPool()
+	cp.outstandingWork = 0
+	cp.flushedLength = cp.length
+
+	blk := types.Block{Offset: cp.length, Size: types.Size(int64(len(key)) + size)}
+	var digest hash.Hash
+	if cp.digests != nil {
+		digest = sha256.New()
+		r = io.TeeReader(r, digest)
+	}
+	if err := cp.writeStreamed(key, r, size); err != nil {
+		// Remove what was written of the entry, so that the file ends with a complete entry.
+		cp.writer.Reset(cp.file)
+		if truncErr := cp.file.Truncate(int64(blk.Offset)); truncErr != nil {
+			return types.Block{}, truncErr
+		}
+		return types.Block{}, err
+	}
+	cp.length += CIDSizePrefix + types.Position(blk.Size)
+	cp.flushedLength = cp.length
+	if digest != nil && size > refSize {
+		var sum [sha256.Size]byte
+		copy(sum[:], digest.Sum(nil))
+		if _, ok := cp.digests[sum]; !ok {
+			cp.digests[sum] = blk
+		}
+	}
+	return blk, nil
+}
+
+func (cp *CIDPrimary) writeStreamed(key []byte, r io.Reader, size int64) error {
+	sizeBuf := make([]byte, CIDSizePrefix)
+	binary.LittleEndian.PutUint32(sizeBuf, uint32(int64(len(key))+size))
+	if _, err := cp.writer.Write(sizeBuf); err != nil {
+		return err
+	}
+	if _, err := cp.writer.Write(key); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(cp.writer, r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return cp.writer.Flush()
+}
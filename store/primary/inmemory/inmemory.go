@@ -62,21 +62,29 @@ func (im *InMemory) GetIndexKey(blk types.Block) ([]byte, error) {
 }
 
 func (im *InMemory) Iter() (primary.PrimaryStorageIter, error) {
-	return &inMemoryIter{im, 0}, nil
+	return &inMemoryIter{im: im}, nil
 }
 
 type inMemoryIter struct {
 	im  *InMemory
 	idx int
+	blk types.Block
 }
 
 func (imi *inMemoryIter) Next() ([]byte, []byte, error) {
-	key, value, err := imi.im.Get(types.Block{Offset: types.Position(imi.idx)})
+	blk := types.Block{Offset: types.Position(imi.idx), Size: 1}
+	key, value, err := imi.im.Get(blk)
 	if err == types.ErrOutOfBounds {
 		return nil, nil, io.EOF
 	}
+	imi.blk = blk
 	imi.idx++
 	return key, value, nil
 }
 
+func (imi *inMemoryIter) Block() types.Block {
+	return imi.blk
+}
+
 var _ primary.PrimaryStorage = &InMemory{}
+var _ primary.BlockIter = &inMemoryIter{}
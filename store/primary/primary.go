@@ -1,6 +1,11 @@
 package primary
 
-import "github.com/hannahhoward/go-storethehash/store/types"
+import (
+	"context"
+	"io"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
 
 // PrimaryStorage is an interface for storing and retrieving key value pairs on disk
 type PrimaryStorage interface {
@@ -24,7 +29,10 @@ type PrimaryStorage interface {
 	// Note that this key might differ from the key that is actually stored.
 	GetIndexKey(blk types.Block) ([]byte, error)
 
+	// Writes all buffered data to the underlying storage, so that it survives a crash of the
+	// process. Returns the amount of work done.
 	Flush() (types.Work, error)
+	// Makes all flushed data durable, so that it survives a crash of the machine.
 	Sync() error
 
 	Close() error
@@ -36,3 +44,167 @@ type PrimaryStorageIter interface {
 	// Next should return io.EOF when done
 	Next() (key []byte, value []byte, err error)
 }
+
+// BlockIter is implemented by iterators that can report where the entries they return are stored.
+type BlockIter interface {
+	PrimaryStorageIter
+	// Block returns the position of the entry that was returned by the last call to Next.
+	Block() types.Block
+}
+
+// IterFromer is implemented by primary storages that can start an iteration at a position, e.g. to
+// replay only the entries that were written after a checkpoint.
+type IterFromer interface {
+	// IterFrom returns an iterator over the entries from the one at `pos` on. `pos` needs to be the
+	// offset of an entry or the size of the stored data.
+	IterFrom(pos types.Position) (PrimaryStorageIter, error)
+}
+
+// Sizer is implemented by primary storages that can report how much data they hold.
+type Sizer interface {
+	// Size returns the size of the stored data in bytes, including data that hasn't been flushed
+	// yet.
+	Size() types.Position
+}
+
+// ValueSizer is implemented by primary storages where the length of a value can't always be
+// derived from its block, i.e. the block size minus the key length.
+type ValueSizer interface {
+	// ValueSize returns the length of the value stored at the given block under the given key.
+	ValueSize(blk types.Block, key []byte) (types.Size, error)
+}
+
+// ValueLimiter is implemented by primary storages that can't store values of up to
+// `types.MaxBlockSize` bytes, e.g. because the size of an entry includes its key.
+type ValueLimiter interface {
+	// MaxValueSize returns the length of the longest value that can be stored under the given key.
+	MaxValueSize(key []byte) int64
+}
+
+// Compactor is implemented by primary storages that support garbage collection.
+type Compactor interface {
+	// Compact starts writing a compacted copy of the storage. The storage itself is unchanged until
+	// the compaction is committed. Only one compaction may run at a time.
+	Compact() (Compaction, error)
+	// DiscardCompaction removes the copy of a compaction that was neither committed nor aborted,
+	// e.g. because the process crashed. It returns false if there was no such copy.
+	DiscardCompaction() (bool, error)
+}
+
+// Compaction is a compacted copy of a primary storage that is being written.
+type Compaction interface {
+	// Move copies the entry at the given block of the storage into the compacted copy and returns
+	// its location in the copy.
+	Move(blk types.Block) (types.Block, error)
+	// Commit makes the compacted copy durable and atomically replaces the storage with it. All
+	// data must be flushed before and no entries may be added while the compaction is running.
+	Commit() error
+	// Abort discards the compacted copy.
+	Abort() error
+}
+
+// CompactionReader is implemented by compactions whose compacted copy can be read before it is
+// committed, e.g. to verify it.
+type CompactionReader interface {
+	// Get returns the key-value pair at the given location in the compacted copy.
+	Get(blk types.Block) (key []byte, value []byte, err error)
+}
+
+// CompactionWriter is implemented by compactions that can store new entries in the compacted copy,
+// e.g. to rewrite entries that refer to the locations of other entries.
+type CompactionWriter interface {
+	// Put stores a key-value pair in the compacted copy and returns its location there.
+	Put(key []byte, value []byte) (types.Block, error)
+}
+
+// CompactionSyncer is implemented by compactions whose compacted copy can be made durable before
+// it's committed, e.g. to commit the compactions of several storages together.
+type CompactionSyncer interface {
+	// Sync writes the compacted copy to disk and makes it durable. The storage is unchanged.
+	Sync() error
+}
+
+// CompactionFinisher is implemented by compactors that can finish a compaction that was synced,
+// see `CompactionSyncer`, but not committed because the process crashed.
+type CompactionFinisher interface {
+	// FinishCompaction replaces the storage with the compacted copy. It returns false if there was
+	// no such copy. The caller needs to know that the copy was synced completely.
+	FinishCompaction() (bool, error)
+}
+
+// Partitioned is implemented by primary storages that keep their entries in several parts with
+// separate ranges of positions, e.g. the tiers of `tiered.TieredPrimary`. The size of such a
+// storage, see `Sizer`, is the sum of the sizes of its parts.
+type Partitioned interface {
+	// Parts returns the parts of the storage ordered by their base.
+	Parts() []Part
+}
+
+// Part is a part of a `Partitioned` primary storage.
+type Part struct {
+	// Suffix is appended to the name of the storage to name the part, e.g. its file or its data
+	// in a backup. It is empty for the first part.
+	Suffix string
+	// Base is the position of the first byte of the part. The blocks of the storage that belong to
+	// the part are positioned at Base plus their position within the part.
+	Base types.Position
+	// Storage is the primary storage that holds the entries of the part.
+	Storage PrimaryStorage
+}
+
+// Aliaser is implemented by primary storages that can store an entry whose value is the value of
+// another entry, without copying it.
+type Aliaser interface {
+	// PutAlias saves an entry for the given key that refers to the value of the entry at `target`
+	// and returns the position it was stored at. The referenced entry is kept as long as the new
+	// entry is, e.g. by a compaction.
+	PutAlias(key []byte, target types.Block) (types.Block, error)
+}
+
+// Reopener is implemented by primary storages that can recover from a failed write without being
+// closed.
+type Reopener interface {
+	// Reopen discards all data that wasn't flushed successfully, including data that was only
+	// partially written to the end of the storage, and reopens the underlying files.
+	Reopen() error
+}
+
+// Streamer is implemented by primary storages that can read a value incrementally instead of
+// loading it into memory.
+type Streamer interface {
+	// GetStream returns the key of the entry at the given block together with a reader of its
+	// value and the length of the value. The reader fails once the storage is closed or its files
+	// are replaced by a compaction.
+	GetStream(blk types.Block) (key []byte, value io.ReadCloser, size int64, err error)
+}
+
+// StreamWriter is implemented by primary storages that can write a value incrementally instead of
+// holding it in memory until it is flushed.
+type StreamWriter interface {
+	// PutFrom saves the key together with a value of `size` bytes that is read from `r` and returns
+	// the position it was stored at. The entry is flushed when PutFrom returns. If `r` fails or
+	// ends early, nothing is stored.
+	PutFrom(key []byte, r io.Reader, size int64) (blk types.Block, err error)
+}
+
+// Backuper is implemented by primary storages that can be backed up by copying their raw data.
+type Backuper interface {
+	// ReadRawAt reads the raw data of the storage at the given offset, see `io.ReaderAt`. Only
+	// data that was flushed can be read.
+	ReadRawAt(p []byte, off int64) (int, error)
+}
+
+// Pather is implemented by primary storages that keep their data in a file, e.g. so that a store
+// can tell whether it's opened again with the same storage.
+type Pather interface {
+	// Path returns the path of the file that holds the data.
+	Path() string
+}
+
+// Warmer is implemented by primary storages that can read their data into the page cache of the
+// operating system ahead of time, see `store.Warmup`.
+type Warmer interface {
+	// Warmup reads the files of the storage sequentially. It returns the number of bytes read, and
+	// stops early with the error of the context once it's done.
+	Warmup(ctx context.Context) (int64, error)
+}
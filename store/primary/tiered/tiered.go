@@ -0,0 +1,462 @@
+// Package tiered provides a primary storage that keeps small and large values in separate primary
+// storages.
+//
+// Mixing tiny values with multi-megabyte ones in a single append log spreads the small values over
+// the whole file, which hurts the locality of reads. With separate tiers, the small values stay
+// close to each other and the tiers can be maintained independently.
+package tiered
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// largeTier is the bit of a position that marks blocks of the large tier. The remaining bits are
+// the position within the storage of the tier.
+const largeTier = types.Position(1) << 63
+
+// LargeSuffix is the suffix of the large tier, see `TieredPrimary.Parts`.
+const LargeSuffix = ".large"
+
+// TieredPrimary routes values smaller than a threshold to one primary storage and all other values
+// to another one. The tier of a block is encoded in the highest bit of its position.
+//
+// Both storages must derive the same index keys from a key.
+type TieredPrimary struct {
+	small     primary.PrimaryStorage
+	large     primary.PrimaryStorage
+	threshold int
+}
+
+// NewTieredPrimary returns a primary storage that stores values smaller than `threshold` bytes in
+// `small` and all others in `large`.
+func NewTieredPrimary(small primary.PrimaryStorage, large primary.PrimaryStorage, threshold int) *TieredPrimary {
+	return &TieredPrimary{
+		small:     small,
+		large:     large,
+		threshold: threshold,
+	}
+}
+
+// tier returns the storage a block belongs to together with the block within that storage.
+func (tp *TieredPrimary) tier(blk types.Block) (primary.PrimaryStorage, types.Block) {
+	if blk.Offset&largeTier != 0 {
+		return tp.large, types.Block{Offset: blk.Offset &^ largeTier, Size: blk.Size}
+	}
+	return tp.small, blk
+}
+
+func (tp *TieredPrimary) Get(blk types.Block) ([]byte, []byte, error) {
+	storage, blk := tp.tier(blk)
+	return storage.Get(blk)
+}
+
+func (tp *TieredPrimary) Put(key []byte, value []byte) (types.Block, error) {
+	if len(value) < tp.threshold {
+		return tp.small.Put(key, value)
+	}
+	blk, err := tp.large.Put(key, value)
+	if err != nil {
+		return types.Block{}, err
+	}
+	blk.Offset |= largeTier
+	return blk, nil
+}
+
+func (tp *TieredPrimary) IndexKey(key []byte) ([]byte, error) {
+	return tp.small.IndexKey(key)
+}
+
+func (tp *TieredPrimary) GetIndexKey(blk types.Block) ([]byte, error) {
+	storage, blk := tp.tier(blk)
+	return storage.GetIndexKey(blk)
+}
+
+// ValueSize returns the length of the value at the given block if the storage of its tier
+// implements `primary.ValueSizer`.
+func (tp *TieredPrimary) ValueSize(blk types.Block, key []byte) (types.Size, error) {
+	storage, blk := tp.tier(blk)
+	if sizer, ok := storage.(primary.ValueSizer); ok {
+		return sizer.ValueSize(blk, key)
+	}
+	return blk.Size - types.Size(len(key)), nil
+}
+
+// MaxValueSize returns the limit of the large tier if its storage implements
+// `primary.ValueLimiter`, see there.
+func (tp *TieredPrimary) MaxValueSize(key []byte) int64 {
+	if limiter, ok := tp.large.(primary.ValueLimiter); ok {
+		return limiter.MaxValueSize(key)
+	}
+	return types.MaxBlockSize
+}
+
+// PutAlias stores the alias in the tier of the entry it refers to, see `primary.Aliaser`. The
+// storage of that tier needs to implement it.
+func (tp *TieredPrimary) PutAlias(key []byte, target types.Block) (types.Block, error) {
+	storage, target := tp.tier(target)
+	aliaser, ok := storage.(primary.Aliaser)
+	if !ok {
+		return types.Block{}, types.ErrAliasNotSupported
+	}
+	blk, err := aliaser.PutAlias(key, target)
+	if err != nil {
+		return types.Block{}, err
+	}
+	if storage == tp.large {
+		blk.Offset |= largeTier
+	}
+	return blk, nil
+}
+
+// GetStream streams the value from the storage of the block's tier if it implements
+// `primary.Streamer`, otherwise the value is read into memory.
+func (tp *TieredPrimary) GetStream(blk types.Block) ([]byte, io.ReadCloser, int64, error) {
+	storage, blk := tp.tier(blk)
+	if streamer, ok := storage.(primary.Streamer); ok {
+		return streamer.GetStream(blk)
+	}
+	key, value, err := storage.Get(blk)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return key, ioutil.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+}
+
+// PutFrom writes the value to the tier its size belongs to, see `primary.StreamWriter`. If the
+// storage of that tier doesn't implement it, the value is read into memory and put.
+func (tp *TieredPrimary) PutFrom(key []byte, r io.Reader, size int64) (types.Block, error) {
+	storage := tp.small
+	if size >= int64(tp.threshold) {
+		storage = tp.large
+	}
+	var blk types.Block
+	var err error
+	if writer, ok := storage.(primary.StreamWriter); ok {
+		blk, err = writer.PutFrom(key, r, size)
+	} else {
+		value := make([]byte, size)
+		if _, err = io.ReadFull(r, value); err != nil {
+			return types.Block{}, err
+		}
+		blk, err = storage.Put(key, value)
+	}
+	if err != nil {
+		return types.Block{}, err
+	}
+	if storage == tp.large {
+		blk.Offset |= largeTier
+	}
+	return blk, nil
+}
+
+func (tp *TieredPrimary) Flush() (types.Work, error) {
+	smallWork, err := tp.small.Flush()
+	if err != nil {
+		return 0, err
+	}
+	largeWork, err := tp.large.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return smallWork + largeWork, nil
+}
+
+func (tp *TieredPrimary) Sync() error {
+	if err := tp.small.Sync(); err != nil {
+		return err
+	}
+	return tp.large.Sync()
+}
+
+func (tp *TieredPrimary) Close() error {
+	smallErr := tp.small.Close()
+	if err := tp.large.Close(); err != nil {
+		return err
+	}
+	return smallErr
+}
+
+// Reopen reopens the storages of both tiers, see `primary.Reopener`. Both storages need to
+// implement it.
+func (tp *TieredPrimary) Reopen() error {
+	small, smallOk := tp.small.(primary.Reopener)
+	large, largeOk := tp.large.(primary.Reopener)
+	if !smallOk || !largeOk {
+		return types.ErrReopenNotSupported
+	}
+	if err := small.Reopen(); err != nil {
+		return err
+	}
+	return large.Reopen()
+}
+
+// Warmup warms up the storages of both tiers, see `primary.Warmer`. Both storages need to
+// implement it.
+func (tp *TieredPrimary) Warmup(ctx context.Context) (int64, error) {
+	small, smallOk := tp.small.(primary.Warmer)
+	large, largeOk := tp.large.(primary.Warmer)
+	if !smallOk || !largeOk {
+		return 0, types.ErrWarmupNotSupported
+	}
+	smallRead, err := small.Warmup(ctx)
+	if err != nil {
+		return smallRead, err
+	}
+	largeRead, err := large.Warmup(ctx)
+	return smallRead + largeRead, err
+}
+
+// Parts returns the tiers, the small one first, see `primary.Partitioned`.
+func (tp *TieredPrimary) Parts() []primary.Part {
+	return []primary.Part{
+		{Storage: tp.small},
+		{Suffix: LargeSuffix, Base: largeTier, Storage: tp.large},
+	}
+}
+
+// Size returns the sum of the sizes of both tiers, see `primary.Sizer`. A tier whose storage
+// doesn't implement it counts as empty.
+func (tp *TieredPrimary) Size() types.Position {
+	var size types.Position
+	for _, storage := range []primary.PrimaryStorage{tp.small, tp.large} {
+		if sizer, ok := storage.(primary.Sizer); ok {
+			size += sizer.Size()
+		}
+	}
+	return size
+}
+
+// ReadRawAt reads the raw data of the tier the offset belongs to, see `primary.Backuper`. The
+// storage of that tier needs to implement it.
+func (tp *TieredPrimary) ReadRawAt(p []byte, off int64) (int, error) {
+	storage, blk := tp.tier(types.Block{Offset: types.Position(off)})
+	backuper, ok := storage.(primary.Backuper)
+	if !ok {
+		return 0, types.ErrBackupNotSupported
+	}
+	return backuper.ReadRawAt(p, int64(blk.Offset))
+}
+
+// Compact compacts both tiers, see `primary.Compactor`. The storage of the small tier needs to
+// implement `primary.Compactor`, the one of the large tier `primary.CompactionFinisher` as well,
+// and both compactions `primary.CompactionSyncer`, so that a commit that was interrupted by a
+// crash can be finished.
+func (tp *TieredPrimary) Compact() (primary.Compaction, error) {
+	small, smallOk := tp.small.(primary.Compactor)
+	large, largeOk := tp.large.(primary.Compactor)
+	_, finishOk := tp.large.(primary.CompactionFinisher)
+	if !smallOk || !largeOk || !finishOk {
+		return nil, types.ErrCompactionNotSupported
+	}
+	smallCompaction, err := small.Compact()
+	if err != nil {
+		return nil, err
+	}
+	largeCompaction, err := large.Compact()
+	if err != nil {
+		_ = smallCompaction.Abort()
+		return nil, err
+	}
+	_, smallSync := smallCompaction.(primary.CompactionSyncer)
+	_, largeSync := largeCompaction.(primary.CompactionSyncer)
+	if !smallSync || !largeSync {
+		_ = smallCompaction.Abort()
+		_ = largeCompaction.Abort()
+		return nil, types.ErrCompactionNotSupported
+	}
+	compaction := &tieredCompaction{tp: tp, small: smallCompaction, large: largeCompaction}
+	_, smallRead := smallCompaction.(primary.CompactionReader)
+	_, largeRead := largeCompaction.(primary.CompactionReader)
+	_, smallWrite := smallCompaction.(primary.CompactionWriter)
+	_, largeWrite := largeCompaction.(primary.CompactionWriter)
+	if smallRead && largeRead && smallWrite && largeWrite {
+		return &tieredRWCompaction{compaction}, nil
+	}
+	return compaction, nil
+}
+
+// DiscardCompaction discards the copies of an interrupted compaction, see `primary.Compactor`. A
+// compaction whose small tier was committed already is finished instead, see
+// `tieredCompaction.Commit`, and reported as not discarded.
+func (tp *TieredPrimary) DiscardCompaction() (bool, error) {
+	small, smallOk := tp.small.(primary.Compactor)
+	large, largeOk := tp.large.(primary.CompactionFinisher)
+	if !smallOk || !largeOk {
+		return false, types.ErrCompactionNotSupported
+	}
+	discarded, err := small.DiscardCompaction()
+	if err != nil {
+		return false, err
+	}
+	if discarded {
+		// Neither tier was committed.
+		_, err := tp.large.(primary.Compactor).DiscardCompaction()
+		return true, err
+	}
+	_, err = large.FinishCompaction()
+	return false, err
+}
+
+func (tp *TieredPrimary) OutstandingWork() types.Work {
+	return tp.small.OutstandingWork() + tp.large.OutstandingWork()
+}
+
+// Iter iterates over the small tier first and then over the large one. The order in which entries
+// were written across tiers is lost, hence an index that is rebuilt from a tiered storage may
+// return an outdated value for keys that moved between tiers on update.
+func (tp *TieredPrimary) Iter() (primary.PrimaryStorageIter, error) {
+	small, err := tp.small.Iter()
+	if err != nil {
+		return nil, err
+	}
+	large, err := tp.large.Iter()
+	if err != nil {
+		return nil, err
+	}
+	iter := &tieredIter{iters: []primary.PrimaryStorageIter{small, large}}
+	_, smallBlocks := small.(primary.BlockIter)
+	_, largeBlocks := large.(primary.BlockIter)
+	if smallBlocks && largeBlocks {
+		return &tieredBlockIter{iter}, nil
+	}
+	return iter, nil
+}
+
+type tieredIter struct {
+	iters []primary.PrimaryStorageIter
+	// Index of the current iterator, 0 for the small tier and 1 for the large one
+	cur int
+	// Whether a tier ended with a partially written entry
+	torn bool
+}
+
+// Next returns the entries of the tiers one after the other. A tier that ends with a partially
+// written entry doesn't hide the entries of the next one, `io.ErrUnexpectedEOF` is returned once
+// all tiers were read instead of `io.EOF`.
+func (ti *tieredIter) Next() ([]byte, []byte, error) {
+	for ti.cur < len(ti.iters) {
+		key, value, err := ti.iters[ti.cur].Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			ti.torn = ti.torn || err == io.ErrUnexpectedEOF
+			ti.cur++
+			continue
+		}
+		return key, value, err
+	}
+	if ti.torn {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return nil, nil, io.EOF
+}
+
+// tieredBlockIter is the iterator of tiers whose iterators report the positions of their entries.
+type tieredBlockIter struct {
+	*tieredIter
+}
+
+func (ti *tieredBlockIter) Block() types.Block {
+	if ti.cur >= len(ti.iters) {
+		return types.Block{}
+	}
+	blk := ti.iters[ti.cur].(primary.BlockIter).Block()
+	if ti.cur == 1 {
+		blk.Offset |= largeTier
+	}
+	return blk
+}
+
+// tieredCompaction compacts both tiers together.
+type tieredCompaction struct {
+	tp    *TieredPrimary
+	small primary.Compaction
+	large primary.Compaction
+}
+
+func (tc *tieredCompaction) Move(blk types.Block) (types.Block, error) {
+	if blk.Offset&largeTier == 0 {
+		return tc.small.Move(blk)
+	}
+	moved, err := tc.large.Move(types.Block{Offset: blk.Offset &^ largeTier, Size: blk.Size})
+	if err != nil {
+		return types.Block{}, err
+	}
+	moved.Offset |= largeTier
+	return moved, nil
+}
+
+// Sync makes the compacted copies of both tiers durable, see `primary.CompactionSyncer`.
+func (tc *tieredCompaction) Sync() error {
+	if err := tc.small.(primary.CompactionSyncer).Sync(); err != nil {
+		return err
+	}
+	return tc.large.(primary.CompactionSyncer).Sync()
+}
+
+// Commit syncs both compacted copies before either tier is replaced, the small one first. If the
+// process crashes after that, DiscardCompaction replaces the large tier as well.
+func (tc *tieredCompaction) Commit() error {
+	if err := tc.Sync(); err != nil {
+		return err
+	}
+	if err := tc.small.Commit(); err != nil {
+		return err
+	}
+	return tc.large.Commit()
+}
+
+func (tc *tieredCompaction) Abort() error {
+	smallErr := tc.small.Abort()
+	if err := tc.large.Abort(); err != nil {
+		return err
+	}
+	return smallErr
+}
+
+// tieredRWCompaction is the compaction of tiers whose compactions implement both
+// `primary.CompactionReader` and `primary.CompactionWriter`.
+type tieredRWCompaction struct {
+	*tieredCompaction
+}
+
+func (tc *tieredRWCompaction) Get(blk types.Block) ([]byte, []byte, error) {
+	if blk.Offset&largeTier == 0 {
+		return tc.small.(primary.CompactionReader).Get(blk)
+	}
+	return tc.large.(primary.CompactionReader).Get(types.Block{Offset: blk.Offset &^ largeTier, Size: blk.Size})
+}
+
+// Put stores the entry in the compacted copy of the tier its size belongs to.
+func (tc *tieredRWCompaction) Put(key []byte, value []byte) (types.Block, error) {
+	if len(value) < tc.tp.threshold {
+		return tc.small.(primary.CompactionWriter).Put(key, value)
+	}
+	blk, err := tc.large.(primary.CompactionWriter).Put(key, value)
+	if err != nil {
+		return types.Block{}, err
+	}
+	blk.Offset |= largeTier
+	return blk, nil
+}
+
+var _ primary.PrimaryStorage = &TieredPrimary{}
+var _ primary.Partitioned = &TieredPrimary{}
+var _ primary.Sizer = &TieredPrimary{}
+var _ primary.Backuper = &TieredPrimary{}
+var _ primary.Compactor = &TieredPrimary{}
+var _ primary.CompactionSyncer = &tieredCompaction{}
+var _ primary.CompactionReader = &tieredRWCompaction{}
+var _ primary.CompactionWriter = &tieredRWCompaction{}
+var _ primary.ValueSizer = &TieredPrimary{}
+var _ primary.ValueLimiter = &TieredPrimary{}
+var _ primary.Reopener = &TieredPrimary{}
+var _ primary.Warmer = &TieredPrimary{}
+var _ primary.Aliaser = &TieredPrimary{}
+var _ primary.Streamer = &TieredPrimary{}
+var _ primary.StreamWriter = &TieredPrimary{}
+var _ primary.BlockIter = &tieredBlockIter{}
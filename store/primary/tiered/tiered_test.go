@@ -0,0 +1,193 @@
+package tiered_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/primary/tiered"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTiers(t *testing.T) {
+	small := inmemory.NewInmemory([][2][]byte{})
+	large := inmemory.NewInmemory([][2][]byte{})
+	storage := tiered.NewTieredPrimary(small, large, 4)
+
+	entries := [][2][]byte{
+		{[]byte("aaaa"), []byte("abc")},
+		{[]byte("bbbb"), []byte("abcdef")},
+		{[]byte("cccc"), []byte("xyz")},
+	}
+	for _, entry := range entries {
+		blk, err := storage.Put(entry[0], entry[1])
+		require.NoError(t, err)
+		key, value, err := storage.Get(blk)
+		require.NoError(t, err)
+		require.Equal(t, entry, [2][]byte{key, value})
+		indexKey, err := storage.GetIndexKey(blk)
+		require.NoError(t, err)
+		require.Equal(t, entry[0], indexKey)
+	}
+	require.Equal(t, [][2][]byte{entries[0], entries[2]}, [][2][]byte(*small))
+	require.Equal(t, [][2][]byte{entries[1]}, [][2][]byte(*large))
+
+	// The iterator visits the small tier first.
+	iter, err := storage.Iter()
+	require.NoError(t, err)
+	blockIter, ok := iter.(primary.BlockIter)
+	require.True(t, ok)
+	for _, entry := range [][2][]byte{entries[0], entries[2], entries[1]} {
+		key, value, err := blockIter.Next()
+		require.NoError(t, err)
+		require.Equal(t, entry, [2][]byte{key, value})
+		key, value, err = storage.Get(blockIter.Block())
+		require.NoError(t, err)
+		require.Equal(t, entry, [2][]byte{key, value})
+	}
+	_, _, err = blockIter.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func openCIDTiers(t *testing.T, path string) (*cidprimary.CIDPrimary, *cidprimary.CIDPrimary, *tiered.TieredPrimary) {
+	small, err := cidprimary.OpenCIDPrimary(path)
+	require.NoError(t, err)
+	large, err := cidprimary.OpenCIDPrimary(path + tiered.LargeSuffix)
+	require.NoError(t, err)
+	return small, large, tiered.NewTieredPrimary(small, large, 500)
+}
+
+func TestTornSmallTier(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "storethehash.data")
+	_, _, storage := openCIDTiers(t, path)
+	blks := append(testutil.GenerateBlocksOfSize(2, 100), testutil.GenerateBlocksOfSize(2, 1000)...)
+	for _, blk := range blks {
+		_, err := storage.Put(blk.Cid().Bytes(), blk.RawData())
+		require.NoError(t, err)
+	}
+	_, err = storage.Flush()
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	// The last entry of the small tier was written partially.
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-10))
+
+	_, _, storage = openCIDTiers(t, path)
+	defer storage.Close()
+	iter, err := storage.Iter()
+	require.NoError(t, err)
+	for _, blk := range []blocks.Block{blks[0], blks[2], blks[3]} {
+		key, value, err := iter.Next()
+		require.NoError(t, err)
+		require.Equal(t, blk.Cid().Bytes(), key)
+		require.Equal(t, blk.RawData(), value)
+	}
+	_, _, err = iter.Next()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCompaction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "storethehash.data")
+	_, _, storage := openCIDTiers(t, path)
+	blks := append(testutil.GenerateBlocksOfSize(4, 100), testutil.GenerateBlocksOfSize(4, 1000)...)
+	var stored []types.Block
+	for _, blk := range blks {
+		stored = append(stored, mustPut(t, storage, blk))
+	}
+	_, err = storage.Flush()
+	require.NoError(t, err)
+	before := storage.Size()
+
+	// Only every other entry of each tier is kept.
+	compaction, err := storage.Compact()
+	require.NoError(t, err)
+	moved := make(map[int]types.Block)
+	for n := 0; n < len(blks); n += 2 {
+		moved[n], err = compaction.Move(stored[n])
+		require.NoError(t, err)
+	}
+	require.NoError(t, compaction.Commit())
+	require.Equal(t, before/2, storage.Size())
+	for n, blk := range moved {
+		key, value, err := storage.Get(blk)
+		require.NoError(t, err)
+		require.Equal(t, blks[n].Cid().Bytes(), key)
+		require.Equal(t, blks[n].RawData(), value)
+	}
+	discarded, err := storage.DiscardCompaction()
+	require.NoError(t, err)
+	require.False(t, discarded)
+	require.NoError(t, storage.Close())
+}
+
+func TestInterruptedCompaction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "storethehash.data")
+	small, large, storage := openCIDTiers(t, path)
+	blks := append(testutil.GenerateBlocksOfSize(2, 100), testutil.GenerateBlocksOfSize(2, 1000)...)
+	var stored []types.Block
+	for _, blk := range blks {
+		stored = append(stored, mustPut(t, storage, blk))
+	}
+	_, err = storage.Flush()
+	require.NoError(t, err)
+
+	// A crash before either tier was committed rolls both back.
+	compaction, err := storage.Compact()
+	require.NoError(t, err)
+	_, err = compaction.Move(stored[1])
+	require.NoError(t, err)
+	require.NoError(t, compaction.(primary.CompactionSyncer).Sync())
+	discarded, err := storage.DiscardCompaction()
+	require.NoError(t, err)
+	require.True(t, discarded)
+	for n, blk := range stored {
+		key, _, err := storage.Get(blk)
+		require.NoError(t, err)
+		require.Equal(t, blks[n].Cid().Bytes(), key)
+	}
+
+	// A crash after the small tier was committed finishes the large one as well.
+	smallCompaction, err := small.Compact()
+	require.NoError(t, err)
+	_, err = smallCompaction.Move(stored[1])
+	require.NoError(t, err)
+	largeCompaction, err := large.Compact()
+	require.NoError(t, err)
+	_, err = largeCompaction.Move(types.Block{Offset: stored[3].Offset &^ (1 << 63), Size: stored[3].Size})
+	require.NoError(t, err)
+	require.NoError(t, largeCompaction.(primary.CompactionSyncer).Sync())
+	require.NoError(t, smallCompaction.Commit())
+	discarded, err = storage.DiscardCompaction()
+	require.NoError(t, err)
+	require.False(t, discarded)
+	_, err = os.Stat(path + tiered.LargeSuffix + ".gc")
+	require.True(t, os.IsNotExist(err))
+	key, value, err := storage.Get(types.Block{Offset: 1 << 63, Size: stored[3].Size})
+	require.NoError(t, err)
+	require.Equal(t, blks[3].Cid().Bytes(), key)
+	require.Equal(t, blks[3].RawData(), value)
+	require.Equal(t, types.Position(cidprimary.CIDSizePrefix)*2+types.Position(stored[1].Size+stored[3].Size), storage.Size())
+	require.NoError(t, storage.Close())
+}
+
+func mustPut(t *testing.T, storage *tiered.TieredPrimary, blk blocks.Block) types.Block {
+	stored, err := storage.Put(blk.Cid().Bytes(), blk.RawData())
+	require.NoError(t, err)
+	return stored
+}
@@ -0,0 +1,270 @@
+// Package provenance records which source the entries of a store were copied from, e.g. by a
+// merge, so that the lineage of the data can be audited later on.
+package provenance
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// The file is a sequence of records, each one assigns a source to a key. An empty source removes
+// the assignment:
+//
+//	|  2 bytes   |  Key length  |     2 bytes     |  Source length  |
+//	| Key length |     Key      |  Source length  |     Source      |
+const lengthBytes = 2
+
+const bufferSize = 32 * 4096
+
+// Provenance maps keys to the sources they were copied from. All assignments are kept in memory,
+// the file is only read when it is opened.
+type Provenance struct {
+	lk              sync.RWMutex
+	file            *os.File
+	writer          *bufio.Writer
+	outstandingWork types.Work
+	// Sources are interned, keys refer to them by their position.
+	sources   []string
+	sourceIDs map[string]int
+	keys      map[string]int
+}
+
+// OpenProvenance opens the provenance file at the given path and reads all assignments. A record
+// that was cut off by a crash is removed.
+func OpenProvenance(path string) (*Provenance, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provenance{
+		file:      file,
+		sourceIDs: make(map[string]int),
+		keys:      make(map[string]int),
+	}
+	size, err := p.load()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(size); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	p.writer = bufio.NewWriterSize(file, bufferSize)
+	return p, nil
+}
+
+// load reads all records of the file and returns the size of the complete ones.
+func (p *Provenance) load() (int64, error) {
+	reader := bufio.NewReaderSize(p.file, bufferSize)
+	var size int64
+	for {
+		key, err := readField(reader)
+		if err == io.EOF {
+			return size, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		source, err := readField(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		p.assign(key, string(source))
+		size += int64(2*lengthBytes + len(key) + len(source))
+	}
+}
+
+func readField(reader io.Reader) ([]byte, error) {
+	lengthBuf := make([]byte, lengthBytes)
+	if _, err := io.ReadFull(reader, lengthBuf); err != nil {
+		return nil, err
+	}
+	field := make([]byte, binary.LittleEndian.Uint16(lengthBuf))
+	if _, err := io.ReadFull(reader, field); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return field, nil
+}
+
+// assign updates the in-memory assignment of a key. It must be called with the lock held.
+func (p *Provenance) assign(key []byte, source string) {
+	if source == "" {
+		delete(p.keys, string(key))
+		return
+	}
+	id, ok := p.sourceIDs[source]
+	if !ok {
+		id = len(p.sources)
+		p.sources = append(p.sources, source)
+		p.sourceIDs[source] = id
+	}
+	p.keys[string(key)] = id
+}
+
+// Put records that the key was copied from the given source. An empty source removes the record,
+// e.g. because the key was written directly afterwards.
+func (p *Provenance) Put(key []byte, source string) error {
+	if len(key) > 0xffff || len(source) > 0xffff {
+		return types.ErrOutOfBounds
+	}
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if _, ok := p.keys[string(key)]; !ok && source == "" {
+		return nil
+	}
+	p.assign(key, source)
+	if err := writeRecord(p.writer, key, source); err != nil {
+		return err
+	}
+	p.outstandingWork += types.Work(2*lengthBytes + len(key) + len(source))
+	return nil
+}
+
+func writeRecord(writer io.Writer, key []byte, source string) error {
+	lengthBuf := make([]byte, lengthBytes)
+	for _, field := range [][]byte{key, []byte(source)} {
+		binary.LittleEndian.PutUint16(lengthBuf, uint16(len(field)))
+		if _, err := writer.Write(lengthBuf); err != nil {
+			return err
+		}
+		if _, err := writer.Write(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the file with one record for every key that `keep` accepts, which drops the
+// records that were replaced or removed. The assignments of the other keys are removed, as are
+// sources that no key refers to anymore. The file is replaced atomically.
+func (p *Provenance) Compact(keep func(key []byte) (bool, error)) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	keys := make(map[string]int, len(p.keys))
+	var sources []string
+	sourceIDs := make(map[string]int)
+	for key, id := range p.keys {
+		ok, err := keep([]byte(key))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		source := p.sources[id]
+		newID, ok := sourceIDs[source]
+		if !ok {
+			newID = len(sources)
+			sources = append(sources, source)
+			sourceIDs[source] = newID
+		}
+		keys[key] = newID
+	}
+
+	path := p.file.Name()
+	compactPath := path + ".compact"
+	file, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(file, bufferSize)
+	err = func() error {
+		for key, id := range keys {
+			if err := writeRecord(writer, []byte(key), sources[id]); err != nil {
+				return err
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	if err == nil {
+		err = os.Rename(compactPath, path)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(compactPath)
+		return err
+	}
+
+	// The outstanding records of the old file are contained in the new one.
+	_ = p.file.Close()
+	p.file = file
+	p.writer = writer
+	p.outstandingWork = 0
+	p.keys = keys
+	p.sources = sources
+	p.sourceIDs = sourceIDs
+	return nil
+}
+
+// Get returns the source the key was copied from.
+func (p *Provenance) Get(key []byte) (string, bool) {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	id, ok := p.keys[string(key)]
+	if !ok {
+		return "", false
+	}
+	return p.sources[id], true
+}
+
+// Has returns whether a source is recorded for the key.
+func (p *Provenance) Has(key []byte) bool {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	_, ok := p.keys[string(key)]
+	return ok
+}
+
+func (p *Provenance) Flush() (types.Work, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	work := p.outstandingWork
+	if err := p.writer.Flush(); err != nil {
+		return 0, err
+	}
+	p.outstandingWork = 0
+	return work, nil
+}
+
+func (p *Provenance) Sync() error {
+	if _, err := p.Flush(); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+func (p *Provenance) OutstandingWork() types.Work {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	return p.outstandingWork
+}
+
+func (p *Provenance) Close() error {
+	if _, err := p.Flush(); err != nil {
+		_ = p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
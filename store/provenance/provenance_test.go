@@ -0,0 +1,102 @@
+package provenance_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/provenance"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvenance(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "storethehash.provenance")
+	p, err := provenance.OpenProvenance(path)
+	require.NoError(t, err)
+	require.NoError(t, p.Put([]byte("aaaa"), "shard-1"))
+	require.NoError(t, p.Put([]byte("bbbb"), "shard-2"))
+	require.NoError(t, p.Put([]byte("cccc"), "shard-1"))
+	require.NoError(t, p.Put([]byte("cccc"), ""))
+	source, ok := p.Get([]byte("aaaa"))
+	require.True(t, ok)
+	require.Equal(t, "shard-1", source)
+	require.NoError(t, p.Close())
+
+	// Append a torn record, it's dropped on open.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{4, 0, 'd', 'd'})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	p, err = provenance.OpenProvenance(path)
+	require.NoError(t, err)
+	source, ok = p.Get([]byte("bbbb"))
+	require.True(t, ok)
+	require.Equal(t, "shard-2", source)
+	_, ok = p.Get([]byte("cccc"))
+	require.False(t, ok)
+	require.NoError(t, p.Put([]byte("dddd"), "shard-3"))
+	require.NoError(t, p.Close())
+
+	p, err = provenance.OpenProvenance(path)
+	require.NoError(t, err)
+	defer p.Close()
+	source, ok = p.Get([]byte("dddd"))
+	require.True(t, ok)
+	require.Equal(t, "shard-3", source)
+	source, ok = p.Get([]byte("aaaa"))
+	require.True(t, ok)
+	require.Equal(t, "shard-1", source)
+}
+
+func TestCompact(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "storethehash.provenance")
+	p, err := provenance.OpenProvenance(path)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, p.Put([]byte("aaaa"), "shard-1"))
+		require.NoError(t, p.Put([]byte("aaaa"), ""))
+	}
+	require.NoError(t, p.Put([]byte("bbbb"), "shard-2"))
+	require.NoError(t, p.Put([]byte("cccc"), "shard-3"))
+	require.NoError(t, p.Put([]byte("dddd"), "shard-2"))
+	_, err = p.Flush()
+	require.NoError(t, err)
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// The key that isn't kept is dropped as well.
+	require.NoError(t, p.Compact(func(key []byte) (bool, error) {
+		return string(key) != "cccc", nil
+	}))
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(2*(2+4+2+7)), after.Size())
+	require.True(t, after.Size() < before.Size())
+	_, ok := p.Get([]byte("cccc"))
+	require.False(t, ok)
+	// The compacted file is appended to.
+	require.NoError(t, p.Put([]byte("eeee"), "shard-3"))
+	require.NoError(t, p.Close())
+
+	p, err = provenance.OpenProvenance(path)
+	require.NoError(t, err)
+	defer p.Close()
+	for key, source := range map[string]string{"bbbb": "shard-2", "dddd": "shard-2", "eeee": "shard-3"} {
+		got, ok := p.Get([]byte(key))
+		require.True(t, ok)
+		require.Equal(t, source, got)
+	}
+	for _, key := range []string{"aaaa", "cccc"} {
+		_, ok := p.Get([]byte(key))
+		require.False(t, ok)
+	}
+	_, err = os.Stat(path + ".compact")
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// RateLimiter throttles writers so that buffered work doesn't grow faster than it can be flushed.
+type RateLimiter interface {
+	// Allow is called after a write added `work` to the outstanding work. It returns how long the
+	// writer has to wait before it may continue, zero means no wait.
+	Allow(work types.Work) time.Duration
+	// OnFlush is called after every successful flush with the flushed work and the time it took.
+	OnFlush(work types.Work, elapsed time.Duration)
+}
+
+// Number of flushes used for the initial burst rate calibration.
+const calibrationFlushes = 5
+
+// Weight of a single flush when re-calibrating the burst rate after the initial calibration.
+const calibrationWeight = 0.05
+
+// TokenBucket is the default rate limiter.
+//
+// Writers may add up to the burst rate of work without being throttled. Beyond that, work is
+// admitted at the rate at which previous large flushes were able to write data to disk. As long as
+// no flush exceeded the burst rate, writers are never throttled.
+type TokenBucket struct {
+	lk       sync.Mutex
+	burst    types.Work
+	rate     float64 // work per second
+	tokens   float64
+	last     time.Time
+	maxWait  time.Duration
+	interval time.Duration
+
+	// burst rate calibration
+	autoCalibrate   bool
+	calibrated      int
+	calibrationWork types.Work
+	calibrationTime time.Duration
+	throughput      float64
+}
+
+// NewTokenBucket returns a token bucket with the given burst rate. Waits are capped at the sync
+// interval, as the outstanding work is flushed at least that often.
+func NewTokenBucket(burstRate types.Work, syncInterval time.Duration) *TokenBucket {
+	return &TokenBucket{
+		burst:    burstRate,
+		tokens:   float64(burstRate),
+		last:     time.Now(),
+		maxWait:  syncInterval,
+		interval: syncInterval,
+	}
+}
+
+// AutoCalibrate makes the token bucket derive its burst rate from the measured flush throughput.
+//
+// The sustained throughput of the first few flushes sets the burst rate to the amount of work that
+// can be flushed within one sync interval. Afterwards the value is re-calibrated slowly with every
+// flush. Until the calibration is done the initial burst rate is used.
+func (tb *TokenBucket) AutoCalibrate() *TokenBucket {
+	tb.lk.Lock()
+	tb.autoCalibrate = true
+	tb.lk.Unlock()
+	return tb
+}
+
+func (tb *TokenBucket) Allow(work types.Work) time.Duration {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+	if tb.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > float64(tb.burst) {
+		tb.tokens = float64(tb.burst)
+	}
+	tb.last = now
+	tb.tokens -= float64(work)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	if wait > tb.maxWait {
+		wait = tb.maxWait
+	}
+	return wait
+}
+
+func (tb *TokenBucket) OnFlush(work types.Work, elapsed time.Duration) {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+	if tb.autoCalibrate && work > 0 {
+		tb.calibrate(work, elapsed)
+	}
+	// Small flushes are dominated by fixed costs like fsync, they don't tell how fast data can be
+	// written.
+	if work > tb.burst && elapsed > 0 {
+		tb.rate = float64(work) / elapsed.Seconds()
+	}
+}
+
+// calibrate updates the burst rate from the throughput of a flush. It must be called with the lock
+// held.
+func (tb *TokenBucket) calibrate(work types.Work, elapsed time.Duration) {
+	if tb.calibrated < calibrationFlushes {
+		tb.calibrationWork += work
+		tb.calibrationTime += elapsed
+		tb.calibrated++
+		if tb.calibrated < calibrationFlushes || tb.calibrationTime <= 0 {
+			return
+		}
+		tb.throughput = float64(tb.calibrationWork) / tb.calibrationTime.Seconds()
+	} else if elapsed > 0 {
+		throughput := float64(work) / elapsed.Seconds()
+		tb.throughput = (1-calibrationWeight)*tb.throughput + calibrationWeight*throughput
+	}
+	tb.burst = types.Work(tb.throughput * tb.interval.Seconds())
+}
+
+// SetBurstRate changes the amount of work that can be added without being throttled. Tokens beyond
+// the new burst rate are dropped.
+func (tb *TokenBucket) SetBurstRate(burstRate types.Work) {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+	tb.burst = burstRate
+	if tb.tokens > float64(burstRate) {
+		tb.tokens = float64(burstRate)
+	}
+}
+
+// SetSyncInterval changes the sync interval that caps waits and, with AutoCalibrate, determines
+// the burst rate.
+func (tb *TokenBucket) SetSyncInterval(interval time.Duration) {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+	tb.maxWait = interval
+	tb.interval = interval
+}
+
+// BurstRate returns the amount of work that can be added without being throttled.
+func (tb *TokenBucket) BurstRate() types.Work {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+	return tb.burst
+}
+
+// Rate returns the rate (in work per second) at which work is admitted beyond the burst rate.
+func (tb *TokenBucket) Rate() float64 {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+	return tb.rate
+}
+
+// NoRateLimit is a rate limiter that never throttles writers.
+type NoRateLimit struct{}
+
+func (NoRateLimit) Allow(types.Work) time.Duration { return 0 }
+
+func (NoRateLimit) OnFlush(types.Work, time.Duration) {}
+
+var _ RateLimiter = &TokenBucket{}
+var _ RateLimiter = NoRateLimit{}
@@ -0,0 +1,94 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := store.NewTokenBucket(1000, time.Second)
+
+	// Writers are not throttled before a flush measured the flush rate
+	require.Zero(t, tb.Allow(5000))
+
+	// Small flushes don't set the rate
+	tb.OnFlush(500, time.Millisecond)
+	require.Zero(t, tb.Rate())
+	require.Zero(t, tb.Allow(5000))
+
+	tb.OnFlush(10000, 100*time.Millisecond)
+	require.Equal(t, float64(100000), tb.Rate())
+
+	// The burst is admitted immediately, further work has to wait
+	tb = store.NewTokenBucket(1000, time.Second)
+	tb.OnFlush(10000, 100*time.Millisecond)
+	require.Zero(t, tb.Allow(1000))
+	wait := tb.Allow(10000)
+	require.True(t, wait > 90*time.Millisecond && wait <= 100*time.Millisecond, "unexpected wait %s", wait)
+
+	// Waits are capped at the sync interval
+	require.Equal(t, time.Second, tb.Allow(1000000))
+	tb.SetSyncInterval(time.Millisecond)
+	require.Equal(t, time.Millisecond, tb.Allow(1000000))
+
+	tb.SetBurstRate(5000)
+	require.Equal(t, types.Work(5000), tb.BurstRate())
+}
+
+func TestTokenBucketAutoCalibrate(t *testing.T) {
+	tb := store.NewTokenBucket(1, time.Second).AutoCalibrate()
+	for n := 0; n < 4; n++ {
+		tb.OnFlush(1000, 10*time.Millisecond)
+		require.Equal(t, types.Work(1), tb.BurstRate())
+	}
+	tb.OnFlush(1000, 10*time.Millisecond)
+	require.Equal(t, types.Work(100000), tb.BurstRate())
+
+	// Further flushes only move the burst rate slowly
+	tb.OnFlush(1000, 20*time.Millisecond)
+	require.Equal(t, types.Work(97500), tb.BurstRate())
+}
+
+func TestNoRateLimit(t *testing.T) {
+	var limiter store.RateLimiter = store.NoRateLimit{}
+	limiter.OnFlush(10000, time.Millisecond)
+	require.Zero(t, limiter.Allow(1000000))
+}
+
+func TestSetSyncInterval(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), inmemory.NewInmemory(nil), defaultIndexSizeBits, time.Hour, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	s.Start()
+
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.Equal(t, types.ErrInvalidSyncInterval, s.SetSyncInterval(0))
+	require.NoError(t, s.SetSyncInterval(10*time.Millisecond))
+	require.Equal(t, 10*time.Millisecond, s.SyncInterval())
+	// The background flusher picks up the new interval right away.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Flushes == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotZero(t, s.Stats().Flushes)
+
+	require.NoError(t, s.SetBurstRate(1234))
+	require.Equal(t, types.Work(1234), s.Stats().BurstRate)
+
+	s2, err := store.OpenStore(filepath.Join(tempDir, "other.index"), inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.RateLimit(store.NoRateLimit{}))
+	require.NoError(t, err)
+	defer s2.Close()
+	require.Equal(t, types.ErrBurstRateNotAdjustable, s2.SetBurstRate(1234))
+}
@@ -0,0 +1,44 @@
+// Package readahead reads files sequentially so that the operating system keeps them in its page
+// cache, which spares the random reads that follow the latency of cold reads from disk.
+package readahead
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// chunkSize is the size of the reads, the context is checked between them.
+const chunkSize = 1 << 20
+
+// File reads the file at the given path from start to end and returns the number of bytes read.
+// Where supported, the operating system is told that the file is read sequentially and will be
+// needed soon, so that it reads ahead. It stops early with the error of the context once it's done.
+func File(ctx context.Context, path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	hint(file, info.Size())
+
+	buf := make([]byte, chunkSize)
+	var read int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return read, err
+		}
+		n, err := file.Read(buf)
+		read += int64(n)
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
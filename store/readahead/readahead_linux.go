@@ -0,0 +1,15 @@
+package readahead
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// hint advises the kernel to read the file ahead aggressively. The hints are only an optimization,
+// their errors are ignored.
+func hint(file *os.File, size int64) {
+	fd := int(file.Fd())
+	_ = unix.Fadvise(fd, 0, size, unix.FADV_SEQUENTIAL)
+	_ = unix.Fadvise(fd, 0, size, unix.FADV_WILLNEED)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package readahead
+
+import "os"
+
+// hint does nothing, only the sequential reads warm the page cache.
+func hint(*os.File, int64) {}
@@ -0,0 +1,31 @@
+package readahead_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/readahead"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "data")
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, 3<<20+17), 0o644))
+
+	read, err := readahead.File(context.Background(), path)
+	require.NoError(t, err)
+	require.Equal(t, int64(3<<20+17), read)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	read, err = readahead.File(ctx, path)
+	require.Equal(t, context.Canceled, err)
+	require.Zero(t, read)
+
+	_, err = readahead.File(context.Background(), filepath.Join(tempDir, "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/bloom"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the index while it is rebuilt.
+const rebuildSuffix = ".rebuild"
+
+// rebuildFlushWork is the amount of buffered index work after which a rebuild flushes the index.
+const rebuildFlushWork = 64 * 1024 * 1024
+
+// RebuildResult describes a completed RebuildIndex, e.g. to validate a `RecoveryEstimate`.
+type RebuildResult struct {
+	// Number of entries that were replayed
+	Entries uint64
+	// Size of the primary storage in bytes. It is zero if the primary storage doesn't implement
+	// `primary.Sizer`.
+	PrimarySize types.Position
+	// Time the rebuild took
+	Duration time.Duration
+}
+
+// RebuildIndex regenerates the index at `path` from the given primary storage, e.g. when the index
+// file was lost or is corrupt. An existing index is replaced once the new one is complete.
+//
+// All entries of the primary storage are replayed in the order they were written, later entries of
+// a key replace earlier ones, as updates do. The replay stops at an entry that is cut off at the end
+// of the primary storage, as a crash may leave one behind. The iterator of the primary storage
+// needs to implement `primary.BlockIter` and the store must not be open in this process.
+func RebuildIndex(path string, primaryStorage primary.PrimaryStorage, indexSizeBits uint8) (RebuildResult, error) {
+	var result RebuildResult
+	key, err := storeKey(path)
+	if err != nil {
+		return result, err
+	}
+	openStores.Lock()
+	defer openStores.Unlock()
+	if _, ok := openStores.stores[key]; ok {
+		return result, types.ErrStoreOpen
+	}
+	return rebuildIndex(path, primaryStorage, indexSizeBits)
+}
+
+// rebuildIndex regenerates the index like RebuildIndex, with the given options, for a store that
+// isn't open.
+func rebuildIndex(path string, primaryStorage primary.PrimaryStorage, indexSizeBits uint8, options ...index.Option) (RebuildResult, error) {
+	start := time.Now()
+	var result RebuildResult
+	iter, err := primaryStorage.Iter()
+	if err != nil {
+		return result, err
+	}
+	blockIter, ok := iter.(primary.BlockIter)
+	if !ok {
+		return result, types.ErrRebuildNotSupported
+	}
+	if sizer, ok := primaryStorage.(primary.Sizer); ok {
+		result.PrimarySize = sizer.Size()
+	}
+
+	rebuildPath := path + rebuildSuffix
+	if err := os.Remove(rebuildPath); err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	idx, err := index.OpenIndex(rebuildPath, primaryStorage, indexSizeBits, options...)
+	if err != nil {
+		return result, err
+	}
+	result.Entries, err = replay(idx, blockIter)
+	if err != nil {
+		_ = idx.Close()
+		_ = os.Remove(rebuildPath)
+		return result, err
+	}
+	if err := idx.Close(); err != nil {
+		return result, err
+	}
+
+	// A rewritten index of an interrupted GC belongs to the old index, see `recoverGC`.
+	if err := os.Remove(path + gcSuffix); err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	if err := index.RenameIndex(rebuildPath, path); err != nil {
+		return result, err
+	}
+	// The new index contains all entries a recovery marker refers to, see `CloseContext`.
+	if err := os.Remove(path + recoverySuffix); err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	// The bloom filter is built again from the new index.
+	if err := bloom.Remove(path); err != nil {
+		return result, err
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// openIndex opens the index of a store. A corrupt index is rebuilt from the primary storage if
+// `RebuildCorruptIndex` is set.
+func openIndex(path string, primaryStorage primary.PrimaryStorage, indexSizeBits uint8, c config) (*index.Index, error) {
+	options := withWriteAheadLog(c.indexOptions, c.wal)
+	idx, err := index.OpenIndex(path, primaryStorage, indexSizeBits, options...)
+	var corrupt types.ErrIndexCorrupt
+	if !c.rebuildCorrupt || !errors.As(err, &corrupt) {
+		return idx, err
+	}
+	c.logger.Warnw("rebuilding corrupt index", "path", path, "err", err)
+	if _, err := rebuildIndex(path, primaryStorage, indexSizeBits, c.indexOptions...); err != nil {
+		return nil, err
+	}
+	return index.OpenIndex(path, primaryStorage, indexSizeBits, options...)
+}
+
+// replay adds all entries that the iterator returns to the index and makes the index durable. It
+// returns the number of entries.
+func replay(idx *index.Index, iter primary.BlockIter) (uint64, error) {
+	var entries uint64
+	for {
+		key, _, err := iter.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		blk := iter.Block()
+		indexKey, err := idx.Primary.IndexKey(key)
+		if err != nil {
+			return 0, err
+		}
+		prevBlk, found, err := idx.Get(indexKey)
+		if err != nil {
+			return 0, err
+		}
+		update := false
+		if found {
+			// The index only stores prefixes, the entry may belong to a different key.
+			prevKey, err := idx.Primary.GetIndexKey(prevBlk)
+			if err != nil {
+				return 0, err
+			}
+			update = bytes.Equal(prevKey, indexKey)
+		}
+		if update {
+			err = idx.Update(indexKey, blk)
+		} else {
+			err = idx.Put(indexKey, blk)
+		}
+		if err != nil {
+			return 0, err
+		}
+		entries++
+		if idx.OutstandingWork() >= rebuildFlushWork {
+			if _, err := idx.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if _, err := idx.Flush(); err != nil {
+		return 0, err
+	}
+	return entries, idx.Sync()
+}
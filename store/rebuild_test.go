@@ -0,0 +1,106 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), []byte("updated")))
+	s.Flush()
+	_, err = store.RebuildIndex(indexPath, primary, defaultIndexSizeBits)
+	require.Equal(t, types.ErrStoreOpen, err)
+	require.NoError(t, s.Close())
+
+	require.NoError(t, os.Remove(indexPath))
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	result, err := store.RebuildIndex(indexPath, primary, defaultIndexSizeBits)
+	require.NoError(t, err)
+	require.Equal(t, uint64(21), result.Entries)
+	require.True(t, result.PrimarySize > 0)
+	require.True(t, result.Duration > 0)
+
+	s, err = store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(20), s.Stats().Keys)
+	for n, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		if n == 0 {
+			require.Equal(t, []byte("updated"), value)
+		} else {
+			require.Equal(t, blk.RawData(), value)
+		}
+	}
+	report, err := s.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, report.OK())
+}
+
+func TestRebuildCorruptIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	options := []store.Option{store.IndexOptions(index.RecordListChecksums())}
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, options...)
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Close())
+
+	// Damage the first record list, behind the header, its size prefix and its bucket prefix.
+	file, err := os.OpenFile(indexPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	header, headerSize, err := index.ReadHeader(file)
+	require.NoError(t, err)
+	require.Equal(t, index.FlagRecordListChecksums, header.Flags)
+	_, err = file.WriteAt([]byte{0xff, 0xff}, int64(headerSize)+int64(index.SizePrefixSize)+int64(index.BucketPrefixSize))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	_, err = store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, options...)
+	require.IsType(t, types.ErrIndexCorrupt(0), err)
+
+	s, err = store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate,
+		append(options, store.RebuildCorruptIndex())...)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
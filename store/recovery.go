@@ -0,0 +1,103 @@
+package store
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Minimum amount of data the throughput of an open needs to be based on to be trusted.
+const minOpenSample = 16 * 1024 * 1024
+
+// Amount of data that is read to measure the read throughput.
+const throughputSample = 64 * 1024 * 1024
+
+// RecoveryEstimate estimates how long it takes to recover a store from its files.
+type RecoveryEstimate struct {
+	// Size of the index file in bytes
+	IndexSize types.Position
+	// Size of the primary storage in bytes. It is zero if the primary storage doesn't implement
+	// `primary.Sizer`.
+	PrimarySize types.Position
+	// Read throughput in bytes per second the estimate is based on
+	ReadThroughput float64
+	// Time it takes to open the store, which reads the whole index file
+	Open time.Duration
+	// Time it takes to rebuild the index from the primary storage, see RebuildIndex. It is zero if
+	// the size of the primary storage is unknown.
+	Rebuild time.Duration
+}
+
+// EstimateRecovery estimates how long it takes to open the store and to rebuild its index from the
+// current sizes of the files.
+//
+// If `readThroughput` (in bytes per second) is zero, the throughput that was measured when the
+// store was opened is used, provided that the index was large enough to measure it. Otherwise the
+// throughput is measured by reading the beginning of the index file, data that is cached by the
+// operating system makes such a measurement too optimistic. Compare the estimate with
+// `Stats.OpenDuration` and `RebuildResult.Duration` of actual recoveries to validate it.
+//
+// The estimate of a store that holds no data, e.g. a fresh one, is zero.
+func (s *Store) EstimateRecovery(readThroughput float64) (RecoveryEstimate, error) {
+	s.swapLk.RLock()
+	estimate := RecoveryEstimate{IndexSize: s.index.Size()}
+	sizer, ok := s.index.Primary.(primary.Sizer)
+	if ok {
+		estimate.PrimarySize = sizer.Size()
+	}
+	s.swapLk.RUnlock()
+	if ok && estimate.PrimarySize == 0 {
+		// The index has no entries either, there's nothing to recover.
+		return RecoveryEstimate{}, nil
+	}
+
+	if readThroughput <= 0 && s.openedIndexSize >= minOpenSample && s.openDuration > 0 {
+		readThroughput = float64(s.openedIndexSize) / s.openDuration.Seconds()
+	}
+	if readThroughput <= 0 {
+		var err error
+		readThroughput, err = MeasureReadThroughput(s.path, throughputSample)
+		if err == io.ErrUnexpectedEOF {
+			// Nothing was written to the index file yet.
+			return RecoveryEstimate{}, nil
+		}
+		if err != nil {
+			return RecoveryEstimate{}, err
+		}
+	}
+	estimate.ReadThroughput = readThroughput
+	estimate.Open = throughputDuration(estimate.IndexSize, readThroughput)
+	if estimate.PrimarySize > 0 {
+		// The primary storage is read and an index of about the current size is written.
+		estimate.Rebuild = throughputDuration(estimate.PrimarySize+estimate.IndexSize, readThroughput)
+	}
+	return estimate, nil
+}
+
+func throughputDuration(size types.Position, throughput float64) time.Duration {
+	return time.Duration(float64(size) / throughput * float64(time.Second))
+}
+
+// MeasureReadThroughput reads up to `sample` bytes of the file at the given path sequentially and
+// returns the throughput in bytes per second.
+func MeasureReadThroughput(path string, sample int64) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(file, sample))
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	if n == 0 || elapsed <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return float64(n) / elapsed.Seconds(), nil
+}
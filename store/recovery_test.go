@@ -0,0 +1,43 @@
+package store_test
+
+import (
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateRecovery(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, blk := range testutil.GenerateBlocksOfSize(100, 1000) {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	s.Flush()
+
+	estimate, err := s.EstimateRecovery(1024 * 1024)
+	require.NoError(t, err)
+	stats := s.Stats()
+	require.Equal(t, stats.IndexSize, estimate.IndexSize)
+	require.Equal(t, stats.PrimarySize, estimate.PrimarySize)
+	require.Equal(t, float64(1024*1024), estimate.ReadThroughput)
+	require.InDelta(t, float64(estimate.IndexSize)/(1024*1024), estimate.Open.Seconds(), 0.001)
+	require.InDelta(t, float64(estimate.IndexSize+estimate.PrimarySize)/(1024*1024), estimate.Rebuild.Seconds(), 0.001)
+
+	// The throughput is measured if it's not given.
+	estimate, err = s.EstimateRecovery(0)
+	require.NoError(t, err)
+	require.True(t, estimate.ReadThroughput > 0)
+	require.True(t, estimate.Rebuild > estimate.Open)
+}
+
+func TestEstimateRecoveryEmpty(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	estimate, err := s.EstimateRecovery(0)
+	require.NoError(t, err)
+	require.Equal(t, store.RecoveryEstimate{}, estimate)
+}
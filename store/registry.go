@@ -0,0 +1,155 @@
+package store
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// openStores keeps track of all stores that are open in this process, keyed by the absolute path
+// of their index.
+//
+// Opening a store that is already open returns a handle of the existing store instead of a second,
+// independent instance on the same files. This way all handles share the same index, pools and
+// caches: a Get on any handle sees the data of every Put that returned on any other handle, whether
+// or not it was flushed yet. Independent instances would only see data once it was flushed, and not
+// even then, as the bucket table is only read on open.
+var openStores = struct {
+	sync.Mutex
+	stores map[string]*sharedStore
+}{stores: make(map[string]*sharedStore)}
+
+// storeKey returns the key of the store with the given index path in `openStores`.
+func storeKey(path string) (string, error) {
+	return filepath.Abs(path)
+}
+
+// release drops the reference of the handle to the store. It returns true if it was the last one,
+// in which case the store is removed from `openStores` and needs to be closed. Releasing a handle
+// again does nothing. It must be called with the lock of `openStores` held.
+func (s *Store) release() bool {
+	if s.released {
+		return false
+	}
+	s.released = true
+	s.refs--
+	if s.refs > 0 {
+		return false
+	}
+	if openStores.stores[s.path] == s.sharedStore {
+		delete(openStores.stores, s.path)
+	}
+	return true
+}
+
+// samePrimary returns false if the primary storages keep their data in different files. Storages
+// that don't implement `primary.Pather` can't be told apart.
+func samePrimary(a, b primary.PrimaryStorage) bool {
+	aPather, aOk := a.(primary.Pather)
+	bPather, bOk := b.(primary.Pather)
+	if !aOk || !bOk {
+		return true
+	}
+	aPath, aErr := filepath.Abs(aPather.Path())
+	bPath, bErr := filepath.Abs(bPather.Path())
+	return aErr == nil && bErr == nil && aPath == bPath
+}
+
+// storeSettings are the parameters and options of OpenStore that a store which is already open
+// needs to match. Options whose values can't be compared, e.g. loggers, metrics or merge operators,
+// only need to be given either on both calls or on neither, the ones of the first call are used.
+type storeSettings struct {
+	indexSizeBits uint8
+	syncInterval  time.Duration
+	burstRate     types.Work
+
+	indexOptions   index.Settings
+	autoBurstRate  bool
+	durability     DurabilityLevel
+	multiValue     bool
+	expiry         bool
+	sweepInterval  time.Duration
+	bloomKeys      uint64
+	cacheSize      int64
+	negCacheSize   int
+	trackAccess    bool
+	maxPausedWork  types.Work
+	verifyPercent  float64
+	degrade        bool
+	slowThreshold  time.Duration
+	slowEntries    int
+	denyEmpty      bool
+	appendable     bool
+	metadata       bool
+	growAverage    float64
+	growMaxBits    uint8
+	compactMode    bool
+	rebuildCorrupt bool
+	wal            bool
+	scrubInterval  time.Duration
+	scrubRepair    bool
+
+	context       bool
+	limiter       bool
+	policy        bool
+	metrics       bool
+	logger        bool
+	mergeOperator bool
+	// The retry policy without its Retryable function
+	retryAttempts   int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+}
+
+func newStoreSettings(indexSizeBits uint8, syncInterval time.Duration, burstRate types.Work, options []Option) storeSettings {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
+	return storeSettings{
+		indexSizeBits: indexSizeBits,
+		syncInterval:  syncInterval,
+		burstRate:     burstRate,
+
+		indexOptions:   index.OptionSettings(c.indexOptions...),
+		autoBurstRate:  c.autoBurstRate,
+		durability:     c.durability,
+		multiValue:     c.multiValue,
+		expiry:         c.expiry,
+		sweepInterval:  c.sweepInterval,
+		bloomKeys:      c.bloomKeys,
+		cacheSize:      c.cacheSize,
+		negCacheSize:   c.negCacheSize,
+		trackAccess:    c.trackAccess,
+		maxPausedWork:  c.maxPausedWork,
+		verifyPercent:  c.verifyPercent,
+		degrade:        c.degrade,
+		slowThreshold:  c.slowThreshold,
+		slowEntries:    c.slowEntries,
+		denyEmpty:      c.denyEmpty,
+		appendable:     c.appendable,
+		metadata:       c.metadata,
+		growAverage:    c.growAverage,
+		growMaxBits:    c.growMaxBits,
+		compactMode:    c.compactMode,
+		rebuildCorrupt: c.rebuildCorrupt,
+		wal:            c.wal,
+		scrubInterval:  c.scrubInterval,
+		scrubRepair:    c.scrubRepair,
+
+		context:       c.ctx != nil,
+		limiter:       c.limiter != nil,
+		policy:        c.policy != nil,
+		metrics:       c.metrics != nil,
+		logger:        c.logger != nil,
+		mergeOperator: c.mergeOperator != nil,
+
+		retryAttempts:   c.retryPolicy.MaxAttempts,
+		retryBackoff:    c.retryPolicy.Backoff,
+		retryMaxBackoff: c.retryPolicy.MaxBackoff,
+	}
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"github.com/hannahhoward/go-storethehash/store/freelist"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/provenance"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// ClearErr recovers the store after a write failed, see Reopen. It does nothing if the store
+// didn't fail.
+func (s *Store) ClearErr() error {
+	if s.Err() == nil {
+		return nil
+	}
+	return s.Reopen()
+}
+
+// Reopen recovers the store from a failed write, e.g. because the disk was full, and resumes
+// operation without closing it.
+//
+// All files are truncated to the end of their last successful flush, which removes data that was
+// written partially, and are opened again. Entries that were put since that flush are discarded.
+// The error of the store is cleared once all files are reopened, if that fails the store keeps
+// rejecting all operations. A store that was degraded to read-only mode (see
+// `DegradeOnWriteError`) accepts writes again.
+//
+// The primary storage needs to implement `primary.Reopener`.
+func (s *Store) Reopen() error {
+	s.swapLk.Lock()
+	defer s.swapLk.Unlock()
+
+	s.stateLk.RLock()
+	open := s.open
+	s.stateLk.RUnlock()
+	if !open {
+		return types.ErrStoreClosed
+	}
+	reopener, ok := s.index.Primary.(primary.Reopener)
+	if !ok {
+		return types.ErrReopenNotSupported
+	}
+	if err := s.reopen(reopener); err != nil {
+		s.setErr(err)
+		return err
+	}
+
+	s.stateLk.Lock()
+	s.err = nil
+	degraded := s.degraded
+	s.degraded = false
+	s.stateLk.Unlock()
+	if metrics, ok := s.metrics.(DegradationMetrics); degraded && ok {
+		metrics.SetDegraded(false)
+	}
+	s.log.Infow("reopened store", "path", s.path)
+	return nil
+}
+
+// reopen reopens the primary storage and all files of the store. It must be called with swapLk
+// held for writing.
+func (s *Store) reopen(reopener primary.Reopener) error {
+	// The index refers to the primary storage, which is flushed before the index. Hence the
+	// primary storage still contains everything the flushed part of the index refers to.
+	if err := reopener.Reopen(); err != nil {
+		return err
+	}
+
+	// Errors of closing the files are those of the failed writes.
+	primaryStorage := s.index.Primary
+	flushedSize := s.index.FlushedSize()
+	_ = s.index.Close()
+	if err := index.TruncateIndex(s.path, flushedSize); err != nil {
+		return err
+	}
+	idx, err := index.OpenIndex(s.path, primaryStorage, s.indexSizeBits, withWriteAheadLog(s.indexOptions, s.wal)...)
+	if err != nil {
+		return err
+	}
+	s.index = idx
+	// The discarded entries that were flushed to the primary storage aren't referenced, they must
+	// not be indexed by a recovery on open.
+	s.indexedPrimary = readPrimaryBounds(primaryStorage)
+
+	// The free list and the provenance remove partially written records when they are opened.
+	_ = s.freelist.Close()
+	freelist, err := freelist.OpenFreeList(s.path + ".free")
+	if err != nil {
+		return err
+	}
+	s.freelist = freelist
+	_ = s.provenance.Close()
+	provenance, err := provenance.OpenProvenance(s.path + ".provenance")
+	if err != nil {
+		return err
+	}
+	s.provenance = provenance
+	if s.cache != nil {
+		// Positions beyond the flushed data are written again.
+		s.cache.clear()
+	}
+	if s.bloom != nil {
+		return s.bloom.Reopen()
+	}
+	return nil
+}
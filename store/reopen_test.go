@@ -0,0 +1,154 @@
+package store_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+var errDiskFull = errors.New("no space left on device")
+
+// failingFlushPrimary fails to flush while `fail` is set. The failed flush leaves a partially
+// written entry at the end of the file.
+type failingFlushPrimary struct {
+	*cidprimary.CIDPrimary
+	path string
+	fail bool
+}
+
+func (fp *failingFlushPrimary) Flush() (types.Work, error) {
+	if !fp.fail {
+		return fp.CIDPrimary.Flush()
+	}
+	file, err := os.OpenFile(fp.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte{0x40, 0, 0, 0, 0x01}); err != nil {
+		return 0, err
+	}
+	return 0, errDiskFull
+}
+
+func TestReopen(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	cp, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	fp := &failingFlushPrimary{CIDPrimary: cp, path: dataPath}
+	s, err := store.OpenStore(indexPath, fp, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Nothing to recover yet.
+	require.NoError(t, s.ClearErr())
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	s.Flush()
+	require.NoError(t, s.Err())
+	stat, err := os.Stat(dataPath)
+	require.NoError(t, err)
+	flushedSize := stat.Size()
+
+	fp.fail = true
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+	_, err = s.FlushResult()
+	require.Equal(t, errDiskFull, err)
+	require.Equal(t, errDiskFull, s.Err())
+	_, _, err = s.Get(blks[0].Cid().Bytes())
+	require.Equal(t, errDiskFull, err)
+
+	fp.fail = false
+	require.NoError(t, s.ClearErr())
+	require.NoError(t, s.Err())
+
+	// The partially written data is gone, together with the entry that wasn't flushed.
+	stat, err = os.Stat(dataPath)
+	require.NoError(t, err)
+	require.Equal(t, flushedSize, stat.Size())
+	value, found, err := s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	_, found, err = s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// The store works again.
+	require.NoError(t, s.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+	s.Flush()
+	require.NoError(t, s.Err())
+	value, found, err = s.Get(blks[2].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[2].RawData(), value)
+}
+
+func TestReopenSegments(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	cp, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	fp := &failingFlushPrimary{CIDPrimary: cp, path: dataPath}
+	options := []store.Option{store.IndexOptions(index.Segments(256))}
+	s, err := store.OpenStore(indexPath, fp, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, options...)
+	require.NoError(t, err)
+
+	// The index spans several segments before the write fails.
+	blks := testutil.GenerateBlocksOfSize(21, 100)
+	for _, blk := range blks[:20] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+		s.Flush()
+	}
+	require.NoError(t, s.Err())
+	_, err = os.Stat(indexPath + ".001")
+	require.NoError(t, err)
+	fp.fail = true
+	require.NoError(t, s.Put(blks[20].Cid().Bytes(), blks[20].RawData()))
+	_, err = s.FlushResult()
+	require.Equal(t, errDiskFull, err)
+	fp.fail = false
+	require.NoError(t, s.ClearErr())
+	require.NoError(t, s.Close())
+
+	cp, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, cp, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, options...)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, blk := range blks[:20] {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+	_, found, err := s.Get(blks[20].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestReopenNotSupported(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	s, err := store.OpenStore(indexPath, inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, types.ErrReopenNotSupported, s.Reopen())
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the index while it is resized.
+const resizeSuffix = ".resize"
+
+// ResizeIndex rewrites the index at `path`, which has `fromBits` bucket bits, with `toBits` bucket
+// bits, e.g. to fix a store that was created with too few bits. The records of the existing index
+// are streamed into the new one, which replaces the existing index once it is complete. The options
+// are passed through to the new index, they should match the ones the store is opened with.
+//
+// If there is no index at `path`, it is rebuilt from the primary storage with `toBits` bits, see
+// RebuildIndex. The store must not be open in this process.
+func ResizeIndex(path string, primaryStorage primary.PrimaryStorage, fromBits uint8, toBits uint8, options ...index.Option) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		_, err := RebuildIndex(path, primaryStorage, toBits)
+		return err
+	}
+	key, err := storeKey(path)
+	if err != nil {
+		return err
+	}
+	openStores.Lock()
+	defer openStores.Unlock()
+	if _, ok := openStores.stores[key]; ok {
+		return types.ErrStoreOpen
+	}
+
+	// Leftovers of an interrupted GC or growth determine which index is the current one.
+	if err := recoverGC(key, primaryStorage, nopLogger{}); err != nil {
+		return err
+	}
+	if err := removeGrownIndex(key); err != nil {
+		return err
+	}
+	from, err := index.OpenIndex(path, primaryStorage, fromBits, options...)
+	if err != nil {
+		return err
+	}
+	resizePath := path + resizeSuffix
+	if err := os.Remove(resizePath); err != nil && !os.IsNotExist(err) {
+		_ = from.Close()
+		return err
+	}
+	to, err := index.OpenIndex(resizePath, primaryStorage, toBits, options...)
+	if err != nil {
+		_ = from.Close()
+		return err
+	}
+	err = copyRecords(from, to, func() error { return nil })
+	if err == nil {
+		err = to.Sync()
+	}
+	if closeErr := to.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := from.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(resizePath)
+		return err
+	}
+	// A recovery marker stays valid, the new index has the same entries as the old one.
+	return index.RenameIndex(resizePath, path)
+}
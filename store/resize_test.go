@@ -0,0 +1,76 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(500, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Delete(blks[0].Cid().Bytes()))
+	require.Equal(t, types.ErrStoreOpen, store.ResizeIndex(indexPath, primary, 8, 12))
+	require.NoError(t, s.Close())
+
+	check := func(bits uint8, deleted bool) {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, bits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		defer s.Close()
+		require.Equal(t, uint64(1)<<bits, s.Stats().Buckets)
+		for n, blk := range blks {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.Equal(t, n > 0 || !deleted, found)
+			if found {
+				require.Equal(t, blk.RawData(), value)
+			}
+		}
+	}
+	// Deleted entries stay deleted.
+	for _, bits := range []uint8{12, 6} {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		from := uint8(8)
+		if bits == 6 {
+			from = 12
+		}
+		require.NoError(t, store.ResizeIndex(indexPath, primary, from, bits))
+		require.NoError(t, primary.Close())
+		check(bits, true)
+	}
+
+	// The index is opened with the given size, which needs to match.
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	require.Equal(t, types.ErrIndexWrongBitSize{6, 8}, store.ResizeIndex(indexPath, primary, 8, 10))
+	require.NoError(t, primary.Close())
+	check(6, true)
+
+	// Without index, it's rebuilt from the primary storage, which brings back deleted entries.
+	require.NoError(t, os.Remove(indexPath))
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	require.NoError(t, store.ResizeIndex(indexPath, primary, 6, 10))
+	require.NoError(t, primary.Close())
+	check(10, false)
+}
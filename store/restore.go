@@ -0,0 +1,200 @@
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the files while they are restored.
+const restoreSuffix = ".restore"
+
+// RestoreStore restores a backup that was written by `Store.Backup` and opens the restored store.
+//
+// The index is restored to `path` and the data of the primary storage to `primaryPath`, which is
+// then opened with `openPrimary`. The data of further parts of a `primary.Partitioned` storage is
+// restored next to it, `primaryPath` with the suffix of the part appended. None of the files may
+// exist yet. The number of bucket bits is taken from the restored index, all other parameters are
+// passed on to OpenStore.
+//
+// The checksums of the backup are verified before the files are moved in place, a backup that is
+// incomplete or corrupt fails with `types.ErrInvalidBackup`. No files are left behind if the files
+// can't be restored, those of a restored store that fails to open are kept.
+func RestoreStore(path string, r io.Reader, primaryPath string, openPrimary func(path string) (primary.PrimaryStorage, error),
+	syncInterval time.Duration, burstRate types.Work, options ...Option) (*Store, error) {
+	for _, p := range []string{path, primaryPath} {
+		if _, err := os.Stat(p); err == nil {
+			return nil, fmt.Errorf("cannot restore to %s: %w", p, os.ErrExist)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	targets := map[string]string{
+		BackupIndexName:   path,
+		BackupPrimaryName: primaryPath,
+	}
+	err := restoreFiles(r, targets, primaryPath)
+	var bits uint8
+	if err == nil {
+		bits, err = readIndexBits(path + restoreSuffix)
+	}
+	var moved []string
+	if err == nil {
+		moved, err = moveRestored(path, targets)
+	}
+	if err != nil {
+		// None of the targets existed before.
+		for _, target := range targets {
+			_ = os.Remove(target + restoreSuffix)
+		}
+		for _, target := range moved {
+			_ = os.Remove(target)
+		}
+		return nil, err
+	}
+
+	primaryStorage, err := openPrimary(primaryPath)
+	if err != nil {
+		return nil, err
+	}
+	return OpenStore(path, primaryStorage, bits, syncInterval, burstRate, options...)
+}
+
+// moveRestored moves the extracted files in place. The primary storage goes first, an index is
+// what makes a store. It returns the targets that were moved, also if it fails.
+func moveRestored(path string, targets map[string]string) ([]string, error) {
+	moved := make([]string, 0, len(targets))
+	for name, target := range targets {
+		if name == BackupIndexName {
+			continue
+		}
+		if err := os.Rename(target+restoreSuffix, target); err != nil {
+			return moved, err
+		}
+		moved = append(moved, target)
+	}
+	if err := os.Rename(path+restoreSuffix, path); err != nil {
+		return moved, err
+	}
+	return append(moved, path), nil
+}
+
+// restoreFiles extracts the files of a backup to the given targets (with `restoreSuffix`
+// appended) and verifies their checksums. The targets of the further parts of the primary storage
+// are added to `targets` when they are extracted.
+func restoreFiles(r io.Reader, targets map[string]string, primaryPath string) error {
+	hashes := make(map[string]hash.Hash, len(targets))
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%w: no checksums", types.ErrInvalidBackup)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", types.ErrInvalidBackup, err)
+		}
+		if header.Name == BackupChecksumsName {
+			return verifyChecksums(tr, hashes)
+		}
+		if _, ok := hashes[header.Name]; ok {
+			return fmt.Errorf("%w: duplicate file %q", types.ErrInvalidBackup, header.Name)
+		}
+		target, ok := targets[header.Name]
+		if !ok {
+			suffix := strings.TrimPrefix(header.Name, BackupPrimaryName)
+			if suffix == header.Name || !strings.HasPrefix(suffix, ".") || strings.ContainsAny(suffix, `/\`) {
+				return fmt.Errorf("%w: unexpected file %q", types.ErrInvalidBackup, header.Name)
+			}
+			target = primaryPath + suffix
+			if _, err := os.Stat(target); err == nil {
+				return fmt.Errorf("cannot restore to %s: %w", target, os.ErrExist)
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+			targets[header.Name] = target
+		}
+		hashes[header.Name] = sha256.New()
+		if err := extractFile(tr, target+restoreSuffix, hashes[header.Name]); err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, hash hash.Hash) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(file, hash), r); err != nil {
+		_ = file.Close()
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: truncated", types.ErrInvalidBackup)
+		}
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// verifyChecksums checks that the checksums file lists a matching checksum for every file that
+// was extracted and that no file is missing.
+func verifyChecksums(r io.Reader, hashes map[string]hash.Hash) error {
+	verified := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return fmt.Errorf("%w: malformed checksum %q", types.ErrInvalidBackup, scanner.Text())
+		}
+		expected, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return fmt.Errorf("%w: malformed checksum %q", types.ErrInvalidBackup, scanner.Text())
+		}
+		hash, ok := hashes[fields[1]]
+		if !ok {
+			return fmt.Errorf("%w: file %q is missing", types.ErrInvalidBackup, fields[1])
+		}
+		if !bytes.Equal(expected, hash.Sum(nil)) {
+			return fmt.Errorf("%w: checksum mismatch of %q", types.ErrInvalidBackup, fields[1])
+		}
+		verified++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %s", types.ErrInvalidBackup, err)
+	}
+	_, hasIndex := hashes[BackupIndexName]
+	_, hasPrimary := hashes[BackupPrimaryName]
+	if verified != len(hashes) || !hasIndex || !hasPrimary {
+		return fmt.Errorf("%w: files without checksum", types.ErrInvalidBackup)
+	}
+	return nil
+}
+
+// readIndexBits returns the number of bucket bits from the header of the index file.
+func readIndexBits(path string) (uint8, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	header, _, err := index.ReadHeader(file)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", types.ErrInvalidBackup, err)
+	}
+	return header.BucketsBits, nil
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy determines how often operations that fail with a transient error are retried, see
+// `WithRetryPolicy`. The zero value doesn't retry.
+type RetryPolicy struct {
+	// Number of attempts of an operation, including the first one
+	MaxAttempts int
+	// Time to wait before the first retry, it's doubled for every further retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable returns whether an error is transient. IsTransient is used if it's nil.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy tries operations up to five times within about a second.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  500 * time.Millisecond,
+}
+
+// RetryMetrics is implemented by metrics that count retries. It is optional, metrics that don't
+// implement it aren't told about retries.
+type RetryMetrics interface {
+	// ObserveRetry is called before an operation is retried, with the name of the operation and
+	// the error of the failed attempt.
+	ObserveRetry(op string, err error)
+}
+
+// IsTransient returns whether an error is likely to go away when the operation is retried: an
+// interrupted system call, a resource that is temporarily unavailable, or a network timeout or
+// reset, as returned by primary storages on remote storage.
+func IsTransient(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't transient, or the attempts of
+// the retry policy are used up. Only operations that can be repeated safely may be retried, which
+// rules out flushes: a buffered writer doesn't recover from a failed write.
+func (s *Store) retry(op string, fn func() error) error {
+	policy := s.retryPolicy
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !retryable(err) {
+			return err
+		}
+		atomic.AddUint64(&s.retries, 1)
+		if metrics, ok := s.metrics.(RetryMetrics); ok {
+			metrics.ObserveRetry(op, err)
+		}
+		s.log.Debugw("retrying after transient error", "path", s.path, "op", op, "attempt", attempt, "err", err)
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyPrimary fails the next `failures` reads with `err`.
+type flakyPrimary struct {
+	primary.PrimaryStorage
+	lk       sync.Mutex
+	failures int
+	err      error
+}
+
+func (p *flakyPrimary) fail(failures int, err error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.failures = failures
+	p.err = err
+}
+
+func (p *flakyPrimary) Get(blk types.Block) ([]byte, []byte, error) {
+	p.lk.Lock()
+	if p.failures > 0 {
+		p.failures--
+		p.lk.Unlock()
+		return nil, nil, p.err
+	}
+	p.lk.Unlock()
+	return p.PrimaryStorage.Get(blk)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	flaky := &flakyPrimary{PrimaryStorage: inmemory.NewInmemory(nil)}
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), flaky, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.WithRetryPolicy(store.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+
+	flaky.fail(2, syscall.EAGAIN)
+	value, found, err := s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	require.Equal(t, uint64(2), s.Stats().Retries)
+
+	// The attempts are used up.
+	flaky.fail(3, syscall.EAGAIN)
+	_, _, err = s.Get(blks[0].Cid().Bytes())
+	require.Equal(t, syscall.EAGAIN, err)
+	require.Equal(t, uint64(4), s.Stats().Retries)
+
+	// Other errors aren't retried.
+	flaky.fail(1, errors.New("broken"))
+	_, _, err = s.Get(blks[0].Cid().Bytes())
+	require.EqualError(t, err, "broken")
+	require.Equal(t, uint64(4), s.Stats().Retries)
+	flaky.fail(0, nil)
+}
+
+func TestIsTransient(t *testing.T) {
+	require.True(t, store.IsTransient(syscall.EINTR))
+	require.True(t, store.IsTransient(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+	require.False(t, store.IsTransient(types.ErrOutOfBounds))
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Number of buckets that Scrub checks at a time, GC and growth wait for a batch at most.
+const scrubBatch = 1024
+
+// Pause between the batches of the background scrubber, which leaves the disk to the writers and
+// readers.
+const scrubPause = 10 * time.Millisecond
+
+// Scrub checks every record list of the index, which catches damage of a long-lived index file
+// before a Get runs into it. A record list that doesn't match its checksum is reported as
+// CorruptRecordList, which needs an index with checksums, see `index.RecordListChecksums`. A record
+// that points beyond the end of the primary storage is reported as DanglingBlock, which needs a
+// primary storage that knows its size.
+//
+// With `repair`, dangling records are removed from the index, their values are gone anyway. A
+// corrupt record list can't be repaired in place, the index needs to be rebuilt, see RebuildIndex.
+// Records aren't removed while the index grows, the next scrub repairs them.
+//
+// Unlike Verify, the primary storage isn't read. The buckets are checked a batch at a time, writes
+// continue meanwhile and GC waits at most for a batch.
+func (s *Store) Scrub(ctx context.Context, repair bool) (Report, error) {
+	return s.scrub(ctx, repair, 0)
+}
+
+// scrub is Scrub with a pause between batches.
+func (s *Store) scrub(ctx context.Context, repair bool, pause time.Duration) (Report, error) {
+	var report Report
+	for bucket := uint64(0); ; bucket += scrubBatch {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		done, err := s.scrubBatch(index.BucketIndex(bucket), repair, &report)
+		if err != nil || done {
+			return report, err
+		}
+		if pause > 0 {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-time.After(pause):
+			}
+		}
+	}
+}
+
+// scrubBatch checks the batch of buckets starting at `first`. It returns true if there are no more
+// buckets.
+func (s *Store) scrubBatch(first index.BucketIndex, repair bool, report *Report) (bool, error) {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return false, err
+	}
+	// The index may have grown since the last batch.
+	numBuckets := uint64(1) << s.indexSizeBits
+	last := uint64(first) + scrubBatch
+	if last > numBuckets {
+		last = numBuckets
+	}
+	for bucket := uint64(first); bucket < last; bucket++ {
+		var records []index.Record
+		err := s.index.ForEachBucketRecord(index.BucketIndex(bucket), func(record index.Record) error {
+			records = append(records, record)
+			return nil
+		})
+		var corrupt types.ErrIndexCorrupt
+		if errors.As(err, &corrupt) {
+			report.Problems = append(report.Problems, Problem{
+				Kind:   CorruptRecordList,
+				Bucket: index.BucketIndex(bucket),
+				Err:    err,
+			})
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		report.Records += uint64(len(records))
+		// The size is read after the records, the primary storage contains the blocks of the
+		// records that were put meanwhile.
+		bounds := readPrimaryBounds(s.index.Primary)
+		if bounds == nil {
+			continue
+		}
+		for _, record := range records {
+			if bounds.contains(record.Block) {
+				continue
+			}
+			problem := Problem{
+				Kind:   DanglingBlock,
+				Bucket: index.BucketIndex(bucket),
+				Key:    append([]byte{}, record.Key...),
+				Block:  record.Block,
+			}
+			if repair && s.growth == nil {
+				removed, err := s.index.RemoveRecord(index.BucketIndex(bucket), record.Key, record.Block)
+				if err != nil {
+					return false, err
+				}
+				problem.Repaired = removed
+			}
+			report.Problems = append(report.Problems, problem)
+		}
+	}
+	return last == numBuckets, nil
+}
+
+// scrubPeriodically scrubs the index every scrub interval until the context is done, see
+// BackgroundScrub.
+func (s *Store) scrubPeriodically(ctx context.Context) {
+	t := time.NewTicker(s.scrubInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-t.C:
+			report, err := s.scrub(ctx, s.scrubRepair, scrubPause)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.log.Errorw("scrubbing index failed", "path", s.path, "err", err)
+				}
+				continue
+			}
+			for _, problem := range report.Problems {
+				s.log.Errorw("scrubbing index found a problem", "path", s.path, "problem", problem.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrub(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	options := []store.Option{store.IndexOptions(index.RecordListChecksums())}
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, options...)
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	report, err := s.Scrub(context.Background(), true)
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, uint64(len(blks)), report.Records)
+	require.NoError(t, s.Close())
+
+	// Cut off the second half of the primary storage, the records of its entries dangle.
+	info, err := os.Stat(dataPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(dataPath, info.Size()/2))
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, primary, 8, defaultSyncInterval, defaultBurstRate, options...)
+	require.NoError(t, err)
+	defer s.Close()
+	report, err = s.Scrub(context.Background(), false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(blks)), report.Records)
+	dangling := len(report.Problems)
+	require.NotZero(t, dangling)
+	require.True(t, dangling < len(blks))
+	for _, problem := range report.Problems {
+		require.Equal(t, store.DanglingBlock, problem.Kind)
+		require.False(t, problem.Repaired)
+	}
+
+	report, err = s.Scrub(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, dangling)
+	for _, problem := range report.Problems {
+		require.True(t, problem.Repaired)
+	}
+	require.Equal(t, uint64(len(blks)-dangling), s.Count())
+	s.Flush()
+	report, err = s.Scrub(context.Background(), true)
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, uint64(len(blks)-dangling), report.Records)
+
+	// Damage the record list of a new entry, which is the last one of the index, in front of its
+	// checksum.
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	s.Flush()
+	info, err = os.Stat(indexPath)
+	require.NoError(t, err)
+	file, err := os.OpenFile(indexPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	data := make([]byte, 1)
+	_, err = file.ReadAt(data, info.Size()-int64(index.ListChecksumSize)-1)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte{^data[0]}, info.Size()-int64(index.ListChecksumSize)-1)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	report, err = s.Scrub(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, store.CorruptRecordList, report.Problems[0].Kind)
+	require.False(t, report.Problems[0].Repaired)
+}
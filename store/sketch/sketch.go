@@ -0,0 +1,238 @@
+// Package sketch provides compact summaries of the keys of a store: a HyperLogLog sketch that
+// estimates the number of distinct keys, and the number of keys per key prefix.
+//
+// Sketches of different stores can be combined to estimate how many keys they share, without
+// enumerating the keys of either store.
+package sketch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Bounds of the precision of a HyperLogLog sketch. A sketch with precision p has 2^p registers and
+// a standard error of about 1.04/sqrt(2^p).
+const (
+	MinPrecision = 4
+	MaxPrecision = 18
+	// DefaultPrecision has a standard error of about 0.8%.
+	DefaultPrecision = 14
+)
+
+// MaxPrefixBits is the largest number of prefix bits the keys can be counted by.
+const MaxPrefixBits = 24
+
+// HLL is a HyperLogLog sketch of a set of keys.
+type HLL struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHLL returns an empty sketch with 2^precision registers.
+func NewHLL(precision uint8) (*HLL, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, types.ErrInvalidSketch
+	}
+	return &HLL{precision: precision, registers: make([]uint8, 1<<precision)}, nil
+}
+
+// Precision returns the precision the sketch was created with.
+func (h *HLL) Precision() uint8 {
+	return h.precision
+}
+
+// Add adds a key to the sketch.
+func (h *HLL) Add(key []byte) {
+	hash := hashKey(key)
+	register := hash >> (64 - h.precision)
+	// The position of the first set bit of the remaining bits, the register bits are shifted out.
+	rank := uint8(bits.LeadingZeros64(hash<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[register] {
+		h.registers[register] = rank
+	}
+}
+
+// hashKey returns a well-mixed 64-bit hash of a key. Keys of stores are usually digests already,
+// but that isn't guaranteed.
+func hashKey(key []byte) uint64 {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write(key)
+	// Finalizer of SplitMix64, FNV alone doesn't spread short keys over the high bits.
+	z := hasher.Sum64()
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Estimate returns the estimated number of distinct keys that were added.
+func (h *HLL) Estimate() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha(len(h.registers)) * m * m / sum
+	// Small cardinalities are estimated more accurately by linear counting.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// Merge adds all keys of another sketch to this one. Both need to have the same precision.
+func (h *HLL) Merge(other *HLL) error {
+	if other.precision != h.precision {
+		return types.ErrInvalidSketch
+	}
+	for n, r := range other.registers {
+		if r > h.registers[n] {
+			h.registers[n] = r
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy of the sketch.
+func (h *HLL) Clone() *HLL {
+	return &HLL{precision: h.precision, registers: append([]uint8{}, h.registers...)}
+}
+
+// EstimateOverlap returns the estimated number of keys that were added to both sketches, by
+// inclusion-exclusion of their union. The error of the estimate is relative to the size of the
+// union, small overlaps of large sets can't be told apart from none.
+func EstimateOverlap(a *HLL, b *HLL) (uint64, error) {
+	union := a.Clone()
+	if err := union.Merge(b); err != nil {
+		return 0, err
+	}
+	both := int64(a.Estimate()) + int64(b.Estimate()) - int64(union.Estimate())
+	if both < 0 {
+		return 0, nil
+	}
+	return uint64(both), nil
+}
+
+// PrefixCounts holds the number of keys for every value of the first `Bits` bits of the keys.
+type PrefixCounts struct {
+	Bits   uint8
+	Counts []uint64
+}
+
+// NewPrefixCounts returns empty counts for prefixes of the given number of bits.
+func NewPrefixCounts(prefixBits uint8) (*PrefixCounts, error) {
+	if prefixBits > MaxPrefixBits {
+		return nil, types.ErrInvalidSketch
+	}
+	return &PrefixCounts{Bits: prefixBits, Counts: make([]uint64, 1<<prefixBits)}, nil
+}
+
+// Add counts a key. The prefix is taken from the leading bits of the key, missing bytes count as
+// zeros.
+func (p *PrefixCounts) Add(key []byte) {
+	var prefix uint32
+	for b := 0; b < 4; b++ {
+		prefix <<= 8
+		if b < len(key) {
+			prefix |= uint32(key[b])
+		}
+	}
+	p.Counts[prefix>>(32-p.Bits)]++
+}
+
+// Sketch summarizes the keys of a store, see `store.Store.KeySketch`.
+type Sketch struct {
+	HLL      *HLL
+	Prefixes *PrefixCounts
+}
+
+// New returns an empty sketch.
+func New(precision uint8, prefixBits uint8) (*Sketch, error) {
+	hll, err := NewHLL(precision)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := NewPrefixCounts(prefixBits)
+	if err != nil {
+		return nil, err
+	}
+	return &Sketch{HLL: hll, Prefixes: prefixes}, nil
+}
+
+// Add adds a key to the sketch.
+func (s *Sketch) Add(key []byte) {
+	s.HLL.Add(key)
+	s.Prefixes.Add(key)
+}
+
+// WriteTo writes the sketch in a compact binary format. It starts with a byte for the precision
+// and a byte for the prefix bits, followed by one byte per register and the count of every prefix
+// as 8-byte little-endian integer.
+func (s *Sketch) WriteTo(w io.Writer) (int64, error) {
+	writer := bufio.NewWriter(w)
+	n, err := writer.Write([]byte{s.HLL.precision, s.Prefixes.Bits})
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	n, err = writer.Write(s.HLL.registers)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	buf := make([]byte, 8)
+	for _, count := range s.Prefixes.Counts {
+		binary.LittleEndian.PutUint64(buf, count)
+		n, err := writer.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, writer.Flush()
+}
+
+// Read reads a sketch that was written by `Sketch.WriteTo`.
+func Read(r io.Reader) (*Sketch, error) {
+	reader := bufio.NewReader(r)
+	params := make([]byte, 2)
+	if _, err := io.ReadFull(reader, params); err != nil {
+		return nil, err
+	}
+	s, err := New(params[0], params[1])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(reader, s.HLL.registers); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8)
+	for n := range s.Prefixes.Counts {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		s.Prefixes.Counts[n] = binary.LittleEndian.Uint64(buf)
+	}
+	return s, nil
+}
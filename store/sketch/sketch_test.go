@@ -0,0 +1,78 @@
+package sketch_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/sketch"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func digest(n int) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+	sum := sha256.Sum256(buf)
+	return sum[:]
+}
+
+func requireClose(t *testing.T, expected int, actual uint64, tolerance float64) {
+	require.True(t, math.Abs(float64(actual)-float64(expected)) <= tolerance*float64(expected),
+		"estimate %d is not within %.0f%% of %d", actual, tolerance*100, expected)
+}
+
+func TestHLL(t *testing.T) {
+	a, err := sketch.NewHLL(sketch.DefaultPrecision)
+	require.NoError(t, err)
+	b, err := sketch.NewHLL(sketch.DefaultPrecision)
+	require.NoError(t, err)
+	require.Zero(t, a.Estimate())
+
+	// a holds 0..60000, b holds 40000..100000.
+	for n := 0; n < 60000; n++ {
+		a.Add(digest(n))
+		// Duplicates don't count.
+		a.Add(digest(n))
+	}
+	for n := 40000; n < 100000; n++ {
+		b.Add(digest(n))
+	}
+	requireClose(t, 60000, a.Estimate(), 0.03)
+	requireClose(t, 60000, b.Estimate(), 0.03)
+	overlap, err := sketch.EstimateOverlap(a, b)
+	require.NoError(t, err)
+	requireClose(t, 20000, overlap, 0.15)
+
+	require.NoError(t, a.Merge(b))
+	requireClose(t, 100000, a.Estimate(), 0.03)
+
+	small, err := sketch.NewHLL(10)
+	require.NoError(t, err)
+	require.Equal(t, types.ErrInvalidSketch, a.Merge(small))
+	_, err = sketch.NewHLL(sketch.MaxPrecision + 1)
+	require.Equal(t, types.ErrInvalidSketch, err)
+}
+
+func TestSketchWriteRead(t *testing.T) {
+	s, err := sketch.New(8, 4)
+	require.NoError(t, err)
+	s.Add([]byte{0x00, 0x01})
+	s.Add([]byte{0x1f})
+	s.Add([]byte{0xf0, 0x01, 0x02})
+	require.Equal(t, uint64(1), s.Prefixes.Counts[0x0])
+	require.Equal(t, uint64(1), s.Prefixes.Counts[0x1])
+	require.Equal(t, uint64(1), s.Prefixes.Counts[0xf])
+
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	read, err := sketch.Read(&buf)
+	require.NoError(t, err)
+	require.Equal(t, s.Prefixes, read.Prefixes)
+	require.Equal(t, s.HLL.Estimate(), read.HLL.Estimate())
+	require.Equal(t, uint64(3), read.HLL.Estimate())
+}
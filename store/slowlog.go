@@ -0,0 +1,143 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// SlowQuery describes an operation that took at least the threshold of the slow query log, see
+// `SlowQueryLog`. Time that isn't attributed to any phase, e.g. reads of stale consistency, is
+// only part of the total.
+type SlowQuery struct {
+	// Name of the operation, "get" or "put"
+	Op    string        `json:"op"`
+	Key   []byte        `json:"key"`
+	Start time.Time     `json:"start"`
+	Total time.Duration `json:"total_ns"`
+	// Time spent waiting for locks, e.g. while a flush or GC swapped the write pools and files
+	PoolWait time.Duration `json:"pool_wait_ns"`
+	// Time spent looking up the key in the index and, for puts, updating it
+	IndexScan time.Duration `json:"index_scan_ns"`
+	// Time spent reading and writing the primary storage
+	PrimaryRead time.Duration `json:"primary_read_ns"`
+	// Time a put spent settling the write: throttled by the rate limiter, or committing it with
+	// FlushOnPut and SyncOnPut durability
+	Throttle time.Duration `json:"throttle_ns"`
+	// Error the operation failed with, empty on success
+	Err string `json:"err,omitempty"`
+}
+
+// SlowQueryMetrics is implemented by metrics that are told about slow operations, see
+// `SlowQueryLog`. It is optional, metrics that don't implement it aren't told about them.
+type SlowQueryMetrics interface {
+	// ObserveSlowQuery is called with every operation that is added to the slow query log.
+	ObserveSlowQuery(query SlowQuery)
+}
+
+// slowLog is a ring buffer of the most recent slow operations.
+type slowLog struct {
+	threshold time.Duration
+
+	lk      sync.Mutex
+	queries []SlowQuery
+	// Position of the next query in queries, which wraps around once it's full
+	next int
+	full bool
+}
+
+func newSlowLog(threshold time.Duration, entries int) *slowLog {
+	return &slowLog{threshold: threshold, queries: make([]SlowQuery, entries)}
+}
+
+func (l *slowLog) add(query SlowQuery) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.queries[l.next] = query
+	if l.next++; l.next == len(l.queries) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// list returns the queries of the log, the oldest first.
+func (l *slowLog) list() []SlowQuery {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if !l.full {
+		return append([]SlowQuery{}, l.queries[:l.next]...)
+	}
+	return append(append([]SlowQuery{}, l.queries[l.next:]...), l.queries[:l.next]...)
+}
+
+// SlowQueries returns the most recent operations that took at least the threshold of the slow
+// query log, the oldest first. It returns nil if the store wasn't opened with `SlowQueryLog`.
+func (s *Store) SlowQueries() []SlowQuery {
+	if s.slowLog == nil {
+		return nil
+	}
+	return s.slowLog.list()
+}
+
+// Phases of an operation that are measured for the slow query log.
+const (
+	phasePoolWait = iota
+	phaseIndexScan
+	phasePrimaryRead
+	phaseThrottle
+)
+
+// opTrace measures the phases of an operation for the slow query log. All methods of a nil trace do
+// nothing, it's used when the log is disabled.
+type opTrace struct {
+	query SlowQuery
+	last  time.Time
+}
+
+// startTrace starts measuring an operation, it returns nil unless the store keeps a slow query log.
+func (s *Store) startTrace(op string, key []byte) *opTrace {
+	if s.slowLog == nil {
+		return nil
+	}
+	now := time.Now()
+	return &opTrace{query: SlowQuery{Op: op, Key: key, Start: now}, last: now}
+}
+
+// mark adds the time since the previous mark to the given phase.
+func (t *opTrace) mark(phase int) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(t.last)
+	t.last = now
+	switch phase {
+	case phasePoolWait:
+		t.query.PoolWait += elapsed
+	case phaseIndexScan:
+		t.query.IndexScan += elapsed
+	case phasePrimaryRead:
+		t.query.PrimaryRead += elapsed
+	case phaseThrottle:
+		t.query.Throttle += elapsed
+	}
+}
+
+// finish adds the operation to the slow query log if it took at least the threshold.
+func (t *opTrace) finish(s *Store, err error) {
+	if t == nil {
+		return
+	}
+	t.query.Total = time.Since(t.query.Start)
+	if t.query.Total < s.slowLog.threshold {
+		return
+	}
+	if err != nil {
+		t.query.Err = err.Error()
+	}
+	// The key may be reused by the caller.
+	t.query.Key = append([]byte{}, t.query.Key...)
+	s.slowLog.add(t.query)
+	if metrics, ok := s.metrics.(SlowQueryMetrics); ok {
+		metrics.ObserveSlowQuery(t.query)
+	}
+}
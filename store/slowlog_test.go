@@ -0,0 +1,68 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	// Every operation is slow.
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.SlowQueryLog(0, 3))
+	require.NoError(t, err)
+	defer s.Close()
+	require.Empty(t, s.SlowQueries())
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	queries := s.SlowQueries()
+	require.Len(t, queries, 1)
+	require.Equal(t, "put", queries[0].Op)
+	require.Equal(t, blks[0].Cid().Bytes(), queries[0].Key)
+	require.Empty(t, queries[0].Err)
+	require.True(t, queries[0].Total >= queries[0].IndexScan+queries[0].PrimaryRead)
+
+	t.Logf("Only the most recent operations are kept")
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[1].RawData()))
+	_, _, err = s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	_, _, err = s.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	queries = s.SlowQueries()
+	require.Len(t, queries, 3)
+	require.Equal(t, "put", queries[0].Op)
+	require.Equal(t, blks[1].Cid().Bytes(), queries[0].Key)
+	require.Equal(t, "get", queries[2].Op)
+	require.Equal(t, blks[1].Cid().Bytes(), queries[2].Key)
+	require.False(t, queries[2].Start.Before(queries[1].Start))
+}
+
+func TestSlowQueryLogThreshold(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.SlowQueryLog(time.Hour, 10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	_, _, err = s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.Empty(t, s.SlowQueries())
+}
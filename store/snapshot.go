@@ -0,0 +1,114 @@
+package store
+
+import (
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Snapshot is a consistent, read-only view of a store at a point in time.
+//
+// Writes to the store after the snapshot was taken aren't visible through it, hence iterating over
+// a snapshot observes a single state of the store while writes continue. A snapshot becomes
+// invalid when the files of the store are replaced, e.g. by a GC, or when the store is closed.
+type Snapshot struct {
+	store      *Store
+	index      *index.Index
+	generation uint64
+	// Bounds of the primary storage, nil if its size is unknown
+	primary primaryBounds
+}
+
+// Snapshot flushes all outstanding work and returns a snapshot of the store.
+//
+// The snapshot holds a copy of the bucket table, see `index.Index.Snapshot` for its memory usage.
+// Reads and writes wait until the snapshot is taken, so that the snapshot of the index and the
+// size of the primary storage match.
+func (s *Store) Snapshot() (*Snapshot, error) {
+	s.swapLk.Lock()
+	defer s.swapLk.Unlock()
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	// Only data on disk is part of a snapshot.
+	if _, err := s.commit(false); err != nil {
+		s.setErr(err)
+		return nil, err
+	}
+	// Nothing can be written while the lock is held, hence all data is on disk.
+	bounds := readPrimaryBounds(s.index.Primary)
+	idx, err := s.index.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		store:      s,
+		index:      idx,
+		generation: s.generation,
+		primary:    bounds,
+	}, nil
+}
+
+// acquire locks the files of the store for reading through the snapshot. If it returns nil, the
+// caller needs to call `s.store.swapLk.RUnlock()` when done.
+func (sn *Snapshot) acquire() error {
+	sn.store.swapLk.RLock()
+	if sn.generation != sn.store.generation {
+		sn.store.swapLk.RUnlock()
+		return types.ErrSnapshotInvalidated
+	}
+	sn.store.stateLk.RLock()
+	open := sn.store.open
+	sn.store.stateLk.RUnlock()
+	if !open {
+		sn.store.swapLk.RUnlock()
+		return types.ErrStoreClosed
+	}
+	return nil
+}
+
+// Get returns the value of a key as it was when the snapshot was taken.
+func (sn *Snapshot) Get(key []byte) ([]byte, bool, error) {
+	if err := sn.acquire(); err != nil {
+		return nil, false, err
+	}
+	defer sn.store.swapLk.RUnlock()
+	if absent, err := sn.store.bloomAbsent(key); err != nil || absent {
+		return nil, false, err
+	}
+	return get(sn.index, key)
+}
+
+// Has returns whether the key was stored when the snapshot was taken.
+func (sn *Snapshot) Has(key []byte) (bool, error) {
+	if err := sn.acquire(); err != nil {
+		return false, err
+	}
+	defer sn.store.swapLk.RUnlock()
+	if absent, err := sn.store.bloomAbsent(key); err != nil || absent {
+		return false, err
+	}
+	_, found, err := lookupChecked(sn.index, key)
+	return found, err
+}
+
+// Scan calls `fn` for every entry of the snapshot whose index key is within the range [start,
+// end), see `Store.Scan`.
+func (sn *Snapshot) Scan(start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+	if err := sn.acquire(); err != nil {
+		return err
+	}
+	defer sn.store.swapLk.RUnlock()
+	return scan(sn.index, start, end, fn)
+}
+
+// ScanPrefix calls `fn` for every entry of the snapshot whose index key starts with the given
+// prefix, ordered by index key.
+func (sn *Snapshot) ScanPrefix(prefix []byte, fn func(key []byte, value []byte) error) error {
+	return sn.Scan(prefix, index.PrefixEnd(prefix), fn)
+}
+
+// PrimarySize returns the size of the primary storage when the snapshot was taken. It is zero if
+// the primary storage doesn't implement `primary.Sizer`.
+func (sn *Snapshot) PrimarySize() types.Position {
+	return sn.primary.size()
+}
@@ -0,0 +1,51 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	snapshot, err := s.Snapshot()
+	require.NoError(t, err)
+	require.NotZero(t, snapshot.PrimarySize())
+
+	// Writes after the snapshot was taken aren't visible through it.
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[1].RawData()))
+	require.NoError(t, s.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+	s.Flush()
+
+	value, found, err := snapshot.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	has, err := snapshot.Has(blks[2].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, has)
+	var scanned [][]byte
+	require.NoError(t, snapshot.Scan(nil, nil, func(key []byte, value []byte) error {
+		scanned = append(scanned, value)
+		return nil
+	}))
+	require.Equal(t, [][]byte{blks[0].RawData()}, scanned)
+
+	value, found, err = s.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[1].RawData(), value)
+
+	// The snapshot refers to the files that are replaced by a GC.
+	require.NoError(t, s.GC(context.Background()))
+	_, _, err = snapshot.Get(blks[0].Cid().Bytes())
+	require.Equal(t, types.ErrSnapshotInvalidated, err)
+}
@@ -0,0 +1,39 @@
+package store
+
+import "github.com/hannahhoward/go-storethehash/store/types"
+
+// KeyStat describes a stored entry.
+type KeyStat struct {
+	// Size of the value in bytes
+	Size types.Size
+	// Source the entry was copied from, e.g. by MergeStores. It is empty for entries that were
+	// written directly.
+	Source string
+}
+
+// Stat returns the size and the provenance of the entry of a key.
+func (s *Store) Stat(key []byte) (KeyStat, bool, error) {
+	size, found, err := s.GetSize(key)
+	if err != nil || !found {
+		return KeyStat{}, found, err
+	}
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	indexKey, err := s.index.Primary.IndexKey(key)
+	if err != nil {
+		return KeyStat{}, false, err
+	}
+	source, _ := s.provenance.Get(indexKey)
+	return KeyStat{Size: size, Source: source}, true, nil
+}
+
+// recordSource records that the entry of the key was copied from the given source.
+func (s *Store) recordSource(key []byte, source string) error {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	indexKey, err := s.index.Primary.IndexKey(key)
+	if err != nil {
+		return err
+	}
+	return s.provenance.Put(indexKey, source)
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Stats is a snapshot of the state of a store.
+type Stats struct {
+	// Number of keys stored, including the ones that haven't been flushed yet.
+	Keys uint64
+	// Size of the primary storage in bytes. It is zero if the primary storage doesn't implement
+	// `primary.Sizer`.
+	PrimarySize types.Position
+	// Size of the index file in bytes.
+	IndexSize types.Position
+	// Number of buckets that contain at least one key.
+	OccupiedBuckets uint64
+	// Total number of buckets of the index.
+	Buckets uint64
+	// Work that is buffered in memory and waits to be flushed.
+	OutstandingWork types.Work
+	// Number of successful flushes since the store was opened.
+	Flushes uint64
+	// Number of failed flushes since the store was opened.
+	FlushErrors uint64
+	// Total work written by successful flushes.
+	FlushedWork types.Work
+	// Duration of the last successful flush.
+	LastFlushDuration time.Duration
+	// Amount of work writers can add before they are throttled. It is only set if the rate limiter
+	// reports it, as the default `TokenBucket` does.
+	BurstRate types.Work
+	// Rate (in work per second) at which writers are admitted once the burst rate is exceeded. It
+	// is only set if the rate limiter reports it.
+	FlushRate float64
+	// Time it took to open the store, which reads the whole index file.
+	OpenDuration time.Duration
+	// Number of bytes of an incomplete record list at the end of the index file, as a crash during
+	// a flush leaves behind, that were cut off when the store was opened.
+	TornIndexBytes int64
+	// Number of lookups of absent keys that the bloom filter answered without reading the index,
+	// see `BloomFilter`.
+	FilteredLookups uint64
+	// Number of reads that were served by the value cache and that missed it, see `ValueCache`.
+	CacheHits, CacheMisses uint64
+	// Number of lookups of absent keys that were answered by the negative cache, see
+	// `NegativeCache`.
+	NegativeCacheHits uint64
+	// Number of operations that were retried after a transient error, see `WithRetryPolicy`.
+	Retries uint64
+	// Whether the store was degraded to read-only mode by a failed write, see
+	// `DegradeOnWriteError`.
+	Degraded bool
+}
+
+// rateReporter is implemented by rate limiters that can report their current parameters.
+type rateReporter interface {
+	BurstRate() types.Work
+	Rate() float64
+}
+
+// Stats returns counts and sizes that describe the current state of the store.
+func (s *Store) Stats() Stats {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	var stats Stats
+	stats.Keys = s.index.Count()
+	if sizer, ok := s.index.Primary.(primary.Sizer); ok {
+		stats.PrimarySize = sizer.Size()
+	}
+	stats.IndexSize = s.index.Size()
+	stats.OccupiedBuckets, stats.Buckets = s.index.OccupiedBuckets()
+	stats.OutstandingWork = s.outstandingWork()
+	stats.OpenDuration = s.openDuration
+	stats.TornIndexBytes = s.tornIndexBytes
+	stats.FilteredLookups = atomic.LoadUint64(&s.filteredLookups)
+	stats.Retries = atomic.LoadUint64(&s.retries)
+	stats.Degraded = s.Degraded()
+	if s.cache != nil {
+		stats.CacheHits, stats.CacheMisses = s.cache.stats()
+	}
+	if s.negCache != nil {
+		stats.NegativeCacheHits = s.negCache.hitCount()
+	}
+
+	s.rateLk.RLock()
+	stats.Flushes = s.flushes
+	stats.FlushErrors = s.flushErrors
+	stats.FlushedWork = s.flushedWork
+	stats.LastFlushDuration = s.lastFlushDuration
+	s.rateLk.RUnlock()
+
+	if reporter, ok := s.limiter.(rateReporter); ok {
+		stats.BurstRate = reporter.BurstRate()
+		stats.FlushRate = reporter.Rate()
+	}
+	return stats
+}
+
+// Count returns the number of keys in the store, including the ones that haven't been flushed yet.
+//
+// The count is kept up to date by puts and deletes and is computed when the index is read on
+// open, hence it doesn't read any data. Keys whose values expired or were all removed with
+// RemoveValue are counted until GC drops them.
+func (s *Store) Count() uint64 {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	return s.index.Count()
+}
+
+// BucketUsage returns the number of records and bytes of every bucket of the index, which shows
+// how evenly the keys are distributed. It reads the whole index.
+func (s *Store) BucketUsage() (index.BucketUsage, error) {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	return s.index.BucketUsage()
+}
+
+// IndexStats returns the distribution of the record lists over the buckets of the index, see
+// `index.Stats`. It reads the whole index.
+func (s *Store) IndexStats() (index.Stats, error) {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	return s.index.Stats()
+}
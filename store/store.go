@@ -2,55 +2,385 @@ package store
 
 import (
 	"bytes"
-	"math"
+	"context"
+	"errors"
 	"sync"
 	"time"
 
+	"github.com/hannahhoward/go-storethehash/store/bloom"
+	"github.com/hannahhoward/go-storethehash/store/filelock"
 	"github.com/hannahhoward/go-storethehash/store/freelist"
 	"github.com/hannahhoward/go-storethehash/store/index"
 	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/provenance"
 	"github.com/hannahhoward/go-storethehash/store/types"
 )
 
 const DefaultBurstRate = 4 * 1024 * 1024
 
+// Store is a handle of a store, see OpenStore. All handles of a store share its state.
 type Store struct {
+	*sharedStore
+	// released is set once the handle was closed, it's protected by the lock of `openStores`.
+	released bool
+}
+
+// sharedStore is the state of a store that is shared by all its handles.
+type sharedStore struct {
 	index    *index.Index
 	freelist *freelist.FreeList
+	// Sources of entries that were copied from other stores
+	provenance *provenance.Provenance
+	// bloom is nil unless the store was opened with BloomFilter.
+	bloom *bloom.Filter
+	// cache is nil unless the store was opened with ValueCache.
+	cache *valueCache
+	// negCache is nil unless the store was opened with NegativeCache.
+	negCache *negativeCache
+	// access is nil unless the store was opened with TrackAccess.
+	access *accessTracker
+	// slowLog is nil unless the store was opened with SlowQueryLog.
+	slowLog *slowLog
+	// Number of lookups the bloom filter answered without reading the index, updated atomically
+	filteredLookups uint64
+	// Number of retried operations, updated atomically
+	retries     uint64
+	retryPolicy RetryPolicy
+	// Percentage of entries that are verified after a compaction, see `VerifyCompaction`
+	verifyPercent float64
 
 	stateLk sync.RWMutex
 	open    bool
 	running bool
 	err     error
+	// Whether the store serves reads of flushed data after a write failed, see
+	// DegradeOnWriteError. degraded is protected by stateLk.
+	degradeOnError bool
+	degraded       bool
+
+	limiter    RateLimiter
+	durability DurabilityLevel
+	policy     Policy
+	metrics    Metrics
+	log        Logger
+	// Whether keys have a list of values, see `MultiValue`
+	multiValue bool
+	// Whether values are chains of segments that can be appended to, see `Appendable`
+	appendable bool
+	// chainLks serialize the puts of keys in multi-value or appendable mode or with a merge
+	// operator, a key uses the lock selected by the last byte of its index key.
+	chainLks [256]sync.Mutex
+	// Advisory locks of the buckets of the index, see LockBuckets
+	bucketLks [bucketLockStripes]sync.Mutex
+	// Whether values are stored with their insertion time and flags, see `EntryMetadata`
+	metadata bool
+	// Whether values are stored with an expiration time, see `Expiry`
+	expiry        bool
+	sweepInterval time.Duration
+	// Combines new values with existing ones, see `WithMergeOperator`
+	mergeOperator MergeOperator
+	// Whether writes of empty values are rejected, see `AllowEmptyValues`
+	denyEmpty bool
+	// Limit of the value sizes of the primary storage, nil if it has none
+	valueLimiter primary.ValueLimiter
+	// Whether nothing runs in the background, see `CompactMode`
+	compactMode bool
+	// Whether the index has a write-ahead log, see WriteAheadLog
+	wal bool
+	// Interval of the background scrubber and whether it repairs problems, see BackgroundScrub
+	scrubInterval time.Duration
+	scrubRepair   bool
+
+	// flushLk serializes commits, which can be triggered by writers as well as the background
+	// flusher.
+	flushLk sync.Mutex
+
+	// pauseLk protects paused, writers wait on pauseCond while writing is paused and the
+	// outstanding work exceeds maxPausedWork, see PauseSync.
+	pauseLk       sync.Mutex
+	pauseCond     *sync.Cond
+	paused        bool
+	maxPausedWork types.Work
+
+	// swapLk is held for reading by all operations that access the files, and for writing while
+	// the files are swapped by GC. generation is increased on every swap and protected by swapLk.
+	swapLk     sync.RWMutex
+	generation uint64
 
 	rateLk    sync.RWMutex
-	rate      float64 // rate at which data can be flushed
-	burstRate types.Work
 	lastFlush time.Time
 
-	closing      chan struct{}
+	// flush counters, protected by rateLk
+	flushes           uint64
+	flushErrors       uint64
+	flushedWork       types.Work
+	lastFlushDuration time.Duration
+
+	// Sequence numbers of the last flush that started and of the latest one that finished, and a
+	// channel that is closed and replaced whenever a flush finishes, protected by rateLk. See
+	// WaitForFlush.
+	flushStarted  uint64
+	flushFinished uint64
+	flushDone     chan struct{}
+
+	// ctx is cancelled when the store is closed (or the parent context is done) and stops all
+	// background goroutines, which are tracked by bgWg.
+	ctx          context.Context
+	cancel       context.CancelFunc
+	bgWg         sync.WaitGroup
 	syncInterval time.Duration
+
+	// resetTicker tells the background flusher that syncInterval changed, which is protected by
+	// rateLk.
+	resetTicker chan struct{}
+
+	// Needed to reopen the index after it was swapped.
+	indexSizeBits uint8
+	indexOptions  []index.Option
+
+	// growLk serializes growths of the index, growth tracks the changes during one, see
+	// GrowIndex. It's protected by swapLk.
+	growLk sync.Mutex
+	growth *indexGrowth
+	// Average number of keys per occupied bucket beyond which the index is grown, up to
+	// growMaxBits bucket bits, see `AutoGrowIndex`. autoGrowing is set while a growth runs.
+	growAverage float64
+	growMaxBits uint8
+	autoGrowing uint32
+
+	// path is the absolute path of the index and the key of the store in `openStores`. refs is the
+	// number of handles that were returned by OpenStore and not closed yet, it's protected by the
+	// lock of `openStores`.
+	path string
+	refs int
+	// Parameters and options the store was opened with, see `storeSettings`
+	settings storeSettings
+	// Lock of the files against other processes, see `filelock`
+	fileLock *filelock.Lock
+
+	// Time it took to read the index when the store was opened, and the size it had
+	openDuration    time.Duration
+	openedIndexSize types.Position
+	// Bytes of an incomplete record list that were cut off the index on open
+	tornIndexBytes int64
+
+	// indexedPrimary are the bounds of the primary storage within which all entries are in the
+	// flushed index, it's protected by flushLk. It's nil if the primary storage doesn't
+	// implement `primary.Sizer`.
+	indexedPrimary primaryBounds
 }
 
-func OpenStore(path string, primary primary.PrimaryStorage, indexSizeBits uint8, syncInterval time.Duration, burstRate types.Work) (*Store, error) {
-	index, err := index.OpenIndex(path, primary, indexSizeBits)
+// OpenStore opens the store with the index at the given path.
+//
+// If the store is already open in this process, a new handle of the existing store is returned. In
+// that case the given primary storage is closed, and the other parameters and options need to
+// match the ones the store was opened with, see `types.ErrOptionsMismatch`. A primary storage that
+// implements `primary.Pather` needs to refer to the same data file as well. All handles share the
+// same state, so that reads on one handle see the writes on any other one. Every handle needs to
+// be closed, the store is only closed once all handles are. Closing a handle again does nothing.
+//
+// If OpenStore fails, the primary storage isn't closed, it stays the caller's.
+//
+// The files are locked against other processes until the store is closed, opening a store that
+// another process has open fails with `types.ErrStoreLocked`.
+func OpenStore(path string, primary primary.PrimaryStorage, indexSizeBits uint8, syncInterval time.Duration, burstRate types.Work, options ...Option) (*Store, error) {
+	key, err := storeKey(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := newStoreSettings(indexSizeBits, syncInterval, burstRate, options)
+	openStores.Lock()
+	defer openStores.Unlock()
+	if s, ok := openStores.stores[key]; ok {
+		if settings != s.settings || !samePrimary(primary, s.index.Primary) {
+			return nil, types.ErrOptionsMismatch
+		}
+		if primary != s.index.Primary {
+			if err := primary.Close(); err != nil {
+				return nil, err
+			}
+		}
+		s.refs++
+		return &Store{sharedStore: s}, nil
+	}
+
+	// Another process must not write the same files.
+	lock, err := filelock.Acquire(key)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openStore(key, path, primary, indexSizeBits, syncInterval, burstRate, options...)
 	if err != nil {
+		_ = lock.Release()
 		return nil, err
 	}
+	store.fileLock = lock
+	store.settings = settings
+	openStores.stores[key] = store.sharedStore
+	return store, nil
+}
+
+// openStore opens a store that isn't open in this process yet, `key` is its key in `openStores`.
+func openStore(key string, path string, primary primary.PrimaryStorage, indexSizeBits uint8, syncInterval time.Duration, burstRate types.Work, options ...Option) (*Store, error) {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
+	if c.logger == nil {
+		c.logger = nopLogger{}
+	}
+	if c.multiValue && (c.expiry || c.mergeOperator != nil) {
+		return nil, types.ErrMultiValue
+	}
+	if c.appendable && (c.multiValue || c.expiry || c.mergeOperator != nil || c.metadata) {
+		return nil, types.ErrAppendable
+	}
+	if c.multiValue && c.metadata {
+		return nil, types.ErrMultiValue
+	}
+	if err := recoverGC(key, primary, c.logger); err != nil {
+		return nil, err
+	}
+	if err := removeGrownIndex(key); err != nil {
+		return nil, err
+	}
+	if c.compactMode {
+		var err error
+		if indexSizeBits, err = compactIndexBits(key, indexSizeBits); err != nil {
+			return nil, err
+		}
+	}
+	if c.growAverage > 0 {
+		// The index may have been grown beyond the given size.
+		var err error
+		if indexSizeBits, err = grownIndexBits(key, indexSizeBits); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	index, err := openIndex(path, primary, indexSizeBits, c)
+	if err != nil {
+		return nil, err
+	}
+	torn, _ := index.TornTail()
+	if torn.Dropped > 0 {
+		c.logger.Warnw("cut off incomplete record list at the end of the index", "path", key,
+			"offset", torn.Offset, "bytes", torn.Dropped)
+	}
+	if pos, ok := index.OpenedFromCheckpoint(); ok {
+		c.logger.Infow("opened index from checkpoint", "path", key, "position", pos)
+	}
+	if replayed := index.ReplayedChanges(); replayed > 0 {
+		c.logger.Infow("replayed index changes from the write-ahead log", "path", key, "changes", replayed)
+	}
 	freelist, err := freelist.OpenFreeList(path + ".free")
 	if err != nil {
 		return nil, err
 	}
-	store := &Store{
+	if err := recoverUnindexed(key, index, freelist, c.multiValue || c.appendable, c.logger); err != nil {
+		return nil, err
+	}
+	openDuration := time.Since(start)
+	provenance, err := provenance.OpenProvenance(path + ".provenance")
+	if err != nil {
+		return nil, err
+	}
+	var filter *bloom.Filter
+	if c.bloomKeys > 0 {
+		if filter, err = openBloom(key, index, c.bloomKeys); err != nil {
+			return nil, err
+		}
+	}
+	var cache *valueCache
+	if c.cacheSize > 0 {
+		cache = newValueCache(c.cacheSize)
+	}
+	var negCache *negativeCache
+	if c.negCacheSize > 0 {
+		negCache = newNegativeCache(c.negCacheSize)
+	}
+	maxPausedWork := c.maxPausedWork
+	if maxPausedWork == 0 {
+		maxPausedWork = burstRate
+	}
+	var access *accessTracker
+	if c.trackAccess {
+		access = newAccessTracker()
+	}
+	var slow *slowLog
+	if c.slowEntries > 0 {
+		slow = newSlowLog(c.slowThreshold, c.slowEntries)
+	}
+	parent := c.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	limiter := c.limiter
+	if limiter == nil && c.compactMode {
+		// Nothing flushes in the background that writers could wait for.
+		limiter = NoRateLimit{}
+	}
+	if limiter == nil {
+		tb := NewTokenBucket(burstRate, syncInterval)
+		if c.autoBurstRate {
+			tb.AutoCalibrate()
+		}
+		limiter = tb
+	}
+	store := &Store{sharedStore: &sharedStore{
 		lastFlush:    time.Now(),
 		index:        index,
 		freelist:     freelist,
+		provenance:   provenance,
+		bloom:        filter,
+		cache:        cache,
+		negCache:     negCache,
+		access:       access,
+		slowLog:      slow,
 		open:         true,
 		running:      false,
 		syncInterval: syncInterval,
-		burstRate:    burstRate,
-		closing:      make(chan struct{}),
-	}
+		resetTicker:  make(chan struct{}, 1),
+		flushDone:    make(chan struct{}),
+		limiter:      limiter,
+		durability:   c.durability,
+		policy:       c.policy,
+		metrics:      c.metrics,
+		log:          c.logger,
+		multiValue:   c.multiValue,
+		appendable:   c.appendable,
+		metadata:     c.metadata,
+		compactMode:  c.compactMode,
+		wal:          c.wal,
+		expiry:       c.expiry,
+		ctx:          ctx,
+		cancel:       cancel,
+		path:         key,
+		refs:         1,
+
+		indexSizeBits: indexSizeBits,
+		growAverage:   c.growAverage,
+		growMaxBits:   c.growMaxBits,
+		indexOptions:  c.indexOptions,
+		sweepInterval: c.sweepInterval,
+		scrubInterval: c.scrubInterval,
+		scrubRepair:   c.scrubRepair,
+		mergeOperator: c.mergeOperator,
+		maxPausedWork: maxPausedWork,
+		retryPolicy:   c.retryPolicy,
+		verifyPercent: c.verifyPercent,
+
+		degradeOnError: c.degrade,
+		denyEmpty:      c.denyEmpty,
+		valueLimiter:   valueLimiter(primary),
+
+		openDuration:    openDuration,
+		openedIndexSize: index.Size(),
+		tornIndexBytes:  torn.Dropped,
+		indexedPrimary:  readPrimaryBounds(primary),
+	}}
+	store.pauseCond = sync.NewCond(&store.pauseLk)
 	return store, nil
 }
 
@@ -59,32 +389,78 @@ func (s *Store) Start() {
 	running := s.running
 	s.running = true
 	s.stateLk.Unlock()
-	if !running {
-		go s.run()
+	if !running && !s.compactMode {
+		s.goBackground(s.run)
+		if s.sweepInterval > 0 {
+			s.goBackground(s.sweep)
+		}
+		if s.scrubInterval > 0 {
+			s.goBackground(s.scrubPeriodically)
+		}
 	}
 }
 
-func (s *Store) run() {
-	d := time.NewTicker(s.syncInterval)
+// goBackground runs fn in a goroutine that is bound to the lifetime of the store. The context
+// passed to fn is cancelled on Close, which waits for fn to return.
+func (s *Store) goBackground(fn func(ctx context.Context)) {
+	s.bgWg.Add(1)
+	go func() {
+		defer s.bgWg.Done()
+		fn(s.ctx)
+	}()
+}
+
+func (s *Store) run(ctx context.Context) {
+	d := time.NewTicker(s.SyncInterval())
+	defer d.Stop()
 
 	for {
 		select {
 
-		case <-s.closing:
-			d.Stop()
-			select {
-			case <-d.C:
-			default:
-			}
+		case <-ctx.Done():
 			return
 
+		case <-s.resetTicker:
+			d.Reset(s.SyncInterval())
+
 		case <-d.C:
 			s.Flush()
+			s.autoGrowIndex()
 		}
 	}
 }
 
+// Close releases a handle of the store. The store is closed, and all outstanding work is flushed,
+// once the last handle is released.
 func (s *Store) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but stops writing the index once the context is done, as committing a
+// large amount of outstanding work can take long.
+//
+// The primary storage is always flushed, the data that isn't on disk would be lost otherwise. Of
+// the index, only the record lists that were written before the context was done are kept. The
+// position from which on the primary storage isn't indexed is written to a recovery marker next to
+// the index (`<index path>.recover`) and these entries are indexed again when the store is opened
+// the next time. If that happens, the store is closed nonetheless and the error of the context is
+// returned.
+//
+// Recovering needs an iterator of the primary storage that implements `primary.BlockIter`, without
+// one the whole index is written regardless of the context.
+func (s *Store) CloseContext(ctx context.Context) error {
+	// The lock is held until the store is closed, so that it can't be opened again before its
+	// files are.
+	openStores.Lock()
+	defer openStores.Unlock()
+	if !s.release() {
+		return nil
+	}
+	// The files may be opened by another process once they are closed.
+	defer func() {
+		_ = s.fileLock.Release()
+	}()
+
 	s.stateLk.Lock()
 	open := s.open
 	s.open = false
@@ -95,16 +471,25 @@ func (s *Store) Close() error {
 	}
 
 	s.stateLk.Lock()
-	running := s.running
 	s.running = false
 	s.stateLk.Unlock()
 
-	if running {
-		close(s.closing)
-	}
+	// Writers that wait for a paused sync would keep the store from closing.
+	s.resume()
 
-	if s.outstandingWork() {
-		if _, err := s.commit(); err != nil {
+	// Stop all background work and wait for it, so that nothing touches the files once they are
+	// closed.
+	s.cancel()
+	s.bgWg.Wait()
+	// Wait for a running GC.
+	s.swapLk.Lock()
+	defer s.swapLk.Unlock()
+
+	var aborted error
+	if s.outstandingWork() > 0 {
+		if err := s.commitClose(ctx); err == ctx.Err() {
+			aborted = err
+		} else if err != nil {
 			s.setErr(err)
 		}
 	}
@@ -121,45 +506,199 @@ func (s *Store) Close() error {
 		return err
 	}
 
-	return nil
+	if err := s.freelist.Close(); err != nil {
+		return err
+	}
+
+	if err := s.provenance.Close(); err != nil {
+		return err
+	}
+
+	if s.bloom != nil {
+		if err := s.bloom.Close(); err != nil {
+			return err
+		}
+	}
+	return aborted
 }
 
-func (s *Store) Get(key []byte) ([]byte, bool, error) {
-	if err := s.Err(); err != nil {
+// Get returns the value of a key. The consistency of the read can be set with `WithConsistency`.
+func (s *Store) Get(key []byte, options ...ReadOption) (value []byte, found bool, err error) {
+	start := time.Now()
+	trace := s.startTrace("get", key)
+	defer func() { trace.finish(s, err) }()
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	trace.mark(phasePoolWait)
+	degraded, err := s.readErr()
+	if err != nil {
 		return nil, false, err
 	}
+	absent, generation, err := s.knownAbsent(key)
+	if err != nil || absent {
+		return nil, false, err
+	}
+	// A degraded store only has the flushed data.
+	stale := degraded || readConsistency(options) == ReadStale
+	err = s.retry("get", func() error {
+		var err error
+		if stale {
+			value, found, err = getFlushed(s.index, key)
+		} else {
+			value, found, err = s.getCached(key, trace)
+		}
+		if found && s.chained() {
+			value, found, err = s.chainValue(value)
+			trace.mark(phasePrimaryRead)
+		}
+		return err
+	})
+	if found && (s.expiry || s.metadata) {
+		value, found, err = s.decodeValue(value)
+	}
+	if !found && err == nil && !stale {
+		s.rememberAbsent(key, generation)
+	}
+	if found {
+		s.onAccess(key)
+	}
+	if found && s.policy != nil {
+		s.policy.OnGet(key)
+	}
+	if s.metrics != nil && err == nil {
+		s.metrics.ObserveGet(found, time.Since(start))
+	}
+	return value, found, err
+}
 
-	indexKey, err := s.index.Primary.IndexKey(key)
-	if err != nil {
+// getLatest returns the most recent value of a key in multi-value mode, the joined segments of a
+// value in appendable mode, or the value of a key that didn't expire yet in expiry mode, without its
+// metadata.
+func (s *Store) getLatest(key []byte) ([]byte, bool, error) {
+	data, found, err := s.getCached(key, nil)
+	if err != nil || !found {
 		return nil, false, err
 	}
-	fileOffset, found, err := s.index.Get(indexKey)
+	if s.chained() {
+		return s.chainValue(data)
+	}
+	return s.decodeValue(data)
+}
+
+// get returns the value of a key from the given index and its primary storage.
+func get(idx *index.Index, key []byte) ([]byte, bool, error) {
+	indexKey, blk, found, err := lookup(idx, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return readValue(idx, indexKey, blk)
+}
+
+// getFlushed returns the value of a key like get, but only considers the flushed part of the index.
+func getFlushed(idx *index.Index, key []byte) ([]byte, bool, error) {
+	indexKey, err := idx.Primary.IndexKey(key)
 	if err != nil {
 		return nil, false, err
 	}
-	if !found {
-		return nil, false, nil
+	blk, found, err := idx.GetFlushed(indexKey)
+	if err != nil || !found {
+		return nil, false, err
 	}
-	primaryKey, value, err := s.index.Primary.Get(fileOffset)
+	return readValue(idx, indexKey, blk)
+}
+
+// readValue returns the value stored at the given block, if it belongs to the given index key.
+func readValue(idx *index.Index, indexKey []byte, blk types.Block) ([]byte, bool, error) {
+	primaryKey, value, err := idx.Primary.Get(blk)
 	if err != nil {
 		return nil, false, err
 	}
+	return matchValue(idx, indexKey, primaryKey, value)
+}
 
+// matchValue returns the value of an entry of the primary storage, if the entry belongs to the
+// given index key.
+func matchValue(idx *index.Index, indexKey []byte, primaryKey []byte, value []byte) ([]byte, bool, error) {
 	// We may be using a key that maps to the same indexKey
 	// in primary storage, so we need to check this the right way.
-	primaryKey, err = s.index.Primary.IndexKey(primaryKey)
+	primaryKey, err := idx.Primary.IndexKey(primaryKey)
 	if err != nil {
 		return nil, false, err
 	}
 
 	// The index stores only prefixes, hence check if the given key fully matches the
 	// key that is stored in the primary storage before returning the actual value.
-	if bytes.Compare(indexKey, primaryKey) != 0 {
+	if !bytes.Equal(indexKey, primaryKey) {
 		return nil, false, nil
 	}
 	return value, true, nil
 }
 
+// lookup returns the index key of a key together with the location of the candidate entry in
+// the primary storage.
+//
+// As the index only stores key prefixes, a found entry may belong to a different key. Callers
+// need to confirm the match against the primary storage, see `verify`.
+func lookup(idx *index.Index, key []byte) ([]byte, types.Block, bool, error) {
+	indexKey, err := idx.Primary.IndexKey(key)
+	if err != nil {
+		return nil, types.Block{}, false, err
+	}
+	blk, found, err := idx.Get(indexKey)
+	if err != nil {
+		return nil, types.Block{}, false, err
+	}
+	return indexKey, blk, found, nil
+}
+
+// lookupChecked returns the index record of a key. The index stores only prefixes, hence the full
+// key is compared with the one in the primary storage, unless the index can tell whether the record
+// belongs to the key, see `index.FullKeys` and `index.KeyChecksums`.
+func lookupChecked(idx *index.Index, key []byte) (index.Record, bool, error) {
+	indexKey, err := idx.Primary.IndexKey(key)
+	if err != nil {
+		return index.Record{}, false, err
+	}
+	record, found, err := idx.GetRecord(indexKey)
+	if err != nil || !found {
+		return index.Record{}, false, err
+	}
+	if found, checked := idx.CheckRecord(record, indexKey); checked {
+		return record, found, nil
+	}
+	found, err = verify(idx, indexKey, record.Block)
+	return record, found, err
+}
+
+// verify checks whether the entry stored at the given block belongs to the given index key.
+func verify(idx *index.Index, indexKey []byte, blk types.Block) (bool, error) {
+	primaryIndexKey, err := idx.Primary.GetIndexKey(blk)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(indexKey, primaryIndexKey), nil
+}
+
+// checkValue returns whether a value of the given size may be written under the key.
+func (s *Store) checkValue(key []byte, size int) error {
+	if size == 0 && s.denyEmpty {
+		return types.ErrEmptyValue
+	}
+	if uint64(size) > types.MaxBlockSize {
+		return types.ErrValueTooLarge
+	}
+	if s.valueLimiter != nil && int64(size) > s.valueLimiter.MaxValueSize(key) {
+		return types.ErrValueTooLarge
+	}
+	return nil
+}
+
+// valueLimiter returns the value size limit of the primary storage, nil if it has none.
+func valueLimiter(primaryStorage primary.PrimaryStorage) primary.ValueLimiter {
+	limiter, _ := primaryStorage.(primary.ValueLimiter)
+	return limiter
+}
+
 func (s *Store) Err() error {
 	s.stateLk.RLock()
 	defer s.stateLk.RUnlock()
@@ -167,53 +706,173 @@ func (s *Store) Err() error {
 }
 
 func (s *Store) setErr(err error) {
+	if isPaused(err) {
+		// Nothing was written.
+		return
+	}
 	s.stateLk.Lock()
 	s.err = err
+	degrade := s.degradeOnError && !s.degraded
+	if degrade {
+		s.degraded = true
+	}
 	s.stateLk.Unlock()
+	if !degrade {
+		s.log.Errorw("store failed, it rejects all further operations", "path", s.path, "err", err)
+		return
+	}
+	s.log.Errorw("store degraded to read-only mode, it only serves reads of flushed data", "path", s.path, "err", err)
+	if metrics, ok := s.metrics.(DegradationMetrics); ok {
+		metrics.SetDegraded(true)
+	}
 }
 
 func (s *Store) Put(key []byte, value []byte) error {
+	return s.observePut(key, value, false, time.Time{}, 0)
+}
+
+// observePut puts a value and reports it to the metrics.
+func (s *Store) observePut(key []byte, value []byte, ifAbsent bool, expiresAt time.Time, flags byte) error {
+	if s.metrics == nil {
+		return s.put(key, value, ifAbsent, expiresAt, flags)
+	}
+	start := time.Now()
+	err := s.put(key, value, ifAbsent, expiresAt, flags)
+	if err == nil {
+		s.metrics.ObservePut(len(key)+len(value), time.Since(start))
+	}
+	return err
+}
+
+// put stores a value. In multi-value mode, it isn't added if `ifAbsent` is set and the key already
+// has an equal value. In expiry mode, it expires at `expiresAt` unless that is zero. With entry
+// metadata, `flags` are stored with it.
+func (s *Store) put(key []byte, value []byte, ifAbsent bool, expiresAt time.Time, flags byte) (err error) {
+	trace := s.startTrace("put", key)
+	defer func() { trace.finish(s, err) }()
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	trace.mark(phasePoolWait)
 	if err := s.Err(); err != nil {
 		return err
 	}
-
-	// Get the key in primary storage
-	indexKey, err := s.index.Primary.IndexKey(key)
-	if err != nil {
+	if err := s.checkValue(key, len(value)); err != nil {
 		return err
 	}
-	// See if the key already exists and get offset
-	prevOffset, found, err := s.index.Get(indexKey)
+	work, err := s.putEntry(key, value, ifAbsent, expiresAt, flags, trace)
 	if err != nil {
 		return err
 	}
+	err = s.settle(work)
+	trace.mark(phaseThrottle)
+	return err
+}
+
+// putEntry writes a value like put and returns the work it caused without settling it. It must be
+// called with swapLk held. The phases of the write are measured with `trace`, which may be nil.
+func (s *Store) putEntry(key []byte, value []byte, ifAbsent bool, expiresAt time.Time, flags byte, trace *opTrace) (types.Work, error) {
+	if s.chained() || s.mergeOperator != nil {
+		// Appending or merging a value reads the previous one, concurrent puts of a key would both
+		// build on it and one of the values would be lost.
+		unlock, err := s.lockChain(key)
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+		trace.mark(phasePoolWait)
+	}
+
+	// Get the key in primary storage and see if the key already exists
+	var indexKey []byte
+	var prevOffset types.Block
+	var found bool
 	// If found get the key and value stored in primary to see if it is the same
 	// (index only stores prefixes)
 	var storedKey []byte
 	var storedVal []byte
-	if found {
-		storedKey, storedVal, err = s.index.Primary.Get(prevOffset)
-		if err != nil {
+	err := s.retry("put", func() error {
+		var err error
+		indexKey, prevOffset, found, err = s.lookupFiltered(key)
+		trace.mark(phaseIndexScan)
+		if err != nil || !found {
 			return err
 		}
+		storedKey, storedVal, err = s.index.Primary.Get(prevOffset)
+		trace.mark(phasePrimaryRead)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if found {
 		// We need to compare to the resulting indexKey for the storedKey.
 		// Two keys may point to same IndexKey (i.e. two CIDS same multihash),
 		// and they need to be treated as the same key.
 		storedKey, err = s.index.Primary.IndexKey(storedKey)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
 	cmpKey := bytes.Equal(indexKey, storedKey)
 
-	if cmpKey && bytes.Equal(value, storedVal) {
+	if s.mergeOperator != nil && found && cmpKey {
+		if value, err = s.merge(key, storedVal, value); err != nil {
+			return 0, err
+		}
+	}
+
+	valueSize := types.Size(len(value))
+	if s.expiry {
+		value = encodeExpiring(expiresAt, value)
+	}
+	if s.multiValue {
+		// The value is added to the values of the key, it links to the previous one.
+		var prev types.Block
+		if found && cmpKey {
+			prev = prevOffset
+			if ifAbsent {
+				has, err := chainHasValue(s.index.Primary, storedVal, value)
+				if err != nil {
+					return 0, err
+				}
+				if has {
+					return 0, types.ErrKeyExists
+				}
+			}
+		}
+		value = encodeChained(prev, value, false)
+	} else if s.appendable {
+		// The value replaces all segments of the stored one.
+		if found && cmpKey {
+			stored, _, err := joinedValue(s.index.Primary, storedVal)
+			if err != nil {
+				return 0, err
+			}
+			if bytes.Equal(value, stored) {
+				return 0, types.ErrKeyExists
+			}
+		}
+		value = encodeChained(types.Block{}, value, false)
+	} else if s.metadata {
+		// The value is only rewritten if it or its flags changed, which keeps its insertion time.
+		if found && cmpKey {
+			meta, stored, err := decodeMeta(storedVal)
+			if err != nil {
+				return 0, err
+			}
+			if meta.Flags == flags && bytes.Equal(value, stored) {
+				return 0, types.ErrKeyExists
+			}
+		}
+		value = encodeMeta(Meta{Inserted: time.Now(), Flags: flags}, value)
+	} else if cmpKey && bytes.Equal(value, storedVal) {
 		// We are trying to put the same value in an existing key,
 		// we can directly return
 		// NOTE: How many times is going to happen this. Can we save ourselves
 		// this step? We can't in the case of the blockstore and that is why we
 		// return an ErrKeyExists.
-		return types.ErrKeyExists
+		return 0, types.ErrKeyExists
 	}
 
 	// We are ready now to start putting/updating the value in the key.
@@ -221,142 +880,407 @@ func (s *Store) Put(key []byte, value []byte) error {
 	// the key, not the indexKey. The storage knows how to manage the key
 	// under the hood while the index is primary storage-agnostic.
 	fileOffset, err := s.index.Primary.Put(key, value)
+	trace.mark(phasePrimaryRead)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	err = s.indexEntry(key, indexKey, fileOffset, valueSize, found && cmpKey, prevOffset)
+	trace.mark(phaseIndexScan)
+	if err != nil {
+		return 0, err
+	}
+	return types.Work(len(key) + len(value)), nil
+}
 
+// indexEntry adds the entry of a key that was written to the primary storage at `blk` to the
+// index. If `replace` is set, it replaces the entry of the key at `prev`.
+func (s *Store) indexEntry(key []byte, indexKey []byte, blk types.Block, valueSize types.Size, replace bool, prev types.Block) error {
 	// If the key being set is not found, or the stored key is not equal
 	// (even if same prefix is shared @index), we put the key without updates
-	if !found || !cmpKey {
-		if err := s.index.Put(indexKey, fileOffset); err != nil {
+	if !replace {
+		if s.bloom != nil {
+			if err := s.bloom.Add(indexKey); err != nil {
+				return err
+			}
+		}
+		if err := s.index.PutWithSize(indexKey, blk, valueSize); err != nil {
 			return err
 		}
+		s.noteIndexChange(indexKey)
 	} else {
 		// If the key exists and the one stored is the one we are trying
 		// to put this is an update.
 		// if found && bytes.Compare(key, storedKey) == 0 {
-		if err := s.index.Update(indexKey, fileOffset); err != nil {
+		if err := s.index.UpdateWithSize(indexKey, blk, valueSize); err != nil {
 			return err
 		}
-		// Add outdated data in primary storage to freelist
-		err = s.freelist.Put(prevOffset)
-		if err != nil {
-			return err
+		s.noteIndexChange(indexKey)
+		// Add outdated data in primary storage to freelist, the previous values of a key with
+		// several values are still in use.
+		if !s.chained() {
+			if err := s.freelist.Put(prev); err != nil {
+				return err
+			}
 		}
 	}
 
-	now := time.Now()
-	s.rateLk.Lock()
-	elapsed := now.Sub(s.lastFlush)
-	// TODO: move this Outstanding calculation into Pool?
-	work := s.index.OutstandingWork() + s.index.Primary.OutstandingWork() + s.freelist.OutstandingWork()
-	rate := math.Ceil(float64(work) / elapsed.Seconds())
-	sleep := s.rate > 0 && rate > s.rate && work > s.burstRate
-	s.rateLk.Unlock()
+	// The entry doesn't come from another store anymore.
+	if err := s.provenance.Put(indexKey, ""); err != nil {
+		return err
+	}
+	s.forgetAbsent(indexKey)
 
-	if sleep {
-		time.Sleep(25 * time.Millisecond)
+	s.onAccess(key)
+	if s.policy != nil {
+		s.policy.OnPut(key, valueSize)
+	}
+	return nil
+}
+
+// settle persists a write of the given size according to the durability level, or throttles the
+// writer if the outstanding work grows faster than it is flushed.
+func (s *Store) settle(work types.Work) error {
+	switch s.durability {
+	case FlushOnPut, SyncOnPut:
+		// The write is committed right away, there is nothing to throttle. While sync is paused,
+		// it's buffered.
+		_, err := s.commit(s.durability == SyncOnPut)
+		if err == nil {
+			return nil
+		}
+		if !isPaused(err) {
+			s.setErr(err)
+			return err
+		}
+	}
+	s.waitWhilePaused()
+
+	if s.metrics != nil {
+		s.metrics.SetOutstandingWork(s.outstandingWork())
+	}
+	if wait := s.limiter.Allow(work); wait > 0 {
+		if s.metrics != nil {
+			s.metrics.ObserveThrottle(wait)
+		}
+		time.Sleep(wait)
 	}
 
 	return nil
 }
 
-func (s *Store) commit() (types.Work, error) {
+// commit writes all outstanding work to the files and syncs them to disk if `sync` is set.
+func (s *Store) commit(sync bool) (types.Work, error) {
+	return s.commitContext(context.Background(), sync)
+}
+
+// commitContext is like commit, but stops writing the index once the context is done, see
+// `index.FlushContext`. All other work is committed nonetheless, then the error of the context is
+// returned.
+func (s *Store) commitContext(ctx context.Context, sync bool) (types.Work, error) {
+	s.flushLk.Lock()
+	defer s.flushLk.Unlock()
+	if s.syncPaused() {
+		return 0, types.ErrSyncPaused
+	}
 
+	// The keys of the bloom filter go first, so that the filter contains every key of the primary
+	// storage, including those that are indexed again on open.
+	var bloomWork types.Work
+	if s.bloom != nil {
+		var err error
+		if bloomWork, err = s.bloom.Flush(); err != nil {
+			return 0, err
+		}
+		if sync {
+			if err := s.bloom.Sync(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	// All entries up to here are indexed once the index is flushed.
+	indexed := readPrimaryBounds(s.index.Primary)
+	// The changes of the index are logged before the data they refer to is flushed, so that they
+	// aren't lost if the index isn't flushed as well.
+	if err := s.index.SyncLog(); err != nil {
+		return 0, err
+	}
 	primaryWork, err := s.index.Primary.Flush()
 	if err != nil {
 		return 0, err
 	}
-	indexWork, err := s.index.Flush()
+	indexWork, indexErr := s.index.FlushContext(ctx)
+	if indexErr != nil && indexErr != ctx.Err() {
+		return 0, indexErr
+	}
+	if indexErr == nil {
+		s.indexedPrimary = indexed
+	}
+	freelistWork, err := s.freelist.Flush()
+	if err != nil {
+		return 0, err
+	}
+	provenanceWork, err := s.provenance.Flush()
 	if err != nil {
 		return 0, err
 	}
+	work := primaryWork + indexWork + freelistWork + provenanceWork + bloomWork
+	if !sync {
+		return work, indexErr
+	}
 	// finalize disk writes
-	if err := s.index.Primary.Sync(); err != nil {
+	if err := s.retry("sync", s.index.Primary.Sync); err != nil {
+		return 0, err
+	}
+	if err := s.retry("sync", s.index.Sync); err != nil {
+		return 0, err
+	}
+	if err := s.retry("sync", s.freelist.Sync); err != nil {
 		return 0, err
 	}
-	if err := s.index.Sync(); err != nil {
+	if err := s.retry("sync", s.provenance.Sync); err != nil {
 		return 0, err
 	}
-	return primaryWork + indexWork, nil
+	return work, indexErr
 }
 
-func (s *Store) outstandingWork() bool {
-	return s.index.OutstandingWork()+s.index.Primary.OutstandingWork() > 0
+func (s *Store) outstandingWork() types.Work {
+	work := s.index.OutstandingWork() + s.index.Primary.OutstandingWork() + s.freelist.OutstandingWork() +
+		s.provenance.OutstandingWork()
+	if s.bloom != nil {
+		work += s.bloom.OutstandingWork()
+	}
+	return work
 }
+
+// Flush commits all outstanding work and syncs it to disk, see FlushResult.
 func (s *Store) Flush() {
+	_, _ = s.FlushResult()
+}
+
+// FlushStats describes a flush.
+type FlushStats struct {
+	// Amount of work that was committed, zero if there was nothing to flush
+	Work types.Work
+	// Time the flush took
+	Duration time.Duration
+}
+
+// FlushResult commits all outstanding work and syncs it to disk, like the background flusher does
+// every sync interval, and returns what was flushed. It's meant for callers that drive their own
+// sync policy.
+//
+// A failed flush poisons the store as it does in the background, the error is returned as well as
+// reported by Err.
+func (s *Store) FlushResult() (FlushStats, error) {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return FlushStats{}, err
+	}
 
 	s.rateLk.Lock()
 	s.lastFlush = time.Now()
+	s.flushStarted++
+	seq := s.flushStarted
 	s.rateLk.Unlock()
 
-	if !s.outstandingWork() {
-		return
+	if s.outstandingWork() == 0 {
+		s.finishFlush(seq)
+		return FlushStats{}, nil
 	}
 
-	work, err := s.commit()
+	work, err := s.commit(true)
+	if isPaused(err) {
+		return FlushStats{}, err
+	}
 	if err != nil {
 		s.setErr(err)
-		return
+		s.rateLk.Lock()
+		s.flushErrors++
+		elapsed := time.Since(s.lastFlush)
+		s.rateLk.Unlock()
+		s.finishFlush(seq)
+		if s.metrics != nil {
+			s.metrics.ObserveFlush(0, elapsed, err)
+		}
+		return FlushStats{Duration: elapsed}, err
 	}
 
 	now := time.Now()
 	s.rateLk.Lock()
 	elapsed := now.Sub(s.lastFlush)
-	rate := math.Ceil(float64(work) / elapsed.Seconds())
-	if work > types.Work(s.burstRate) {
-		s.rate = rate
-	}
+	s.flushes++
+	s.flushedWork += work
+	s.lastFlushDuration = elapsed
 	s.rateLk.Unlock()
+	s.finishFlush(seq)
+	if s.metrics != nil {
+		s.metrics.ObserveFlush(work, elapsed, nil)
+		s.metrics.SetOutstandingWork(s.outstandingWork())
+	}
+
+	s.limiter.OnFlush(work, elapsed)
+	if elapsed > s.SyncInterval() {
+		// The next flush is already due.
+		s.log.Warnw("slow flush", "path", s.path, "elapsed", elapsed, "work", work)
+	}
+	return FlushStats{Work: work, Duration: elapsed}, nil
 }
 
 func (s *Store) Has(key []byte) (bool, error) {
-	if err := s.Err(); err != nil {
-		return false, err
-	}
-	indexKey, err := s.index.Primary.IndexKey(key)
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	degraded, err := s.readErr()
 	if err != nil {
 		return false, err
 	}
-	blk, found, err := s.index.Get(indexKey)
-	if !found {
-		return false, nil
-	}
-
-	// The index stores only prefixes, hence check if the given key fully matches the
-	// key that is stored in the primary storage before returning the actual value.
-	// TODO: avoid second lookup
-	primaryIndexKey, err := s.index.Primary.GetIndexKey(blk)
-	if err != nil {
+	absent, generation, err := s.knownAbsent(key)
+	if err != nil || absent {
 		return false, err
 	}
-
-	return bytes.Compare(indexKey, primaryIndexKey) == 0, nil
+	var found bool
+	err = s.retry("has", func() error {
+		var err error
+		if degraded {
+			_, found, err = s.getFlushedLatest(key)
+		} else if s.chained() || s.expiry || s.metadata {
+			// The key is gone once all its values were removed or it expired.
+			_, found, err = s.getLatest(key)
+		} else {
+			_, found, err = lookupChecked(s.index, key)
+		}
+		return err
+	})
+	if !found && err == nil && !degraded {
+		s.rememberAbsent(key, generation)
+	}
+	return found, err
 }
 
 func (s *Store) GetSize(key []byte) (types.Size, bool, error) {
-	indexKey, err := s.index.Primary.IndexKey(key)
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	degraded, err := s.readErr()
 	if err != nil {
 		return 0, false, err
 	}
-	blk, found, err := s.index.Get(indexKey)
-	if err != nil {
+	absent, generation, err := s.knownAbsent(key)
+	if err != nil || absent {
 		return 0, false, err
 	}
-	if !found {
-		return 0, false, nil
+	var size types.Size
+	var found bool
+	err = s.retry("get size", func() error {
+		if degraded {
+			value, ok, err := s.getFlushedLatest(key)
+			size, found = types.Size(len(value)), ok
+			return err
+		}
+		var err error
+		size, found, err = s.getSize(key)
+		return err
+	})
+	if !found && err == nil && !degraded {
+		s.rememberAbsent(key, generation)
 	}
+	return size, found, err
+}
 
-	// The index stores only prefixes, hence check if the given key fully matches the
-	// key that is stored in the primary storage before returning the actual value.
-	// TODO: avoid second lookup
-	primaryIndexKey, err := s.index.Primary.GetIndexKey(blk)
-	if err != nil {
+func (s *Store) getSize(key []byte) (types.Size, bool, error) {
+	if s.chained() || s.expiry || s.metadata {
+		value, found, err := s.getLatest(key)
+		return types.Size(len(value)), found, err
+	}
+	record, found, err := lookupChecked(s.index, key)
+	if err != nil || !found {
 		return 0, false, err
 	}
+	if record.HasValueSize {
+		return record.ValueSize, true, nil
+	}
+	blk := record.Block
+	size := blk.Size - types.Size(len(key))
+	if sizer, ok := s.index.Primary.(primary.ValueSizer); ok {
+		size, err = sizer.ValueSize(blk, key)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	return size, true, nil
+}
 
-	if bytes.Compare(indexKey, primaryIndexKey) != 0 {
-		return 0, false, nil
+// Scan calls `fn` with the key and value of every entry whose index key is within the range
+// [start, end), ordered by index key. A nil `end` means that the range is unbounded.
+func (s *Store) Scan(start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if s.chained() {
+		// Only the most recent value of a key, or the joined segments of an appendable one, are
+		// passed on.
+		scanFn := fn
+		fn = func(key []byte, value []byte) error {
+			value, found, err := s.chainValue(value)
+			if err != nil || !found {
+				return err
+			}
+			return scanFn(key, value)
+		}
+	}
+	if s.expiry || s.metadata {
+		// Expired entries are skipped, the metadata isn't passed on.
+		scanFn := fn
+		fn = func(key []byte, value []byte) error {
+			value, found, err := s.decodeValue(value)
+			if err != nil || !found {
+				return err
+			}
+			return scanFn(key, value)
+		}
+	}
+	return scan(s.index, start, end, fn)
+}
+
+// scan calls `fn` for every entry of the given index within the range [start, end).
+func scan(idx *index.Index, start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+	return idx.Scan(start, end, func(_ []byte, blk types.Block) error {
+		key, value, err := idx.Primary.Get(blk)
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
+
+// ScanPrefix calls `fn` with the key and value of every entry whose index key starts with the
+// given prefix, ordered by index key.
+func (s *Store) ScanPrefix(prefix []byte, fn func(key []byte, value []byte) error) error {
+	return s.Scan(prefix, index.PrefixEnd(prefix), fn)
+}
+
+// errLimitReached stops a scan once enough entries were found.
+var errLimitReached = errors.New("limit reached")
+
+// FindByDigestPrefix returns the keys whose index key (the digest of a CID for the CID primary
+// storage) starts with the given prefix, ordered by index key. At most `limit` keys are returned,
+// all of them if it isn't positive. It's meant to resolve truncated identifiers, e.g. in debugging
+// tools.
+//
+// Only the buckets covered by the prefix are read, the shorter the prefix, the more of the index
+// is scanned.
+func (s *Store) FindByDigestPrefix(prefix []byte, limit int) ([][]byte, error) {
+	var keys [][]byte
+	err := s.ScanPrefix(prefix, func(key []byte, _ []byte) error {
+		keys = append(keys, key)
+		if limit > 0 && len(keys) >= limit {
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil && err != errLimitReached {
+		return nil, err
 	}
-	return blk.Size - types.Size(len(key)), true, nil
+	return keys, nil
 }
@@ -1,15 +1,23 @@
 package store_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
 	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/index"
 	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
 	"github.com/hannahhoward/go-storethehash/store/testutil"
 	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/ipfs/go-cid"
 	"github.com/stretchr/testify/require"
 )
 
@@ -59,3 +67,532 @@ func TestUpdate(t *testing.T) {
 	require.Equal(t, value, blks[1].RawData())
 
 }
+
+func TestScanPrefix(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	blks := testutil.GenerateBlocksOfSize(50, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	prefix := blks[0].Cid().Hash()[2:3]
+	var expected int
+	for _, blk := range blks {
+		if blk.Cid().Hash()[2] == prefix[0] {
+			expected++
+		}
+	}
+	var found int
+	err = s.ScanPrefix(prefix, func(key []byte, value []byte) error {
+		_, c, err := cid.CidFromBytes(key)
+		require.NoError(t, err)
+		require.Equal(t, prefix[0], []byte(c.Hash())[2])
+		found++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, found)
+}
+
+// failingPrimary is an in-memory primary that fails to read back index keys.
+type failingPrimary struct {
+	*inmemory.InMemory
+}
+
+var errPrimaryRead = errors.New("primary read failed")
+
+func (fp failingPrimary) GetIndexKey(blk types.Block) ([]byte, error) {
+	return nil, errPrimaryRead
+}
+
+func TestLookupErrors(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary := failingPrimary{inmemory.NewInmemory([][2][]byte{})}
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+
+	// Index errors are surfaced instead of being reported as "not found".
+	_, err = s.Has([]byte{1, 2})
+	require.EqualError(t, err, types.ErrKeyTooShort.Error())
+	_, _, err = s.GetSize([]byte{1, 2})
+	require.EqualError(t, err, types.ErrKeyTooShort.Error())
+	_, _, err = s.Get([]byte{1, 2})
+	require.EqualError(t, err, types.ErrKeyTooShort.Error())
+
+	// Missing keys are not an error.
+	found, err := s.Has([]byte{1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// Errors while confirming a match in the primary are surfaced as well.
+	require.NoError(t, s.Put([]byte{1, 2, 3, 4, 5}, []byte{0x10}))
+	_, err = s.Has([]byte{1, 2, 3, 4, 5})
+	require.Equal(t, errPrimaryRead, err)
+	_, _, err = s.GetSize([]byte{1, 2, 3, 4, 5})
+	require.Equal(t, errPrimaryRead, err)
+}
+
+func TestHasKeyChecksums(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary := failingPrimary{inmemory.NewInmemory([][2][]byte{})}
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.IndexOptions(index.KeyChecksums()))
+	require.NoError(t, err)
+
+	// The primary storage isn't read to confirm a match, hence its errors don't matter.
+	require.NoError(t, s.Put([]byte{1, 2, 3, 4, 5}, []byte{0x10}))
+	found, err := s.Has([]byte{1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.True(t, found)
+	found, err = s.Has([]byte{1, 2, 3, 4, 6})
+	require.NoError(t, err)
+	require.False(t, found)
+	_, found, err = s.GetSize([]byte{1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.True(t, found)
+}
+
+func TestHasFullKeys(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary := failingPrimary{inmemory.NewInmemory([][2][]byte{})}
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.IndexOptions(index.FullKeys()))
+	require.NoError(t, err)
+
+	// The index tells keys with a common prefix apart without reading the primary storage.
+	require.NoError(t, s.Put([]byte{1, 2, 3, 4, 5}, []byte{0x10}))
+	found, err := s.Has([]byte{1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.True(t, found)
+	found, err = s.Has([]byte{1, 2, 3, 4, 6})
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestGetSizeFromIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary := failingPrimary{inmemory.NewInmemory([][2][]byte{})}
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.IndexOptions(index.KeyChecksums(), index.ValueSizes()))
+	require.NoError(t, err)
+
+	// The size is answered by the index alone, the primary storage fails all reads.
+	require.NoError(t, s.Put([]byte{1, 2, 3, 4, 5}, []byte{0x10, 0x11, 0x12}))
+	size, found, err := s.GetSize([]byte{1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, types.Size(3), size)
+	_, found, err = s.GetSize([]byte{1, 2, 3, 4, 6})
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestGetSizeDedup(t *testing.T) {
+	for _, options := range [][]store.Option{nil, {store.IndexOptions(index.ValueSizes())}} {
+		tempDir, err := ioutil.TempDir("", "sth")
+		require.NoError(t, err)
+		indexPath := filepath.Join(tempDir, "storethehash.index")
+		dataPath := filepath.Join(tempDir, "storethehash.data")
+		open := func() *store.Store {
+			primary, err := cidprimary.OpenCIDPrimary(dataPath, cidprimary.Dedup())
+			require.NoError(t, err)
+			s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+				options...)
+			require.NoError(t, err)
+			return s
+		}
+		s := open()
+
+		// The second key only references the value of the first one, its size is that of the value.
+		blks := testutil.GenerateBlocksOfSize(2, 1000)
+		require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+		require.NoError(t, s.Put(blks[1].Cid().Bytes(), blks[0].RawData()))
+		check := func(s *store.Store) {
+			for _, blk := range blks {
+				size, found, err := s.GetSize(blk.Cid().Bytes())
+				require.NoError(t, err)
+				require.True(t, found)
+				require.Equal(t, types.Size(len(blks[0].RawData())), size)
+				stat, found, err := s.Stat(blk.Cid().Bytes())
+				require.NoError(t, err)
+				require.True(t, found)
+				require.Equal(t, types.Size(len(blks[0].RawData())), stat.Size)
+			}
+		}
+		// from memory before flush
+		check(s)
+		s.Flush()
+		// from disk after flush
+		check(s)
+		require.NoError(t, s.Close())
+		s = open()
+		check(s)
+		require.NoError(t, s.Close())
+	}
+}
+
+func TestStats(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// Overwriting a key doesn't add a new one
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[1].RawData()))
+
+	stats := s.Stats()
+	require.Equal(t, uint64(20), stats.Keys)
+	require.Equal(t, uint64(1)<<defaultIndexSizeBits, stats.Buckets)
+	require.Equal(t, uint64(20), stats.OccupiedBuckets)
+	require.NotZero(t, stats.OutstandingWork)
+	require.NotZero(t, stats.PrimarySize)
+	require.Zero(t, stats.Flushes)
+
+	s.Flush()
+	stats = s.Stats()
+	require.Zero(t, stats.OutstandingWork)
+	require.Equal(t, uint64(1), stats.Flushes)
+	require.NotZero(t, stats.FlushedWork)
+	require.NotZero(t, stats.IndexSize)
+	require.Zero(t, stats.TornIndexBytes)
+	require.NoError(t, s.Close())
+
+	// The counts are recovered when the index is opened again, an incomplete size prefix at the
+	// end is cut off.
+	file, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err = store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	reopened := s.Stats()
+	require.Equal(t, stats.Keys, reopened.Keys)
+	require.Equal(t, stats.OccupiedBuckets, reopened.OccupiedBuckets)
+	require.Equal(t, stats.IndexSize, reopened.IndexSize)
+	require.Equal(t, stats.PrimarySize, reopened.PrimarySize)
+	require.Equal(t, int64(3), reopened.TornIndexBytes)
+}
+
+func TestFlushResult(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Nothing to flush
+	result, err := s.FlushResult()
+	require.NoError(t, err)
+	require.Equal(t, store.FlushStats{}, result)
+
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	outstanding := s.Stats().OutstandingWork
+	result, err = s.FlushResult()
+	require.NoError(t, err)
+	require.Equal(t, outstanding, result.Work)
+	require.NotZero(t, result.Duration)
+	require.Equal(t, result.Work, s.Stats().FlushedWork)
+}
+
+func TestAutoBurstRate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, 1, store.AutoBurstRate())
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(100, 1000)
+	for n, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+		if n%10 == 9 {
+			s.Flush()
+			stats := s.Stats()
+			if stats.Flushes < 5 {
+				// The configured burst rate is used until the calibration is done
+				require.Equal(t, types.Work(1), stats.BurstRate)
+			} else {
+				require.NotEqual(t, types.Work(1), stats.BurstRate)
+			}
+		}
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	s, err := initStore(t)
+	require.NoError(t, err)
+	s.Start()
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	require.NoError(t, s.Close())
+	require.Equal(t, before, runtime.NumGoroutine())
+}
+
+func TestParentContextStopsBackgroundWork(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	before := runtime.NumGoroutine()
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits,
+		10*time.Millisecond, defaultBurstRate, store.Context(ctx))
+	require.NoError(t, err)
+	s.Start()
+	require.Equal(t, before+1, runtime.NumGoroutine())
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() != before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, before, runtime.NumGoroutine())
+	require.NoError(t, s.Close())
+}
+
+func TestDurability(t *testing.T) {
+	for _, level := range []store.DurabilityLevel{store.FlushOnPut, store.SyncOnPut} {
+		tempDir, err := ioutil.TempDir("", "sth")
+		require.NoError(t, err)
+		indexPath := filepath.Join(tempDir, "storethehash.index")
+		dataPath := filepath.Join(tempDir, "storethehash.data")
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+			store.Durability(level))
+		require.NoError(t, err)
+
+		blks := testutil.GenerateBlocksOfSize(5, 100)
+		for _, blk := range blks {
+			require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+			require.Zero(t, s.Stats().OutstandingWork)
+		}
+
+		// The data is in the files without closing or flushing the store. Opening the store again
+		// would share the state of the open one, hence read the files directly.
+		primary, err = cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		reader, err := index.OpenIndex(indexPath, primary, defaultIndexSizeBits)
+		require.NoError(t, err)
+		for _, blk := range blks {
+			indexKey, err := primary.IndexKey(blk.Cid().Bytes())
+			require.NoError(t, err)
+			offset, found, err := reader.Get(indexKey)
+			require.NoError(t, err)
+			require.True(t, found)
+			_, value, err := primary.Get(offset)
+			require.NoError(t, err)
+			require.Equal(t, blk.RawData(), value)
+		}
+		require.NoError(t, reader.Close())
+		require.NoError(t, primary.Close())
+		require.NoError(t, s.Close())
+	}
+}
+
+func TestSharedHandles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	writer := open()
+	reader := open()
+
+	// Writes are visible on other handles before they are flushed.
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	for _, blk := range blks {
+		require.NoError(t, writer.Put(blk.Cid().Bytes(), blk.RawData()))
+		value, found, err := reader.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+		has, err := reader.Has(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// The store stays open until the last handle is closed.
+	require.NoError(t, writer.Close())
+	value, found, err := reader.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	require.NoError(t, reader.Close())
+
+	reopened := open()
+	defer reopened.Close()
+	for _, blk := range blks {
+		value, found, err := reopened.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
+
+func TestSharedHandleClose(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func(options ...store.Option) (*store.Store, error) {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, options...)
+		if err != nil {
+			require.NoError(t, primary.Close())
+		}
+		return s, err
+	}
+	first, err := open()
+	require.NoError(t, err)
+	second, err := open()
+	require.NoError(t, err)
+
+	// Closing a handle twice doesn't close the store for the other handle.
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	require.NoError(t, first.Put(blk.Cid().Bytes(), blk.RawData()))
+	require.NoError(t, first.Close())
+	require.NoError(t, first.Close())
+	value, found, err := second.Get(blk.Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blk.RawData(), value)
+
+	// A handle with different options isn't returned.
+	_, err = open(store.TrackAccess())
+	require.Equal(t, types.ErrOptionsMismatch, err)
+	_, err = open(store.IndexOptions(index.KeyChecksums()))
+	require.Equal(t, types.ErrOptionsMismatch, err)
+
+	require.NoError(t, second.Close())
+	// The store was closed with the last handle, other options can be used again.
+	reopened, err := open(store.TrackAccess())
+	require.NoError(t, err)
+	require.NoError(t, reopened.Close())
+}
+
+func TestSharedHandleMismatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	open := func(dataPath string, options ...store.Option) (*store.Store, error) {
+		primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, dataPath))
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate, options...)
+		if err != nil {
+			require.NoError(t, primary.Close())
+		}
+		return s, err
+	}
+	s, err := open("storethehash.data", store.IndexOptions(index.KeyChecksums()))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The same number of index options with different values
+	_, err = open("storethehash.data", store.IndexOptions(index.FullKeys()))
+	require.Equal(t, types.ErrOptionsMismatch, err)
+	// A different data file
+	_, err = open("other.data", store.IndexOptions(index.KeyChecksums()))
+	require.Equal(t, types.ErrOptionsMismatch, err)
+
+	other, err := open("storethehash.data", store.IndexOptions(index.KeyChecksums()))
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+}
+
+func TestCount(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	require.Zero(t, s.Count())
+
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// Updates and puts of the same value don't add keys.
+	require.Equal(t, types.ErrKeyExists, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.NoError(t, s.Put(blks[1].Cid().Bytes(), []byte("updated")))
+	require.NoError(t, s.Delete(blks[2].Cid().Bytes()))
+	require.Equal(t, uint64(9), s.Count())
+	require.NoError(t, s.Close())
+
+	s = open()
+	defer s.Close()
+	require.Equal(t, uint64(9), s.Count())
+}
+
+func TestFindByDigestPrefix(t *testing.T) {
+	s, err := initStore(t)
+	require.NoError(t, err)
+	defer s.Close()
+	blks := testutil.GenerateBlocksOfSize(100, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	digest := blks[0].Cid().Hash()[2:]
+	for _, length := range []int{1, 4, len(digest)} {
+		keys, err := s.FindByDigestPrefix(digest[:length], 0)
+		require.NoError(t, err)
+		var expected int
+		for _, blk := range blks {
+			if bytes.HasPrefix(blk.Cid().Hash()[2:], digest[:length]) {
+				expected++
+			}
+		}
+		require.Len(t, keys, expected)
+		require.Contains(t, keys, blks[0].Cid().Bytes())
+	}
+
+	keys, err := s.FindByDigestPrefix(nil, 10)
+	require.NoError(t, err)
+	require.Len(t, keys, 10)
+
+	keys, err = s.FindByDigestPrefix([]byte{digest[0] ^ 0xff, 0, 0, 0, 0, 0}, 0)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// GetStream returns a reader of the value of a key together with its length, so that large values
+// can be passed on without holding them in memory. The reader needs to be closed.
+//
+// The value is read incrementally if the primary storage implements `primary.Streamer`. Otherwise,
+// and in multi-value, appendable or expiry mode or with entry metadata, it's read into memory
+// first. Reading fails if the store is closed or GC replaces its files before the reader is
+// consumed.
+func (s *Store) GetStream(key []byte) (io.ReadCloser, int64, bool, error) {
+	s.swapLk.RLock()
+	streamer, ok := s.index.Primary.(primary.Streamer)
+	s.swapLk.RUnlock()
+	if !ok || s.chained() || s.expiry || s.metadata {
+		value, found, err := s.Get(key)
+		if err != nil || !found {
+			return nil, 0, false, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(value)), int64(len(value)), true, nil
+	}
+
+	start := time.Now()
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	absent, generation, err := s.knownAbsent(key)
+	if err != nil || absent {
+		return nil, 0, false, err
+	}
+	indexKey, blk, found, err := lookup(s.index, key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	var value io.ReadCloser
+	var size int64
+	if found {
+		var primaryKey []byte
+		if primaryKey, value, size, err = streamer.GetStream(blk); err != nil {
+			return nil, 0, false, err
+		}
+		// The index stores only prefixes, the entry may belong to another key.
+		if _, found, err = matchValue(s.index, indexKey, primaryKey, nil); err != nil || !found {
+			_ = value.Close()
+			value = nil
+		}
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if !found {
+		s.rememberAbsent(key, generation)
+	} else {
+		s.onAccess(key)
+		if s.policy != nil {
+			s.policy.OnGet(key)
+		}
+	}
+	if s.metrics != nil {
+		s.metrics.ObserveGet(found, time.Since(start))
+	}
+	return value, size, found, nil
+}
+
+// PutFrom stores a value of `size` bytes that is read from `r`, so that large values can be
+// ingested without holding them in memory.
+//
+// The value is written straight to the primary storage if it implements `primary.StreamWriter`,
+// which also flushes it. Otherwise, and in multi-value or expiry mode or with a merge operator, it
+// is read into memory and put. Unlike Put, the value isn't compared with the stored one, putting a
+// key again with the same value writes it again.
+func (s *Store) PutFrom(key []byte, r io.Reader, size int64) error {
+	if err := s.checkValue(key, int(size)); err != nil {
+		return err
+	}
+	s.swapLk.RLock()
+	writer, ok := s.index.Primary.(primary.StreamWriter)
+	s.swapLk.RUnlock()
+	if !ok || s.chained() || s.expiry || s.metadata || s.mergeOperator != nil {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		return s.Put(key, value)
+	}
+
+	start := time.Now()
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	indexKey, prevOffset, found, err := s.lookupFiltered(key)
+	if err != nil {
+		return err
+	}
+	replace := false
+	if found {
+		storedKey, err := s.index.Primary.GetIndexKey(prevOffset)
+		if err != nil {
+			return err
+		}
+		replace = bytes.Equal(indexKey, storedKey)
+	}
+	blk, err := writer.PutFrom(key, r, size)
+	if err != nil {
+		return err
+	}
+	if err := s.indexEntry(key, indexKey, blk, types.Size(size), replace, prevOffset); err != nil {
+		return err
+	}
+	// The value is flushed already, only the index entry is outstanding.
+	if err := s.settle(types.Work(len(key))); err != nil {
+		return err
+	}
+	if s.metrics != nil {
+		s.metrics.ObservePut(len(key)+int(size), time.Since(start))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package store_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/inmemory"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func readStream(t *testing.T, s *store.Store, key []byte) ([]byte, bool) {
+	r, size, found, err := s.GetStream(key)
+	require.NoError(t, err)
+	if !found {
+		return nil, false
+	}
+	defer r.Close()
+	value, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(value)), size)
+	return value, true
+}
+
+func TestGetStream(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"), cidprimary.Dedup())
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+
+	blks := testutil.GenerateBlocksOfSize(3, 100000)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	// Values are returned before they are flushed.
+	value, found := readStream(t, s, blks[0].Cid().Bytes())
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+
+	require.NoError(t, s.Alias(blks[1].Cid().Bytes(), blks[0].Cid().Bytes()))
+	s.Flush()
+	for _, blk := range blks[:2] {
+		r, size, found, err := s.GetStream(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, int64(len(blks[0].RawData())), size)
+		// The value can be read in parts.
+		part := make([]byte, 1000)
+		_, err = io.ReadFull(r, part)
+		require.NoError(t, err)
+		require.Equal(t, blks[0].RawData()[:1000], part)
+		rest, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, blks[0].RawData()[1000:], rest)
+		require.NoError(t, r.Close())
+	}
+	_, found = readStream(t, s, blks[2].Cid().Bytes())
+	require.False(t, found)
+}
+
+func TestGetStreamInMemory(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	s, err := store.OpenStore(indexPath, inmemory.NewInmemory(nil), defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Storages that can't stream return the value from memory.
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	value, found := readStream(t, s, blks[0].Cid().Bytes())
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+}
+
+func TestPutFrom(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+
+	blks := testutil.GenerateBlocksOfSize(4, 100000)
+	// The entry that is pending when the value is streamed keeps its position.
+	require.NoError(t, s.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	require.NoError(t, s.PutFrom(blks[1].Cid().Bytes(), bytes.NewReader(blks[1].RawData()), int64(len(blks[1].RawData()))))
+	// A reader that ends early stores nothing.
+	short := bytes.NewReader(blks[2].RawData()[:5000])
+	err = s.PutFrom(blks[2].Cid().Bytes(), short, int64(len(blks[2].RawData())))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.NoError(t, s.PutFrom(blks[3].Cid().Bytes(), bytes.NewReader(blks[3].RawData()), int64(len(blks[3].RawData()))))
+	// Putting a key again replaces its value.
+	require.NoError(t, s.PutFrom(blks[0].Cid().Bytes(), bytes.NewReader(blks[0].RawData()), int64(len(blks[0].RawData()))))
+
+	check := func(s *store.Store) {
+		for i, blk := range blks {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.Equal(t, i != 2, found)
+			if found {
+				require.Equal(t, blk.RawData(), value)
+			}
+		}
+		require.Equal(t, uint64(3), s.Stats().Keys)
+	}
+	check(s)
+	require.NoError(t, s.Close())
+
+	// The cut off value left nothing behind.
+	primary, err = cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	iter, err := primary.Iter()
+	require.NoError(t, err)
+	entries := 0
+	for {
+		_, _, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		entries++
+	}
+	require.Equal(t, 4, entries)
+	s, err = store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+	check(s)
+}
+
+func TestPutFromValueLimit(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), primary, defaultIndexSizeBits,
+		defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The highest bit of the size of an entry of the CID primary is reserved, the key counts
+	// towards the size.
+	key := testutil.GenerateBlocksOfSize(1, 100)[0].Cid().Bytes()
+	limit := int64(1<<31 - 1 - len(key))
+	require.Equal(t, limit, primary.MaxValueSize(key))
+	err = s.PutFrom(key, bytes.NewReader(nil), limit+1)
+	require.Equal(t, types.ErrValueTooLarge, err)
+	// A value of the largest size passes the check and fails only because the reader ends early.
+	err = s.PutFrom(key, bytes.NewReader(nil), limit)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	_, found, err := s.Get(key)
+	require.NoError(t, err)
+	require.False(t, found)
+}
@@ -0,0 +1,167 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/tiered"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func openTieredPrimary(path string) (primary.PrimaryStorage, error) {
+	small, err := cidprimary.OpenCIDPrimary(path)
+	if err != nil {
+		return nil, err
+	}
+	large, err := cidprimary.OpenCIDPrimary(path + tiered.LargeSuffix)
+	if err != nil {
+		_ = small.Close()
+		return nil, err
+	}
+	return tiered.NewTieredPrimary(small, large, 500), nil
+}
+
+func openTieredStore(t *testing.T, indexPath string, dataPath string) *store.Store {
+	primary, err := openTieredPrimary(dataPath)
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	return s
+}
+
+func checkBlocks(t *testing.T, s *store.Store, blks []blocks.Block) {
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
+
+func TestTieredGC(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	s := openTieredStore(t, indexPath, dataPath)
+
+	blks := append(testutil.GenerateBlocksOfSize(10, 100), testutil.GenerateBlocksOfSize(10, 1000)...)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	// Deleted blocks of both tiers are garbage.
+	for _, blk := range append(append([]blocks.Block{}, blks[:5]...), blks[10:15]...) {
+		require.NoError(t, s.Delete(blk.Cid().Bytes()))
+	}
+	s.Flush()
+	before := s.Stats().PrimarySize
+
+	require.NoError(t, s.GC(context.Background()))
+	require.True(t, s.Stats().PrimarySize < before)
+	for _, path := range []string{dataPath, dataPath + tiered.LargeSuffix} {
+		_, err := os.Stat(path + ".gc")
+		require.True(t, os.IsNotExist(err))
+	}
+	kept := append(append([]blocks.Block{}, blks[5:10]...), blks[15:]...)
+	checkBlocks(t, s, kept)
+	require.NoError(t, s.Close())
+
+	s = openTieredStore(t, indexPath, dataPath)
+	defer s.Close()
+	checkBlocks(t, s, kept)
+	report, err := s.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, report.OK())
+}
+
+func TestTieredVerify(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	s := openTieredStore(t, indexPath, dataPath)
+	blks := append(testutil.GenerateBlocksOfSize(5, 100), testutil.GenerateBlocksOfSize(5, 1000)...)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	report, err := s.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, uint64(10), report.Records)
+	require.NoError(t, s.Close())
+
+	// Cut off the last entry of the large tier, the blocks of the small one stay valid.
+	largePath := dataPath + tiered.LargeSuffix
+	info, err := os.Stat(largePath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(largePath, info.Size()-info.Size()/5))
+
+	s = openTieredStore(t, indexPath, dataPath)
+	defer s.Close()
+	report, err = s.Verify(context.Background())
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, store.DanglingBlock, report.Problems[0].Kind)
+}
+
+func TestTieredBackup(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	s := openTieredStore(t, filepath.Join(tempDir, "storethehash.index"), filepath.Join(tempDir, "storethehash.data"))
+	defer s.Close()
+	blks := append(testutil.GenerateBlocksOfSize(5, 100), testutil.GenerateBlocksOfSize(5, 1000)...)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	var backup bytes.Buffer
+	require.NoError(t, s.Backup(&backup))
+
+	tempDir, err = ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	restored, err := store.RestoreStore(indexPath, bytes.NewReader(backup.Bytes()), dataPath,
+		openTieredPrimary, defaultSyncInterval, defaultBurstRate)
+	require.NoError(t, err)
+	defer restored.Close()
+	_, err = os.Stat(dataPath + tiered.LargeSuffix)
+	require.NoError(t, err)
+	require.Equal(t, s.Stats().PrimarySize, restored.Stats().PrimarySize)
+	checkBlocks(t, restored, blks)
+}
+
+func TestTieredCloseContext(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	s := openTieredStore(t, indexPath, dataPath)
+	blks := append(testutil.GenerateBlocksOfSize(10, 100), testutil.GenerateBlocksOfSize(10, 1000)...)
+	for _, blk := range append(append([]blocks.Block{}, blks[:5]...), blks[10:15]...) {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	s.Flush()
+	require.NoError(t, s.Err())
+	for _, blk := range append(append([]blocks.Block{}, blks[5:10]...), blks[15:]...) {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	// The entries of both tiers that weren't indexed are recovered on open.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, s.CloseContext(ctx))
+	s = openTieredStore(t, indexPath, dataPath)
+	defer s.Close()
+	_, err = os.Stat(indexPath + ".recover")
+	require.True(t, os.IsNotExist(err))
+	checkBlocks(t, s, blks)
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// syncIntervalSetter is implemented by rate limiters that depend on the sync interval, like
+// `TokenBucket`.
+type syncIntervalSetter interface {
+	SetSyncInterval(interval time.Duration)
+}
+
+// burstRateSetter is implemented by rate limiters whose burst rate can be changed, like
+// `TokenBucket`.
+type burstRateSetter interface {
+	SetBurstRate(burstRate types.Work)
+}
+
+// SyncInterval returns the interval at which the background flusher commits the outstanding work.
+func (s *Store) SyncInterval() time.Duration {
+	s.rateLk.RLock()
+	defer s.rateLk.RUnlock()
+	return s.syncInterval
+}
+
+// SetSyncInterval changes the interval at which the background flusher commits the outstanding
+// work, e.g. to tune flushing under live load. The next flush is due one interval after the call.
+// The rate limiter is updated as well if it depends on the interval.
+func (s *Store) SetSyncInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return types.ErrInvalidSyncInterval
+	}
+	s.rateLk.Lock()
+	s.syncInterval = interval
+	s.rateLk.Unlock()
+	if setter, ok := s.limiter.(syncIntervalSetter); ok {
+		setter.SetSyncInterval(interval)
+	}
+	select {
+	case s.resetTicker <- struct{}{}:
+	default:
+		// A reset is pending already, it picks up the new interval.
+	}
+	return nil
+}
+
+// SetBurstRate changes the amount of work writers can add before they are throttled. It fails with
+// `types.ErrBurstRateNotAdjustable` if the rate limiter doesn't support it, the default
+// `TokenBucket` does. A token bucket that calibrates itself overrides the value with the next
+// calibration.
+func (s *Store) SetBurstRate(burstRate types.Work) error {
+	setter, ok := s.limiter.(burstRateSetter)
+	if !ok {
+		return types.ErrBurstRateNotAdjustable
+	}
+	setter.SetBurstRate(burstRate)
+	return nil
+}
@@ -23,3 +23,149 @@ type ErrIndexWrongBitSize [2]byte
 func (e ErrIndexWrongBitSize) Error() string {
 	return fmt.Sprintf("Index bit size for buckets is %d, expected %d", e[0], e[1])
 }
+
+// ErrIndexVersion indicates that the format version of an index file, the first element, is newer
+// than the latest supported one, the second element
+type ErrIndexVersion [2]byte
+
+func (e ErrIndexVersion) Error() string {
+	return fmt.Sprintf("index format version %d is newer than supported version %d", e[0], e[1])
+}
+
+// ErrIndexFeatures indicates that an index file uses features, given as `index.HeaderFlags`, that
+// aren't supported
+type ErrIndexFeatures uint16
+
+func (e ErrIndexFeatures) Error() string {
+	return fmt.Sprintf("index uses unsupported features %#x", uint16(e))
+}
+
+// ErrIndexCorrupt indicates that the record list at the given offset of the index file doesn't
+// match its checksum
+type ErrIndexCorrupt uint64
+
+func (e ErrIndexCorrupt) Error() string {
+	return fmt.Sprintf("index is corrupt: record list at offset %d doesn't match its checksum", uint64(e))
+}
+
+// ErrNotIndex indicates that a file doesn't start with the header of an index
+const ErrNotIndex = errorType("file is not an index")
+
+// ErrCompactionNotSupported indicates that the primary storage doesn't implement
+// `primary.Compactor`
+const ErrCompactionNotSupported = errorType("Primary storage does not support compaction")
+
+const ErrStoreClosed = errorType("store is closed")
+
+// ErrSnapshotInvalidated indicates that the files a snapshot refers to were replaced, e.g. by a
+// GC
+const ErrSnapshotInvalidated = errorType("snapshot was invalidated")
+
+// ErrBackupNotSupported indicates that the primary storage doesn't implement `primary.Backuper`
+const ErrBackupNotSupported = errorType("Primary storage does not support backups")
+
+// ErrNoPolicy indicates that entries can't be evicted as no eviction policy was set
+const ErrNoPolicy = errorType("no eviction policy set")
+
+// ErrInvalidBackup indicates that a backup is incomplete or corrupt
+const ErrInvalidBackup = errorType("invalid backup")
+
+// ErrRebuildNotSupported indicates that the iterator of the primary storage doesn't implement
+// `primary.BlockIter`
+const ErrRebuildNotSupported = errorType("Primary storage does not support rebuilding the index")
+
+// ErrStoreOpen indicates that an operation needs a store to be closed
+const ErrStoreOpen = errorType("store is open")
+
+// ErrOptionsMismatch indicates that a store that is already open was opened again with different
+// parameters or options
+const ErrOptionsMismatch = errorType("store is already open with different options")
+
+// ErrReopenNotSupported indicates that the primary storage doesn't implement `primary.Reopener`
+const ErrReopenNotSupported = errorType("Primary storage does not support reopening")
+
+// ErrMultiValue indicates that an operation isn't supported by stores in multi-value mode
+const ErrMultiValue = errorType("operation not supported in multi-value mode")
+
+// ErrNoMultiValue indicates that a key can't have several values as the store wasn't opened with
+// the `MultiValue` option
+const ErrNoMultiValue = errorType("multi-value mode not enabled")
+
+// ErrAppendable indicates that an operation or option isn't supported by stores with appendable
+// values
+const ErrAppendable = errorType("operation not supported for appendable values")
+
+// ErrNoAppend indicates that values can't be appended to as the store wasn't opened with the
+// `Appendable` option
+const ErrNoAppend = errorType("appending not enabled")
+
+// ErrWarmupNotSupported indicates that the primary storage doesn't implement `primary.Warmer`
+const ErrWarmupNotSupported = errorType("Primary storage does not support warming up")
+
+// ErrAliasNotSupported indicates that the primary storage doesn't implement `primary.Aliaser`
+const ErrAliasNotSupported = errorType("Primary storage does not support aliases")
+
+// ErrKeyNotFound indicates that an operation needs a key that isn't stored
+const ErrKeyNotFound = errorType("key not found")
+
+// ErrNoExpiry indicates that entries can't expire as the store wasn't opened with the `Expiry`
+// option
+const ErrNoExpiry = errorType("expiry not enabled")
+
+// ErrNoMetadata indicates that entries have no metadata as the store wasn't opened with the
+// `EntryMetadata` option
+const ErrNoMetadata = errorType("entry metadata not enabled")
+
+// ErrNoAccessTracking indicates that access statistics aren't available as the store wasn't opened
+// with the `TrackAccess` option
+const ErrNoAccessTracking = errorType("access tracking not enabled")
+
+// ErrSyncPaused indicates that the files of a store can't be written as writing was paused with
+// `Store.PauseSync`
+const ErrSyncPaused = errorType("sync is paused")
+
+// ErrInvalidSyncInterval indicates that a sync interval isn't positive
+const ErrInvalidSyncInterval = errorType("sync interval must be positive")
+
+// ErrBurstRateNotAdjustable indicates that the rate limiter of a store doesn't support changing its
+// burst rate
+const ErrBurstRateNotAdjustable = errorType("rate limiter does not support changing the burst rate")
+
+// ErrCompactionVerification indicates that the compacted copy of a store didn't match the
+// original, see `store.VerifyCompaction`
+const ErrCompactionVerification = errorType("compaction failed verification")
+
+// ErrCompactionVerificationNotSupported indicates that compactions can't be verified as the
+// compaction of the primary storage doesn't implement `primary.CompactionReader`
+const ErrCompactionVerificationNotSupported = errorType("Primary storage does not support verifying compactions")
+
+// ErrBatchClosed indicates that a batch can't be used anymore as it was already committed or
+// discarded
+const ErrBatchClosed = errorType("batch was already committed or discarded")
+
+// ErrInvalidSketch indicates that the parameters of a key sketch are out of range, that sketches
+// with different parameters are combined, or that an exported sketch is malformed
+const ErrInvalidSketch = errorType("invalid key sketch")
+
+// ErrEmptyValue indicates that a value is empty and the store was opened with
+// `AllowEmptyValues(false)`
+const ErrEmptyValue = errorType("empty values are not allowed")
+
+// ErrStoreLocked indicates that the files of a store are in use by another process
+const ErrStoreLocked = errorType("store is locked by another process")
+
+// ErrSegmentedIndex indicates that an operation or option isn't supported for indexes that are split
+// into segments
+const ErrSegmentedIndex = errorType("operation not supported for segmented indexes")
+
+// ErrMemoryIndex indicates that an option or index file isn't supported for indexes that are kept in
+// memory, see `index.OpenMemoryIndex`
+const ErrMemoryIndex = errorType("not supported for in-memory indexes")
+
+// ErrValueTooLarge indicates that a value doesn't fit into a block of the primary storage, see
+// `MaxBlockSize`
+const ErrValueTooLarge = errorType("value is too large")
+
+// ErrRecordListTooLarge indicates that the keys of a bucket don't fit into a record list of the index
+// anymore, see `index.MaxRecordListSize`
+const ErrRecordListTooLarge = errorType("record list is too large")
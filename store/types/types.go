@@ -1,6 +1,7 @@
 package types
 
-// Position indicates a position in a file
+// Position indicates a position in a file. Positions are stored with all 64 bits, in the index as
+// well as in the primary storage, hence files aren't limited in size.
 type Position uint64
 
 const OffBytesLen = 8
@@ -10,8 +11,13 @@ type Block struct {
 	Size   Size
 }
 
+// Size indicates the size of a block. It has 32 bits, a block is at most MaxBlockSize bytes.
 type Size uint32
 
 const SizeBytesLen = 4
 
+// MaxBlockSize is the size of the largest block, which includes what the primary storage stores
+// along with a value.
+const MaxBlockSize = 1<<32 - 1
+
 type Work uint64
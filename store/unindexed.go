@@ -0,0 +1,355 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/hannahhoward/go-storethehash/store/freelist"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// Suffix of the recovery marker, which is written by CloseContext if the index wasn't written
+// completely. It contains the position in the primary storage from which on entries need to be
+// indexed again, one for every part of a `primary.Partitioned` storage.
+const recoverySuffix = ".recover"
+
+// commitClose commits all outstanding work when the store is closed. If the context is done before
+// the index is written completely, a recovery marker is written instead and the error of the
+// context is returned. It must be called with swapLk held for writing.
+func (s *Store) commitClose(ctx context.Context) error {
+	// No commit runs concurrently, hence this is the state before this one.
+	indexed := s.indexedPrimary
+	_, err := s.commitContext(ctx, true)
+	if err == nil || err != ctx.Err() {
+		return err
+	}
+	if _, err := unindexedIter(s.index.Primary, indexed); err != nil {
+		if err != types.ErrRebuildNotSupported {
+			return err
+		}
+		// The entries couldn't be recovered, write the rest of the index after all.
+		_, err := s.commit(true)
+		return err
+	}
+	if err := writeRecoveryMarker(s.path+recoverySuffix, indexed); err != nil {
+		return err
+	}
+	s.log.Warnw("closed store before the index was written completely, it is recovered on open",
+		"path", s.path, "from", indexed.ends())
+	return ctx.Err()
+}
+
+func writeRecoveryMarker(path string, indexed primaryBounds) error {
+	// Write the marker atomically, a torn one would lose entries.
+	data := make([]byte, 0, types.OffBytesLen*len(indexed))
+	for _, end := range indexed.ends() {
+		data = append(data, make([]byte, types.OffBytesLen)...)
+		binary.LittleEndian.PutUint64(data[len(data)-types.OffBytesLen:], uint64(end))
+	}
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// recoverUnindexed indexes the entries that a store, which was closed by CloseContext before its
+// index was written completely, left unindexed. The primary storage is read from the position of
+// the recovery marker on, or from the start if it doesn't implement `primary.IterFromer`.
+//
+// Entries that were deleted or replaced according to the freelist aren't indexed again, and
+// deletions of keys that were indexed before are applied to the index, as their removal from the
+// index may have been lost as well. `chained` is set for stores whose entries refer to the previous
+// ones of their key, their entries are replayed all the same, so that a deletion applies to the
+// most recent one.
+func recoverUnindexed(path string, idx *index.Index, freeList *freelist.FreeList, chained bool, log Logger) error {
+	markerPath := path + recoverySuffix
+	data, err := ioutil.ReadFile(markerPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The marker of a storage whose size is unknown is empty, all entries are indexed again.
+	var indexed primaryBounds
+	if len(data) > 0 {
+		indexed = partBounds(idx.Primary)
+	}
+	if len(data) != types.OffBytesLen*len(indexed) {
+		return fmt.Errorf("invalid recovery marker %s", markerPath)
+	}
+	for i := range indexed {
+		indexed[i].end = indexed[i].base + types.Position(binary.LittleEndian.Uint64(data[i*types.OffBytesLen:]))
+	}
+	iter, err := unindexedIter(idx.Primary, indexed)
+	if err != nil {
+		return err
+	}
+	if !chained {
+		// Only the freed entries that weren't indexed are skipped, which a single close left.
+		if iter.freed, err = freedBlocks(freeList, func(blk types.Block) bool {
+			return len(indexed) == 0 || !indexed.contains(blk)
+		}); err != nil {
+			return err
+		}
+	}
+	entries, err := replay(idx, iter)
+	if err != nil {
+		return err
+	}
+	removed, err := removeFreed(idx, freeList)
+	if err != nil {
+		return err
+	}
+	log.Infow("indexed entries that weren't indexed on close", "path", path, "from", indexed.ends(),
+		"entries", entries, "skipped", iter.skipped, "removed", removed)
+	return os.Remove(markerPath)
+}
+
+// unindexedIter returns an iterator over the entries of the primary storage that aren't within the
+// given bounds. Each part is read from the end of its bounds on if all of them implement
+// `primary.IterFromer`.
+func unindexedIter(primaryStorage primary.PrimaryStorage, indexed primaryBounds) (*recoveryIter, error) {
+	if len(indexed) > 0 {
+		iter := &recoveryIter{}
+		for i, part := range primaryParts(primaryStorage) {
+			from, ok := part.Storage.(primary.IterFromer)
+			if !ok {
+				iter = nil
+				break
+			}
+			partIter, err := from.IterFrom(indexed[i].end - indexed[i].base)
+			if err != nil {
+				return nil, err
+			}
+			blockIter, ok := partIter.(primary.BlockIter)
+			if !ok {
+				iter = nil
+				break
+			}
+			iter.iters = append(iter.iters, blockIter)
+			iter.bases = append(iter.bases, part.Base)
+		}
+		if iter != nil {
+			return iter, nil
+		}
+	}
+	allIter, err := primaryStorage.Iter()
+	if err != nil {
+		return nil, err
+	}
+	blockIter, ok := allIter.(primary.BlockIter)
+	if !ok {
+		return nil, types.ErrRebuildNotSupported
+	}
+	return &recoveryIter{iters: []primary.BlockIter{blockIter}, bases: []types.Position{0}, indexed: indexed}, nil
+}
+
+// recoveryIter returns the entries of several iterators, one after the other, that need to be
+// indexed again.
+type recoveryIter struct {
+	iters []primary.BlockIter
+	// Position at which the entries of each iterator start
+	bases []types.Position
+	// Index of the current iterator
+	cur int
+	// Whether an iterator ended with a partially written entry
+	torn bool
+	// Entries within these bounds are skipped, they were indexed before.
+	indexed primaryBounds
+	// Entries that are skipped, as they were deleted or replaced
+	freed map[types.Block]struct{}
+	// Number of entries that were skipped as freed
+	skipped uint64
+}
+
+// Next returns the next entry that needs to be indexed. An iterator that ends with a partially
+// written entry doesn't hide the entries of the next one, `io.ErrUnexpectedEOF` is returned once
+// all were read instead of `io.EOF`.
+func (ri *recoveryIter) Next() ([]byte, []byte, error) {
+	for ri.cur < len(ri.iters) {
+		key, value, err := ri.iters[ri.cur].Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			ri.torn = ri.torn || err == io.ErrUnexpectedEOF
+			ri.cur++
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		blk := ri.Block()
+		if ri.indexed.contains(blk) {
+			continue
+		}
+		if _, ok := ri.freed[blk]; ok {
+			ri.skipped++
+			continue
+		}
+		return key, value, nil
+	}
+	if ri.torn {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return nil, nil, io.EOF
+}
+
+func (ri *recoveryIter) Block() types.Block {
+	if ri.cur >= len(ri.iters) {
+		return types.Block{}
+	}
+	blk := ri.iters[ri.cur].Block()
+	blk.Offset += ri.bases[ri.cur]
+	return blk
+}
+
+// freedBlocks returns the blocks of the freelist that `include` accepts.
+func freedBlocks(freeList *freelist.FreeList, include func(types.Block) bool) (map[types.Block]struct{}, error) {
+	freed := make(map[types.Block]struct{})
+	err := iterFreeList(freeList, func(blk types.Block) error {
+		if include(blk) {
+			freed[blk] = struct{}{}
+		}
+		return nil
+	})
+	return freed, err
+}
+
+// removeFreed removes the keys from the index whose entries are in the freelist, i.e. the keys that
+// were deleted. A replaced entry isn't referenced by the index anymore. It returns the number of
+// removed keys.
+func removeFreed(idx *index.Index, freeList *freelist.FreeList) (uint64, error) {
+	var removed uint64
+	err := iterFreeList(freeList, func(blk types.Block) error {
+		indexKey, err := idx.Primary.GetIndexKey(blk)
+		if err != nil {
+			return err
+		}
+		indexed, found, err := idx.Get(indexKey)
+		if err != nil || !found || indexed != blk {
+			return err
+		}
+		if _, err := idx.Remove(indexKey); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil || removed == 0 {
+		return removed, err
+	}
+	if _, err := idx.Flush(); err != nil {
+		return removed, err
+	}
+	return removed, idx.Sync()
+}
+
+func iterFreeList(freeList *freelist.FreeList, fn func(types.Block) error) error {
+	iter, err := freeList.Iter()
+	if err != nil {
+		return err
+	}
+	for {
+		blk, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(*blk); err != nil {
+			return err
+		}
+	}
+}
+
+// primaryBounds are the ranges of positions that are occupied by the data of a primary storage,
+// one for every part of a `primary.Partitioned` storage, otherwise a single one from zero on.
+type primaryBounds []primaryRange
+
+type primaryRange struct {
+	// Suffix of the part, see `primary.Part`
+	suffix string
+	base   types.Position
+	end    types.Position
+}
+
+// readPrimaryBounds returns the current bounds of the primary storage. It returns nil if the
+// storage, or one of its parts, doesn't implement `primary.Sizer`.
+func readPrimaryBounds(primaryStorage primary.PrimaryStorage) primaryBounds {
+	parts := primaryParts(primaryStorage)
+	bounds := make(primaryBounds, len(parts))
+	for i, part := range parts {
+		sizer, ok := part.Storage.(primary.Sizer)
+		if !ok {
+			return nil
+		}
+		bounds[i] = primaryRange{suffix: part.Suffix, base: part.Base, end: part.Base + sizer.Size()}
+	}
+	return bounds
+}
+
+// partBounds returns empty bounds for the parts of the primary storage.
+func partBounds(primaryStorage primary.PrimaryStorage) primaryBounds {
+	parts := primaryParts(primaryStorage)
+	bounds := make(primaryBounds, len(parts))
+	for i, part := range parts {
+		bounds[i] = primaryRange{suffix: part.Suffix, base: part.Base, end: part.Base}
+	}
+	return bounds
+}
+
+// primaryParts returns the parts of a `primary.Partitioned` storage, otherwise the storage itself
+// as the only part.
+func primaryParts(primaryStorage primary.PrimaryStorage) []primary.Part {
+	if partitioned, ok := primaryStorage.(primary.Partitioned); ok {
+		return partitioned.Parts()
+	}
+	return []primary.Part{{Storage: primaryStorage}}
+}
+
+// contains returns whether the block starts within the bounds.
+func (b primaryBounds) contains(blk types.Block) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		if blk.Offset >= b[i].base {
+			return blk.Offset < b[i].end
+		}
+	}
+	return false
+}
+
+// size returns the size of the data within the bounds.
+func (b primaryBounds) size() types.Position {
+	var size types.Position
+	for _, r := range b {
+		size += r.end - r.base
+	}
+	return size
+}
+
+// ends returns the relative end of every range.
+func (b primaryBounds) ends() []types.Position {
+	ends := make([]types.Position, len(b))
+	for i, r := range b {
+		ends[i] = r.end - r.base
+	}
+	return ends
+}
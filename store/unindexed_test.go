@@ -0,0 +1,130 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseContext(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	openStore := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+
+	s := openStore()
+	blks := testutil.GenerateBlocksOfSize(100, 100)
+	for _, blk := range blks[:50] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	s.Flush()
+	require.NoError(t, s.Err())
+	for _, blk := range blks[50:] {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	// The deadline passed before the index could be written.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, s.CloseContext(ctx))
+	_, err = os.Stat(indexPath + ".recover")
+	require.NoError(t, err)
+
+	// The entries that weren't indexed are recovered on open.
+	s = openStore()
+	defer s.Close()
+	_, err = os.Stat(indexPath + ".recover")
+	require.True(t, os.IsNotExist(err))
+	for _, blk := range blks {
+		value, found, err := s.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+}
+
+// checkpointPrimary fails to iterate over all entries, the recovery on open reads only those after
+// the recovery marker.
+type checkpointPrimary struct {
+	*cidprimary.CIDPrimary
+}
+
+func (cp checkpointPrimary) Iter() (primary.PrimaryStorageIter, error) {
+	return nil, errors.New("iterated from the start")
+}
+
+func TestCloseContextDeleted(t *testing.T) {
+	for _, multiValue := range []bool{false, true} {
+		tempDir, err := ioutil.TempDir("", "sth")
+		require.NoError(t, err)
+		indexPath := filepath.Join(tempDir, "storethehash.index")
+		dataPath := filepath.Join(tempDir, "storethehash.data")
+		openStore := func() *store.Store {
+			cidPrimary, err := cidprimary.OpenCIDPrimary(dataPath)
+			require.NoError(t, err)
+			var options []store.Option
+			if multiValue {
+				options = append(options, store.MultiValue())
+			}
+			s, err := store.OpenStore(indexPath, checkpointPrimary{cidPrimary}, defaultIndexSizeBits,
+				defaultSyncInterval, defaultBurstRate, options...)
+			require.NoError(t, err)
+			return s
+		}
+
+		s := openStore()
+		blks := testutil.GenerateBlocksOfSize(100, 100)
+		for _, blk := range blks[:50] {
+			require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+		}
+		s.Flush()
+		require.NoError(t, s.Err())
+		for _, blk := range blks[50:] {
+			require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+		}
+		// Keys that were indexed and keys that weren't are deleted, one of them is stored again.
+		for _, blk := range append(append([]blocks.Block{}, blks[40:50]...), blks[90:]...) {
+			require.NoError(t, s.Delete(blk.Cid().Bytes()))
+		}
+		require.NoError(t, s.Put(blks[99].Cid().Bytes(), []byte("again")))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.Equal(t, context.Canceled, s.CloseContext(ctx))
+
+		s = openStore()
+		for _, blk := range append(append([]blocks.Block{}, blks[:40]...), blks[50:90]...) {
+			value, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, blk.RawData(), value)
+		}
+		for _, blk := range append(append([]blocks.Block{}, blks[40:50]...), blks[90:99]...) {
+			_, found, err := s.Get(blk.Cid().Bytes())
+			require.NoError(t, err)
+			require.False(t, found)
+		}
+		value, found, err := s.Get(blks[99].Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, []byte("again"), value)
+		require.NoError(t, s.Close())
+	}
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"bytes"
+
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// UnionStore layers a writable store over read-only base stores, e.g. a local delta over a frozen,
+// published dataset.
+//
+// Reads are resolved through the layers from the top down, the first layer that contains a key
+// wins. Writes only go to the top layer, so a value in the top layer shadows the values of the
+// same key in the base stores. The layers aren't owned by the union, they need to be closed by the
+// caller.
+type UnionStore struct {
+	top    *Store
+	layers []*Store
+}
+
+// NewUnionStore returns a union of `top` and `bases`. Bases are searched in the given order.
+func NewUnionStore(top *Store, bases ...*Store) *UnionStore {
+	return &UnionStore{
+		top:    top,
+		layers: append([]*Store{top}, bases...),
+	}
+}
+
+// Get returns the value of a key from the topmost layer that contains it.
+func (u *UnionStore) Get(key []byte, options ...ReadOption) ([]byte, bool, error) {
+	for _, layer := range u.layers {
+		value, found, err := layer.Get(key, options...)
+		if err != nil || found {
+			return value, found, err
+		}
+	}
+	return nil, false, nil
+}
+
+// Has returns whether any layer contains the key.
+func (u *UnionStore) Has(key []byte) (bool, error) {
+	for _, layer := range u.layers {
+		has, err := layer.Has(key)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+// GetSize returns the size of the value of a key from the topmost layer that contains it.
+func (u *UnionStore) GetSize(key []byte) (types.Size, bool, error) {
+	for _, layer := range u.layers {
+		size, found, err := layer.GetSize(key)
+		if err != nil || found {
+			return size, found, err
+		}
+	}
+	return 0, false, nil
+}
+
+// Stat returns the size and provenance of the entry of a key from the topmost layer that contains
+// it. Entries that were written directly to a layer have the path of the index of that layer as
+// source.
+func (u *UnionStore) Stat(key []byte) (KeyStat, bool, error) {
+	for _, layer := range u.layers {
+		stat, found, err := layer.Stat(key)
+		if err != nil {
+			return KeyStat{}, false, err
+		}
+		if found {
+			if stat.Source == "" {
+				stat.Source = layer.path
+			}
+			return stat, true, nil
+		}
+	}
+	return KeyStat{}, false, nil
+}
+
+// Put stores a value in the top layer. Like `Store.Put`, it returns `types.ErrKeyExists` if the
+// union already resolves the key to the same value, in which case nothing is written.
+func (u *UnionStore) Put(key []byte, value []byte) error {
+	stored, found, err := u.Get(key)
+	if err != nil {
+		return err
+	}
+	if found && bytes.Equal(stored, value) {
+		return types.ErrKeyExists
+	}
+	return u.top.Put(key, value)
+}
+
+// Flush flushes the top layer, the base stores aren't written to.
+func (u *UnionStore) Flush() {
+	u.top.Flush()
+}
+
+// Err returns the error of the first layer that failed.
+func (u *UnionStore) Err() error {
+	for _, layer := range u.layers {
+		if err := layer.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
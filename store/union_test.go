@@ -0,0 +1,67 @@
+package store_test
+
+import (
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/hannahhoward/go-storethehash/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnionStore(t *testing.T) {
+	top, err := initStore(t)
+	require.NoError(t, err)
+	defer top.Close()
+	base, err := initStore(t)
+	require.NoError(t, err)
+	defer base.Close()
+
+	blks := testutil.GenerateBlocksOfSize(4, 100)
+	for _, blk := range blks[:2] {
+		require.NoError(t, base.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	union := store.NewUnionStore(top, base)
+
+	// Values of the base are found, but not written again.
+	value, found, err := union.Get(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, blks[0].RawData(), value)
+	require.Equal(t, types.ErrKeyExists, union.Put(blks[0].Cid().Bytes(), blks[0].RawData()))
+	has, err := top.Has(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Entries are attributed to the layer they were found in.
+	stat, found, err := union.Stat(blks[0].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NotEmpty(t, stat.Source)
+
+	// The top layer shadows the base.
+	require.NoError(t, union.Put(blks[1].Cid().Bytes(), []byte("updated")))
+	value, found, err = union.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("updated"), value)
+	size, found, err := union.GetSize(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, types.Size(len("updated")), size)
+	topStat, _, err := union.Stat(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.NotEqual(t, stat.Source, topStat.Source)
+	value, _, err = base.Get(blks[1].Cid().Bytes())
+	require.NoError(t, err)
+	require.Equal(t, blks[1].RawData(), value)
+
+	// New keys go to the top layer.
+	require.NoError(t, union.Put(blks[2].Cid().Bytes(), blks[2].RawData()))
+	has, err = top.Has(blks[2].Cid().Bytes())
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = union.Has(blks[3].Cid().Bytes())
+	require.NoError(t, err)
+	require.False(t, has)
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+// ProblemKind is the kind of inconsistency that Verify found.
+type ProblemKind int
+
+const (
+	// KeyMismatch means that the entry in the primary storage belongs to a different key than the
+	// index record that points to it.
+	KeyMismatch ProblemKind = iota
+	// DanglingBlock means that the index record points beyond the end of the primary storage.
+	DanglingBlock
+	// TruncatedBlock means that the entry in the primary storage ends prematurely.
+	TruncatedBlock
+	// CorruptBlock means that the entry in the primary storage can't be decoded.
+	CorruptBlock
+	// CorruptRecordList means that a record list of the index doesn't match its checksum, see
+	// `index.RecordListChecksums`. The problem has no key and block.
+	CorruptRecordList
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case KeyMismatch:
+		return "key mismatch"
+	case DanglingBlock:
+		return "dangling block"
+	case TruncatedBlock:
+		return "truncated block"
+	case CorruptBlock:
+		return "corrupt block"
+	case CorruptRecordList:
+		return "corrupt record list"
+	default:
+		return fmt.Sprintf("ProblemKind(%d)", int(k))
+	}
+}
+
+// Problem is an index record that doesn't match the primary storage.
+type Problem struct {
+	Kind ProblemKind
+	// Bucket of the record
+	Bucket index.BucketIndex
+	// Key prefix that is stored in the record
+	Key []byte
+	// Block of the primary storage that the record points to
+	Block types.Block
+	// Error that reading the block failed with, if any
+	Err error
+	// Whether the record was removed from the index, see Scrub
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	if p.Kind == CorruptRecordList {
+		return fmt.Sprintf("%s: bucket %d: %s", p.Kind, p.Bucket, p.Err)
+	}
+	s := fmt.Sprintf("%s: bucket %d, key %x, block %d+%d", p.Kind, p.Bucket, p.Key, p.Block.Offset, p.Block.Size)
+	if p.Err != nil {
+		s += ": " + p.Err.Error()
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Report is the result of Verify.
+type Report struct {
+	// Number of index records that were checked
+	Records uint64
+	// Records that don't match the primary storage
+	Problems []Problem
+}
+
+// OK returns true if no problems were found.
+func (r Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify checks that every record of the index points to an entry of the primary storage that
+// belongs to the key of the record. Use it to check a store after an unclean shutdown.
+//
+// Problems are collected in the report, an error is only returned if the check couldn't be
+// finished, e.g. because the context was cancelled. The whole index is read, writes can continue
+// meanwhile, but GC waits until Verify returns.
+func (s *Store) Verify(ctx context.Context) (Report, error) {
+	s.swapLk.RLock()
+	defer s.swapLk.RUnlock()
+	var report Report
+	if err := s.Err(); err != nil {
+		return report, err
+	}
+	bounds := readPrimaryBounds(s.index.Primary)
+	err := s.index.ForEachRecord(func(bucket index.BucketIndex, record index.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.Records++
+		problem := Problem{
+			Bucket: bucket,
+			Key:    append([]byte{}, record.Key...),
+			Block:  record.Block,
+		}
+		if bounds != nil && !bounds.contains(record.Block) {
+			problem.Kind = DanglingBlock
+			report.Problems = append(report.Problems, problem)
+			return nil
+		}
+		// Read the whole entry, not only its key, to detect truncated values.
+		key, _, err := s.index.Primary.Get(record.Block)
+		var indexKey []byte
+		if err == nil {
+			indexKey, err = s.index.Primary.IndexKey(key)
+		}
+		if err != nil {
+			problem.Kind = CorruptBlock
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				problem.Kind = TruncatedBlock
+			}
+			problem.Err = err
+			report.Problems = append(report.Problems, problem)
+			return nil
+		}
+		if !s.index.RecordMatches(bucket, record, indexKey) {
+			problem.Kind = KeyMismatch
+			report.Problems = append(report.Problems, problem)
+		}
+		return nil
+	})
+	return report, err
+}
@@ -0,0 +1,62 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	open := func() *store.Store {
+		primary, err := cidprimary.OpenCIDPrimary(dataPath)
+		require.NoError(t, err)
+		s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate)
+		require.NoError(t, err)
+		return s
+	}
+
+	s := open()
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	report, err := s.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, uint64(10), report.Records)
+	require.NoError(t, s.Close())
+
+	// Cut off the last entry entirely and half of the one before.
+	info, err := os.Stat(dataPath)
+	require.NoError(t, err)
+	entrySize := info.Size() / int64(len(blks))
+	require.NoError(t, os.Truncate(dataPath, info.Size()-entrySize-entrySize/2))
+
+	s = open()
+	defer s.Close()
+	report, err = s.Verify(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), report.Records)
+	require.Len(t, report.Problems, 2)
+	kinds := map[store.ProblemKind]int{}
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	require.Equal(t, map[store.ProblemKind]int{store.DanglingBlock: 1, store.TruncatedBlock: 1}, kinds)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.Verify(ctx)
+	require.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,63 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	store "github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	primary, err := cidprimary.OpenCIDPrimary(filepath.Join(tempDir, "storethehash.data"))
+	require.NoError(t, err)
+	s, err := store.OpenStore(indexPath, primary, defaultIndexSizeBits, defaultSyncInterval, defaultBurstRate,
+		store.Durability(store.FlushOnPut), store.WriteAheadLog())
+	require.NoError(t, err)
+	defer s.Close()
+	s.Flush()
+	indexData, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+
+	blks := testutil.GenerateBlocksOfSize(50, 100)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	// Copy the files as a crash after flushing the primary storage, but before flushing the index
+	// would have left them.
+	crashDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	files, err := ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(tempDir, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(crashDir, file.Name()), data, 0o644))
+	}
+	crashIndexPath := filepath.Join(crashDir, "storethehash.index")
+	require.NoError(t, ioutil.WriteFile(crashIndexPath, indexData, 0o644))
+
+	primary, err = cidprimary.OpenCIDPrimary(filepath.Join(crashDir, "storethehash.data"))
+	require.NoError(t, err)
+	crashed, err := store.OpenStore(crashIndexPath, primary, defaultIndexSizeBits, defaultSyncInterval,
+		defaultBurstRate, store.WriteAheadLog())
+	require.NoError(t, err)
+	for _, blk := range blks {
+		value, found, err := crashed.Get(blk.Cid().Bytes())
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, blk.RawData(), value)
+	}
+	// The log is removed by a clean close.
+	require.NoError(t, crashed.Close())
+	_, err = os.Stat(crashIndexPath + ".wal")
+	require.True(t, os.IsNotExist(err))
+}
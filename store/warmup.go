@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/hannahhoward/go-storethehash/store/primary"
+	"github.com/hannahhoward/go-storethehash/store/readahead"
+	"github.com/hannahhoward/go-storethehash/store/types"
+)
+
+type warmupConfig struct {
+	primary bool
+}
+
+// WarmupOption configures a warmup, see Warmup.
+type WarmupOption func(*warmupConfig)
+
+// WarmupPrimary warms up the primary storage after the index, which needs to implement
+// `primary.Warmer`. It is usually much larger than the index.
+func WarmupPrimary() WarmupOption {
+	return func(c *warmupConfig) {
+		c.primary = true
+	}
+}
+
+// Warmup reads the index file, and with WarmupPrimary the primary storage, sequentially into the
+// page cache of the operating system, so that the lookups after a restart don't suffer from the
+// latency of cold reads. The operating system is hinted to read ahead where supported.
+//
+// The store can be used while it warms up. Warmup stops early with the error of the context once
+// it's done, and it's only worth it if the files fit into memory.
+func (s *Store) Warmup(ctx context.Context, options ...WarmupOption) error {
+	var c warmupConfig
+	for _, option := range options {
+		option(&c)
+	}
+	start := time.Now()
+	indexBytes, err := readahead.File(ctx, s.path)
+	if err != nil {
+		return err
+	}
+	var primaryBytes int64
+	if c.primary {
+		s.swapLk.RLock()
+		storage := s.index.Primary
+		s.swapLk.RUnlock()
+		warmer, ok := storage.(primary.Warmer)
+		if !ok {
+			return types.ErrWarmupNotSupported
+		}
+		if primaryBytes, err = warmer.Warmup(ctx); err != nil {
+			return err
+		}
+	}
+	s.log.Infow("warmed up store", "path", s.path, "index_bytes", indexBytes, "primary_bytes", primaryBytes,
+		"elapsed", time.Since(start))
+	return nil
+}
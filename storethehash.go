@@ -2,10 +2,14 @@ package storethehash
 
 import (
 	"context"
+	"io"
 	"time"
 
 	store "github.com/hannahhoward/go-storethehash/store"
+	"github.com/hannahhoward/go-storethehash/store/index"
+	"github.com/hannahhoward/go-storethehash/store/primary"
 	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/tiered"
 	"github.com/hannahhoward/go-storethehash/store/types"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
@@ -34,6 +38,9 @@ type configOptions struct {
 	indexSizeBits uint8
 	syncInterval  time.Duration
 	burstRate     types.Work
+	storeOptions  []store.Option
+	cidOptions    []cidprimary.Option
+	tierThreshold int
 }
 
 type Option func(*configOptions)
@@ -56,6 +63,145 @@ func BurstRate(burstRate uint64) Option {
 	}
 }
 
+// AutoBurstRate calibrates the burst rate from the measured flush throughput, see
+// `store.AutoBurstRate`.
+func AutoBurstRate() Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.AutoBurstRate())
+	}
+}
+
+// Durability sets when writes are persisted, see `store.Durability`.
+func Durability(level store.DurabilityLevel) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.Durability(level))
+	}
+}
+
+// RateLimit replaces the default rate limiter of the blockstore, see `store.RateLimit`.
+func RateLimit(limiter store.RateLimiter) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.RateLimit(limiter))
+	}
+}
+
+// Context sets a parent context for the background work of the blockstore, see `store.Context`.
+func Context(ctx context.Context) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.Context(ctx))
+	}
+}
+
+// PagedBuckets bounds the memory used by the bucket table, see `index.PagedBuckets`.
+func PagedBuckets(residentPages int) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.IndexOptions(index.PagedBuckets(residentPages)))
+	}
+}
+
+// MinKeyLength stores at least `length` bytes of every key in the index, which saves reads of the
+// data file for lookups of blocks that aren't stored, see `index.MinKeyLength`.
+func MinKeyLength(length int) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.IndexOptions(index.MinKeyLength(length)))
+	}
+}
+
+// KeyChecksums stores a checksum of every key in the index, so that Has and GetSize don't need to
+// read the data file, see `index.KeyChecksums`.
+func KeyChecksums() Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.IndexOptions(index.KeyChecksums()))
+	}
+}
+
+// ValueSizes stores the size of every block in the index. Together with KeyChecksums, GetSize is
+// answered without reading the data file, see `index.ValueSizes`.
+func ValueSizes() Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.IndexOptions(index.ValueSizes()))
+	}
+}
+
+// PreallocateIndex grows the index file in extents of `extent` bytes, which keeps it contiguous on
+// filesystems that fragment small appends, see `index.Preallocate`.
+func PreallocateIndex(extent int64) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.IndexOptions(index.Preallocate(extent)))
+	}
+}
+
+// BloomFilter keeps a bloom filter of the stored blocks, sized for `expectedBlocks` blocks, so that
+// most lookups of missing blocks don't read the index, see `store.BloomFilter`.
+func BloomFilter(expectedBlocks uint64) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.BloomFilter(expectedBlocks))
+	}
+}
+
+// ValueCache keeps up to `size` bytes of recently read blocks in memory, see `store.ValueCache`.
+func ValueCache(size int64) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.ValueCache(size))
+	}
+}
+
+// NegativeCache remembers up to `entries` recently missed blocks, so that repeated lookups of the
+// same missing CID don't read the index, see `store.NegativeCache`.
+func NegativeCache(entries int) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.NegativeCache(entries))
+	}
+}
+
+// EvictionPolicy sets the policy that selects the blocks that are evicted, see
+// `store.EvictionPolicy`.
+func EvictionPolicy(policy store.Policy) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.EvictionPolicy(policy))
+	}
+}
+
+// WithMetrics sets where the blockstore reports its measurements to, see `store.Metrics`.
+func WithMetrics(metrics store.Metrics) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.WithMetrics(metrics))
+	}
+}
+
+// WithLogger sets where the blockstore logs to, see `store.Logger`. A go-log logger can be passed
+// directly.
+func WithLogger(logger store.Logger) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.WithLogger(logger))
+	}
+}
+
+// SlowQueryLog keeps the `entries` most recent reads and writes that took at least `threshold`,
+// see `store.SlowQueryLog`. They are served by the admin handler.
+func SlowQueryLog(threshold time.Duration, entries int) Option {
+	return func(co *configOptions) {
+		co.storeOptions = append(co.storeOptions, store.SlowQueryLog(threshold, entries))
+	}
+}
+
+// DedupValues stores blocks with the same data but different CIDs only once, see
+// `cidprimary.Dedup`.
+func DedupValues() Option {
+	return func(co *configOptions) {
+		co.cidOptions = append(co.cidOptions, cidprimary.Dedup())
+	}
+}
+
+// SizeTiers stores blocks smaller than `threshold` bytes and larger blocks in separate data files,
+// see `tiered.TieredPrimary`. The large blocks are stored next to the data file, with the suffix
+// ".large".
+func SizeTiers(threshold int) Option {
+	return func(co *configOptions) {
+		co.tierThreshold = threshold
+	}
+}
+
 // OpenHashedBlockstore opens a HashedBlockstore with the default index size
 func OpenHashedBlockstore(indexPath string, dataPath string, options ...Option) (*HashedBlockstore, error) {
 	co := configOptions{
@@ -66,17 +212,74 @@ func OpenHashedBlockstore(indexPath string, dataPath string, options ...Option)
 	for _, option := range options {
 		option(&co)
 	}
-	primary, err := cidprimary.OpenCIDPrimary(dataPath)
+	primary, err := openPrimary(dataPath, co)
 	if err != nil {
 		return nil, err
 	}
-	store, err := store.OpenStore(indexPath, primary, co.indexSizeBits, co.syncInterval, co.burstRate)
+	store, err := store.OpenStore(indexPath, primary, co.indexSizeBits, co.syncInterval, co.burstRate, co.storeOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &HashedBlockstore{store}, nil
+}
+
+// openPrimary opens the primary storage of a blockstore.
+func openPrimary(dataPath string, co configOptions) (primary.PrimaryStorage, error) {
+	small, err := cidprimary.OpenCIDPrimary(dataPath, co.cidOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if co.tierThreshold <= 0 {
+		return small, nil
+	}
+	large, err := cidprimary.OpenCIDPrimary(dataPath+tiered.LargeSuffix, co.cidOptions...)
+	if err != nil {
+		_ = small.Close()
+		return nil, err
+	}
+	return tiered.NewTieredPrimary(small, large, co.tierThreshold), nil
+}
+
+// RestoreHashedBlockstore restores a backup of a HashedBlockstore to the given paths and opens it,
+// see `store.RestoreStore`. The index size is taken from the backup. The data file of the large
+// blocks is restored as well, it's opened if `SizeTiers` is given.
+func RestoreHashedBlockstore(indexPath string, dataPath string, r io.Reader, options ...Option) (*HashedBlockstore, error) {
+	co := configOptions{
+		syncInterval: defaultSyncInterval,
+		burstRate:    defaultBurstRate,
+	}
+	for _, option := range options {
+		option(&co)
+	}
+	open := func(path string) (primary.PrimaryStorage, error) {
+		return openPrimary(path, co)
+	}
+	store, err := store.RestoreStore(indexPath, r, dataPath, open, co.syncInterval, co.burstRate, co.storeOptions...)
 	if err != nil {
 		return nil, err
 	}
 	return &HashedBlockstore{store}, nil
 }
 
+// RebuildIndex regenerates a lost or corrupt index from the data file, see `store.RebuildIndex`.
+// The blockstore must be closed. The options that the blockstore was opened with select the data
+// files, e.g. the one of the large blocks with `SizeTiers`.
+func RebuildIndex(dataPath string, indexPath string, indexBitSize uint8, options ...Option) (store.RebuildResult, error) {
+	var co configOptions
+	for _, option := range options {
+		option(&co)
+	}
+	primary, err := openPrimary(dataPath, co)
+	if err != nil {
+		return store.RebuildResult{}, err
+	}
+	result, err := store.RebuildIndex(indexPath, primary, indexBitSize)
+	if closeErr := primary.Close(); err == nil {
+		err = closeErr
+	}
+	return result, err
+}
+
 // DeleteBlock is not supported for this store
 func (bs *HashedBlockstore) DeleteBlock(_ cid.Cid) error {
 	return ErrNotSupported
@@ -99,6 +302,19 @@ func (bs *HashedBlockstore) Get(c cid.Cid) (blocks.Block, error) {
 	return blocks.NewBlockWithCid(value, c)
 }
 
+// GetStream returns a reader of the data of a block together with its size, see
+// `store.Store.GetStream`. The reader needs to be closed.
+func (bs *HashedBlockstore) GetStream(c cid.Cid) (io.ReadCloser, int64, error) {
+	value, size, found, err := bs.store.GetStream(c.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, bstore.ErrNotFound
+	}
+	return value, size, nil
+}
+
 // GetSize returns the CIDs mapped BlockSize
 func (bs *HashedBlockstore) GetSize(c cid.Cid) (int, error) {
 	// unoptimized implementation for now
@@ -155,6 +371,33 @@ func (bs *HashedBlockstore) Close() {
 	bs.store.Close()
 }
 
+// Warmup reads the index and data files into the page cache, see `store.Warmup`.
+func (bs *HashedBlockstore) Warmup(ctx context.Context) error {
+	return bs.store.Warmup(ctx, store.WarmupPrimary())
+}
+
+// Capabilities returns the format version and the features of the underlying store, see
+// `store.Capabilities`.
+func (bs *HashedBlockstore) Capabilities() store.Capabilities {
+	return bs.store.Capabilities()
+}
+
+// Stats returns the statistics of the underlying store, see `store.Stats`.
+func (bs *HashedBlockstore) Stats() store.Stats {
+	return bs.store.Stats()
+}
+
+// SlowQueries returns the most recent slow reads and writes, see `SlowQueryLog`.
+func (bs *HashedBlockstore) SlowQueries() []store.SlowQuery {
+	return bs.store.SlowQueries()
+}
+
+// CloseContext closes the blockstore, but stops writing the index once the context is done, see
+// `store.CloseContext`.
+func (bs *HashedBlockstore) CloseContext(ctx context.Context) error {
+	return bs.store.CloseContext(ctx)
+}
+
 var _ bstore.Blockstore = &HashedBlockstore{}
 
 // ErrOutOfBounds indicates the bucket index was greater than the number of bucks
@@ -1,16 +1,21 @@
 package storethehash_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/hannahhoward/go-storethehash"
+	"github.com/hannahhoward/go-storethehash/store"
+	cidprimary "github.com/hannahhoward/go-storethehash/store/primary/cid"
+	"github.com/hannahhoward/go-storethehash/store/primary/tiered"
 	"github.com/hannahhoward/go-storethehash/store/testutil"
 	"github.com/hannahhoward/go-storethehash/store/types"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
@@ -127,3 +132,92 @@ func TestParallelism(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestSizeTiers(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	bs, err := storethehash.OpenHashedBlockstore(indexPath, dataPath, storethehash.IndexBitSize(16),
+		storethehash.SizeTiers(500))
+	require.NoError(t, err)
+	blks := append(testutil.GenerateBlocksOfSize(5, 100), testutil.GenerateBlocksOfSize(5, 1000)...)
+	require.NoError(t, bs.PutMany(blks))
+	bs.Close()
+
+	// Only the large blocks are in the large tier.
+	info, err := os.Stat(dataPath + ".large")
+	require.NoError(t, err)
+	require.True(t, info.Size() > 5*1000 && info.Size() < 5*1100)
+
+	bs, err = storethehash.OpenHashedBlockstore(indexPath, dataPath, storethehash.IndexBitSize(16),
+		storethehash.SizeTiers(500))
+	require.NoError(t, err)
+	defer bs.Close()
+	for _, blk := range blks {
+		stored, err := bs.Get(blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), stored.RawData())
+	}
+}
+
+func TestSizeTiersRebuild(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	indexPath := filepath.Join(tempDir, "storethehash.index")
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	bs, err := storethehash.OpenHashedBlockstore(indexPath, dataPath, storethehash.IndexBitSize(16),
+		storethehash.SizeTiers(500))
+	require.NoError(t, err)
+	blks := append(testutil.GenerateBlocksOfSize(5, 100), testutil.GenerateBlocksOfSize(5, 1000)...)
+	require.NoError(t, bs.PutMany(blks))
+	bs.Close()
+
+	// The blocks of both data files are indexed again.
+	require.NoError(t, os.Remove(indexPath))
+	result, err := storethehash.RebuildIndex(dataPath, indexPath, 16, storethehash.SizeTiers(500))
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(blks)), result.Entries)
+
+	bs, err = storethehash.OpenHashedBlockstore(indexPath, dataPath, storethehash.IndexBitSize(16),
+		storethehash.SizeTiers(500))
+	require.NoError(t, err)
+	defer bs.Close()
+	for _, blk := range blks {
+		stored, err := bs.Get(blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), stored.RawData())
+	}
+}
+
+func TestSizeTiersRestore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	dataPath := filepath.Join(tempDir, "storethehash.data")
+	small, err := cidprimary.OpenCIDPrimary(dataPath)
+	require.NoError(t, err)
+	large, err := cidprimary.OpenCIDPrimary(dataPath + tiered.LargeSuffix)
+	require.NoError(t, err)
+	s, err := store.OpenStore(filepath.Join(tempDir, "storethehash.index"), tiered.NewTieredPrimary(small, large, 500),
+		16, time.Second, 4*1024*1024)
+	require.NoError(t, err)
+	blks := append(testutil.GenerateBlocksOfSize(5, 100), testutil.GenerateBlocksOfSize(5, 1000)...)
+	for _, blk := range blks {
+		require.NoError(t, s.Put(blk.Cid().Bytes(), blk.RawData()))
+	}
+	var backup bytes.Buffer
+	require.NoError(t, s.Backup(&backup))
+	require.NoError(t, s.Close())
+
+	tempDir, err = ioutil.TempDir("", "sth")
+	require.NoError(t, err)
+	bs, err := storethehash.RestoreHashedBlockstore(filepath.Join(tempDir, "storethehash.index"),
+		filepath.Join(tempDir, "storethehash.data"), &backup, storethehash.SizeTiers(500))
+	require.NoError(t, err)
+	defer bs.Close()
+	for _, blk := range blks {
+		stored, err := bs.Get(blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), stored.RawData())
+	}
+}